@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func isAdmin(username string) bool {
+	for _, admin := range config.AdminUsers {
+		if admin == username || (config.CaseInsensitiveUsernames && strings.EqualFold(admin, username)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminRequired restricts a route to the -admin-users. API keys are never enough,
+// the request has to be authenticated with the account password.
+func AdminRequired(c *gin.Context) {
+	scopes := c.GetStringSlice("scopes")
+	if !isAdmin(c.MustGet("username").(string)) || len(scopes) != 1 || scopes[0] != ScopeAll {
+		c.Error(&AdminOnly)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DocumentAlias declares that a document is the same book as the canonical one, e.g. an EPUB downloaded
+// again with different metadata and so a different hash. The progress of an alias is read and written
+// as the canonical document's. Aliases are stored as RecordAlias records named by the alias.
+type DocumentAlias struct {
+	DocumentId string `json:"document"`
+	Canonical  string `json:"canonical"`
+	Created    int64  `json:"created"`
+}
+
+// aliasesMu serializes the changes of the aliases, so no chains of aliases are created
+var aliasesMu sync.Mutex
+
+// canonicalDocument returns the document the progress of documentId is kept under, itself unless it's an alias
+func canonicalDocument(username string, documentId string) string {
+	var alias DocumentAlias
+	if err := getRecord(username, RecordAlias, documentId, &alias); err != nil {
+		return documentId
+	}
+	return alias.Canonical
+}
+
+func userAliases(username string) ([]DocumentAlias, error) {
+	records, err := store.GetRecords(username, RecordAlias)
+	if err != nil {
+		return nil, err
+	}
+	aliases := make([]DocumentAlias, 0, len(records))
+	for _, record := range records {
+		var alias DocumentAlias
+		if err := json.Unmarshal([]byte(record.Value), &alias); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
+}
+
+// mergeAliasProgress copies the progress of the alias into the canonical document, for each device
+// unless the canonical document has newer progress of that device
+func mergeAliasProgress(username string, documentId string, canonical string) error {
+	devices, err := store.GetDocumentDevices(username, documentId)
+	if err == ErrDevicesUnsupported {
+		return mergeLatestAliasProgress(username, documentId, canonical)
+	}
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	canonicalDevices, err := store.GetDocumentDevices(username, canonical)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	newest := map[string]int64{}
+	for _, device := range canonicalDevices {
+		newest[device.DeviceId] = device.Timestamp
+	}
+	for _, device := range devices {
+		if timestamp, ok := newest[device.DeviceId]; ok && timestamp >= device.Timestamp {
+			continue
+		}
+		device.DocumentId = canonical
+		if err := store.ImportDocument(username, device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeLatestAliasProgress is mergeAliasProgress for the backends keeping a single progress per document
+func mergeLatestAliasProgress(username string, documentId string, canonical string) error {
+	document, err := store.GetDocument(username, documentId)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	existing, err := store.GetDocument(username, canonical)
+	if err == nil && existing.Timestamp >= document.Timestamp {
+		return nil
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	document.DocumentId = canonical
+	return store.ImportDocument(username, document)
+}
+
+func listAliases(c *gin.Context) {
+	aliases, err := userAliases(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, aliases)
+}
+
+// filenameDocument returns the document id KOReader derives from the file name when its checksum method
+// is set to filename: the MD5 of the file's base name
+func filenameDocument(filename string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(path.Base(filename))))
+}
+
+// addAlias makes documentId an alias of the canonical document of canonical. The progress synced for
+// documentId so far is merged into the canonical document, and aliases of documentId are moved to it.
+// The caller holds aliasesMu.
+func addAlias(username string, documentId string, canonical string) (DocumentAlias, *ErrorResponse) {
+	alias := DocumentAlias{
+		DocumentId: documentId,
+		Canonical:  canonicalDocument(username, canonical),
+		Created:    time.Now().Unix(),
+	}
+	if !validKeyField(alias.DocumentId) || !validKeyField(alias.Canonical) || alias.DocumentId == alias.Canonical {
+		return alias, &InvalidRequest
+	}
+	aliases, err := userAliases(username)
+	if err != nil {
+		return alias, &UnknownServerError
+	}
+	if err := mergeAliasProgress(username, alias.DocumentId, alias.Canonical); err != nil {
+		return alias, &UnknownServerError
+	}
+	for _, existing := range aliases {
+		if existing.Canonical == alias.DocumentId {
+			existing.Canonical = alias.Canonical
+			if err := putRecord(username, RecordAlias, existing.DocumentId, existing); err != nil {
+				return alias, &UnknownServerError
+			}
+		}
+	}
+	if err := putRecord(username, RecordAlias, alias.DocumentId, alias); err != nil {
+		return alias, &UnknownServerError
+	}
+	progressChanges.Publish(ProgressChange{username, alias.Canonical})
+	return alias, nil
+}
+
+// createAlias makes :document an alias of the canonical document of the body, or with a filename instead,
+// of the document KOReader's filename checksum method derives from it
+func createAlias(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		Canonical string `json:"canonical"`
+		Filename  string `json:"filename"`
+	}
+	if err := bindBody(c, &request); err != nil || (request.Canonical == "") == (request.Filename == "") {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if request.Filename != "" {
+		request.Canonical = filenameDocument(request.Filename)
+	}
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	alias, err := addAlias(username, c.Param("document"), request.Canonical)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	respond(c, http.StatusOK, alias)
+}
+
+// FilenameLinks maps the documents of a library, identified by KOReader's default binary checksum,
+// to their file names
+type FilenameLinks struct {
+	Filenames map[string]string `json:"filenames"`
+}
+
+// linkFilenames makes each document an alias of the document the filename checksum method derives from its
+// file name, so a user switching checksum methods keeps the progress of both. Documents already linked are
+// skipped. It answers with the aliases created.
+func linkFilenames(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var links FilenameLinks
+	if err := bindBody(c, &links); err != nil || len(links.Filenames) > maxBatchDocuments {
+		c.Error(&InvalidRequest)
+		return
+	}
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	for documentId, filename := range links.Filenames {
+		if !validKeyField(documentId) || filename == "" {
+			c.Error(&InvalidRequest)
+			return
+		}
+	}
+	created := []DocumentAlias{}
+	for documentId, filename := range links.Filenames {
+		canonical := filenameDocument(filename)
+		if canonicalDocument(username, documentId) == canonicalDocument(username, canonical) {
+			continue
+		}
+		alias, err := addAlias(username, documentId, canonical)
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		created = append(created, alias)
+	}
+	sort.Slice(created, func(i, j int) bool { return created[i].DocumentId < created[j].DocumentId })
+	respond(c, http.StatusOK, created)
+}
+
+// deleteAlias separates the documents again, the alias keeps the progress it had before it was declared
+func deleteAlias(c *gin.Context) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	err := store.DeleteRecord(c.MustGet("username").(string), RecordAlias, c.Param("document"))
+	if err == ErrNotFound {
+		c.Error(&AliasNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
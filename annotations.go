@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Annotation is a highlight or note of a document. Pos0 and Pos1 are the start and end as KOReader
+// keeps them, an xpointer for reflowable documents or a page position otherwise, and are stored as sent.
+// A deleted annotation is kept as a tombstone, so the deletion reaches the other devices instead of
+// the annotation coming back with their next upload.
+type Annotation struct {
+	Id        string          `json:"id"`
+	Text      string          `json:"text,omitempty"`
+	Note      string          `json:"note,omitempty"`
+	Chapter   string          `json:"chapter,omitempty"`
+	Page      json.RawMessage `json:"page,omitempty"`
+	Pos0      json.RawMessage `json:"pos0,omitempty"`
+	Pos1      json.RawMessage `json:"pos1,omitempty"`
+	Color     string          `json:"color,omitempty"`
+	Drawer    string          `json:"drawer,omitempty"`
+	Created   int64           `json:"created"`
+	UpdatedAt int64           `json:"updated_at"`
+	Deleted   bool            `json:"deleted,omitempty"`
+}
+
+// DocumentAnnotations are the annotations of a document, stored as a RecordAnnotations record per document
+type DocumentAnnotations struct {
+	DocumentId  string       `json:"document"`
+	Annotations []Annotation `json:"annotations"`
+}
+
+// AnnotationsSummary is a document in the listing of annotated documents
+type AnnotationsSummary struct {
+	DocumentId  string `json:"document"`
+	Annotations int    `json:"annotations"`
+	UpdatedAt   int64  `json:"updated_at"`
+}
+
+const (
+	// maxAnnotations bounds the annotations of a document, tombstones included
+	maxAnnotations = 10000
+	// maxAnnotationText bounds the highlighted text and the note in bytes
+	maxAnnotationText = 64 * 1024
+)
+
+// annotationsMu serializes the merges, two devices uploading the same document at once would
+// otherwise lose the annotations of one of them
+var annotationsMu sync.Mutex
+
+func validAnnotation(annotation Annotation) bool {
+	if annotation.Id == "" || utf8.RuneCountInString(annotation.Id) > maxMetadataLength {
+		return false
+	}
+	for _, field := range []string{annotation.Chapter, annotation.Color, annotation.Drawer} {
+		if utf8.RuneCountInString(field) > maxMetadataLength {
+			return false
+		}
+	}
+	for _, position := range []json.RawMessage{annotation.Page, annotation.Pos0, annotation.Pos1} {
+		if len(position) > maxProgressRawLength {
+			return false
+		}
+	}
+	return len(annotation.Text) <= maxAnnotationText && len(annotation.Note) <= maxAnnotationText &&
+		annotation.Created >= 0 && annotation.UpdatedAt >= 0
+}
+
+// mergeAnnotations merges the uploaded annotations into the stored ones by id, the one updated last wins
+// and an upload wins a tie. Uploaded annotations without updated_at are stamped with now.
+func mergeAnnotations(stored []Annotation, uploaded []Annotation, now int64) []Annotation {
+	byId := map[string]int{}
+	for i, annotation := range stored {
+		byId[annotation.Id] = i
+	}
+	merged := stored
+	for _, annotation := range uploaded {
+		if annotation.UpdatedAt == 0 {
+			annotation.UpdatedAt = now
+		}
+		if annotation.Created == 0 {
+			annotation.Created = annotation.UpdatedAt
+		}
+		i, ok := byId[annotation.Id]
+		if !ok {
+			byId[annotation.Id] = len(merged)
+			merged = append(merged, annotation)
+		} else if annotation.UpdatedAt >= merged[i].UpdatedAt {
+			merged[i] = annotation
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Created != merged[j].Created {
+			return merged[i].Created < merged[j].Created
+		}
+		return merged[i].Id < merged[j].Id
+	})
+	return merged
+}
+
+func getDocumentAnnotations(username string, documentId string) (DocumentAnnotations, error) {
+	var annotations DocumentAnnotations
+	err := getRecord(username, RecordAnnotations, documentId, &annotations)
+	return annotations, err
+}
+
+func userAnnotations(username string) ([]DocumentAnnotations, error) {
+	records, err := store.GetRecords(username, RecordAnnotations)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]DocumentAnnotations, 0, len(records))
+	for _, record := range records {
+		var annotations DocumentAnnotations
+		if err := json.Unmarshal([]byte(record.Value), &annotations); err != nil {
+			return nil, err
+		}
+		documents = append(documents, annotations)
+	}
+	return documents, nil
+}
+
+// updateAnnotations merges the uploaded annotations and answers with the merged ones, tombstones included,
+// so a device can apply the changes of the others
+func updateAnnotations(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := c.Param("document")
+	var upload DocumentAnnotations
+	if err := bindBody(c, &upload); err != nil || !validKeyField(documentId) || len(upload.Annotations) > maxAnnotations {
+		c.Error(&InvalidRequest)
+		return
+	}
+	for _, annotation := range upload.Annotations {
+		if !validAnnotation(annotation) {
+			c.Error(&InvalidRequest)
+			return
+		}
+	}
+	annotationsMu.Lock()
+	defer annotationsMu.Unlock()
+	annotations, err := getDocumentAnnotations(username, documentId)
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	annotations.DocumentId = documentId
+	annotations.Annotations = mergeAnnotations(annotations.Annotations, upload.Annotations, time.Now().Unix())
+	if len(annotations.Annotations) > maxAnnotations {
+		c.Error(&QuotaExceeded)
+		return
+	}
+	if err := putRecord(username, RecordAnnotations, documentId, annotations); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, annotations)
+}
+
+// getAnnotations leaves out the tombstones unless ?deleted=true
+func getAnnotations(c *gin.Context) {
+	annotations, err := getDocumentAnnotations(c.MustGet("username").(string), c.Param("document"))
+	if err == ErrNotFound {
+		c.Error(&AnnotationsNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if c.Query("deleted") != "true" {
+		kept := []Annotation{}
+		for _, annotation := range annotations.Annotations {
+			if !annotation.Deleted {
+				kept = append(kept, annotation)
+			}
+		}
+		annotations.Annotations = kept
+	}
+	respond(c, http.StatusOK, annotations)
+}
+
+// listAnnotations returns the annotated documents with their number of annotations, ordered by
+// ?sort=document (default), updated_at or annotations
+func listAnnotations(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	records, err := store.GetRecords(username, RecordAnnotations)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	summaries := make([]AnnotationsSummary, 0, len(records))
+	for _, record := range records {
+		var annotations DocumentAnnotations
+		if err := json.Unmarshal([]byte(record.Value), &annotations); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		summary := AnnotationsSummary{DocumentId: record.Name, UpdatedAt: record.UpdatedAt}
+		for _, annotation := range annotations.Annotations {
+			if !annotation.Deleted {
+				summary.Annotations++
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	orders := map[string]listingOrder{
+		"document":    func(i, j int) bool { return summaries[i].DocumentId < summaries[j].DocumentId },
+		"updated_at":  func(i, j int) bool { return summaries[i].UpdatedAt < summaries[j].UpdatedAt },
+		"annotations": func(i, j int) bool { return summaries[i].Annotations < summaries[j].Annotations },
+	}
+	if !sortListing(c, summaries, orders, "document", "asc") {
+		c.Error(&InvalidRequest)
+		return
+	}
+	start, end, ok := pageListing(c, len(summaries), 0)
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	respond(c, http.StatusOK, summaries[start:end])
+}
+
+// deleteAnnotation turns the annotation into a tombstone
+func deleteAnnotation(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := c.Param("document")
+	annotationsMu.Lock()
+	defer annotationsMu.Unlock()
+	annotations, err := getDocumentAnnotations(username, documentId)
+	if err == ErrNotFound {
+		c.Error(&AnnotationNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	found := false
+	for i, annotation := range annotations.Annotations {
+		if annotation.Id == c.Param("id") && !annotation.Deleted {
+			annotations.Annotations[i] = Annotation{Id: annotation.Id, Created: annotation.Created, UpdatedAt: time.Now().Unix(), Deleted: true}
+			found = true
+		}
+	}
+	if !found {
+		c.Error(&AnnotationNotFound)
+		return
+	}
+	if err := putRecord(username, RecordAnnotations, documentId, annotations); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
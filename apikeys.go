@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes that can be granted to an API key. Authenticating with the account password grants ScopeAll.
+const (
+	ScopeAll           = "*"
+	ScopeAccount       = "account"
+	ScopeProgressRead  = "progress:read"
+	ScopeProgressWrite = "progress:write"
+)
+
+// grantableScopes are the scopes an API key may be created with. ScopeAccount is deliberately
+// missing so that a leaked key can never be used to mint further keys.
+var grantableScopes = map[string]bool{
+	ScopeProgressRead:  true,
+	ScopeProgressWrite: true,
+}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type APIKey struct {
+	Name    string   `json:"name"`
+	Key     string   `json:"key,omitempty"`
+	Scopes  []string `json:"scopes"`
+	Created int64    `json:"created"`
+}
+
+func newAPIKey(dbAPIKey DbAPIKey) APIKey {
+	return APIKey{
+		Name:    dbAPIKey.Name,
+		Scopes:  strings.Fields(dbAPIKey.Scopes),
+		Created: dbAPIKey.Created,
+	}
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func generateAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashAPIKey returns the SHA-256 of an API key, which is what the stores keep, so reading the database
+// or a backup doesn't give away working credentials. The keys are random, so no salt is needed.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPlaintextAPIKeys replaces the API keys stored in plain text by earlier versions with their hash
+func hashPlaintextAPIKeys() error {
+	users, err := store.GetUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		apiKeys, err := store.GetAPIKeys(user.Username)
+		if err != nil {
+			return err
+		}
+		for _, apiKey := range apiKeys {
+			// Plain keys are 48 hex digits, hashes 64
+			if len(apiKey.Key) == 2*sha256.Size {
+				continue
+			}
+			if err := store.DeleteAPIKey(user.Username, apiKey.Name); err != nil {
+				return err
+			}
+			apiKey.Key = hashAPIKey(apiKey.Key)
+			if err := store.AddAPIKey(apiKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RequireScope aborts the request unless the authenticated credentials carry the given scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasScope(c.GetStringSlice("scopes"), scope) {
+			c.Error(&InsufficientScope)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func createAPIKey(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request APIKeyRequest
+	if err := bindBody(c, &request); err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if !validKeyField(request.Name) || len(request.Scopes) == 0 {
+		c.Error(&InvalidRequest)
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !grantableScopes[scope] {
+			c.Error(&InvalidScope)
+			return
+		}
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	dbAPIKey := DbAPIKey{
+		Username: username,
+		Name:     request.Name,
+		Key:      hashAPIKey(key),
+		Scopes:   strings.Join(request.Scopes, " "),
+		Created:  time.Now().Unix(),
+	}
+	if err := store.AddAPIKey(dbAPIKey); err != nil {
+		c.Error(&APIKeyAlreadyExists)
+		return
+	}
+	apiKey := newAPIKey(dbAPIKey)
+	// The key itself is only ever returned once, at creation time
+	apiKey.Key = key
+	respond(c, http.StatusCreated, apiKey)
+}
+
+func listAPIKeys(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	dbAPIKeys, err := store.GetAPIKeys(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	apiKeys := make([]APIKey, 0, len(dbAPIKeys))
+	for _, dbAPIKey := range dbAPIKeys {
+		apiKeys = append(apiKeys, newAPIKey(dbAPIKey))
+	}
+	respond(c, http.StatusOK, apiKeys)
+}
+
+func deleteAPIKey(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	if err := store.DeleteAPIKey(username, c.Param("name")); err != nil {
+		c.Error(&APIKeyNotFound)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// createTestAPIKey creates an API key of alice with the scopes, a JSON list
+func createTestAPIKey(t *testing.T, router http.Handler, name string, scopes string) string {
+	t.Helper()
+	w := testRequest(router, http.MethodPost, "/users/keys", `{"name": "`+name+`", "scopes": `+scopes+`}`, "alice", "pw")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the API key %s: %d %s", name, w.Code, w.Body)
+	}
+	var apiKey APIKey
+	decodeTestResponse(t, w, &apiKey)
+	return apiKey.Key
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.5")
+	readKey := createTestAPIKey(t, router, "reader", `["progress:read"]`)
+	writeKey := createTestAPIKey(t, router, "writer", `["progress:read", "progress:write"]`)
+
+	tests := []struct {
+		name   string
+		key    string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"read with a read key", readKey, http.MethodGet, "/syncs/progress/doc1", "", http.StatusOK},
+		{"write with a read key", readKey, http.MethodPut, "/syncs/progress",
+			`{"document": "doc1", "progress": "2", "percentage": 0.6, "device": "kobo"}`, http.StatusForbidden},
+		{"write with a write key", writeKey, http.MethodPut, "/syncs/progress",
+			`{"document": "doc1", "progress": "2", "percentage": 0.6, "device": "kobo"}`, http.StatusOK},
+		{"delete with a read key", readKey, http.MethodDelete, "/syncs/progress/doc1", "", http.StatusForbidden},
+		{"list keys with a key", writeKey, http.MethodGet, "/users/keys", "", http.StatusForbidden},
+		{"create a key with a key", writeKey, http.MethodPost, "/users/keys",
+			`{"name": "minted", "scopes": ["progress:read"]}`, http.StatusForbidden},
+		{"list keys with the password", "pw", http.MethodGet, "/users/keys", "", http.StatusOK},
+		{"unknown key", "nope", http.MethodGet, "/syncs/progress/doc1", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		w := testRequest(router, test.method, test.path, test.body, "alice", test.key)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body, test.status)
+		}
+	}
+}
+
+func TestAPIKeyAccountScopeNotGrantable(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	for _, scopes := range []string{`["account"]`, `["*"]`, `["progress:read", "bogus"]`} {
+		w := testRequest(router, http.MethodPost, "/users/keys", `{"name": "k", "scopes": `+scopes+`}`, "alice", "pw")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("scopes %s: got %d %s, want %d", scopes, w.Code, w.Body, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIKeyOtherUser(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	registerTestUser(t, router, "", "bob", "pw2")
+	key := createTestAPIKey(t, router, "reader", `["progress:read"]`)
+	if w := testRequest(router, http.MethodGet, "/users/auth", "", "bob", key); w.Code != http.StatusUnauthorized {
+		t.Errorf("alice's key authenticated bob: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAPIKeyStoredHashed(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	key := createTestAPIKey(t, router, "reader", `["progress:read"]`)
+	apiKeys, err := store.GetAPIKeys("alice")
+	if err != nil || len(apiKeys) != 1 || apiKeys[0].Key != hashAPIKey(key) {
+		t.Fatalf("stored API keys: %+v %v", apiKeys, err)
+	}
+	if w := testRequest(router, http.MethodGet, "/users/auth", "", "alice", apiKeys[0].Key); w.Code != http.StatusUnauthorized {
+		t.Errorf("the stored hash authenticated: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestHashPlaintextAPIKeys(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	plain, err := generateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddAPIKey(DbAPIKey{Username: "alice", Name: "old", Key: plain, Scopes: ScopeProgressRead, Created: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hashPlaintextAPIKeys(); err != nil {
+		t.Fatal(err)
+	}
+	// A second run leaves the hashed keys alone
+	if err := hashPlaintextAPIKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if apiKeys, err := store.GetAPIKeys("alice"); err != nil || len(apiKeys) != 1 || apiKeys[0].Key != hashAPIKey(plain) {
+		t.Errorf("stored API keys: %+v %v", apiKeys, err)
+	}
+	if w := testRequest(router, http.MethodGet, "/syncs/progress/doc1", "", "alice", plain); w.Code != http.StatusOK {
+		t.Errorf("hashed key of an earlier version: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+// backupPrefix is the file name prefix of the backups, e.g. syncdata-20220131T030000Z.db
+func backupPrefix() string {
+	base := filepath.Base(config.DBFile)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+// scheduleBackups runs backupDatabase on the -backup-schedule, a cron expression or a descriptor like @daily
+func scheduleBackups(scheduler *cron.Cron) error {
+	_, err := scheduler.AddFunc(config.BackupSchedule, func() {
+		if path, err := backupDatabase(); err != nil {
+			log.Println("Database backup failed:", err)
+		} else {
+			log.Println("Database backed up to", path)
+		}
+	})
+	return err
+}
+
+// backupStore is implemented by the backends that can write a consistent copy of the live database
+type backupStore interface {
+	// Backup writes a copy of the database to dest, which must not exist yet
+	Backup(dest string) error
+}
+
+var ErrBackupUnsupported = errors.New("the database backend doesn't support backups")
+
+// newBackupPath returns the path of a new backup in -backup-dir, creating the directory if needed
+func newBackupPath() (string, error) {
+	if err := os.MkdirAll(config.BackupDir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(config.BackupDir, backupPrefix()+time.Now().UTC().Format("20060102T150405Z")+".db"), nil
+}
+
+// writeBackup writes a backup to a temporary file first and renames it to path,
+// so a backup file is always complete
+func writeBackup(path string, backup func(dest string) error) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := backup(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The backup holds the password hashes, keep it private
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// backupDatabase snapshots the SQLite database into -backup-dir and rotates the old backups
+func backupDatabase() (string, error) {
+	path, err := newBackupPath()
+	if err != nil {
+		return "", err
+	}
+	if err := writeBackup(path, sqliteBackup); err != nil {
+		return "", err
+	}
+	return path, rotateBackups()
+}
+
+// rotateBackups removes all but the newest -backup-keep backups
+func rotateBackups() error {
+	backups, err := filepath.Glob(filepath.Join(config.BackupDir, backupPrefix()+"*.db"))
+	if err != nil {
+		return err
+	}
+	// The UTC timestamps in the names sort chronologically
+	sort.Strings(backups)
+	for len(backups) > config.BackupKeep {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("removing old backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// createBackup writes a compacted copy of the live database to -backup-dir
+func createBackup(c *gin.Context) {
+	backupStore, ok := store.(backupStore)
+	if !ok || config.BackupDir == "" {
+		c.Error(&BackupUnavailable)
+		return
+	}
+	path, err := newBackupPath()
+	if err == nil {
+		err = writeBackup(path, backupStore.Backup)
+	}
+	if err == ErrBackupUnsupported {
+		c.Error(&BackupUnavailable)
+		return
+	}
+	if err == nil {
+		err = rotateBackups()
+	}
+	if err != nil {
+		log.Println("Database backup failed:", err)
+		c.Error(&UnknownServerError)
+		return
+	}
+	log.Println("Database backed up to", path)
+	respond(c, http.StatusCreated, gin.H{"backup": filepath.Base(path)})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bookmark is a bookmarked position of a document, Page being the xpointer or page number as KOReader
+// keeps it. Deleted bookmarks are kept as tombstones like annotations.
+type Bookmark struct {
+	Id        string          `json:"id"`
+	Page      json.RawMessage `json:"page"`
+	Chapter   string          `json:"chapter,omitempty"`
+	Created   int64           `json:"created"`
+	UpdatedAt int64           `json:"updated_at"`
+	Deleted   bool            `json:"deleted,omitempty"`
+}
+
+// DocumentBookmarks are the bookmarks of a document, stored as a RecordBookmarks record per document
+type DocumentBookmarks struct {
+	DocumentId string     `json:"document"`
+	Bookmarks  []Bookmark `json:"bookmarks"`
+}
+
+// maxBookmarks bounds the bookmarks of a document, tombstones included
+const maxBookmarks = 5000
+
+// bookmarksMu serializes the changes of the bookmarks
+var bookmarksMu sync.Mutex
+
+func validBookmark(bookmark Bookmark) bool {
+	return bookmark.Id != "" && utf8.RuneCountInString(bookmark.Id) <= maxMetadataLength &&
+		len(bookmark.Page) > 0 && len(bookmark.Page) <= maxProgressRawLength &&
+		utf8.RuneCountInString(bookmark.Chapter) <= maxMetadataLength &&
+		bookmark.Created >= 0 && bookmark.UpdatedAt >= 0
+}
+
+func getDocumentBookmarks(username string, documentId string) (DocumentBookmarks, error) {
+	bookmarks := DocumentBookmarks{DocumentId: documentId, Bookmarks: []Bookmark{}}
+	err := getRecord(username, RecordBookmarks, documentId, &bookmarks)
+	return bookmarks, err
+}
+
+func userBookmarks(username string) ([]DocumentBookmarks, error) {
+	records, err := store.GetRecords(username, RecordBookmarks)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]DocumentBookmarks, 0, len(records))
+	for _, record := range records {
+		var bookmarks DocumentBookmarks
+		if err := json.Unmarshal([]byte(record.Value), &bookmarks); err != nil {
+			return nil, err
+		}
+		documents = append(documents, bookmarks)
+	}
+	return documents, nil
+}
+
+// listBookmarks returns the bookmarks of a document ordered by creation. With ?since= only those
+// changed since then are returned, tombstones included, otherwise tombstones are left out.
+func listBookmarks(c *gin.Context) {
+	var since int64
+	if value := c.Query("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			c.Error(&InvalidRequest)
+			return
+		}
+	}
+	bookmarks, err := getDocumentBookmarks(c.MustGet("username").(string), c.Param("document"))
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	kept := []Bookmark{}
+	for _, bookmark := range bookmarks.Bookmarks {
+		if since != 0 && bookmark.UpdatedAt >= since || since == 0 && !bookmark.Deleted {
+			kept = append(kept, bookmark)
+		}
+	}
+	bookmarks.Bookmarks = kept
+	respond(c, http.StatusOK, bookmarks)
+}
+
+// createBookmark adds the bookmark or replaces the one with its id, unless that one was updated later.
+// Bookmarks without updated_at are stamped with now. It answers with the stored bookmark.
+func createBookmark(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := c.Param("document")
+	var bookmark Bookmark
+	if err := bindBody(c, &bookmark); err != nil || !validKeyField(documentId) || !validBookmark(bookmark) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if bookmark.UpdatedAt == 0 {
+		bookmark.UpdatedAt = time.Now().Unix()
+	}
+	if bookmark.Created == 0 {
+		bookmark.Created = bookmark.UpdatedAt
+	}
+	bookmark.Deleted = false
+
+	bookmarksMu.Lock()
+	defer bookmarksMu.Unlock()
+	bookmarks, err := getDocumentBookmarks(username, documentId)
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	i := 0
+	for i < len(bookmarks.Bookmarks) && bookmarks.Bookmarks[i].Id != bookmark.Id {
+		i++
+	}
+	switch {
+	case i < len(bookmarks.Bookmarks):
+		if bookmark.UpdatedAt < bookmarks.Bookmarks[i].UpdatedAt {
+			respond(c, http.StatusOK, bookmarks.Bookmarks[i])
+			return
+		}
+		bookmarks.Bookmarks[i] = bookmark
+	case len(bookmarks.Bookmarks) >= maxBookmarks:
+		c.Error(&QuotaExceeded)
+		return
+	default:
+		bookmarks.Bookmarks = append(bookmarks.Bookmarks, bookmark)
+	}
+	sort.SliceStable(bookmarks.Bookmarks, func(i, j int) bool {
+		return bookmarks.Bookmarks[i].Created < bookmarks.Bookmarks[j].Created
+	})
+	if err := putRecord(username, RecordBookmarks, documentId, bookmarks); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusCreated, bookmark)
+}
+
+// deleteBookmark turns the bookmark into a tombstone
+func deleteBookmark(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := c.Param("document")
+	bookmarksMu.Lock()
+	defer bookmarksMu.Unlock()
+	bookmarks, err := getDocumentBookmarks(username, documentId)
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	found := false
+	for i, bookmark := range bookmarks.Bookmarks {
+		if bookmark.Id == c.Param("id") && !bookmark.Deleted {
+			bookmarks.Bookmarks[i] = Bookmark{Id: bookmark.Id, Page: bookmark.Page, Created: bookmark.Created, UpdatedAt: time.Now().Unix(), Deleted: true}
+			found = true
+		}
+	}
+	if !found {
+		c.Error(&BookmarkNotFound)
+		return
+	}
+	if err := putRecord(username, RecordBookmarks, documentId, bookmarks); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
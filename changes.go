@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// ProgressChange tells subscribers that the progress of a document was updated or deleted
+type ProgressChange struct {
+	Username   string
+	DocumentId string
+}
+
+// ProgressEvent is pushed to the devices listening for changes of their account's progress
+type ProgressEvent struct {
+	// Type is "progress" for an update, with the progress picked by the conflict strategy, or "deleted"
+	Type     string    `json:"type"`
+	Document string    `json:"document"`
+	Progress *Document `json:"progress,omitempty"`
+}
+
+// progressEvent looks up the progress a change left behind for the device
+func progressEvent(change ProgressChange, deviceId string) ProgressEvent {
+	document, ok := findProgress(change.Username, change.DocumentId, deviceId)
+	if !ok {
+		return ProgressEvent{Type: "deleted", Document: change.DocumentId}
+	}
+	return ProgressEvent{Type: "progress", Document: change.DocumentId, Progress: &document}
+}
+
+// changeBufferSize is how many changes a subscriber may fall behind before further ones are dropped,
+// maxQueuedChanges the same for a changeQueue
+const (
+	changeBufferSize = 16
+	maxQueuedChanges = 100000
+)
+
+// changeBroker fans the progress changes accepted by this process out to the subscribers of the user,
+// e.g. long-polling requests, and to the queues of all users' changes. Changes made by other server
+// processes sharing the database aren't seen.
+type changeBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan ProgressChange]bool
+	queues      []*changeQueue
+}
+
+var progressChanges = &changeBroker{subscribers: map[string]map[chan ProgressChange]bool{}}
+
+// Subscribe returns a channel receiving the changes of the user's documents and a function ending the subscription
+func (b *changeBroker) Subscribe(username string) (<-chan ProgressChange, func()) {
+	changes := make(chan ProgressChange, changeBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[username] == nil {
+		b.subscribers[username] = map[chan ProgressChange]bool{}
+	}
+	b.subscribers[username][changes] = true
+	return changes, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[username], changes)
+		if len(b.subscribers[username]) == 0 {
+			delete(b.subscribers, username)
+		}
+	}
+}
+
+// Queue returns a queue receiving the changes of all users for as long as the process runs
+func (b *changeBroker) Queue() *changeQueue {
+	queue := &changeQueue{ready: make(chan struct{}, 1)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queues = append(b.queues, queue)
+	return queue
+}
+
+// Publish never blocks the request making the change. A subscriber whose buffer is full misses it and
+// fetches the progress again when it comes back, e.g. with the next long poll; queues keep it.
+func (b *changeBroker) Publish(change ProgressChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for changes := range b.subscribers[change.Username] {
+		select {
+		case changes <- change:
+		default:
+		}
+	}
+	for _, queue := range b.queues {
+		queue.push(change)
+	}
+}
+
+// changeQueue holds the changes for a consumer that mustn't miss any, e.g. the webhooks, however far it
+// falls behind. Only beyond maxQueuedChanges are changes dropped, which is logged with their count.
+type changeQueue struct {
+	mu      sync.Mutex
+	changes []ProgressChange
+	ready   chan struct{}
+	dropped int64
+}
+
+func (q *changeQueue) push(change ProgressChange) {
+	q.mu.Lock()
+	if len(q.changes) >= maxQueuedChanges {
+		q.dropped++
+		dropped := q.dropped
+		q.mu.Unlock()
+		log.Printf("Change queue full, dropped the change of %q by %s, %d changes dropped so far",
+			change.DocumentId, change.Username, dropped)
+		return
+	}
+	q.changes = append(q.changes, change)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Next waits for the oldest change and returns it
+func (q *changeQueue) Next() ProgressChange {
+	for {
+		q.mu.Lock()
+		if len(q.changes) > 0 {
+			change := q.changes[0]
+			q.changes = q.changes[1:]
+			q.mu.Unlock()
+			return change
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
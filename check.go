@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkStore is implemented by the backends that can verify their stored data
+type checkStore interface {
+	// Check runs the backend's integrity check and validates the schema, it returns the problems found
+	Check() ([]string, error)
+}
+
+type CheckResult struct {
+	OK         bool     `json:"ok"`
+	Problems   []string `json:"problems"`
+	DurationMs int64    `json:"duration_ms"`
+}
+
+func checkDatabase() (CheckResult, bool, error) {
+	checkStore, ok := store.(checkStore)
+	if !ok {
+		return CheckResult{}, false, nil
+	}
+	start := time.Now()
+	problems, err := checkStore.Check()
+	if err != nil {
+		return CheckResult{}, true, err
+	}
+	result := CheckResult{OK: len(problems) == 0, Problems: problems, DurationMs: time.Since(start).Milliseconds()}
+	if result.Problems == nil {
+		result.Problems = []string{}
+	}
+	for _, problem := range problems {
+		log.Println("Database check:", problem)
+	}
+	log.Printf("Database check done in %dms, %d problems found", result.DurationMs, len(problems))
+	return result, true, nil
+}
+
+// runCheck answers 500 when problems were found, so monitoring can alert on the status alone
+func runCheck(c *gin.Context) {
+	result, ok, err := checkDatabase()
+	if !ok {
+		c.Error(&CheckUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("Database check failed:", err)
+		c.Error(&UnknownServerError)
+		return
+	}
+	status := http.StatusOK
+	if !result.OK {
+		status = http.StatusInternalServerError
+	}
+	respond(c, status, result)
+}
+
+func checkCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: kosyncsrv check")
+	}
+	result, ok, err := checkDatabase()
+	if !ok {
+		return fmt.Errorf("the %s backend has no integrity check", config.DBDriver)
+	}
+	if err != nil {
+		return err
+	}
+	for _, problem := range result.Problems {
+		fmt.Println(problem)
+	}
+	if !result.OK {
+		return fmt.Errorf("%d problems found", len(result.Problems))
+	}
+	fmt.Println("Database is ok")
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// collectionMember keeps when a document was last added to and removed from a collection. It's a
+// member while the addition is at least as new as the removal, so the changes of several devices
+// merge into the same collection whatever order they arrive in.
+type collectionMember struct {
+	AddedAt   int64 `json:"added_at"`
+	RemovedAt int64 `json:"removed_at,omitempty"`
+}
+
+func (member collectionMember) present() bool {
+	return member.AddedAt >= member.RemovedAt
+}
+
+// storedCollection is a collection as stored in a RecordCollection record named by the collection
+type storedCollection struct {
+	Name      string                      `json:"name"`
+	Members   map[string]collectionMember `json:"members"`
+	CreatedAt int64                       `json:"created_at"`
+	DeletedAt int64                       `json:"deleted_at,omitempty"`
+	UpdatedAt int64                       `json:"updated_at"`
+}
+
+// Collection is a named list of documents, e.g. "Currently reading", ordered by when they were added
+type Collection struct {
+	Name      string   `json:"name"`
+	Documents []string `json:"documents"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+// CollectionChanges are the documents to add to and remove from a collection. Timestamp is when the
+// device made the changes, now when it's left out.
+type CollectionChanges struct {
+	Add       []string `json:"add"`
+	Remove    []string `json:"remove"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+const (
+	// maxCollectionName fits the record names of the MySQL schema
+	maxCollectionName = 100
+	// maxCollectionDocuments bounds the documents of a collection, removed ones included
+	maxCollectionDocuments = 10000
+)
+
+// collectionsMu serializes the changes of the collections
+var collectionsMu sync.Mutex
+
+// visible tells whether the collection exists: it was created or got a document after its deletion
+func (stored storedCollection) visible() bool {
+	if stored.CreatedAt > stored.DeletedAt {
+		return true
+	}
+	for _, member := range stored.Members {
+		if member.present() && member.AddedAt > stored.DeletedAt {
+			return true
+		}
+	}
+	return false
+}
+
+func (stored storedCollection) toCollection() Collection {
+	collection := Collection{Name: stored.Name, Documents: []string{}, UpdatedAt: stored.UpdatedAt}
+	for documentId, member := range stored.Members {
+		if member.present() {
+			collection.Documents = append(collection.Documents, documentId)
+		}
+	}
+	sort.Slice(collection.Documents, func(i, j int) bool {
+		a, b := stored.Members[collection.Documents[i]], stored.Members[collection.Documents[j]]
+		if a.AddedAt != b.AddedAt {
+			return a.AddedAt < b.AddedAt
+		}
+		return collection.Documents[i] < collection.Documents[j]
+	})
+	return collection
+}
+
+func validCollectionChanges(changes CollectionChanges) bool {
+	if changes.Timestamp < 0 || len(changes.Add)+len(changes.Remove) > maxCollectionDocuments {
+		return false
+	}
+	for _, documentId := range append(append([]string{}, changes.Add...), changes.Remove...) {
+		if !validKeyField(documentId) || utf8.RuneCountInString(documentId) > maxMetadataLength {
+			return false
+		}
+	}
+	return true
+}
+
+func userCollections(username string) ([]Collection, error) {
+	records, err := store.GetRecords(username, RecordCollection)
+	if err != nil {
+		return nil, err
+	}
+	collections := []Collection{}
+	for _, record := range records {
+		var stored storedCollection
+		if err := json.Unmarshal([]byte(record.Value), &stored); err != nil {
+			return nil, err
+		}
+		if stored.visible() {
+			collections = append(collections, stored.toCollection())
+		}
+	}
+	return collections, nil
+}
+
+func listCollections(c *gin.Context) {
+	collections, err := userCollections(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, collections)
+}
+
+func getCollection(c *gin.Context) {
+	var stored storedCollection
+	err := getRecord(c.MustGet("username").(string), RecordCollection, c.Param("name"), &stored)
+	if err == ErrNotFound || err == nil && !stored.visible() {
+		c.Error(&CollectionNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, stored.toCollection())
+}
+
+// updateCollection applies the additions and removals to the collection, creating it if needed, and
+// answers with the collection
+func updateCollection(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	name := c.Param("name")
+	var changes CollectionChanges
+	if err := bindBody(c, &changes); err != nil || utf8.RuneCountInString(name) > maxCollectionName || !validCollectionChanges(changes) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	now := time.Now().Unix()
+	if changes.Timestamp == 0 {
+		changes.Timestamp = now
+	}
+
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	stored := storedCollection{Name: name, Members: map[string]collectionMember{}}
+	err := getRecord(username, RecordCollection, name, &stored)
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if !stored.visible() && changes.Timestamp > stored.CreatedAt {
+		stored.CreatedAt = changes.Timestamp
+	}
+	for _, documentId := range changes.Add {
+		member := stored.Members[documentId]
+		if changes.Timestamp > member.AddedAt {
+			member.AddedAt = changes.Timestamp
+		}
+		stored.Members[documentId] = member
+	}
+	for _, documentId := range changes.Remove {
+		member, ok := stored.Members[documentId]
+		if ok && changes.Timestamp > member.RemovedAt {
+			member.RemovedAt = changes.Timestamp
+			stored.Members[documentId] = member
+		}
+	}
+	if len(stored.Members) > maxCollectionDocuments {
+		c.Error(&QuotaExceeded)
+		return
+	}
+	stored.UpdatedAt = now
+	if err := putRecord(username, RecordCollection, name, stored); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, stored.toCollection())
+}
+
+// deleteCollection removes every document of the collection, additions made later on another device
+// bring the collection back with just those documents
+func deleteCollection(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	name := c.Param("name")
+	collectionsMu.Lock()
+	defer collectionsMu.Unlock()
+	var stored storedCollection
+	err := getRecord(username, RecordCollection, name, &stored)
+	if err == ErrNotFound || err == nil && !stored.visible() {
+		c.Error(&CollectionNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	now := time.Now().Unix()
+	for documentId, member := range stored.Members {
+		if member.RemovedAt < now {
+			member.RemovedAt = now
+		}
+		stored.Members[documentId] = member
+	}
+	stored.DeletedAt = now
+	stored.UpdatedAt = now
+	if err := putRecord(username, RecordCollection, name, stored); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
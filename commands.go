@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a one-off operation run instead of the server, e.g. kosyncsrv -d syncdata.db backup copy.db
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {"backup <file>", "Write a compacted copy of the database to file", backupCommand},
+	"export": {"export [-h] [-format csv] [-user alice] [-o file]", "Dump users and documents as JSON or CSV", exportCommand},
+	"import-redis": {"import-redis [-mode merge|replace] [-db n] <redis://host/db | dump.rdb>",
+		"Import the data of the original koreader-sync-server from Redis or an RDB dump", importRedisCommand},
+	"import-sql": {"import-sql [-driver sqlite3|postgres|mysql] -dsn <source> [-preset koreader-sync] [-mode merge|replace]",
+		"Import a koreader-sync or older kosyncsrv database, or another SQL schema through queries", importSQLCommand},
+	"import-positions": {"import-positions -user <username> [-source kindle|kobo] [-dry-run] <file>",
+		"Import the reading positions of a Kindle's My Clippings.txt or a KoboReader.sqlite", importPositionsCommand},
+	"dedupe":         {"dedupe [-dry-run]", "Merge duplicate user and document rows into the newest one, then migrate", dedupeCommand},
+	"check":          {"check", "Verify the integrity of the database and its schema", checkCommand},
+	"stats":          {"stats [-json]", "Print user, document and sync statistics", statsCommand},
+	"replay-journal": {"replay-journal [-since unixtime] <file>", "Apply a -journal file, e.g. on top of a restored backup", replayJournalCommand},
+	"import":         {"import [-mode merge|replace] <file>", "Load a JSON dump written by export, - reads standard input", importCommand},
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("Commands:")
+	for _, name := range names {
+		fmt.Printf("  %s\n    \t%s\n", commands[name].usage, commands[name].description)
+	}
+}
+
+func runCommand(args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return command.run(args[1:])
+}
+
+func backupCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: kosyncsrv backup <file>")
+	}
+	backupStore, ok := store.(backupStore)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+	if _, err := os.Stat(args[0]); err == nil {
+		return fmt.Errorf("%s already exists", args[0])
+	}
+	if err := writeBackup(args[0], backupStore.Backup); err != nil {
+		return err
+	}
+	fmt.Println("Database backed up to", args[0])
+	return nil
+}
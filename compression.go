@@ -0,0 +1,98 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// maxDecompressedBody bounds a gzip request body once decompressed, so a small bomb can't exhaust the memory
+const maxDecompressedBody = 32 << 20
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, i.e. names it or * without q=0
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		parts := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter compresses the body of a response, the headers are set on the first write so empty
+// answers like 204 and 304 go out unchanged
+type gzipWriter struct {
+	gin.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if w.gz == nil {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	return w.gz.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Compression decompresses gzip request bodies and compresses the responses of clients sending
+// Accept-Encoding: gzip, e.g. large batch fetches over a slow mobile connection. The event stream and
+// WebSocket are left alone, they are flushed message by message.
+func Compression(c *gin.Context) {
+	switch strings.ToLower(c.GetHeader("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		body, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			writeError(c, &InvalidRequest)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, body, maxDecompressedBody)
+		c.Request.Header.Del("Content-Encoding")
+		c.Request.ContentLength = -1
+	default:
+		writeError(c, &UnsupportedEncoding)
+		return
+	}
+	if !acceptsGzip(c.GetHeader("Accept-Encoding")) || isEventStream(c) || websocket.IsWebSocketUpgrade(c.Request) {
+		c.Next()
+		return
+	}
+	writer := &gzipWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	defer writer.close()
+	c.Next()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipTestBody(t *testing.T, body string) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	if _, err := gz.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestGzipRequestAndAnswer(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	req := httptest.NewRequest(http.MethodPut, "/syncs/progress",
+		gzipTestBody(t, `{"document": "doc1", "progress": "7", "percentage": 0.7, "device": "kobo"}`))
+	req.Header.Set("Accept", mediaTypeV1)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("x-auth-user", "alice")
+	req.Header.Set("x-auth-key", "pw")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip coded update: %d %v", w.Code, w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := io.ReadAll(gz)
+	if err != nil || !strings.Contains(string(answer), `"document":"doc1"`) {
+		t.Errorf("gzip coded answer: %s %v", answer, err)
+	}
+	if document, err := store.GetDocument("alice", "doc1"); err != nil || document.Percentage != 0.7 {
+		t.Errorf("gzip coded update not stored: %+v %v", document, err)
+	}
+
+	// Without Accept-Encoding the answer isn't coded
+	if w := testRequest(router, http.MethodGet, "/syncs/progress/doc1", "", "alice", "pw"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("answer coded without Accept-Encoding: %v", w.Header())
+	}
+}
+
+func TestGzipRequestBodies(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	tests := []struct {
+		name     string
+		encoding string
+		body     io.Reader
+		status   int
+	}{
+		{"unsupported coding", "br", strings.NewReader("{}"), UnsupportedEncoding.Status},
+		{"not gzip", "gzip", strings.NewReader("{}"), InvalidRequest.Status},
+		{"bomb", "gzip", gzipTestBody(t, `{"document": "`+strings.Repeat("x", maxDecompressedBody)+`"}`), InvalidRequest.Status},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/syncs/progress", test.body)
+		req.Header.Set("Accept", mediaTypeV1)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", test.encoding)
+		req.Header.Set("x-auth-user", "alice")
+		req.Header.Set("x-auth-key", "pw")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body, test.status)
+		}
+	}
+}
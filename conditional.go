@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// progressETag derives the entity tag of a progress as answered to the request: its timestamp and a hash
+// of the answer's fields, including the note, status and metadata of v2 that change without a new
+// timestamp, and of the negotiated media type, so each representation has a tag of its own
+func progressETag(c *gin.Context, document Document) string {
+	hash := fnv.New32a()
+	b, _ := json.Marshal(document)
+	hash.Write(b)
+	fmt.Fprintf(hash, "v%d %s", apiVersion(c), c.GetString("encoding"))
+	if document.TimestampMs != 0 {
+		return fmt.Sprintf(`"%d-%08x"`, document.TimestampMs, hash.Sum32())
+	}
+	return fmt.Sprintf(`"%d-%08x"`, document.Timestamp, hash.Sum32())
+}
+
+// gzipETagSuffix ends the tags of gzip coded answers, so caches tell them from the uncoded ones.
+// Tags are compared without it, the progress underneath is the same.
+const gzipETagSuffix = `-gzip"`
+
+// codedETag returns the tag of the answer to the request, with gzipETagSuffix when Compression gzips it
+func codedETag(c *gin.Context, etag string) string {
+	if _, gzipped := c.Writer.(*gzipWriter); gzipped {
+		return strings.TrimSuffix(etag, `"`) + gzipETagSuffix
+	}
+	return etag
+}
+
+// etagMatches reports whether an If-None-Match header lists the tag, comparing weakly as RFC 7232 asks
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasSuffix(candidate, gzipETagSuffix) {
+			candidate = strings.TrimSuffix(candidate, gzipETagSuffix) + `"`
+		}
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedSince reports whether an If-Modified-Since header is at or after the timestamp,
+// unparseable dates are ignored as RFC 7232 asks
+func notModifiedSince(header string, timestamp int64) bool {
+	since, err := http.ParseTime(header)
+	return err == nil && timestamp <= since.Unix()
+}
+
+// notModified reports whether the conditional headers of the request show the client has the progress,
+// If-None-Match takes precedence over If-Modified-Since
+func notModified(c *gin.Context, document Document) bool {
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		return etagMatches(header, progressETag(c, document))
+	}
+	header := c.GetHeader("If-Modified-Since")
+	return header != "" && notModifiedSince(header, document.Timestamp)
+}
+
+// hasConditions reports whether the request names the progress the client has
+func hasConditions(c *gin.Context) bool {
+	return c.GetHeader("If-None-Match") != "" || c.GetHeader("If-Modified-Since") != ""
+}
+
+// preconditionFailed reports whether the If-Match or If-Unmodified-Since header of an update shows the
+// progress changed since the client fetched it, e.g. another device moved further. current is extended
+// like the answers of the request. If-Match takes precedence; without stored progress only If-Match fails.
+func preconditionFailed(c *gin.Context, current Document, exists bool) bool {
+	if header := c.GetHeader("If-Match"); header != "" {
+		return !exists || !etagMatches(header, progressETag(c, current))
+	}
+	if header := c.GetHeader("If-Unmodified-Since"); header != "" && exists {
+		since, err := http.ParseTime(header)
+		return err == nil && current.Timestamp > since.Unix()
+	}
+	return false
+}
+
+// hasPreconditions reports whether an update is conditional on the progress the client has
+func hasPreconditions(c *gin.Context) bool {
+	return c.GetHeader("If-Match") != "" || c.GetHeader("If-Unmodified-Since") != ""
+}
+
+// writeProgress answers with the progress, or with 304 Not Modified when the client already has it,
+// so devices polling a document don't download it again
+func writeProgress(c *gin.Context, document Document) {
+	c.Header("ETag", codedETag(c, progressETag(c, document)))
+	c.Header("Last-Modified", time.Unix(document.Timestamp, 0).UTC().Format(http.TimeFormat))
+	// The tag doesn't cover the positions of the other devices, a listing of them is always sent
+	if document.Devices == nil && notModified(c, document) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	respond(c, http.StatusOK, document)
+}
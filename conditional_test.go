@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// conditionalGet fetches alice's progress of doc1 with the Accept and If-None-Match headers
+func conditionalGet(router http.Handler, accept string, acceptEncoding string, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/syncs/progress/doc1", nil)
+	req.Header.Set("Accept", accept)
+	req.Header.Set("x-auth-user", "alice")
+	req.Header.Set("x-auth-key", "pw")
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestConditionalProgress(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.5")
+
+	etag := conditionalGet(router, mediaTypeV1, "", "").Header().Get("ETag")
+	if w := conditionalGet(router, mediaTypeV1, "", etag); w.Code != http.StatusNotModified {
+		t.Errorf("unchanged progress: %d %s", w.Code, w.Body)
+	}
+	gzipTag := conditionalGet(router, mediaTypeV1, "gzip", "").Header().Get("ETag")
+	if gzipTag == etag {
+		t.Errorf("gzip coded answer has the tag of the uncoded one: %s", gzipTag)
+	}
+	if w := conditionalGet(router, mediaTypeV1, "gzip", gzipTag); w.Code != http.StatusNotModified {
+		t.Errorf("unchanged gzip coded progress: %d", w.Code)
+	}
+
+	v2 := mediaTypePrefix + "2+" + EncodingJSON
+	v2Tag := conditionalGet(router, v2, "", "").Header().Get("ETag")
+	if v2Tag == etag {
+		t.Errorf("v2 answer has the tag of the v1 one: %s", v2Tag)
+	}
+	// The note changes without a new progress timestamp
+	if err := setDocumentNote("alice", "doc1", "great"); err != nil {
+		t.Fatal(err)
+	}
+	if w := conditionalGet(router, v2, "", v2Tag); w.Code != http.StatusOK {
+		t.Errorf("v2 progress with a new note answered %d", w.Code)
+	}
+}
+
+func TestConditionalUpdate(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.5")
+	etag := conditionalGet(router, mediaTypeV1, "gzip", "").Header().Get("ETag")
+
+	update := func(ifMatch string) int {
+		req := httptest.NewRequest(http.MethodPut, "/syncs/progress",
+			strings.NewReader(`{"document": "doc1", "progress": "2", "percentage": 0.6, "device": "kobo", "device_id": "K1"}`))
+		req.Header.Set("Accept", mediaTypeV1)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("x-auth-user", "alice")
+		req.Header.Set("x-auth-key", "pw")
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	// The tag of the gzip coded answer names the same progress
+	if status := update(etag); status != http.StatusOK {
+		t.Errorf("update of the fetched progress: %d", status)
+	}
+	if status := update(etag); status != http.StatusPreconditionFailed {
+		t.Errorf("update of progress changed since: %d", status)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// The -config file sets the flags by their names, e.g. db-driver: postgres, and so do the KOSYNC_*
+// environment variables, e.g. KOSYNC_DB_DRIVER=postgres, so every flag can be set there. Flags given on
+// the command line take precedence over the environment, which takes precedence over the file.
+
+// envAliases name the environment variables of the single letter flags
+var envAliases = map[string]string{
+	"d": "KOSYNC_DB_FILE",
+	"t": "KOSYNC_HOST",
+	"p": "KOSYNC_PORT",
+	"c": "KOSYNC_SSL_CERT",
+	"k": "KOSYNC_SSL_KEY",
+}
+
+// envName returns the environment variable of a flag, e.g. KOSYNC_DB_DRIVER for -db-driver
+func envName(name string) string {
+	if alias, ok := envAliases[name]; ok {
+		return alias
+	}
+	return "KOSYNC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvironment sets the flags that aren't in explicit from the environment and adds them to it
+func applyEnvironment(explicit map[string]bool) error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+			return
+		}
+		explicit[f.Name] = true
+	})
+	return err
+}
+
+// readConfigFile decodes a YAML file, or TOML for a .toml file, into its settings
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]interface{}{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &settings)
+	} else {
+		err = yaml.Unmarshal(data, &settings)
+	}
+	return settings, err
+}
+
+// configValue returns a setting as the value of a flag. Lists become space separated lists and maps
+// space separated key=value pairs, e.g. for -user-conflict-strategies.
+func configValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, " "), nil
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(value))
+		for key, item := range value {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+s)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, " "), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// applyConfigFile sets the flags of the file that aren't in explicit. Names may use underscores
+// instead of dashes, as is common in TOML.
+func applyConfigFile(path string, explicit map[string]bool) error {
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range settings {
+		name := strings.ReplaceAll(key, "_", "-")
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if explicit[name] {
+			continue
+		}
+		s, err := configValue(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if err := flag.Set(name, s); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
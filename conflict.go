@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Conflict strategies choose which device's progress of a document is returned
+const (
+	// ConflictLatest returns the most recently synced progress, like the original server
+	ConflictLatest = "latest"
+	// ConflictFurthest returns the progress furthest into the document, so a device reopening an
+	// old copy doesn't send the others back
+	ConflictFurthest = "furthest"
+	// ConflictDevice returns the progress of the device asking, see requestDeviceId
+	ConflictDevice = "device"
+)
+
+func validConflictStrategy(strategy string) bool {
+	return strategy == ConflictLatest || strategy == ConflictFurthest || strategy == ConflictDevice
+}
+
+// parseUserConflictStrategies parses a space separated list of user=strategy, e.g. "alice=furthest bob=device"
+func parseUserConflictStrategies(list string) (map[string]string, error) {
+	strategies := map[string]string{}
+	for _, entry := range strings.Fields(list) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || !validConflictStrategy(parts[1]) {
+			return nil, fmt.Errorf("invalid entry %q, expected user=latest, user=furthest or user=device", entry)
+		}
+		strategies[parts[0]] = parts[1]
+	}
+	return strategies, nil
+}
+
+// conflictStrategy returns the strategy of a user as stored, i.e. with the tenant prefix
+func conflictStrategy(username string) string {
+	if strategy, ok := config.UserConflictStrategies[username]; ok {
+		return strategy
+	}
+	return config.ConflictStrategy
+}
+
+// requestDeviceId returns the device asking for progress. KOReader doesn't identify itself when
+// fetching, other clients pass their device_id as a query parameter or the X-Device-Id header.
+func requestDeviceId(c *gin.Context) string {
+	if deviceId := c.Query("device_id"); deviceId != "" {
+		return deviceId
+	}
+	return c.GetHeader("X-Device-Id")
+}
+
+// resolveProgress picks the progress to return from the devices' progress of a document, ordered
+// newest first. Without progress of the asking device the device strategy falls back to the latest.
+func resolveProgress(strategy string, devices []Document, deviceId string) (Document, bool) {
+	if len(devices) == 0 {
+		return Document{}, false
+	}
+	switch strategy {
+	case ConflictFurthest:
+		furthest := devices[0]
+		for _, document := range devices[1:] {
+			// The structured positions settle a tie, e.g. of devices rounding the percentage alike
+			if document.Percentage > furthest.Percentage ||
+				document.Percentage == furthest.Percentage && comparePositions(document.Position, furthest.Position) > 0 {
+				furthest = document
+			}
+		}
+		return furthest, true
+	case ConflictDevice:
+		for _, document := range devices {
+			if deviceId != "" && document.DeviceId == deviceId {
+				return document, true
+			}
+		}
+	}
+	return devices[0], true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// dedupeKey is a table's natural key, rows sharing it are merged into the one ordered first by newest
+type dedupeKey struct {
+	table   string
+	columns []string
+	newest  string
+}
+
+// dedupeKeys returns the keys for the schema version, legacy databases may lack the timestamp columns
+// and kept a single progress per document before version 9
+func dedupeKeys(version int, userColumns []string) []dedupeKey {
+	userNewest := "1"
+	for _, column := range userColumns {
+		if column == "updated_at" {
+			userNewest = "COALESCE(updated_at, 0)"
+		}
+	}
+	documentKey := []string{"username", "documentid"}
+	if version >= 9 {
+		documentKey = append(documentKey, "device_id")
+	}
+	return []dedupeKey{
+		{"user", []string{"username"}, userNewest},
+		{"document", documentKey, `COALESCE("timestamp", 0)`},
+	}
+}
+
+// Dedupe merges the rows sharing a user's or document's key into the newest one. Such rows were
+// accepted by databases created without the unique indexes, which then fail migration 1, or are
+// left behind by manual edits. It returns a line for each merged key.
+func (s *sqlStore) Dedupe(dryRun bool) ([]string, error) {
+	if _, err := s.db.Exec(schemaVersionTable); err != nil {
+		return nil, err
+	}
+	version, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	userColumns, err := s.tableColumns("user")
+	if err != nil {
+		return nil, err
+	}
+	var merged []string
+	err = s.transaction(func(tx *sqlStore) error {
+		merged = nil
+		for _, key := range dedupeKeys(version, userColumns) {
+			lines, err := tx.dedupeTable(key, dryRun)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key.table, err)
+			}
+			merged = append(merged, lines...)
+		}
+		return nil
+	})
+	return merged, err
+}
+
+func (s *sqlStore) dedupeTable(key dedupeKey, dryRun bool) ([]string, error) {
+	columns := `"` + strings.Join(key.columns, `", "`) + `"`
+	rows, err := s.ext().Query(`SELECT ` + columns + `, COUNT(*) FROM "` + key.table + `"
+		GROUP BY ` + columns + ` HAVING COUNT(*) > 1`)
+	if err != nil {
+		return nil, err
+	}
+	type group struct {
+		values []interface{}
+		count  int
+	}
+	var groups []group
+	for rows.Next() {
+		values := make([]sql.NullString, len(key.columns))
+		dest := make([]interface{}, 0, len(values)+1)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		var count int
+		if err := rows.Scan(append(dest, &count)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		g := group{count: count}
+		valid := true
+		for _, value := range values {
+			valid = valid && value.Valid
+			g.values = append(g.values, value.String)
+		}
+		// Rows without a key are dropped by the cleanup of migration 4
+		if valid {
+			groups = append(groups, g)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var where []string
+	for _, column := range key.columns {
+		where = append(where, `"`+column+`"=?`)
+	}
+	condition := strings.Join(where, " AND ")
+	var merged []string
+	for _, g := range groups {
+		merged = append(merged, fmt.Sprintf("%s %s: %d rows merged into the newest", key.table, strings.Join(stringValues(g.values), "/"), g.count))
+		if dryRun {
+			continue
+		}
+		// The rows may be identical, so all of them are deleted and the newest inserted again
+		newest := map[string]interface{}{}
+		err := s.ext().QueryRowx(s.db.Rebind(`SELECT * FROM "`+key.table+`" WHERE `+condition+` ORDER BY `+key.newest+` DESC`),
+			g.values...).MapScan(newest)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.ext().Exec(s.db.Rebind(`DELETE FROM "`+key.table+`" WHERE `+condition), g.values...); err != nil {
+			return nil, err
+		}
+		var names []string
+		var values []interface{}
+		for name, value := range newest {
+			names = append(names, `"`+name+`"`)
+			values = append(values, value)
+		}
+		insert := `INSERT INTO "` + key.table + `" (` + strings.Join(names, ", ") + `) VALUES (?` + strings.Repeat(", ?", len(names)-1) + `)`
+		if _, err := s.ext().Exec(s.db.Rebind(insert), values...); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+func stringValues(values []interface{}) []string {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		strs[i] = fmt.Sprint(value)
+	}
+	return strs
+}
+
+func dedupeCommand(args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only report the duplicate rows")
+	flags.Parse(args)
+	var sqlStores []*sqlStore
+	switch s := store.(type) {
+	case *sqlStore:
+		sqlStores = []*sqlStore{s}
+	case *shardedStore:
+		sqlStores = s.sqlStores()
+	default:
+		return fmt.Errorf("the %s backend can't hold duplicate rows", config.DBDriver)
+	}
+	total := 0
+	for _, sqlStore := range sqlStores {
+		merged, err := sqlStore.Dedupe(*dryRun)
+		if err != nil {
+			return err
+		}
+		for _, line := range merged {
+			fmt.Println(line)
+		}
+		total += len(merged)
+	}
+	if *dryRun {
+		fmt.Printf("%d duplicate keys found\n", total)
+		return nil
+	}
+	fmt.Printf("%d duplicate keys merged\n", total)
+	// The database was opened without migrating, in case the duplicates kept the unique indexes from being created
+	for _, sqlStore := range sqlStores {
+		if err := sqlStore.migrate(len(sqlStore.dialect.migrations)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
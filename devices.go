@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Device is a reader that synced progress to the account, stored as a RecordDevice record named by its
+// device id, or by its name for clients sending none
+type Device struct {
+	DeviceId string `json:"device_id"`
+	Device   string `json:"device"`
+	// Name is a friendly name given by the user, e.g. "Bedroom Kobo"
+	Name      string `json:"name,omitempty"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
+// deviceSeenInterval is how stale last_seen may get before a sync updates it, so not every sync writes the registry
+const deviceSeenInterval = 60
+
+var devicesMu sync.Mutex
+
+func deviceRecordName(deviceId string, device string) string {
+	if deviceId != "" {
+		return deviceId
+	}
+	return device
+}
+
+// trackDevice notes the sync of a device in the user's registry. Failures are only logged,
+// the progress is stored already.
+func trackDevice(username string, device string, deviceId string, timestamp int64) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	name := deviceRecordName(deviceId, device)
+	seen := Device{DeviceId: deviceId, Device: device, FirstSeen: timestamp}
+	err := getRecord(username, RecordDevice, name, &seen)
+	if err != nil && err != ErrNotFound {
+		log.Println("Looking up device", name, "of", username, "failed:", err)
+		return
+	}
+	if err == nil && seen.Device == device && timestamp-seen.LastSeen < deviceSeenInterval {
+		return
+	}
+	seen.Device = device
+	seen.LastSeen = timestamp
+	if err := putRecord(username, RecordDevice, name, seen); err != nil {
+		log.Println("Recording device", name, "of", username, "failed:", err)
+	}
+}
+
+// userDevices returns the devices of the registry, completed with those found in the stored progress,
+// ordered by last activity
+func userDevices(username string) ([]Device, error) {
+	records, err := store.GetRecords(username, RecordDevice)
+	if err != nil {
+		return nil, err
+	}
+	devices := map[string]*Device{}
+	for _, record := range records {
+		var device Device
+		if err := json.Unmarshal([]byte(record.Value), &device); err != nil {
+			return nil, err
+		}
+		devices[record.Name] = &device
+	}
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		return nil, err
+	}
+	synced := map[string]*Device{}
+	for _, document := range documents {
+		name := deviceRecordName(document.DeviceId, document.Device)
+		// Devices may have synced before the registry existed
+		if device, ok := devices[name]; ok {
+			if document.Timestamp < device.FirstSeen {
+				device.FirstSeen = document.Timestamp
+			}
+			continue
+		}
+		device, ok := synced[name]
+		if !ok {
+			device = &Device{DeviceId: document.DeviceId, Device: document.Device, FirstSeen: document.Timestamp}
+			synced[name] = device
+		}
+		if document.Timestamp < device.FirstSeen {
+			device.FirstSeen = document.Timestamp
+		}
+		if document.Timestamp > device.LastSeen {
+			device.LastSeen = document.Timestamp
+		}
+	}
+	list := make([]Device, 0, len(devices)+len(synced))
+	for _, device := range devices {
+		list = append(list, *device)
+	}
+	for _, device := range synced {
+		list = append(list, *device)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].LastSeen != list[j].LastSeen {
+			return list[i].LastSeen > list[j].LastSeen
+		}
+		return list[i].DeviceId < list[j].DeviceId
+	})
+	return list, nil
+}
+
+func listDevices(c *gin.Context) {
+	devices, err := userDevices(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, devices)
+}
+
+// findDevice returns the device named by the :device of the route, its device id or the name of
+// a device syncing without one, and whether it's in the registry
+func findDevice(username string, name string) (Device, bool, error) {
+	var device Device
+	err := getRecord(username, RecordDevice, name, &device)
+	if err == nil {
+		return device, true, nil
+	}
+	if err != ErrNotFound {
+		return device, false, err
+	}
+	devices, err := userDevices(username)
+	if err != nil {
+		return device, false, err
+	}
+	for _, device := range devices {
+		if deviceRecordName(device.DeviceId, device.Device) == name {
+			return device, false, nil
+		}
+	}
+	return device, false, ErrNotFound
+}
+
+// renameDevice gives the device a friendly name, an empty name removes it
+func renameDevice(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := bindBody(c, &request); err != nil || utf8.RuneCountInString(request.Name) > maxMetadataLength {
+		c.Error(&InvalidRequest)
+		return
+	}
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	device, _, err := findDevice(username, c.Param("device"))
+	if err == ErrNotFound {
+		c.Error(&DeviceNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	device.Name = request.Name
+	if err := putRecord(username, RecordDevice, c.Param("device"), device); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, device)
+}
+
+// deleteDevice removes a device the user no longer owns together with its progress on every document,
+// the progress of the other devices is kept. A device syncing again comes back.
+func deleteDevice(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	device, registered, err := findDevice(username, c.Param("device"))
+	if err == ErrNotFound {
+		c.Error(&DeviceNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	var deleted int64
+	// The progress of clients without a device id can't be told apart by device
+	if device.DeviceId != "" {
+		if deleted, err = store.DeleteDeviceDocuments(username, device.DeviceId); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		journal.Record(JournalEntry{Op: JournalDeleteDevice, User: username, Document: &Document{DeviceId: device.DeviceId}})
+	}
+	if registered {
+		if err := store.DeleteRecord(username, RecordDevice, c.Param("device")); err != nil && err != ErrNotFound {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	respond(c, http.StatusOK, gin.H{"deleted_documents": deleted})
+}
+
+// DevicePosition is the last position a device synced of a document, listed with the progress in v2
+// for clients offering to jump to where the user was on another device
+type DevicePosition struct {
+	DeviceId string `json:"device_id"`
+	Device   string `json:"device"`
+	// Name is the friendly name of the device, see renameDevice
+	Name        string       `json:"name,omitempty"`
+	Progress    *StringOrInt `json:"progress"`
+	Percentage  float64      `json:"percentage"`
+	Position    *Position    `json:"position,omitempty"`
+	Timestamp   int64        `json:"timestamp"`
+	TimestampMs int64        `json:"timestamp_ms,omitempty"`
+}
+
+// devicePositions returns the last position of each device on the document, newest first, or
+// ErrDevicesUnsupported
+func devicePositions(username string, documentId string) ([]DevicePosition, error) {
+	documents, err := store.GetDocumentDevices(username, documentId)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	records, err := store.GetRecords(username, RecordDevice)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, record := range records {
+		var device Device
+		if err := json.Unmarshal([]byte(record.Value), &device); err == nil {
+			names[record.Name] = device.Name
+		}
+	}
+	positions := make([]DevicePosition, 0, len(documents))
+	for _, document := range documents {
+		positions = append(positions, DevicePosition{
+			DeviceId:    document.DeviceId,
+			Device:      document.Device,
+			Name:        names[deviceRecordName(document.DeviceId, document.Device)],
+			Progress:    document.Progress,
+			Percentage:  document.Percentage,
+			Position:    document.Position,
+			Timestamp:   document.Timestamp,
+			TimestampMs: document.TimestampMs,
+		})
+	}
+	return positions, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DatabaseDump is the JSON format of the export command. Unlike UserExport it includes
+// the password keys, so the dump can be imported into another server.
+type DatabaseDump struct {
+	Exported int64      `json:"exported"`
+	Users    []UserDump `json:"users"`
+}
+
+type UserDump struct {
+	Username  string             `json:"username"`
+	Password  string             `json:"password"`
+	CreatedAt int64              `json:"created_at"`
+	Documents []Document         `json:"documents"`
+	Metadata  []DocumentMetadata `json:"metadata,omitempty"`
+	Records   []Record           `json:"records,omitempty"`
+}
+
+var csvHeader = []string{"username", "document", "progress", "percentage", "device", "device_id", "timestamp"}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "json", "Output format: json or csv; csv has one row per document and no passwords")
+	username := flags.String("user", "", "Only export this user")
+	output := flags.String("o", "", "Output file, standard output when empty")
+	flags.Parse(args)
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+
+	var users []DbUser
+	if *username != "" {
+		user, err := store.GetUser(*username)
+		if err != nil {
+			return fmt.Errorf("user %s: %w", *username, err)
+		}
+		users = []DbUser{user}
+	} else {
+		var err error
+		if users, err = store.GetUsers(); err != nil {
+			return err
+		}
+	}
+	dump := DatabaseDump{Exported: time.Now().Unix(), Users: make([]UserDump, 0, len(users))}
+	for _, user := range users {
+		documents, err := store.GetDocuments(user.Username)
+		if err != nil {
+			return err
+		}
+		metadata, err := userDocumentMetadata(user.Username)
+		if err != nil {
+			return err
+		}
+		records, err := userRecords(user.Username)
+		if err != nil {
+			return err
+		}
+		dump.Users = append(dump.Users, UserDump{
+			Username:  user.Username,
+			Password:  user.Password,
+			CreatedAt: user.CreatedAt,
+			Documents: documents,
+			Metadata:  metadata,
+			Records:   records,
+		})
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		// The JSON dump holds the password keys
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if *format == "csv" {
+		return writeDumpCSV(out, dump)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+func writeDumpCSV(out io.Writer, dump DatabaseDump) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, user := range dump.Users {
+		for _, document := range user.Documents {
+			err := w.Write([]string{
+				user.Username,
+				document.DocumentId,
+				document.Progress.inner,
+				strconv.FormatFloat(document.Percentage, 'f', -1, 64),
+				document.Device,
+				document.DeviceId,
+				strconv.FormatInt(document.Timestamp, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// validImportedDocument checks an imported document like updateProgress checks a request
+func validImportedDocument(document Document) bool {
+	return validKeyField(document.DocumentId) && document.Progress != nil && document.Device != "" &&
+		validPercentage(document.Percentage) && validPosition(document.Position) && document.Timestamp > 0
+}
+
+// importDocument stores the document unless the user already has newer progress for it from the same device,
+// or from any device with a backend keeping a single progress per document
+func importDocument(username string, document Document) (bool, error) {
+	devices, err := store.GetDocumentDevices(username, document.DocumentId)
+	if err == ErrDevicesUnsupported {
+		existing, err := store.GetDocument(username, document.DocumentId)
+		if err == nil && existing.Timestamp >= document.Timestamp {
+			return false, nil
+		}
+		if err != nil && err != ErrNotFound {
+			return false, err
+		}
+		return true, store.ImportDocument(username, document)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range devices {
+		if existing.DeviceId == document.DeviceId && existing.Timestamp >= document.Timestamp {
+			return false, nil
+		}
+	}
+	return true, store.ImportDocument(username, document)
+}
+
+// importCommand reads a dump written by the export command. In merge mode existing users keep their
+// password and the newer progress of each document wins; in replace mode the users in the dump
+// are deleted and recreated from it. Users that are not in the dump are never touched.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	mode := flags.String("mode", "merge", "merge or replace")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*mode != "merge" && *mode != "replace") {
+		return fmt.Errorf("usage: kosyncsrv import [-mode merge|replace] <file>")
+	}
+
+	in := io.Reader(os.Stdin)
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	var dump DatabaseDump
+	if err := json.NewDecoder(in).Decode(&dump); err != nil {
+		return fmt.Errorf("reading dump: %w", err)
+	}
+	return importDump(dump, *mode == "replace")
+}
+
+// importDump stores the users and documents of a dump, see importCommand for the modes
+func importDump(dump DatabaseDump, replace bool) error {
+	var users, imported, skipped int
+	for _, user := range dump.Users {
+		if !validStoredUsername(user.Username) || user.Password == "" {
+			log.Printf("Skipping invalid user %q, or one of a tenant missing from -tenants", user.Username)
+			continue
+		}
+		if replace {
+			if err := store.DeleteUser(user.Username); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+		if err := store.AddUser(user.Username, user.Password); err != nil && err != ErrAlreadyExists {
+			return err
+		}
+		users++
+		for _, document := range user.Documents {
+			if !validImportedDocument(document) {
+				log.Printf("Skipping invalid document %q of %s", document.DocumentId, user.Username)
+				skipped++
+				continue
+			}
+			ok, err := importDocument(user.Username, document)
+			if err != nil {
+				return err
+			}
+			if ok {
+				imported++
+			} else {
+				skipped++
+			}
+		}
+		for _, metadata := range user.Metadata {
+			if !validDocumentMetadata(metadata) {
+				log.Printf("Skipping invalid metadata of %q of %s", metadata.DocumentId, user.Username)
+				continue
+			}
+			existing, err := store.GetDocumentMetadata(user.Username, metadata.DocumentId)
+			if err == nil && existing.UpdatedAt >= metadata.UpdatedAt {
+				continue
+			}
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			if err := store.SetDocumentMetadata(newDbDocumentMetadata(user.Username, metadata)); err != nil {
+				return err
+			}
+		}
+		for _, record := range user.Records {
+			if !validRecordKind(record.Kind) || record.Name == "" || !json.Valid(record.Value) {
+				log.Printf("Skipping invalid %s record %q of %s", record.Kind, record.Name, user.Username)
+				continue
+			}
+			if err := importRecord(user.Username, record); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("Imported %d users and %d documents, skipped %d documents\n", users, imported, skipped)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/ugorji/go/codec"
+)
+
+// The encodings of the sync payloads. The binary ones carry the same values as the JSON, which stays
+// the single source of truth: payloads are converted from and to their JSON, so e.g. the progress keeps
+// its original type.
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+	EncodingCBOR    = "cbor"
+)
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	mapType := reflect.TypeOf(map[string]interface{}(nil))
+	msgpackHandle.MapType = mapType
+	msgpackHandle.RawToString = true
+	msgpackHandle.WriteExt = true
+	cborHandle.MapType = mapType
+}
+
+func validEncoding(encoding string) bool {
+	return encoding == EncodingJSON || encoding == EncodingMsgpack || encoding == EncodingCBOR
+}
+
+func codecHandle(encoding string) codec.Handle {
+	if encoding == EncodingCBOR {
+		return cborHandle
+	}
+	return msgpackHandle
+}
+
+// bodyEncoding returns the encoding of the request body named by its Content-Type, JSON unless it's
+// MessagePack or CBOR
+func bodyEncoding(c *gin.Context) string {
+	contentType := c.ContentType()
+	switch contentType {
+	case "application/msgpack", "application/x-msgpack":
+		return EncodingMsgpack
+	case "application/cbor":
+		return EncodingCBOR
+	}
+	if _, encoding, ok := parseMediaType(contentType); ok {
+		return encoding
+	}
+	return EncodingJSON
+}
+
+// bindBody binds the request body like ShouldBindJSON, in whichever encoding it was sent
+func bindBody(c *gin.Context, obj interface{}) error {
+	encoding := bodyEncoding(c)
+	if encoding == EncodingJSON {
+		return c.ShouldBindJSON(obj)
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := codec.NewDecoderBytes(body, codecHandle(encoding)).Decode(&value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return binding.JSON.BindBody(data, obj)
+}
+
+// jsonValue returns obj as the values of its JSON, with integral numbers as int64 and the others as float64
+func jsonValue(obj interface{}) (interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return convertNumbers(value), nil
+}
+
+func convertNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = convertNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = convertNumbers(item)
+		}
+	}
+	return value
+}
+
+// respond answers with obj in the encoding the request negotiated, with the negotiated media type
+func respond(c *gin.Context, status int, obj interface{}) {
+	encoding := c.GetString("encoding")
+	if encoding == "" || encoding == EncodingJSON {
+		c.JSON(status, obj)
+		return
+	}
+	value, err := jsonValue(obj)
+	var data []byte
+	if err == nil {
+		err = codec.NewEncoderBytes(&data, codecHandle(encoding)).Encode(value)
+	}
+	if err != nil {
+		log.Println("Encoding the answer as", encoding, "failed:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Data(status, c.GetHeader("Accept"), data)
+}
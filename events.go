@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventStreamType is the Accept header of browsers' EventSource, which can't send other headers
+const eventStreamType = "text/event-stream"
+
+// eventStreamKeepAlive sends a comment on idle streams, so proxies don't time them out
+const eventStreamKeepAlive = 30 * time.Second
+
+// isEventStream reports whether the request is for the server-sent events stream
+func isEventStream(c *gin.Context) bool {
+	return c.GetHeader("Accept") == eventStreamType && strings.HasSuffix(c.FullPath(), "/syncs/events")
+}
+
+// progressEvents streams a ProgressEvent for every change of the account's progress as server-sent
+// events named after the event type, for browser dashboards. Like the WebSocket, only changes made
+// through this server process are streamed.
+func progressEvents(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	changes, unsubscribe := progressChanges.Subscribe(username)
+	defer unsubscribe()
+	c.Header("Content-Type", eventStreamType)
+	c.Header("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	c.Status(http.StatusOK)
+	io.WriteString(c.Writer, ": connected\n\n")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case change := <-changes:
+			event := progressEvent(change, requestDeviceId(c))
+			c.SSEvent(event.Type, event)
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		case <-shuttingDown:
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserExport is the archive returned by the data export endpoint.
+// Secrets (the password key, API key values and webhook secrets) are never included.
+type UserExport struct {
+	Username  string     `json:"username"`
+	Exported  int64      `json:"exported"`
+	Documents []Document `json:"documents"`
+	// History is the progress history of every document, newest first
+	History  []Document         `json:"history"`
+	Metadata []DocumentMetadata `json:"metadata"`
+	APIKeys  []APIKey           `json:"api_keys"`
+	// Annotations include the tombstones of deleted annotations
+	Annotations []DocumentAnnotations `json:"annotations"`
+	Bookmarks   []DocumentBookmarks   `json:"bookmarks"`
+	Vocabulary  []VocabularyWord      `json:"vocabulary"`
+	Collections []Collection          `json:"collections"`
+	Settings    []Setting             `json:"settings"`
+	Notes       []DocumentNote        `json:"notes"`
+	Statuses    []DocumentStatus      `json:"statuses"`
+	// Records are all records kept for the user, in the format of the database dump
+	Records []Record `json:"records"`
+	// Journal holds the user's entries of the -journal file, if any
+	Journal []JournalEntry `json:"journal"`
+}
+
+func exportUserData(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	export := UserExport{
+		Username: displayUsername(username),
+		Exported: time.Now().Unix(),
+	}
+
+	var err error
+	if export.Documents, err = store.GetDocuments(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	export.History = []Document{}
+	seen := map[string]bool{}
+	for _, document := range export.Documents {
+		if seen[document.DocumentId] {
+			continue
+		}
+		seen[document.DocumentId] = true
+		history, err := store.GetDocumentHistory(username, document.DocumentId)
+		if err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		export.History = append(export.History, history...)
+	}
+	if export.Metadata, err = userDocumentMetadata(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if export.Annotations, err = userAnnotations(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if export.Bookmarks, err = userBookmarks(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if export.Vocabulary, err = userVocabulary(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if export.Collections, err = userCollections(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	dbSettings, err := store.GetRecords(username, RecordSetting)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	export.Settings = make([]Setting, 0, len(dbSettings))
+	for _, record := range dbSettings {
+		export.Settings = append(export.Settings, newSetting(record))
+	}
+	notes, err := userNotes(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	export.Notes = make([]DocumentNote, 0, len(notes))
+	for _, note := range notes {
+		export.Notes = append(export.Notes, note)
+	}
+	sort.Slice(export.Notes, func(i, j int) bool { return export.Notes[i].DocumentId < export.Notes[j].DocumentId })
+	statuses, err := userStatuses(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	export.Statuses = make([]DocumentStatus, 0, len(statuses))
+	for _, status := range statuses {
+		export.Statuses = append(export.Statuses, status)
+	}
+	sort.Slice(export.Statuses, func(i, j int) bool { return export.Statuses[i].DocumentId < export.Statuses[j].DocumentId })
+	dbAPIKeys, err := store.GetAPIKeys(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	export.APIKeys = make([]APIKey, 0, len(dbAPIKeys))
+	for _, dbAPIKey := range dbAPIKeys {
+		export.APIKeys = append(export.APIKeys, newAPIKey(dbAPIKey))
+	}
+	if export.Records, err = exportedRecords(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if export.Journal, err = userJournal(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="kosync-`+export.Username+`.json"`)
+	respond(c, http.StatusOK, export)
+}
+
+// exportedRecords returns every record of the user, with the webhook secrets removed
+func exportedRecords(username string) ([]Record, error) {
+	records, err := userRecords(username)
+	if err != nil {
+		return nil, err
+	}
+	exported := make([]Record, 0, len(records))
+	for _, record := range records {
+		if record.Kind == RecordWebhook {
+			var webhook Webhook
+			if err := json.Unmarshal(record.Value, &webhook); err != nil {
+				return nil, err
+			}
+			webhook.Secret = ""
+			if record.Value, err = json.Marshal(webhook); err != nil {
+				return nil, err
+			}
+		}
+		exported = append(exported, record)
+	}
+	return exported, nil
+}
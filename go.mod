@@ -3,7 +3,24 @@ module kosyncsrv
 go 1.16
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20230218143504-906a9b012302 // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible
+	github.com/cupcake/rdb v0.0.0-20161107195141-43ba34106c76
 	github.com/gin-gonic/gin v1.7.7
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gomodule/redigo v1.8.9
+	github.com/gorilla/websocket v1.5.0
 	github.com/jmoiron/sqlx v1.3.4
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.11
+	github.com/mutecomm/go-sqlcipher/v4 v4.4.2
+	github.com/pelletier/go-toml/v2 v2.0.8
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/ugorji/go/codec v1.1.7
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.8.0
+	golang.org/x/sys v0.7.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.14.6
 )
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Goals are the reading goals of a user, stored as a RecordGoals record. 0 leaves a goal unset.
+type Goals struct {
+	DailyMinutes int `json:"daily_minutes"`
+	YearlyBooks  int `json:"yearly_books"`
+	// Timezone is where the days and years of the goals start, UTC when empty
+	Timezone  string `json:"timezone"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// GoalProgress are the goals with the progress computed from the reading statistics and the synced progress
+type GoalProgress struct {
+	Goals
+	TodayMinutes int  `json:"today_minutes"`
+	DailyGoalMet bool `json:"daily_goal_met"`
+	// CurrentStreak counts the days in a row the daily goal was met, or anything was read without one,
+	// up to today or yesterday, as today isn't over yet
+	CurrentStreak      int     `json:"current_streak"`
+	LongestStreak      int     `json:"longest_streak"`
+	BooksThisYear      int     `json:"books_this_year"`
+	YearlyGoalProgress float64 `json:"yearly_goal_progress"`
+}
+
+// goalsRecord is the name of the user's RecordGoals record
+const goalsRecord = "goals"
+
+// finishedPercentage is the progress from which a book counts as finished, KOReader rarely reports
+// exactly 1 on the last page
+const finishedPercentage = 0.99
+
+func validGoals(goals Goals) bool {
+	if _, err := time.LoadLocation(goals.Timezone); err != nil {
+		return false
+	}
+	return goals.DailyMinutes >= 0 && goals.DailyMinutes <= 24*60 && goals.YearlyBooks >= 0
+}
+
+// readingDays returns the seconds read per day, the days being midnight in location as unix timestamps
+func readingDays(books []BookStatistics, location *time.Location) map[int64]int64 {
+	days := map[int64]int64{}
+	for _, book := range books {
+		for _, session := range book.Sessions {
+			day, _ := periodStart("day", time.Unix(session.StartTime, 0).In(location))
+			days[day.Unix()] += session.Duration
+		}
+	}
+	return days
+}
+
+// computeStreaks returns the current and the longest run of days in a row with at least minSeconds read
+func computeStreaks(days map[int64]int64, minSeconds int64, today time.Time) (current int, longest int) {
+	var met []int64
+	for day, seconds := range days {
+		if seconds >= minSeconds {
+			met = append(met, day)
+		}
+	}
+	sort.Slice(met, func(i, j int) bool { return met[i] < met[j] })
+	run := 0
+	for i, day := range met {
+		// Days are compared by date, as they don't all last 24 hours
+		if i > 0 && time.Unix(met[i-1], 0).In(today.Location()).AddDate(0, 0, 1).Unix() == day {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+	// Today not being over yet doesn't break the streak
+	day := today
+	if days[day.Unix()] < minSeconds {
+		day = day.AddDate(0, 0, -1)
+	}
+	for days[day.Unix()] >= minSeconds {
+		current++
+		day = day.AddDate(0, 0, -1)
+	}
+	return current, longest
+}
+
+// finishedBooks counts the documents whose progress reached finishedPercentage, or that were marked
+// finished, within [from, to)
+func finishedBooks(documents []Document, statuses map[string]DocumentStatus, from int64, to int64) int {
+	finished := map[string]bool{}
+	for _, document := range documents {
+		if document.Percentage >= finishedPercentage && document.Timestamp >= from && document.Timestamp < to {
+			finished[document.DocumentId] = true
+		}
+	}
+	for documentId, status := range statuses {
+		if status.Status == StatusFinished && status.UpdatedAt >= from && status.UpdatedAt < to {
+			finished[documentId] = true
+		}
+	}
+	return len(finished)
+}
+
+func getGoals(username string) (Goals, error) {
+	var goals Goals
+	err := getRecord(username, RecordGoals, goalsRecord, &goals)
+	if err == ErrNotFound {
+		return Goals{Timezone: "UTC"}, nil
+	}
+	return goals, err
+}
+
+func computeGoalProgress(username string, goals Goals, now time.Time) (GoalProgress, error) {
+	progress := GoalProgress{Goals: goals}
+	location, err := time.LoadLocation(goals.Timezone)
+	if err != nil {
+		return progress, err
+	}
+	books, err := userBookStatistics(username)
+	if err != nil {
+		return progress, err
+	}
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		return progress, err
+	}
+	statuses, err := userStatuses(username)
+	if err != nil {
+		return progress, err
+	}
+	today, _ := periodStart("day", now.In(location))
+	days := readingDays(books, location)
+	progress.TodayMinutes = int(days[today.Unix()] / 60)
+	minSeconds := int64(goals.DailyMinutes) * 60
+	if minSeconds == 0 {
+		minSeconds = 1
+	}
+	progress.DailyGoalMet = goals.DailyMinutes > 0 && days[today.Unix()] >= minSeconds
+	progress.CurrentStreak, progress.LongestStreak = computeStreaks(days, minSeconds, today)
+	year := time.Date(today.Year(), 1, 1, 0, 0, 0, 0, location)
+	progress.BooksThisYear = finishedBooks(documents, statuses, year.Unix(), year.AddDate(1, 0, 0).Unix())
+	if goals.YearlyBooks > 0 {
+		progress.YearlyGoalProgress = float64(progress.BooksThisYear) / float64(goals.YearlyBooks)
+	}
+	return progress, nil
+}
+
+// getGoalProgress answers with the goals and the progress towards them, the streaks are computed
+// without goals as well
+func getGoalProgress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	goals, err := getGoals(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	progress, err := computeGoalProgress(username, goals, time.Now())
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, progress)
+}
+
+func updateGoals(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	goals := Goals{Timezone: "UTC"}
+	if err := bindBody(c, &goals); err != nil || !validGoals(goals) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if goals.Timezone == "" {
+		goals.Timezone = "UTC"
+	}
+	goals.UpdatedAt = time.Now().Unix()
+	if err := putRecord(username, RecordGoals, goalsRecord, goals); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	progress, err := computeGoalProgress(username, goals, time.Now())
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, progress)
+}
+
+func deleteGoals(c *gin.Context) {
+	err := store.DeleteRecord(c.MustGet("username").(string), RecordGoals, goalsRecord)
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadingGroup lets users, e.g. a book club or a couple, see each other's progress in the documents each
+// member opts in. The group is a RecordGroup record of its owner named by its id, holding the members.
+type ReadingGroup struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	Created int64    `json:"created"`
+}
+
+// GroupMembership is a RecordGroupMember record of each member named by the group id. An invited user
+// only becomes a member once the invitation is accepted; Documents are the ones the member shares.
+type GroupMembership struct {
+	Group     string   `json:"group"`
+	Name      string   `json:"name"`
+	Owner     string   `json:"owner"`
+	Accepted  bool     `json:"accepted"`
+	Documents []string `json:"documents"`
+}
+
+// GroupProgress is the progress of a member in a shared document, with the title the member gave it
+// so copies with different hashes can be matched
+type GroupProgress struct {
+	Username string `json:"username"`
+	Title    string `json:"title,omitempty"`
+	Document
+}
+
+const (
+	maxGroupMembers = 32
+	// maxGroupDocuments bounds the documents a member shares with a group
+	maxGroupDocuments = 1000
+)
+
+// groupsMu serializes the changes of the groups, which span the records of several users
+var groupsMu sync.Mutex
+
+func newGroupId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findGroup returns the group of the user's membership, invitations included
+func findGroup(username string, id string) (ReadingGroup, GroupMembership, error) {
+	var group ReadingGroup
+	var membership GroupMembership
+	if err := getRecord(username, RecordGroupMember, id, &membership); err != nil {
+		return group, membership, err
+	}
+	err := getRecord(membership.Owner, RecordGroup, id, &group)
+	return group, membership, err
+}
+
+// groupResponse names the members of the group by their display names
+func groupResponse(group ReadingGroup) ReadingGroup {
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, displayUsername(member))
+	}
+	group.Owner = displayUsername(group.Owner)
+	group.Members = members
+	return group
+}
+
+// listGroups returns the groups of the user, with accepted false for the invitations
+func listGroups(c *gin.Context) {
+	records, err := store.GetRecords(c.MustGet("username").(string), RecordGroupMember)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	memberships := make([]GroupMembership, 0, len(records))
+	for _, record := range records {
+		var membership GroupMembership
+		if err := json.Unmarshal([]byte(record.Value), &membership); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		membership.Owner = displayUsername(membership.Owner)
+		memberships = append(memberships, membership)
+	}
+	respond(c, http.StatusOK, memberships)
+}
+
+func createGroup(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := bindBody(c, &request); err != nil || request.Name == "" || utf8.RuneCountInString(request.Name) > maxMetadataLength {
+		c.Error(&InvalidRequest)
+		return
+	}
+	id, err := newGroupId()
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	group := ReadingGroup{Id: id, Name: request.Name, Owner: username, Members: []string{username}, Created: time.Now().Unix()}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if err := putRecord(username, RecordGroup, id, group); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	membership := GroupMembership{Group: id, Name: group.Name, Owner: username, Accepted: true, Documents: []string{}}
+	if err := putRecord(username, RecordGroupMember, id, membership); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusCreated, groupResponse(group))
+}
+
+func getGroup(c *gin.Context) {
+	group, _, err := findGroup(c.MustGet("username").(string), c.Param("group"))
+	if err == ErrNotFound {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, groupResponse(group))
+}
+
+// inviteGroupMember lets the owner invite a user of the same tenant, who has to accept with joinGroup
+func inviteGroupMember(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		Username string `json:"username"`
+	}
+	if err := bindBody(c, &request); err != nil || !validKeyField(request.Username) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	group, _, err := findGroup(username, c.Param("group"))
+	if err == ErrNotFound {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if group.Owner != username {
+		c.Error(&GroupOwnerOnly)
+		return
+	}
+	invited, err := lookupUser(tenantUsername(c, normalizeUsername(request.Username)))
+	if err != nil {
+		c.Error(&UserNotFound)
+		return
+	}
+	for _, member := range group.Members {
+		if member == invited.Username {
+			respond(c, http.StatusOK, groupResponse(group))
+			return
+		}
+	}
+	if len(group.Members) >= maxGroupMembers {
+		c.Error(&QuotaExceeded)
+		return
+	}
+	membership := GroupMembership{Group: group.Id, Name: group.Name, Owner: group.Owner, Documents: []string{}}
+	if err := putRecord(invited.Username, RecordGroupMember, group.Id, membership); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	group.Members = append(group.Members, invited.Username)
+	if err := putRecord(group.Owner, RecordGroup, group.Id, group); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, groupResponse(group))
+}
+
+// joinGroup accepts the invitation to the group
+func joinGroup(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	_, membership, err := findGroup(username, c.Param("group"))
+	if err == ErrNotFound {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	membership.Accepted = true
+	if err := putRecord(username, RecordGroupMember, membership.Group, membership); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	membership.Owner = displayUsername(membership.Owner)
+	respond(c, http.StatusOK, membership)
+}
+
+// shareGroupDocuments replaces the documents the member shares with the group
+func shareGroupDocuments(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		Documents []string `json:"documents"`
+	}
+	if err := bindBody(c, &request); err != nil || len(request.Documents) > maxGroupDocuments {
+		c.Error(&InvalidRequest)
+		return
+	}
+	for _, documentId := range request.Documents {
+		if !validKeyField(documentId) {
+			c.Error(&InvalidRequest)
+			return
+		}
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	_, membership, err := findGroup(username, c.Param("group"))
+	if err == ErrNotFound || err == nil && !membership.Accepted {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	membership.Documents = request.Documents
+	if membership.Documents == nil {
+		membership.Documents = []string{}
+	}
+	if err := putRecord(username, RecordGroupMember, membership.Group, membership); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	membership.Owner = displayUsername(membership.Owner)
+	respond(c, http.StatusOK, membership)
+}
+
+// removeGroupMember lets the owner remove a member and a member leave, declining an invitation as well.
+// The owner can't leave, but deletes the group instead.
+func removeGroupMember(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	group, _, err := findGroup(username, c.Param("group"))
+	if err == ErrNotFound {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	removed := tenantUsername(c, normalizeUsername(c.Param("username")))
+	if removed != username && group.Owner != username || removed == group.Owner {
+		c.Error(&GroupOwnerOnly)
+		return
+	}
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		if member != removed {
+			members = append(members, member)
+		}
+	}
+	if len(members) == len(group.Members) {
+		c.Error(&UserNotFound)
+		return
+	}
+	group.Members = members
+	if err := putRecord(group.Owner, RecordGroup, group.Id, group); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if err := store.DeleteRecord(removed, RecordGroupMember, group.Id); err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deleteGroup lets the owner remove the group with the memberships of all members
+func deleteGroup(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	group, _, err := findGroup(username, c.Param("group"))
+	if err == ErrNotFound {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if group.Owner != username {
+		c.Error(&GroupOwnerOnly)
+		return
+	}
+	for _, member := range group.Members {
+		if err := store.DeleteRecord(member, RecordGroupMember, group.Id); err != nil && err != ErrNotFound {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	if err := store.DeleteRecord(group.Owner, RecordGroup, group.Id); err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getGroupProgress returns the progress of the members, the user included, in the documents they share
+// with the group, ordered by member and document. Only members who accepted are included.
+func getGroupProgress(c *gin.Context) {
+	group, membership, err := findGroup(c.MustGet("username").(string), c.Param("group"))
+	if err == ErrNotFound || err == nil && !membership.Accepted {
+		c.Error(&GroupNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	progress := []GroupProgress{}
+	for _, member := range group.Members {
+		var shared GroupMembership
+		if err := getRecord(member, RecordGroupMember, group.Id, &shared); err != nil || !shared.Accepted {
+			continue
+		}
+		documents := append([]string{}, shared.Documents...)
+		sort.Strings(documents)
+		for _, documentId := range documents {
+			canonical := canonicalDocument(member, documentId)
+			document, ok := findProgress(member, canonical, "")
+			if !ok {
+				continue
+			}
+			document.DocumentId = documentId
+			dropPosition(c, &document)
+			entry := GroupProgress{Username: displayUsername(member), Document: document}
+			if metadata, err := store.GetDocumentMetadata(member, canonical); err == nil {
+				entry.Title = metadata.Title
+			}
+			progress = append(progress, entry)
+		}
+	}
+	respond(c, http.StatusOK, progress)
+}
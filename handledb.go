@@ -2,119 +2,1114 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-var schemaUser = `
-CREATE TABLE IF NOT EXISTS "user" (
-	"username"  TEXT(255),
-	"password"  TEXT(255)
-);
-CREATE UNIQUE INDEX IF NOT EXISTS username ON user(username);
-`
-var schemaDocument = `
-CREATE TABLE IF NOT EXISTS "document" (
-	"username"  TEXT(255),
-	"documentid"  TEXT(255),
-	"percentage"  REAL(64,4),
-	"progress"  TEXT(255),
-	"device"  TEXT(255),
-	"device_id"  TEXT(255),
-	"timestamp"  INTEGER
-);
-CREATE UNIQUE INDEX IF NOT EXISTS username_documentid ON document(username,documentid);
-`
-
-var (
-	db     *sqlx.DB
-	dbname string
+// Migrations of the SQLite schema. Version 1 uses IF NOT EXISTS so databases created
+// before schema versioning was introduced are adopted as they are.
+var sqliteMigrations = []migration{
+	{
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS "user" (
+				"username"  TEXT(255),
+				"password"  TEXT(255)
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS username ON user(username)`,
+			`CREATE TABLE IF NOT EXISTS "document" (
+				"username"  TEXT(255),
+				"documentid"  TEXT(255),
+				"percentage"  REAL(64,4),
+				"progress"  TEXT(255),
+				"device"  TEXT(255),
+				"device_id"  TEXT(255),
+				"timestamp"  INTEGER
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS username_documentid ON document(username,documentid)`,
+		},
+		down: []string{`DROP TABLE "document"`, `DROP TABLE "user"`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS "api_key" (
+				"username"  TEXT(255),
+				"name"  TEXT(255),
+				"key"  TEXT(255),
+				"scopes"  TEXT(255),
+				"created"  INTEGER
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS username_name ON api_key(username,name)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS api_key_key ON api_key(key)`,
+		},
+		down: []string{`DROP TABLE "api_key"`},
+	},
+	{
+		// SQLite can't add a foreign key to an existing table, so the tables are rebuilt.
+		// Rows of users that don't exist anymore are dropped on the way.
+		up: []string{
+			`CREATE TABLE "document_new" (
+				"username"  TEXT(255) REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255),
+				"percentage"  REAL(64,4),
+				"progress"  TEXT(255),
+				"device"  TEXT(255),
+				"device_id"  TEXT(255),
+				"timestamp"  INTEGER
+			)`,
+			`INSERT INTO "document_new" SELECT * FROM "document" WHERE username IN (SELECT username FROM "user")`,
+			`DROP TABLE "document"`,
+			`ALTER TABLE "document_new" RENAME TO "document"`,
+			`CREATE UNIQUE INDEX username_documentid ON document(username,documentid)`,
+			`CREATE TABLE "api_key_new" (
+				"username"  TEXT(255) REFERENCES "user"(username) ON DELETE CASCADE,
+				"name"  TEXT(255),
+				"key"  TEXT(255),
+				"scopes"  TEXT(255),
+				"created"  INTEGER
+			)`,
+			`INSERT INTO "api_key_new" SELECT * FROM "api_key" WHERE username IN (SELECT username FROM "user")`,
+			`DROP TABLE "api_key"`,
+			`ALTER TABLE "api_key_new" RENAME TO "api_key"`,
+			`CREATE UNIQUE INDEX username_name ON api_key(username,name)`,
+			`CREATE UNIQUE INDEX api_key_key ON api_key(key)`,
+		},
+		down: []string{
+			`CREATE TABLE "document_old" (
+				"username"  TEXT(255),
+				"documentid"  TEXT(255),
+				"percentage"  REAL(64,4),
+				"progress"  TEXT(255),
+				"device"  TEXT(255),
+				"device_id"  TEXT(255),
+				"timestamp"  INTEGER
+			)`,
+			`INSERT INTO "document_old" SELECT * FROM "document"`,
+			`DROP TABLE "document"`,
+			`ALTER TABLE "document_old" RENAME TO "document"`,
+			`CREATE UNIQUE INDEX username_documentid ON document(username,documentid)`,
+			`CREATE TABLE "api_key_old" (
+				"username"  TEXT(255),
+				"name"  TEXT(255),
+				"key"  TEXT(255),
+				"scopes"  TEXT(255),
+				"created"  INTEGER
+			)`,
+			`INSERT INTO "api_key_old" SELECT * FROM "api_key"`,
+			`DROP TABLE "api_key"`,
+			`ALTER TABLE "api_key_old" RENAME TO "api_key"`,
+			`CREATE UNIQUE INDEX username_name ON api_key(username,name)`,
+			`CREATE UNIQUE INDEX api_key_key ON api_key(key)`,
+		},
+	},
+	{
+		// The user table is left alone: dropping it to rebuild it would cascade to every document.
+		// Its rows are always written with both columns anyway.
+		up: append(append(append([]string{}, cleanupConstraintViolations...),
+			sqliteRebuildTable("document", `CREATE TABLE %s (
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"percentage"  REAL(64,4) NOT NULL DEFAULT 0 CHECK (percentage BETWEEN 0 AND 1),
+				"progress"  TEXT(255) NOT NULL,
+				"device"  TEXT(255) NOT NULL,
+				"device_id"  TEXT(255) NOT NULL DEFAULT '',
+				"timestamp"  INTEGER NOT NULL CHECK (timestamp > 0)
+			)`, `CREATE UNIQUE INDEX username_documentid ON document(username,documentid)`)...),
+			sqliteRebuildTable("api_key", `CREATE TABLE %s (
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"name"  TEXT(255) NOT NULL,
+				"key"  TEXT(255) NOT NULL,
+				"scopes"  TEXT(255) NOT NULL,
+				"created"  INTEGER NOT NULL
+			)`, `CREATE UNIQUE INDEX username_name ON api_key(username,name)`,
+				`CREATE UNIQUE INDEX api_key_key ON api_key(key)`)...),
+		down: append(
+			sqliteRebuildTable("document", `CREATE TABLE %s (
+				"username"  TEXT(255) REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255),
+				"percentage"  REAL(64,4),
+				"progress"  TEXT(255),
+				"device"  TEXT(255),
+				"device_id"  TEXT(255),
+				"timestamp"  INTEGER
+			)`, `CREATE UNIQUE INDEX username_documentid ON document(username,documentid)`),
+			sqliteRebuildTable("api_key", `CREATE TABLE %s (
+				"username"  TEXT(255) REFERENCES "user"(username) ON DELETE CASCADE,
+				"name"  TEXT(255),
+				"key"  TEXT(255),
+				"scopes"  TEXT(255),
+				"created"  INTEGER
+			)`, `CREATE UNIQUE INDEX username_name ON api_key(username,name)`,
+				`CREATE UNIQUE INDEX api_key_key ON api_key(key)`)...),
+	},
+	{
+		up: []string{
+			`ALTER TABLE "user" ADD COLUMN "created_at" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE "user" ADD COLUMN "updated_at" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document" ADD COLUMN "created_at" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document" ADD COLUMN "updated_at" INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE "document" SET created_at=timestamp, updated_at=timestamp`,
+			`UPDATE "user" SET updated_at=CAST(strftime('%s', 'now') AS INTEGER),
+				created_at=COALESCE((SELECT MIN(timestamp) FROM "document" WHERE document.username="user".username),
+					CAST(strftime('%s', 'now') AS INTEGER))`,
+		},
+		down: []string{
+			`ALTER TABLE "user" DROP COLUMN "created_at"`,
+			`ALTER TABLE "user" DROP COLUMN "updated_at"`,
+			`ALTER TABLE "document" DROP COLUMN "created_at"`,
+			`ALTER TABLE "document" DROP COLUMN "updated_at"`,
+		},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "document_history" (
+				"id"  INTEGER PRIMARY KEY AUTOINCREMENT,
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"percentage"  REAL(64,4) NOT NULL DEFAULT 0,
+				"progress"  TEXT(255) NOT NULL,
+				"device"  TEXT(255) NOT NULL,
+				"device_id"  TEXT(255) NOT NULL DEFAULT '',
+				"timestamp"  INTEGER NOT NULL
+			)`,
+			`CREATE INDEX document_history_username_documentid ON document_history(username,documentid)`,
+		},
+		down: []string{`DROP TABLE "document_history"`},
+	},
+	{
+		up:   []string{`ALTER TABLE "document" ADD COLUMN "deleted_at" INTEGER NOT NULL DEFAULT 0`},
+		down: []string{`ALTER TABLE "document" DROP COLUMN "deleted_at"`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "document_metadata" (
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"title"  TEXT(255) NOT NULL,
+				"author"  TEXT(255) NOT NULL DEFAULT '',
+				"series"  TEXT(255) NOT NULL DEFAULT '',
+				"updated_at"  INTEGER NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX document_metadata_username_documentid ON document_metadata(username,documentid)`,
+		},
+		down: []string{`DROP TABLE "document_metadata"`},
+	},
+	{
+		up: []string{
+			`DROP INDEX username_documentid`,
+			`CREATE UNIQUE INDEX username_documentid_device_id ON document(username,documentid,device_id)`,
+		},
+		down: []string{
+			collapseDeviceDocuments,
+			`DROP INDEX username_documentid_device_id`,
+			`CREATE UNIQUE INDEX username_documentid ON document(username,documentid)`,
+		},
+	},
+	{
+		// REAL(64,4) only looked like a fixed precision type, SQLite ignores the arguments.
+		// The percentage is a plain double, so it round-trips exactly; the history gets the range check as well.
+		up: append(append([]string{clampHistoryPercentage},
+			sqliteRebuildTable("document", `CREATE TABLE %s (
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"percentage"  REAL NOT NULL DEFAULT 0 CHECK (percentage BETWEEN 0 AND 1),
+				"progress"  TEXT(255) NOT NULL,
+				"device"  TEXT(255) NOT NULL,
+				"device_id"  TEXT(255) NOT NULL DEFAULT '',
+				"timestamp"  INTEGER NOT NULL CHECK (timestamp > 0),
+				"created_at"  INTEGER NOT NULL DEFAULT 0,
+				"updated_at"  INTEGER NOT NULL DEFAULT 0,
+				"deleted_at"  INTEGER NOT NULL DEFAULT 0
+			)`, `CREATE UNIQUE INDEX username_documentid_device_id ON document(username,documentid,device_id)`)...),
+			sqliteRebuildTable("document_history", `CREATE TABLE %s (
+				"id"  INTEGER PRIMARY KEY AUTOINCREMENT,
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"percentage"  REAL NOT NULL DEFAULT 0 CHECK (percentage BETWEEN 0 AND 1),
+				"progress"  TEXT(255) NOT NULL,
+				"device"  TEXT(255) NOT NULL,
+				"device_id"  TEXT(255) NOT NULL DEFAULT '',
+				"timestamp"  INTEGER NOT NULL
+			)`, `CREATE INDEX document_history_username_documentid ON document_history(username,documentid)`)...),
+		down: append(
+			sqliteRebuildTable("document", `CREATE TABLE %s (
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"percentage"  REAL(64,4) NOT NULL DEFAULT 0 CHECK (percentage BETWEEN 0 AND 1),
+				"progress"  TEXT(255) NOT NULL,
+				"device"  TEXT(255) NOT NULL,
+				"device_id"  TEXT(255) NOT NULL DEFAULT '',
+				"timestamp"  INTEGER NOT NULL CHECK (timestamp > 0),
+				"created_at"  INTEGER NOT NULL DEFAULT 0,
+				"updated_at"  INTEGER NOT NULL DEFAULT 0,
+				"deleted_at"  INTEGER NOT NULL DEFAULT 0
+			)`, `CREATE UNIQUE INDEX username_documentid_device_id ON document(username,documentid,device_id)`),
+			sqliteRebuildTable("document_history", `CREATE TABLE %s (
+				"id"  INTEGER PRIMARY KEY AUTOINCREMENT,
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"documentid"  TEXT(255) NOT NULL,
+				"percentage"  REAL(64,4) NOT NULL DEFAULT 0,
+				"progress"  TEXT(255) NOT NULL,
+				"device"  TEXT(255) NOT NULL,
+				"device_id"  TEXT(255) NOT NULL DEFAULT '',
+				"timestamp"  INTEGER NOT NULL
+			)`, `CREATE INDEX document_history_username_documentid ON document_history(username,documentid)`)...),
+	},
+	{
+		// Lets the statistics count the recent syncs without scanning every document
+		up:   []string{`CREATE INDEX document_updated_at ON document(updated_at)`},
+		down: []string{`DROP INDEX document_updated_at`},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "progress_raw" TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE "document_history" ADD COLUMN "progress_raw" TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "progress_raw"`,
+			`ALTER TABLE "document_history" DROP COLUMN "progress_raw"`,
+		},
+	},
+	{
+		// Looks up the users case-insensitively for -case-insensitive-usernames
+		up:   []string{`CREATE INDEX user_username_lower ON "user"(LOWER(username))`},
+		down: []string{`DROP INDEX user_username_lower`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "user_record" (
+				"username"  TEXT(255) NOT NULL REFERENCES "user"(username) ON DELETE CASCADE,
+				"kind"  TEXT(64) NOT NULL,
+				"name"  TEXT(255) NOT NULL,
+				"value"  TEXT NOT NULL,
+				"updated_at"  INTEGER NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX user_record_username_kind_name ON user_record(username,kind,name)`,
+		},
+		down: []string{`DROP TABLE "user_record"`},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "position" TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE "document_history" ADD COLUMN "position" TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "position"`,
+			`ALTER TABLE "document_history" DROP COLUMN "position"`,
+		},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "timestamp_ms" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document_history" ADD COLUMN "timestamp_ms" INTEGER NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "timestamp_ms"`,
+			`ALTER TABLE "document_history" DROP COLUMN "timestamp_ms"`,
+		},
+	},
+	{
+		// Lets FindRecord look up a record without its user
+		up:   []string{`CREATE INDEX user_record_kind_name ON user_record(kind,name)`},
+		down: []string{`DROP INDEX user_record_kind_name`},
+	},
+}
+
+// sqliteRebuildTable returns the statements recreating a table from a new CREATE TABLE definition,
+// with %s in place of the table name, since SQLite's ALTER TABLE can't change constraints.
+// The new definition must have the same columns in the same order.
+func sqliteRebuildTable(table string, definition string, indexes ...string) []string {
+	return append([]string{
+		fmt.Sprintf(definition, `"`+table+`_new"`),
+		`INSERT INTO "` + table + `_new" SELECT * FROM "` + table + `"`,
+		`DROP TABLE "` + table + `"`,
+		`ALTER TABLE "` + table + `_new" RENAME TO "` + table + `"`,
+	}, indexes...)
+}
+
+// sqlDialect holds what differs between the SQL databases sqlStore can run on.
+type sqlDialect struct {
+	driver     string
+	migrations []migration
+	// upsert returns an INSERT statement with named parameters for columns that updates the
+	// existing row instead when the keys conflict, see upsertUpdatedColumns
+	upsert func(table string, keys []string, columns []string) string
+	// sizeQuery returns the size of the database in bytes, maintain compacts and analyzes it
+	sizeQuery string
+	maintain  func(db *sqlx.DB) error
+	// integrityCheck returns the corruption the database finds in its own files, nil if it has no such check
+	integrityCheck func(db *sqlx.DB) ([]string, error)
+	// busy reports whether err is a transient lock conflict worth retrying, nil if the driver has none
+	busy func(err error) bool
+	// pool holds the connection pool defaults, overridden by the -db-max-* flags
+	pool poolSettings
+}
+
+type poolSettings struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+}
+
+var sqliteDialect = sqlDialect{
+	driver:         sqliteDriver,
+	migrations:     sqliteMigrations,
+	upsert:         upsertOnConflict,
+	sizeQuery:      "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+	maintain:       execStatements("VACUUM", "ANALYZE"),
+	integrityCheck: sqliteIntegrityCheck,
+	busy:           sqliteBusy,
+	// SQLite allows a single writer at a time anyway, one connection serializes the writes
+	// instead of having them wait for each other's locks
+	pool: poolSettings{maxOpenConns: 1, maxIdleConns: 1},
+}
+
+// sqliteIntegrityCheck reads every page of the file and looks for rows referencing users that don't
+// exist, which happens when foreign keys were turned off with -sqlite-foreign-keys=false
+func sqliteIntegrityCheck(db *sqlx.DB) ([]string, error) {
+	var results []string
+	if err := db.Select(&results, "PRAGMA integrity_check"); err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, result := range results {
+		// A sound database answers with a single "ok" row
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows, err := db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return nil, err
+		}
+		problems = append(problems, fmt.Sprintf("%s row %d references a missing %s", table, rowid.Int64, parent))
+	}
+	return problems, rows.Err()
+}
+
+// execStatements returns a maintain func executing the statements in order
+func execStatements(statements ...string) func(db *sqlx.DB) error {
+	return func(db *sqlx.DB) error {
+		for _, statement := range statements {
+			if _, err := db.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type sqlitePragma struct {
+	name  string
+	value string
+}
+
+// sqlitePragmas lists the configured pragmas that have to be set on every connection of the pool.
+// WAL and a busy timeout avoid "database is locked" errors when several devices sync at once.
+func sqlitePragmas() []sqlitePragma {
+	pragmas := []sqlitePragma{
+		{"busy_timeout", strconv.Itoa(config.SQLiteBusyTimeout)},
+		{"foreign_keys", strconv.FormatBool(config.SQLiteForeignKeys)},
+	}
+	if config.SQLiteJournalMode != "" {
+		pragmas = append(pragmas, sqlitePragma{"journal_mode", config.SQLiteJournalMode})
+	}
+	if config.SQLiteSynchronous != "" {
+		pragmas = append(pragmas, sqlitePragma{"synchronous", config.SQLiteSynchronous})
+	}
+	return pragmas
+}
+
+// withDSNParams appends URL query parameters to a file name or connection string
+func withDSNParams(dsn string, params url.Values) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + params.Encode()
+	}
+	return dsn + "?" + params.Encode()
+}
+
+// upsertUpdatedColumns returns the columns an upsert overwrites on conflict:
+// everything except the conflicting keys and created_at.
+func upsertUpdatedColumns(keys []string, columns []string) []string {
+	var updated []string
+	for _, column := range columns {
+		if column == "created_at" || containsString(keys, column) {
+			continue
+		}
+		updated = append(updated, column)
+	}
+	return updated
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// upsertOnConflict builds an upsert with the INSERT ... ON CONFLICT syntax shared by SQLite and PostgreSQL
+func upsertOnConflict(table string, keys []string, columns []string) string {
+	var updates []string
+	for _, column := range upsertUpdatedColumns(keys, columns) {
+		updates = append(updates, `"`+column+`"=excluded."`+column+`"`)
+	}
+	return insertStatement(table, columns) +
+		" ON CONFLICT(" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+func insertStatement(table string, columns []string) string {
+	return `INSERT INTO "` + table + `" ("` + strings.Join(columns, `", "`) + `") VALUES (:` + strings.Join(columns, ", :") + ")"
+}
+
+var documentColumns = []string{"username", "documentid", "percentage", "progress", "progress_raw", "position", "device", "device_id", "timestamp", "timestamp_ms", "created_at", "updated_at", "deleted_at"}
+
+// sqlStore implements Store on top of any database/sql driver, the default being a single sqlite3 file.
+type sqlStore struct {
+	db      *sqlx.DB
+	dialect sqlDialect
+	// tx is set on the copy of the store passed to a transaction func, the helpers below run in it
+	tx *sqlx.Tx
+	// replicas serve the document reads, taking turns; read is set on the copy returned by replica
+	replicas    []*sqlx.DB
+	nextReplica uint32
+	read        *sqlx.DB
+}
+
+func openSQLStore(dialect sqlDialect, dsn string) (*sqlStore, error) {
+	db, err := connectSQL(dialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, dialect: dialect}
+	target := len(dialect.migrations)
+	if config.SchemaVersion >= 0 {
+		target = config.SchemaVersion
+	}
+	if config.SkipMigrations {
+		return s, nil
+	}
+	if err := s.migrate(target); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// connectSQL connects to the database with the dialect's connection pool, see sqlDialect.pool
+func connectSQL(dialect sqlDialect, dsn string) (*sqlx.DB, error) {
+	db, err := sqlx.Connect(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool := dialect.pool
+	if config.DBMaxOpenConns != 0 {
+		pool.maxOpenConns = config.DBMaxOpenConns
+	}
+	if config.DBMaxIdleConns != 0 {
+		pool.maxIdleConns = config.DBMaxIdleConns
+	}
+	if config.DBConnMaxLifetime != 0 {
+		pool.connMaxLifetime = config.DBConnMaxLifetime
+	}
+	db.SetMaxOpenConns(pool.maxOpenConns)
+	db.SetMaxIdleConns(pool.maxIdleConns)
+	db.SetConnMaxLifetime(pool.connMaxLifetime)
+	return db, nil
+}
+
+// openReplicas connects to the read replicas. They follow the primary's schema through replication,
+// so no migrations run on them.
+func (s *sqlStore) openReplicas(dsns []string) error {
+	for i, dsn := range dsns {
+		db, err := connectSQL(s.dialect, dsn)
+		if err != nil {
+			// The DSN may contain a password, the replica is only identified by its position
+			return fmt.Errorf("connecting to read replica %d: %w", i+1, err)
+		}
+		s.replicas = append(s.replicas, db)
+	}
+	return nil
+}
+
+// replica returns a copy of the store reading from the next replica. Replicas lag behind the
+// primary, so only the reads of documents use them; users and API keys are read from the primary
+// so a new account or password works right away.
+func (s *sqlStore) replica() *sqlStore {
+	if s.tx != nil || len(s.replicas) == 0 {
+		return s
+	}
+	i := atomic.AddUint32(&s.nextReplica, 1) % uint32(len(s.replicas))
+	return &sqlStore{db: s.db, dialect: s.dialect, read: s.replicas[i]}
+}
+
+func (s *sqlStore) Close() error {
+	for _, replica := range s.replicas {
+		replica.Close()
+	}
+	return s.db.Close()
+}
+
+// ext returns the transaction the store is bound to, or the database
+func (s *sqlStore) ext() sqlx.Ext {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// Writes failing with a lock conflict are retried busyRetries times, waiting busyBackoff
+// before the first retry and twice as long before each further one
+const (
+	busyRetries = 5
+	busyBackoff = 50 * time.Millisecond
 )
 
-type DbUser struct {
-	Username string `db:"username"`
-	Password string `db:"password"`
+// retryBusy runs fn again after a backoff while it fails because the database is locked.
+// SQLite's busy timeout covers most conflicts, but a transaction that has to upgrade its read
+// lock to a write lock fails right away, e.g. when two devices sync at the same moment.
+// Inside a transaction fn runs once, the transaction as a whole is retried instead.
+func (s *sqlStore) retryBusy(fn func() error) error {
+	err := fn()
+	if s.tx != nil {
+		return err
+	}
+	backoff := busyBackoff
+	for attempt := 1; attempt <= busyRetries && s.isBusy(err); attempt++ {
+		log.Printf("Database is busy, retrying in %v (%d/%d)", backoff, attempt, busyRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+func (s *sqlStore) isBusy(err error) bool {
+	return err != nil && s.dialect.busy != nil && s.dialect.busy(err)
 }
 
-type DbDocument struct {
-	Username   string  `db:"username"`
-	DocumentID string  `db:"documentid"`
-	Percentage float64 `db:"percentage"`
-	Progress   string  `db:"progress"`
-	Device     string  `db:"device"`
-	DeviceId   string  `db:"device_id"`
-	Timestamp  int64   `db:"timestamp"`
+// transaction runs fn with a copy of the store bound to a new transaction, which is committed
+// when fn succeeds and rolled back otherwise. Operations spanning several statements use it.
+func (s *sqlStore) transaction(fn func(tx *sqlStore) error) error {
+	return s.retryBusy(func() error {
+		tx, err := s.db.Beginx()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(&sqlStore{db: s.db, dialect: s.dialect, tx: tx}); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			log.Println(err)
+			return err
+		}
+		return nil
+	})
 }
 
-func initDB() {
-	var err error
-	db, err = sqlx.Connect("sqlite3", dbname)
+// reader returns the replica to read from when the store is a copy returned by replica
+func (s *sqlStore) reader() sqlx.Queryer {
+	if s.read != nil {
+		return s.read
+	}
+	return s.ext()
+}
+
+// get wraps sqlx Get, translating sql.ErrNoRows to ErrNotFound and logging anything else.
+// A failing replica is logged and the primary is asked instead.
+func (s *sqlStore) get(dest interface{}, query string, args ...interface{}) error {
+	err := sqlx.Get(s.reader(), dest, s.db.Rebind(query), args...)
+	if err != nil && err != sql.ErrNoRows && s.read != nil {
+		log.Println("Reading from the replica failed, using the primary:", err)
+		err = sqlx.Get(s.db, dest, s.db.Rebind(query), args...)
+	}
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
 	}
-	db.MustExec(schemaUser)
-	db.MustExec(schemaDocument)
+	return err
 }
 
-func getDBUser(username string) (DbUser, bool) {
-	var user DbUser
-	var noRows = false
-	err := db.Get(&user, "SELECT * FROM user WHERE username=$1", username)
+func (s *sqlStore) selectAll(dest interface{}, query string, args ...interface{}) error {
+	err := sqlx.Select(s.reader(), dest, s.db.Rebind(query), args...)
+	if err != nil && s.read != nil {
+		log.Println("Reading from the replica failed, using the primary:", err)
+		err = sqlx.Select(s.db, dest, s.db.Rebind(query), args...)
+	}
 	if err != nil {
 		log.Println(err)
-		if err == sql.ErrNoRows {
-			noRows = true
-		}
 	}
-	return user, noRows
+	return err
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (int64, error) {
+	var result sql.Result
+	err := s.retryBusy(func() (err error) {
+		result, err = s.ext().Exec(s.db.Rebind(query), args...)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-func addDBUser(username string, password string) bool {
+// execAffecting runs a statement and returns ErrNotFound if it didn't touch any row
+func (s *sqlStore) execAffecting(query string, args ...interface{}) error {
+	affected, err := s.exec(query, args...)
+	if err == nil && affected == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *sqlStore) GetUser(username string) (DbUser, error) {
+	var user DbUser
+	err := s.get(&user, `SELECT * FROM "user" WHERE username=?`, username)
+	return user, err
+}
+
+// GetUserFold finds the user case-insensitively, see lookupUser. MySQL's default collation compares
+// case-insensitively anyway, its lookups never get here for an existing user.
+func (s *sqlStore) GetUserFold(username string) (DbUser, error) {
+	var user DbUser
+	err := s.get(&user, `SELECT * FROM "user" WHERE LOWER(username)=LOWER(?) ORDER BY username LIMIT 1`, username)
+	return user, err
+}
+
+func (s *sqlStore) GetUsers() ([]DbUser, error) {
+	users := []DbUser{}
+	err := s.selectAll(&users, `SELECT * FROM "user" ORDER BY username`)
+	return users, err
+}
+
+func (s *sqlStore) AddUser(username string, password string) error {
 	// Unique constraint will cause error if username already exists
-	_, err := db.Exec("INSERT INTO user (username, password) VALUES ($1, $2)", username, password)
-	return err == nil
+	now := time.Now().Unix()
+	err := s.retryBusy(func() error {
+		_, err := s.db.Exec(s.db.Rebind(`INSERT INTO "user" (username, password, created_at, updated_at) VALUES (?, ?, ?, ?)`),
+			username, password, now, now)
+		return err
+	})
+	if s.isBusy(err) {
+		log.Println(err)
+		return err
+	}
+	if err != nil {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// DeleteUser removes the user's rows explicitly in one transaction, rather than relying on the
+// foreign keys alone, which SQLite only enforces with -sqlite-foreign-keys
+func (s *sqlStore) DeleteUser(username string) error {
+	return s.transaction(func(tx *sqlStore) error {
+		for _, table := range []string{"document_history", "document_metadata", "document", "api_key", "user_record"} {
+			if _, err := tx.exec(`DELETE FROM "`+table+`" WHERE username=?`, username); err != nil {
+				return err
+			}
+		}
+		return tx.execAffecting(`DELETE FROM "user" WHERE username=?`, username)
+	})
 }
 
-func getDBDocument(username string, documentId string) (Document, error) {
-	var document Document
+func (s *sqlStore) UpdateUserPassword(username string, password string) error {
+	return s.execAffecting(`UPDATE "user" SET password=?, updated_at=? WHERE username=?`, password, time.Now().Unix(), username)
+}
+
+func (s *sqlStore) GetDocument(username string, documentId string) (Document, error) {
 	var dbDocument DbDocument
-	err := db.Get(&dbDocument, "SELECT * FROM document WHERE document.username=$1 AND document.documentid=$2 ORDER BY document.timestamp DESC", username, documentId)
+	err := s.replica().get(&dbDocument, `SELECT * FROM document WHERE document.username=? AND document.documentid=? AND deleted_at=0
+		ORDER BY document.timestamp DESC, document.timestamp_ms DESC LIMIT 1`, username, documentId)
+	if err != nil {
+		return Document{}, err
+	}
+	return dbDocument.toDocument(), nil
+}
+
+func (s *sqlStore) GetDocumentDevices(username string, documentId string) ([]Document, error) {
+	var dbDocuments []DbDocument
+	err := s.replica().selectAll(&dbDocuments, `SELECT * FROM document WHERE document.username=? AND document.documentid=? AND deleted_at=0
+		ORDER BY document.timestamp DESC, document.timestamp_ms DESC`, username, documentId)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]Document, 0, len(dbDocuments))
+	for _, dbDocument := range dbDocuments {
+		documents = append(documents, dbDocument.toDocument())
+	}
+	return documents, nil
+}
+
+func (s *sqlStore) GetDocuments(username string) ([]Document, error) {
+	var dbDocuments []DbDocument
+	err := s.replica().selectAll(&dbDocuments, "SELECT * FROM document WHERE document.username=? AND deleted_at=0 ORDER BY document.timestamp DESC, document.timestamp_ms DESC", username)
+	if err != nil {
+		return nil, err
+	}
+	documents := make([]Document, 0, len(dbDocuments))
+	for _, dbDocument := range dbDocuments {
+		documents = append(documents, dbDocument.toDocument())
+	}
+	return documents, nil
+}
+
+func (s *sqlStore) UpdateDocument(username string, document Document) (int64, error) {
+	stampDocument(&document)
+	err := s.transaction(func(tx *sqlStore) error {
+		dbDocument, err := tx.putDocument(username, document)
+		if err != nil || config.HistoryCount == 0 {
+			return err
+		}
+		return tx.appendHistory(dbDocument)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return document.Timestamp, nil
+}
+
+func (s *sqlStore) ImportDocument(username string, document Document) error {
+	_, err := s.putDocument(username, document)
+	return err
+}
+
+// putDocument upserts the document with its timestamp; created_at is kept when the row exists
+func (s *sqlStore) putDocument(username string, document Document) (DbDocument, error) {
+	dbDocument := newDbDocument(username, document)
+	dbDocument.CreatedAt = document.Timestamp
+	dbDocument.UpdatedAt = document.Timestamp
+	err := s.retryBusy(func() error {
+		_, err := sqlx.NamedExec(s.ext(),
+			s.dialect.upsert("document", []string{"username", "documentid", "device_id"}, documentColumns),
+			dbDocument)
+		return err
+	})
 	if err != nil {
 		log.Println(err)
-		return document, err
 	}
-	document.Timestamp = dbDocument.Timestamp
-	document.DocumentId = documentId
-	document.Percentage = dbDocument.Percentage
-	document.Progress = &StringOrInt{dbDocument.Progress}
-	document.Device = dbDocument.Device
-	document.DeviceId = dbDocument.DeviceId
-	return document, nil
+	return dbDocument, err
+}
+
+func (s *sqlStore) DeleteDeviceDocuments(username string, deviceId string) (int64, error) {
+	now := time.Now().Unix()
+	return s.exec("UPDATE document SET deleted_at=?, updated_at=? WHERE username=? AND device_id=? AND deleted_at=0",
+		now, now, username, deviceId)
 }
 
-func updateDBDocument(username string, document Document) int64 {
+// DeleteDocument keeps a tombstone row, the next UpdateDocument revives it
+func (s *sqlStore) DeleteDocument(username string, documentId string) error {
 	now := time.Now().Unix()
-	_, err := db.NamedExec(
-		`
-			INSERT INTO document (username, documentid, percentage, progress, device, device_id, timestamp)
-			VALUES (:user, :docid, :perc, :prog, :dev, :devid, :time)
-			ON CONFLICT(username, documentid)
-			DO UPDATE SET percentage=:perc, progress=:prog, device=:dev, device_id=:devid, timestamp=:time
-		`,
-		map[string]interface{}{
-			"user":  username,
-			"docid": document.DocumentId,
-			"perc":  document.Percentage,
-			"prog":  document.Progress.inner,
-			"dev":   document.Device,
-			"devid": document.DeviceId,
-			"time":  now,
-		})
-	if err != nil {
-		log.Fatalln(err)
-	}
-	return now
+	return s.execAffecting("UPDATE document SET deleted_at=?, updated_at=? WHERE username=? AND documentid=? AND deleted_at=0",
+		now, now, username, documentId)
+}
+
+func (s *sqlStore) GetDeletedDocuments(username string, since int64) ([]DbDocument, error) {
+	var dbDocuments []DbDocument
+	err := s.replica().selectAll(&dbDocuments, "SELECT * FROM document WHERE username=? AND deleted_at>=? AND deleted_at<>0",
+		username, since)
+	return dbDocuments, err
+}
+
+// PruneDocuments keeps the pruned progress as tombstones for the delta sync, see GetDeletedDocuments
+func (s *sqlStore) PruneDocuments(before int64, archive func(pruned []DbDocument) error) (int, error) {
+	var pruned []DbDocument
+	err := s.transaction(func(tx *sqlStore) error {
+		pruned = nil
+		if err := tx.selectAll(&pruned, "SELECT * FROM document WHERE updated_at<?", before); err != nil {
+			return err
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		if err := archive(pruned); err != nil {
+			return err
+		}
+		if _, err := tx.exec("DELETE FROM document WHERE updated_at<? AND deleted_at<>0", before); err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		if _, err := tx.exec("UPDATE document SET deleted_at=?, updated_at=? WHERE updated_at<? AND deleted_at=0", now, now, before); err != nil {
+			return err
+		}
+		_, err := tx.exec(`DELETE FROM document_history WHERE NOT EXISTS (SELECT 1 FROM document
+			WHERE document.username=document_history.username AND document.documentid=document_history.documentid)`)
+		return err
+	})
+	return len(pruned), err
+}
+
+func (s *sqlStore) GetStatistics(since int64) (Statistics, error) {
+	var statistics Statistics
+	if err := s.get(&statistics.Users, `SELECT COUNT(*) FROM "user"`); err != nil {
+		return statistics, err
+	}
+	statistics.DocumentsPerUser = []UserDocuments{}
+	err := s.selectAll(&statistics.DocumentsPerUser, `SELECT username, COUNT(DISTINCT documentid) AS documents
+		FROM document WHERE deleted_at=0 GROUP BY username ORDER BY username`)
+	if err != nil {
+		return statistics, err
+	}
+	for _, user := range statistics.DocumentsPerUser {
+		statistics.Documents += user.Documents
+	}
+	var synced struct {
+		Documents int `db:"documents"`
+		Users     int `db:"users"`
+	}
+	err = s.get(&synced, `SELECT COUNT(*) AS documents, COUNT(DISTINCT username) AS users
+		FROM document WHERE updated_at>=? AND deleted_at=0`, since)
+	if err != nil {
+		return statistics, err
+	}
+	statistics.Synced, statistics.ActiveUsers = synced.Documents, synced.Users
+	err = s.get(&statistics.DatabaseSize, s.dialect.sizeQuery)
+	return statistics, err
+}
+
+func (s *sqlStore) Maintain() (MaintenanceResult, error) {
+	var result MaintenanceResult
+	if err := s.db.Get(&result.SizeBefore, s.dialect.sizeQuery); err != nil {
+		return result, err
+	}
+	if err := s.dialect.maintain(s.db); err != nil {
+		return result, err
+	}
+	err := s.db.Get(&result.SizeAfter, s.dialect.sizeQuery)
+	return result, err
+}
+
+// schemaTables are the tables and columns the queries rely on, Check validates them
+var schemaTables = []struct {
+	name    string
+	columns []string
+}{
+	{"user", []string{"username", "password", "created_at", "updated_at"}},
+	{"document", documentColumns},
+	{"document_history", append([]string{"id"}, historyColumns...)},
+	{"document_metadata", metadataColumns},
+	{"api_key", []string{"username", "name", "key", "scopes", "created"}},
+	{"user_record", recordColumns},
+}
+
+func (s *sqlStore) Check() ([]string, error) {
+	var problems []string
+	if s.dialect.integrityCheck != nil {
+		found, err := s.dialect.integrityCheck(s.db)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+	version, err := s.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if latest := len(s.dialect.migrations); version != latest {
+		problems = append(problems, fmt.Sprintf("schema version is %d, this build expects %d", version, latest))
+	}
+	for _, table := range schemaTables {
+		columns, err := s.tableColumns(table.name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("table %s: %v", table.name, err))
+			continue
+		}
+		found := map[string]bool{}
+		for _, column := range columns {
+			found[column] = true
+		}
+		for _, column := range table.columns {
+			if !found[column] {
+				problems = append(problems, fmt.Sprintf("table %s has no column %s", table.name, column))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// tableColumns returns the column names of the table, an error if it doesn't exist
+func (s *sqlStore) tableColumns(table string) ([]string, error) {
+	rows, err := s.ext().Query(`SELECT * FROM "` + table + `" WHERE 1=0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// Backup uses VACUUM INTO, which writes a compacted, consistent copy without blocking writers for long.
+// Only SQLite supports it; use the database's own tools for the other SQL backends.
+func (s *sqlStore) Backup(dest string) error {
+	if s.dialect.driver != sqliteDialect.driver {
+		return ErrBackupUnsupported
+	}
+	return sqliteCompactCopy(s.db, dest)
+}
+
+var historyColumns = []string{"username", "documentid", "percentage", "progress", "progress_raw", "position", "device", "device_id", "timestamp", "timestamp_ms"}
+
+// appendHistory adds the progress to the document history and drops the entries
+// beyond -history-count or older than -history-max-age
+func (s *sqlStore) appendHistory(dbDocument DbDocument) error {
+	if _, err := sqlx.NamedExec(s.ext(), insertStatement("document_history", historyColumns), dbDocument); err != nil {
+		log.Println(err)
+		return err
+	}
+	var oldestKept int64
+	err := s.get(&oldestKept, `SELECT id FROM document_history WHERE username=? AND documentid=?
+		ORDER BY id DESC LIMIT 1 OFFSET ?`, dbDocument.Username, dbDocument.DocumentID, config.HistoryCount-1)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err == nil {
+		_, err := s.exec("DELETE FROM document_history WHERE username=? AND documentid=? AND id<?",
+			dbDocument.Username, dbDocument.DocumentID, oldestKept)
+		if err != nil {
+			return err
+		}
+	}
+	if cutoff := historyCutoff(dbDocument.Timestamp); cutoff > 0 {
+		_, err := s.exec("DELETE FROM document_history WHERE username=? AND documentid=? AND timestamp<?",
+			dbDocument.Username, dbDocument.DocumentID, cutoff)
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) GetDocumentHistory(username string, documentId string) ([]Document, error) {
+	var dbDocuments []DbDocument
+	err := s.replica().selectAll(&dbDocuments, `SELECT `+strings.Join(historyColumns, ", ")+` FROM document_history
+		WHERE username=? AND documentid=? ORDER BY id DESC`, username, documentId)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Document, 0, len(dbDocuments))
+	for _, dbDocument := range dbDocuments {
+		history = append(history, dbDocument.toDocument())
+	}
+	return history, nil
+}
+
+var metadataColumns = []string{"username", "documentid", "title", "author", "series", "updated_at"}
+
+func (s *sqlStore) GetDocumentMetadata(username string, documentId string) (DbDocumentMetadata, error) {
+	var metadata DbDocumentMetadata
+	err := s.replica().get(&metadata, "SELECT * FROM document_metadata WHERE username=? AND documentid=?", username, documentId)
+	return metadata, err
+}
+
+func (s *sqlStore) GetDocumentsMetadata(username string) ([]DbDocumentMetadata, error) {
+	metadata := []DbDocumentMetadata{}
+	err := s.replica().selectAll(&metadata, "SELECT * FROM document_metadata WHERE username=? ORDER BY documentid", username)
+	return metadata, err
+}
+
+func (s *sqlStore) SetDocumentMetadata(metadata DbDocumentMetadata) error {
+	err := s.retryBusy(func() error {
+		_, err := sqlx.NamedExec(s.ext(),
+			s.dialect.upsert("document_metadata", []string{"username", "documentid"}, metadataColumns),
+			metadata)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (s *sqlStore) DeleteDocumentMetadata(username string, documentId string) error {
+	return s.execAffecting("DELETE FROM document_metadata WHERE username=? AND documentid=?", username, documentId)
+}
+
+var recordColumns = []string{"username", "kind", "name", "value", "updated_at"}
+
+func (s *sqlStore) GetRecord(username string, kind string, name string) (DbRecord, error) {
+	var record DbRecord
+	err := s.get(&record, "SELECT * FROM user_record WHERE username=? AND kind=? AND name=?", username, kind, name)
+	return record, err
+}
+
+func (s *sqlStore) GetRecords(username string, kind string) ([]DbRecord, error) {
+	records := []DbRecord{}
+	err := s.selectAll(&records, "SELECT * FROM user_record WHERE username=? AND kind=? ORDER BY name", username, kind)
+	return records, err
+}
+
+func (s *sqlStore) PutRecord(record DbRecord) error {
+	err := s.retryBusy(func() error {
+		_, err := sqlx.NamedExec(s.ext(), s.dialect.upsert("user_record", []string{"username", "kind", "name"}, recordColumns), record)
+		return err
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (s *sqlStore) DeleteRecord(username string, kind string, name string) error {
+	return s.execAffecting("DELETE FROM user_record WHERE username=? AND kind=? AND name=?", username, kind, name)
+}
+
+func (s *sqlStore) FindRecord(kind string, name string) (DbRecord, error) {
+	var record DbRecord
+	err := s.get(&record, "SELECT * FROM user_record WHERE kind=? AND name=?", kind, name)
+	return record, err
+}
+
+func (s *sqlStore) AddAPIKey(apiKey DbAPIKey) error {
+	// Unique constraints will cause error if the name or key already exists
+	err := s.retryBusy(func() error {
+		_, err := s.db.NamedExec(insertStatement("api_key", []string{"username", "name", "key", "scopes", "created"}), apiKey)
+		return err
+	})
+	if s.isBusy(err) {
+		log.Println(err)
+		return err
+	}
+	if err != nil {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (s *sqlStore) GetAPIKey(username string, key string) (DbAPIKey, error) {
+	var apiKey DbAPIKey
+	err := s.get(&apiKey, `SELECT * FROM api_key WHERE username=? AND "key"=?`, username, key)
+	return apiKey, err
+}
+
+func (s *sqlStore) GetAPIKeys(username string) ([]DbAPIKey, error) {
+	apiKeys := []DbAPIKey{}
+	err := s.selectAll(&apiKeys, "SELECT * FROM api_key WHERE username=? ORDER BY created", username)
+	return apiKeys, err
+}
+
+func (s *sqlStore) DeleteAPIKey(username string, name string) error {
+	return s.execAffecting("DELETE FROM api_key WHERE username=? AND name=?", username, name)
+}
+
+func (s *sqlStore) DeleteAPIKeys(username string) (int64, error) {
+	return s.exec("DELETE FROM api_key WHERE username=?", username)
 }
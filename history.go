@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// historyCutoff returns the timestamp before which history entries are dropped, or 0 to keep them all
+func historyCutoff(now int64) int64 {
+	if config.HistoryMaxAge <= 0 {
+		return 0
+	}
+	return now - int64(config.HistoryMaxAge/time.Second)
+}
+
+// pruneHistory applies the retention settings to a document history ordered newest first
+// and returns how many entries are kept
+func pruneHistory(history []DbDocument, now int64) int {
+	kept := len(history)
+	if kept > config.HistoryCount {
+		kept = config.HistoryCount
+	}
+	cutoff := historyCutoff(now)
+	for kept > 0 && history[kept-1].Timestamp < cutoff {
+		kept--
+	}
+	return kept
+}
+
+func getProgressHistory(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var requestDocument Document
+	if err := c.ShouldBindUri(&requestDocument); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	history, err := store.GetDocumentHistory(username, canonicalDocument(username, requestDocument.DocumentId))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	for i := range history {
+		dropPosition(c, &history[i])
+	}
+	respond(c, http.StatusOK, history)
+}
+
+// undoProgress restores the latest position in the history that differs from the current one, e.g. after
+// a device jumped back to page 1 and synced it. The position is stored as a new update of the device
+// holding the current one, so all devices pick it up; undoing again returns to the replaced position.
+func undoProgress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := canonicalDocument(username, c.Param("document"))
+	current, err := store.GetDocument(username, documentId)
+	if err != nil {
+		c.Error(&DocumentNotFound)
+		return
+	}
+	history, err := store.GetDocumentHistory(username, documentId)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	var previous *Document
+	for i := range history {
+		if history[i].Progress != nil && *history[i].Progress != *current.Progress {
+			previous = &history[i]
+			break
+		}
+	}
+	if previous == nil {
+		c.Error(&NoPreviousProgress)
+		return
+	}
+	restored := Document{
+		DocumentId: documentId,
+		Progress:   previous.Progress,
+		Percentage: previous.Percentage,
+		Position:   previous.Position,
+		Device:     current.Device,
+		DeviceId:   current.DeviceId,
+	}
+	timestamp, err := store.UpdateDocument(username, restored)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	restored.Timestamp = timestamp
+	journal.Record(JournalEntry{Op: JournalProgress, User: username, Document: &restored})
+	progressChanges.Publish(ProgressChange{username, documentId})
+	respond(c, http.StatusOK, restored)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// syncTestPage stores alice's progress of doc1 at a page through the API
+func syncTestPage(t *testing.T, router http.Handler, page int) {
+	t.Helper()
+	w := testRequest(router, http.MethodPut, "/syncs/progress",
+		`{"document": "doc1", "progress": "`+strconv.Itoa(page)+`", "percentage": `+strconv.FormatFloat(float64(page)/100, 'f', -1, 64)+`, "device": "kobo", "device_id": "K1"}`,
+		"alice", "pw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("syncing page %d: %d %s", page, w.Code, w.Body)
+	}
+}
+
+// testHistory returns the pages in alice's history of doc1, newest first
+func testHistory(t *testing.T, router http.Handler) []string {
+	t.Helper()
+	w := testRequest(router, http.MethodGet, "/syncs/progress/doc1/history", "", "alice", "pw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("history: %d %s", w.Code, w.Body)
+	}
+	var history []Document
+	decodeTestResponse(t, w, &history)
+	pages := []string{}
+	for _, document := range history {
+		pages = append(pages, document.Progress.inner)
+	}
+	return pages
+}
+
+func TestProgressHistory(t *testing.T) {
+	router := newTestRouter(t)
+	config.HistoryCount = 3
+	registerTestUser(t, router, "", "alice", "pw")
+	for page := 1; page <= 5; page++ {
+		syncTestPage(t, router, page)
+	}
+	if pages := testHistory(t, router); len(pages) != 3 || pages[0] != "5" || pages[2] != "3" {
+		t.Errorf("history kept beyond -history-count: %v", pages)
+	}
+
+	config.HistoryCount = 0
+	syncTestPage(t, router, 6)
+	if pages := testHistory(t, router); len(pages) != 3 || pages[0] != "5" {
+		t.Errorf("history recorded with -history-count 0: %v", pages)
+	}
+}
+
+func TestUndoProgress(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	undoError := func() int {
+		w := testRequest(router, http.MethodPost, "/syncs/progress/doc1/undo", "", "alice", "pw")
+		var answer struct{ Code int }
+		decodeTestResponse(t, w, &answer)
+		return answer.Code
+	}
+	if code := undoError(); code != DocumentNotFound.Code {
+		t.Errorf("undo without progress: code %d", code)
+	}
+	syncTestPage(t, router, 40)
+	if code := undoError(); code != NoPreviousProgress.Code {
+		t.Errorf("undo without a previous position: code %d", code)
+	}
+	// A device jumped back to the start
+	syncTestPage(t, router, 1)
+
+	for _, want := range []string{"40", "1"} {
+		w := testRequest(router, http.MethodPost, "/syncs/progress/doc1/undo", "", "alice", "pw")
+		if w.Code != http.StatusOK {
+			t.Fatalf("undo: %d %s", w.Code, w.Body)
+		}
+		document, err := store.GetDocument("alice", "doc1")
+		if err != nil || document.Progress.inner != want || document.DeviceId != "K1" {
+			t.Errorf("progress after undo: %+v %v, want page %s", document, err, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clients on a flaky connection, e.g. e-ink readers waking their WiFi, retry requests whose answer
+// they didn't get. With an Idempotency-Key header, a retried PUT or POST is answered with the response
+// of the first one instead of being processed again.
+
+const (
+	// idempotencyTTL is how long the response to a key is kept
+	idempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKeys bounds the responses kept, the oldest are dropped first
+	maxIdempotencyKeys = 10000
+	maxIdempotencyKey  = 255
+	// maxIdempotentBody bounds the request body read to fingerprint it, like a decompressed gzip body
+	maxIdempotentBody = maxDecompressedBody
+)
+
+// idempotentResponse is the response to a key, or a placeholder while the first request is processed
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	created     time.Time
+	// element holds the name of the response in idempotentOrder
+	element *list.Element
+}
+
+// idempotentResponses are kept in memory, per server process. idempotentOrder lists their names oldest
+// first, so expiring and dropping them doesn't scan them all.
+var (
+	idempotentResponses   = map[string]*idempotentResponse{}
+	idempotentOrder       = list.New()
+	idempotentResponsesMu sync.Mutex
+)
+
+// recordingWriter keeps a copy of the body written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// addIdempotentResponse keeps a response as the newest. The caller holds idempotentResponsesMu.
+func addIdempotentResponse(name string, response *idempotentResponse) {
+	response.element = idempotentOrder.PushBack(name)
+	idempotentResponses[name] = response
+}
+
+// dropIdempotentResponse forgets a response. The caller holds idempotentResponsesMu.
+func dropIdempotentResponse(name string) {
+	if response, ok := idempotentResponses[name]; ok {
+		idempotentOrder.Remove(response.element)
+		delete(idempotentResponses, name)
+	}
+}
+
+// pruneIdempotentResponses drops the expired responses and, beyond maxIdempotencyKeys, the oldest one
+// that is done. The caller holds idempotentResponsesMu.
+func pruneIdempotentResponses(now time.Time) {
+	for element := idempotentOrder.Front(); element != nil; element = idempotentOrder.Front() {
+		name := element.Value.(string)
+		if now.Sub(idempotentResponses[name].created) <= idempotencyTTL {
+			break
+		}
+		dropIdempotentResponse(name)
+	}
+	if len(idempotentResponses) < maxIdempotencyKeys {
+		return
+	}
+	for element := idempotentOrder.Front(); element != nil; element = element.Next() {
+		if name := element.Value.(string); idempotentResponses[name].done {
+			dropIdempotentResponse(name)
+			return
+		}
+	}
+}
+
+// Idempotency answers a PUT or POST retried with the same Idempotency-Key with the first response. The key
+// is per user and route; sending it with a different body is refused, as is a retry while the first request
+// is still processed. Only successful responses are kept, a failed request can be retried with the same key.
+func Idempotency(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" || (c.Request.Method != http.MethodPut && c.Request.Method != http.MethodPost) {
+		c.Next()
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBody)
+	body, err := c.GetRawData()
+	if err != nil || len(key) > maxIdempotencyKey {
+		writeError(c, &InvalidRequest)
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	name := c.MustGet("username").(string) + "\x00" + c.Request.Method + " " + c.Request.URL.Path + "\x00" + key
+	fingerprint := sha256.Sum256(body)
+
+	now := time.Now()
+	idempotentResponsesMu.Lock()
+	pruneIdempotentResponses(now)
+	response, ok := idempotentResponses[name]
+	if !ok {
+		response = &idempotentResponse{fingerprint: fingerprint, created: now}
+		addIdempotentResponse(name, response)
+	}
+	idempotentResponsesMu.Unlock()
+	if ok {
+		switch {
+		case response.fingerprint != fingerprint:
+			writeError(c, &IdempotencyKeyReused)
+		case !response.done:
+			writeError(c, &IdempotencyKeyInUse)
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(response.status, response.contentType, response.body)
+			c.Abort()
+		}
+		return
+	}
+
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	// A panic of the handler is recovered by gin.Recovery above, the placeholder mustn't stay behind
+	// answering IdempotencyKeyInUse until it expires
+	defer func() {
+		if !response.done {
+			idempotentResponsesMu.Lock()
+			dropIdempotentResponse(name)
+			idempotentResponsesMu.Unlock()
+		}
+	}()
+	c.Next()
+	c.Writer = writer.ResponseWriter
+	idempotentResponsesMu.Lock()
+	defer idempotentResponsesMu.Unlock()
+	if len(c.Errors) > 0 || writer.Status() < 200 || writer.Status() >= 300 {
+		return
+	}
+	response.done = true
+	response.status = writer.Status()
+	response.contentType = writer.Header().Get("Content-Type")
+	response.body = writer.body.Bytes()
+}
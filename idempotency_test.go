@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotentRequest sends a request of alice with the Idempotency-Key
+func idempotentRequest(router http.Handler, method string, path string, body string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Accept", mediaTypeV1)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-auth-user", "alice")
+	req.Header.Set("x-auth-key", "pw")
+	req.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	body := `{"document": "doc1", "progress": "2", "percentage": 0.2, "device": "kobo"}`
+	first := idempotentRequest(router, http.MethodPut, "/syncs/progress", body, "k1")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request: %d %s", first.Code, first.Body)
+	}
+	retry := idempotentRequest(router, http.MethodPut, "/syncs/progress", body, "k1")
+	if retry.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry: %d %v %s", retry.Code, retry.Header(), retry.Body)
+	}
+	if w := idempotentRequest(router, http.MethodPut, "/syncs/progress", strings.Replace(body, "0.2", "0.3", 1), "k1"); w.Code != IdempotencyKeyReused.Status {
+		t.Errorf("key reused with another body: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyAfterPanic(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	panics := true
+	router.Group("/", AuthRequired, Idempotency).POST("/test/panic", func(c *gin.Context) {
+		if panics {
+			panic("handler failed")
+		}
+		c.Status(http.StatusNoContent)
+	})
+	if w := idempotentRequest(router, http.MethodPost, "/test/panic", "{}", "k1"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("panicking handler: %d %s", w.Code, w.Body)
+	}
+	panics = false
+	if w := idempotentRequest(router, http.MethodPost, "/test/panic", "{}", "k1"); w.Code != http.StatusNoContent {
+		t.Errorf("retry after the panic: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotentBodyBounded(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	body := `{"document": "` + strings.Repeat("x", maxIdempotentBody) + `"}`
+	if w := idempotentRequest(router, http.MethodPut, "/syncs/progress", body, "k1"); w.Code != InvalidRequest.Status {
+		t.Errorf("oversized body: %d", w.Code)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// ImportedPosition is how far a book was read on a Kindle or Kobo, as found in its exports. Books are
+// identified by title and author only, they're matched to documents through the document metadata.
+type ImportedPosition struct {
+	Title      string
+	Author     string
+	Page       int
+	Percentage float64
+	Timestamp  int64
+}
+
+// ImportedProgress is a book whose position was imported as the progress of a document
+type ImportedProgress struct {
+	Title      string  `json:"title"`
+	DocumentId string  `json:"document"`
+	Percentage float64 `json:"percentage,omitempty"`
+	Page       int     `json:"page,omitempty"`
+}
+
+// PositionImport reports what an import did with each book of the export
+type PositionImport struct {
+	Source   string             `json:"source"`
+	DryRun   bool               `json:"dry_run"`
+	Imported []ImportedProgress `json:"imported"`
+	// Skipped are books whose document already has newer progress
+	Skipped []string `json:"skipped"`
+	// Unmatched are books without a document of the same title, or with several
+	Unmatched []string `json:"unmatched"`
+}
+
+// positionSources are the exports positions are imported from, and the device the progress is stored for
+var positionSources = map[string]struct {
+	device string
+	read   func(path string) ([]ImportedPosition, error)
+}{
+	"kindle": {"Kindle", readKindleClippingsFile},
+	"kobo":   {"Kobo", readKoboDatabase},
+}
+
+// maxPositionImport bounds the uploaded export, a KoboReader.sqlite is rarely larger
+const maxPositionImport = 32 << 20
+
+var (
+	kindlePage   = regexp.MustCompile(`(?i)\bpage (\d+)`)
+	kindleAuthor = regexp.MustCompile(`^(.*) \(([^()]*)\)$`)
+)
+
+// kindleDateLayouts are the "Added on" dates of the English Kindle firmwares, US and UK
+var kindleDateLayouts = []string{
+	"Monday, January 2, 2006 3:04:05 PM",
+	"Monday, 2 January 2006 15:04:05",
+}
+
+// parseKindleClippings reads a "My Clippings.txt". The clippings of a book are reduced to the furthest
+// one with a page number, clippings of books without page numbers only have a location, which can't be
+// turned into a page or a percentage without the length of the book, and are left out.
+func parseKindleClippings(r io.Reader) ([]ImportedPosition, error) {
+	books := map[string]*ImportedPosition{}
+	var order []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lines []string
+	flush := func() {
+		defer func() { lines = nil }()
+		if len(lines) < 2 {
+			return
+		}
+		position := ImportedPosition{Title: strings.TrimSpace(strings.TrimPrefix(lines[0], "\ufeff"))}
+		if match := kindleAuthor.FindStringSubmatch(position.Title); match != nil {
+			position.Title, position.Author = strings.TrimSpace(match[1]), strings.TrimSpace(match[2])
+		}
+		if position.Title == "" {
+			return
+		}
+		details := strings.Split(lines[1], "|")
+		for _, detail := range details {
+			if match := kindlePage.FindStringSubmatch(detail); match != nil {
+				position.Page, _ = strconv.Atoi(match[1])
+			}
+			if added := strings.TrimSpace(detail); strings.HasPrefix(added, "Added on ") {
+				for _, layout := range kindleDateLayouts {
+					if t, err := time.Parse(layout, strings.TrimPrefix(added, "Added on ")); err == nil {
+						position.Timestamp = t.Unix()
+						break
+					}
+				}
+			}
+		}
+		key := position.Title + "\x00" + position.Author
+		book, ok := books[key]
+		if !ok {
+			book = &ImportedPosition{Title: position.Title, Author: position.Author}
+			books[key] = book
+			order = append(order, key)
+		}
+		if position.Page > book.Page {
+			book.Page = position.Page
+		}
+		if position.Timestamp > book.Timestamp {
+			book.Timestamp = position.Timestamp
+		}
+	}
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "==========" {
+			flush()
+			continue
+		}
+		if len(lines) == 0 && strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	positions := make([]ImportedPosition, 0, len(order))
+	for _, key := range order {
+		if books[key].Page > 0 {
+			positions = append(positions, *books[key])
+		}
+	}
+	return positions, nil
+}
+
+func readKindleClippingsFile(path string) ([]ImportedPosition, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseKindleClippings(file)
+}
+
+// readKoboDatabase reads the books a Kobo has progress for from its KoboReader.sqlite, which is where
+// the Kobo keeps its library and annotations, and what the Kobo export tools read as well
+func readKoboDatabase(path string) ([]ImportedPosition, error) {
+	db, err := sqlx.Connect(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var rows []struct {
+		Title        sql.NullString `db:"title"`
+		Author       sql.NullString `db:"author"`
+		PercentRead  sql.NullInt64  `db:"percent_read"`
+		DateLastRead sql.NullString `db:"date_last_read"`
+	}
+	// ContentType 6 are the books, the other rows are their chapters
+	err = db.Select(&rows, `SELECT Title AS title, Attribution AS author, ___PercentRead AS percent_read,
+		DateLastRead AS date_last_read FROM content WHERE ContentType = 6 AND ___PercentRead > 0`)
+	if err != nil {
+		return nil, fmt.Errorf("reading the Kobo library: %w", err)
+	}
+	positions := make([]ImportedPosition, 0, len(rows))
+	for _, row := range rows {
+		if strings.TrimSpace(row.Title.String) == "" {
+			continue
+		}
+		position := ImportedPosition{
+			Title:      strings.TrimSpace(row.Title.String),
+			Author:     strings.TrimSpace(row.Author.String),
+			Percentage: float64(row.PercentRead.Int64) / 100,
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000", "2006-01-02T15:04:05"} {
+			if t, err := time.Parse(layout, row.DateLastRead.String); err == nil {
+				position.Timestamp = t.Unix()
+				break
+			}
+		}
+		positions = append(positions, position)
+	}
+	return positions, nil
+}
+
+// normalizeTitle makes titles comparable across stores, which differ in case, punctuation and spacing
+func normalizeTitle(title string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// sameAuthor compares authors ignoring the order of the names, Kindle writes "Herbert, Frank"
+func sameAuthor(a string, b string) bool {
+	aNames, bNames := strings.Fields(normalizeTitle(a)), strings.Fields(normalizeTitle(b))
+	sort.Strings(aNames)
+	sort.Strings(bNames)
+	return strings.Join(aNames, " ") == strings.Join(bNames, " ")
+}
+
+// matchDocument returns the document with the title of the book. The author only decides between
+// documents of the same title, as it's often missing or spelled differently.
+func matchDocument(metadata []DocumentMetadata, position ImportedPosition) (string, bool) {
+	var matches []DocumentMetadata
+	for _, m := range metadata {
+		if normalizeTitle(m.Title) == normalizeTitle(position.Title) {
+			matches = append(matches, m)
+		}
+	}
+	if len(matches) > 1 && position.Author != "" {
+		var byAuthor []DocumentMetadata
+		for _, m := range matches {
+			if sameAuthor(m.Author, position.Author) {
+				byAuthor = append(byAuthor, m)
+			}
+		}
+		matches = byAuthor
+	}
+	if len(matches) != 1 {
+		return "", false
+	}
+	return matches[0].DocumentId, true
+}
+
+// importPositions stores the positions as the progress of the matching documents on the source's device.
+// Documents with newer progress from any device are skipped, the import only seeds the books not synced
+// since. Pages become the progress, KOReader jumps to them in paged documents; reflowable documents only
+// get the percentage.
+func importPositions(username string, source string, positions []ImportedPosition, dryRun bool) (PositionImport, error) {
+	report := PositionImport{Source: source, DryRun: dryRun, Imported: []ImportedProgress{}, Skipped: []string{}, Unmatched: []string{}}
+	metadata, err := userDocumentMetadata(username)
+	if err != nil {
+		return report, err
+	}
+	now := time.Now().Unix()
+	for _, position := range positions {
+		documentId, ok := matchDocument(metadata, position)
+		if !ok {
+			report.Unmatched = append(report.Unmatched, position.Title)
+			continue
+		}
+		documentId = canonicalDocument(username, documentId)
+		if position.Timestamp <= 0 || position.Timestamp > now {
+			position.Timestamp = now
+		}
+		if existing, err := store.GetDocument(username, documentId); err == nil && existing.Timestamp >= position.Timestamp {
+			report.Skipped = append(report.Skipped, position.Title)
+			continue
+		} else if err != nil && err != ErrNotFound {
+			return report, err
+		}
+		document := Document{
+			DocumentId: documentId,
+			Progress:   &StringOrInt{},
+			Device:     positionSources[source].device,
+			DeviceId:   "import-" + source,
+			Percentage: position.Percentage,
+			Timestamp:  position.Timestamp,
+		}
+		if position.Page > 0 {
+			document.Progress = &StringOrInt{inner: strconv.Itoa(position.Page)}
+			document.Position = &Position{Page: position.Page}
+		}
+		if !dryRun {
+			if err := store.ImportDocument(username, document); err != nil {
+				return report, err
+			}
+			progressChanges.Publish(ProgressChange{username, documentId})
+		}
+		report.Imported = append(report.Imported, ImportedProgress{
+			Title:      position.Title,
+			DocumentId: documentId,
+			Percentage: position.Percentage,
+			Page:       position.Page,
+		})
+	}
+	return report, nil
+}
+
+// importPositionsUpload imports the export uploaded as the request body, "My Clippings.txt" for
+// :source kindle or KoboReader.sqlite for kobo. ?dry_run=1 only reports the matches.
+func importPositionsUpload(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	source, ok := positionSources[c.Param("source")]
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	// The readers take a file, the Kobo database can't be read from memory
+	upload, err := ioutil.TempFile("", "kosyncsrv-import-")
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	defer os.Remove(upload.Name())
+	_, err = io.Copy(upload, http.MaxBytesReader(c.Writer, c.Request.Body, maxPositionImport))
+	upload.Close()
+	if err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	positions, err := source.read(upload.Name())
+	if err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	report, err := importPositions(username, c.Param("source"), positions, dryRun)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, report)
+}
+
+// importPositionsCommand imports a Kindle or Kobo export for a user from the command line
+func importPositionsCommand(args []string) error {
+	flags := flag.NewFlagSet("import-positions", flag.ExitOnError)
+	user := flags.String("user", "", "User whose documents the positions are imported into")
+	sourceName := flags.String("source", "kindle", "kindle for a My Clippings.txt, kobo for a KoboReader.sqlite")
+	dryRun := flags.Bool("dry-run", false, "Only print the matches")
+	flags.Parse(args)
+	source, ok := positionSources[*sourceName]
+	if flags.NArg() != 1 || *user == "" || !ok {
+		return fmt.Errorf("usage: kosyncsrv import-positions -user <username> [-source kindle|kobo] [-dry-run] <file>")
+	}
+	account, err := lookupUser(*user)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", *user, err)
+	}
+	positions, err := source.read(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	report, err := importPositions(account.Username, *sourceName, positions, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, imported := range report.Imported {
+		fmt.Printf("Imported %q into %s\n", imported.Title, imported.DocumentId)
+	}
+	for _, title := range report.Skipped {
+		fmt.Printf("Skipped %q, the document has newer progress\n", title)
+	}
+	for _, title := range report.Unmatched {
+		fmt.Printf("No document matches %q\n", title)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build cgo || modernc
+// +build cgo modernc
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReadKoboDatabase(t *testing.T) {
+	path := writeTestSQLite(t,
+		`CREATE TABLE content (ContentID TEXT, ContentType INTEGER, Title TEXT, Attribution TEXT,
+			___PercentRead INTEGER, DateLastRead TEXT)`,
+		`INSERT INTO content VALUES ('dune', 6, 'Dune', 'Frank Herbert', 35, '2020-03-03T21:00:00Z')`,
+		`INSERT INTO content VALUES ('dune#chapter1', 9, 'Chapter 1', '', 100, '2020-03-03T21:00:00Z')`,
+		`INSERT INTO content VALUES ('emma', 6, 'Emma', 'Jane Austen', 0, NULL)`,
+		`INSERT INTO content VALUES ('persuasion', 6, ' Persuasion ', 'Jane Austen', 80, '2020-03-01T10:00:00.000')`,
+	)
+	positions, err := readKoboDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chapters and unread books are left out
+	if len(positions) != 2 {
+		t.Fatalf("positions: %+v", positions)
+	}
+	byTitle := map[string]ImportedPosition{}
+	for _, position := range positions {
+		byTitle[position.Title] = position
+	}
+	if dune := byTitle["Dune"]; dune.Author != "Frank Herbert" || dune.Percentage != 0.35 || dune.Timestamp != 1583269200 {
+		t.Errorf("Dune: %+v", dune)
+	}
+	if persuasion := byTitle["Persuasion"]; persuasion.Percentage != 0.8 || persuasion.Timestamp != 1583056800 {
+		t.Errorf("Persuasion: %+v", persuasion)
+	}
+
+	if _, err := readKoboDatabase(writeTestSQLite(t, `CREATE TABLE other (id INTEGER)`)); err == nil {
+		t.Error("a database without a Kobo library is read")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testKindleClippings = "\ufeffDune (Herbert, Frank)\r\n" +
+	"- Your Highlight on page 12 | Location 180-181 | Added on Monday, March 2, 2020 8:15:00 PM\r\n" +
+	"\r\n" +
+	"The spice must flow.\r\n" +
+	"==========\r\n" +
+	"Dune (Herbert, Frank)\r\n" +
+	"- Your Note on page 40 | Location 610 | Added on Tuesday, March 3, 2020 9:00:00 PM\r\n" +
+	"\r\n" +
+	"Fear is the mind-killer.\r\n" +
+	"==========\r\n" +
+	"Emma (Austen, Jane)\r\n" +
+	"- Your Highlight on page 5 | Added on Sunday, 1 March 2020 10:00:00\r\n" +
+	"\r\n" +
+	"Handsome, clever, and rich.\r\n" +
+	"==========\r\n" +
+	"Persuasion (Jane Austen)\r\n" +
+	"- Your Bookmark on page 3 | Added on Sunday, 1 March 2020 10:00:00\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"==========\r\n" +
+	"Unknown Book (Nobody)\r\n" +
+	"- Your Highlight on page 1 | Added on Sunday, 1 March 2020 10:00:00\r\n" +
+	"\r\n" +
+	"Text.\r\n" +
+	"==========\r\n" +
+	"Location Only (Somebody)\r\n" +
+	"- Your Highlight at location 100-101 | Added on Sunday, 1 March 2020 10:00:00\r\n" +
+	"\r\n" +
+	"Text.\r\n" +
+	"==========\r\n"
+
+func TestParseKindleClippings(t *testing.T) {
+	positions, err := parseKindleClippings(strings.NewReader(testKindleClippings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 4 {
+		t.Fatalf("positions: %+v", positions)
+	}
+	dune := positions[0]
+	if dune.Title != "Dune" || dune.Author != "Herbert, Frank" || dune.Page != 40 || dune.Timestamp != 1583269200 {
+		t.Errorf("furthest clipping of Dune: %+v", dune)
+	}
+	if emma := positions[1]; emma.Page != 5 || emma.Timestamp != 1583056800 {
+		t.Errorf("clipping with a UK date: %+v", emma)
+	}
+}
+
+// importTestClippings uploads testKindleClippings for alice
+func importTestClippings(t *testing.T, router http.Handler, query string) PositionImport {
+	t.Helper()
+	w := testRequest(router, http.MethodPost, "/syncs/import/kindle"+query, testKindleClippings, "alice", "pw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("importing the clippings: %d %s", w.Code, w.Body)
+	}
+	var report PositionImport
+	decodeTestResponse(t, w, &report)
+	return report
+}
+
+func TestImportPositions(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	for document, metadata := range map[string]string{
+		"doc1": `{"title": "Dune", "author": "Frank Herbert"}`,
+		"doc2": `{"title": "Emma", "author": "Jane Austen"}`,
+		"doc3": `{"title": "Emma", "author": "Someone Else"}`,
+		"doc4": `{"title": "Persuasion", "author": "Jane Austen"}`,
+	} {
+		if w := testRequest(router, http.MethodPut, "/syncs/metadata/"+document, metadata, "alice", "pw"); w.Code != http.StatusOK {
+			t.Fatalf("metadata of %s: %d %s", document, w.Code, w.Body)
+		}
+	}
+	// doc4 was read since the clippings were exported
+	syncTestProgress(t, router, "", "alice", "pw", "doc4", "0.5")
+
+	report := importTestClippings(t, router, "?dry_run=1")
+	if len(report.Imported) != 2 || !report.DryRun {
+		t.Errorf("dry run: %+v", report)
+	}
+	if _, err := store.GetDocument("alice", "doc1"); err != ErrNotFound {
+		t.Errorf("progress stored by a dry run: %v", err)
+	}
+
+	report = importTestClippings(t, router, "")
+	imported := map[string]int{}
+	for _, progress := range report.Imported {
+		imported[progress.DocumentId] = progress.Page
+	}
+	if len(imported) != 2 || imported["doc1"] != 40 || imported["doc2"] != 5 {
+		t.Errorf("imported: %+v", report.Imported)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0] != "Persuasion" {
+		t.Errorf("skipped: %+v", report.Skipped)
+	}
+	if len(report.Unmatched) != 1 || report.Unmatched[0] != "Unknown Book" {
+		t.Errorf("unmatched: %+v", report.Unmatched)
+	}
+
+	w := testRequest(router, http.MethodGet, "/syncs/progress/doc1", "", "alice", "pw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("imported progress: %d %s", w.Code, w.Body)
+	}
+	var document Document
+	decodeTestResponse(t, w, &document)
+	if document.Progress.inner != "40" || document.Device != "Kindle" || document.Timestamp != 1583269200 {
+		t.Errorf("imported progress: %+v", document)
+	}
+
+	if w := testRequest(router, http.MethodPost, "/syncs/import/nook", testKindleClippings, "alice", "pw"); w.Code != InvalidRequest.Status {
+		t.Errorf("unknown source: %d %s", w.Code, w.Body)
+	}
+}
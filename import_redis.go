@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cupcake/rdb"
+	"github.com/cupcake/rdb/nopdecoder"
+)
+
+// importRedisCommand copies the users and documents of an original koreader-sync-server
+// from its Redis database, or from an RDB dump of it, into the configured store.
+func importRedisCommand(args []string) error {
+	flags := flag.NewFlagSet("import-redis", flag.ExitOnError)
+	mode := flags.String("mode", "merge", "merge or replace, see the import command")
+	db := flags.Int("db", -1, "Only read this database of an RDB dump, all of them when -1")
+	flags.Parse(args)
+	if flags.NArg() != 1 || (*mode != "merge" && *mode != "replace") {
+		return fmt.Errorf("usage: kosyncsrv import-redis [-mode merge|replace] [-db n] <redis://host/db | dump.rdb>")
+	}
+
+	var dump DatabaseDump
+	var err error
+	if source, parseErr := url.Parse(flags.Arg(0)); parseErr == nil && strings.HasPrefix(source.Scheme, "redis") {
+		dump, err = dumpRedis(flags.Arg(0))
+	} else {
+		dump, err = dumpRDB(flags.Arg(0), *db)
+	}
+	if err != nil {
+		return err
+	}
+	return importDump(dump, *mode == "replace")
+}
+
+// dumpRedis reads a live Redis database through the redis backend, which uses the same key layout
+func dumpRedis(url string) (DatabaseDump, error) {
+	source, err := openRedisStore(url)
+	if err != nil {
+		return DatabaseDump{}, err
+	}
+	defer source.Close()
+	users, err := source.GetUsers()
+	if err != nil {
+		return DatabaseDump{}, err
+	}
+	var dump DatabaseDump
+	for _, user := range users {
+		documents, err := source.GetDocuments(user.Username)
+		if err != nil {
+			return DatabaseDump{}, err
+		}
+		dump.Users = append(dump.Users, UserDump{Username: user.Username, Password: user.Password, Documents: documents})
+	}
+	return dump, nil
+}
+
+// rdbDecoder collects the user:<name>:key strings and user:<name>:document:<id> hashes of an RDB file
+type rdbDecoder struct {
+	nopdecoder.NopDecoder
+	db        int
+	current   int
+	passwords map[string]string
+	documents map[string]map[string]map[string]string // username -> documentid -> hash fields
+}
+
+func (d *rdbDecoder) StartDatabase(n int) {
+	d.current = n
+}
+
+func (d *rdbDecoder) Set(key, value []byte, expiry int64) {
+	if d.db >= 0 && d.current != d.db {
+		return
+	}
+	username, rest, ok := splitRedisUserKey(string(key))
+	if ok && rest == "key" {
+		d.passwords[username] = string(value)
+	}
+}
+
+func (d *rdbDecoder) Hset(key, field, value []byte) {
+	if d.db >= 0 && d.current != d.db {
+		return
+	}
+	username, rest, ok := splitRedisUserKey(string(key))
+	if !ok || !strings.HasPrefix(rest, "document:") {
+		return
+	}
+	documentId := strings.TrimPrefix(rest, "document:")
+	if d.documents[username] == nil {
+		d.documents[username] = map[string]map[string]string{}
+	}
+	if d.documents[username][documentId] == nil {
+		d.documents[username][documentId] = map[string]string{}
+	}
+	d.documents[username][documentId][string(field)] = string(value)
+}
+
+// splitRedisUserKey splits user:<name>:<rest>; usernames never contain ':'
+func splitRedisUserKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 || parts[0] != "user" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func dumpRDB(path string, db int) (DatabaseDump, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return DatabaseDump{}, err
+	}
+	defer file.Close()
+	decoder := &rdbDecoder{
+		db:        db,
+		passwords: map[string]string{},
+		documents: map[string]map[string]map[string]string{},
+	}
+	if err := rdb.Decode(file, decoder); err != nil {
+		// Only RDB versions up to 7 (Redis 3.2) can be parsed
+		return DatabaseDump{}, fmt.Errorf("reading %s: %w; for dumps of newer Redis versions, "+
+			"load the dump into a redis-server and import from its URL instead", path, err)
+	}
+
+	var dump DatabaseDump
+	for username, password := range decoder.passwords {
+		user := UserDump{Username: username, Password: password, Documents: []Document{}}
+		for documentId, fields := range decoder.documents[username] {
+			dbDocument := redisDocumentFromFields(fields)
+			dbDocument.Username = username
+			dbDocument.DocumentID = documentId
+			user.Documents = append(user.Documents, dbDocument.toDocument())
+		}
+		dump.Users = append(dump.Users, user)
+	}
+	sort.Slice(dump.Users, func(i, j int) bool {
+		return dump.Users[i].Username < dump.Users[j].Username
+	})
+	return dump, nil
+}
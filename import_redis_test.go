@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cupcake/rdb"
+)
+
+// originalProgress are the fields of a document hash of the original koreader-sync-server
+var originalProgress = map[string]string{
+	"percentage": "0.42",
+	"progress":   "/body/DocFragment[12]/body/p[3]",
+	"device":     "kobo",
+	"device_id":  "K1",
+	"timestamp":  "1600000000",
+}
+
+// checkImportedProgress checks alice's progress of doc1 through the API
+func checkImportedProgress(t *testing.T, router http.Handler) {
+	t.Helper()
+	w := testRequest(router, http.MethodGet, "/syncs/progress/doc1", "", "alice", "pw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("imported progress: %d %s", w.Code, w.Body)
+	}
+	var document Document
+	decodeTestResponse(t, w, &document)
+	if document.Percentage != 0.42 || document.Device != "kobo" || document.Timestamp != 1600000000 {
+		t.Errorf("imported progress: %+v", document)
+	}
+}
+
+func TestImportRedis(t *testing.T) {
+	server := startTestRedis(t)
+	server.Set("user:alice:key", "pw")
+	for field, value := range originalProgress {
+		server.HSet("user:alice:document:doc1", field, value)
+	}
+	router := newTestRouter(t)
+	if err := importRedisCommand([]string{"redis://" + server.Addr()}); err != nil {
+		t.Fatal(err)
+	}
+	checkImportedProgress(t, router)
+}
+
+// writeTestRDB writes alice's account and progress to database 0 of an RDB dump, and bob's account to database 1
+func writeTestRDB(t *testing.T, path string) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	encoder := rdb.NewEncoder(file)
+	check := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(encoder.EncodeHeader())
+	check(encoder.EncodeDatabase(0))
+	check(encoder.EncodeType(rdb.TypeString))
+	check(encoder.EncodeString([]byte("user:alice:key")))
+	check(encoder.EncodeString([]byte("pw")))
+	check(encoder.EncodeType(rdb.TypeHash))
+	check(encoder.EncodeString([]byte("user:alice:document:doc1")))
+	check(encoder.EncodeLength(uint32(len(originalProgress))))
+	for field, value := range originalProgress {
+		check(encoder.EncodeString([]byte(field)))
+		check(encoder.EncodeString([]byte(value)))
+	}
+	check(encoder.EncodeDatabase(1))
+	check(encoder.EncodeType(rdb.TypeString))
+	check(encoder.EncodeString([]byte("user:bob:key")))
+	check(encoder.EncodeString([]byte("pw")))
+	check(encoder.EncodeFooter())
+}
+
+func TestImportRDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	writeTestRDB(t, path)
+	router := newTestRouter(t)
+	if err := importRedisCommand([]string{"-db", "0", path}); err != nil {
+		t.Fatal(err)
+	}
+	checkImportedProgress(t, router)
+	if _, err := store.GetUser("bob"); err != ErrNotFound {
+		t.Errorf("user of another database imported: %v", err)
+	}
+
+	if err := importRedisCommand([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUser("bob"); err != nil {
+		t.Errorf("user of database 1 without -db: %v", err)
+	}
+}
+
+func TestImportRDBOfNewerRedis(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := os.WriteFile(path, []byte("REDIS0011\xfa\x09redis-ver\x057.2.4"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newTestRouter(t)
+	if err := importRedisCommand([]string{path}); err == nil {
+		t.Error("an RDB version 11 dump is read")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sqlImportPreset holds the queries reading another server's schema. The users query returns
+// username and password, the documents query username, document, progress, percentage,
+// device, device_id and timestamp.
+type sqlImportPreset struct {
+	users     string
+	documents string
+}
+
+// sqlImportPresets are the SQL schemas of other sync servers. The original koreader-sync-server keeps its
+// data in Redis, see import-redis, and kosync-dotnet in LiteDB, so koreader-sync is the only SQL one.
+var sqlImportPresets = map[string]sqlImportPreset{
+	// koreader-sync and kosyncsrv releases before schema versioning share this schema
+	"koreader-sync": {
+		users: `SELECT username, password FROM "user"`,
+		documents: `SELECT username, documentid AS document, progress, percentage, device, device_id, timestamp
+			FROM "document"`,
+	},
+}
+
+type importedUser struct {
+	Username string         `db:"username"`
+	Password sql.NullString `db:"password"`
+}
+
+type importedDocument struct {
+	Username   string          `db:"username"`
+	Document   string          `db:"document"`
+	Progress   sql.NullString  `db:"progress"`
+	Percentage sql.NullFloat64 `db:"percentage"`
+	Device     sql.NullString  `db:"device"`
+	DeviceId   sql.NullString  `db:"device_id"`
+	Timestamp  sql.NullInt64   `db:"timestamp"`
+}
+
+// importSQLCommand imports the users and documents of a koreader-sync or older kosyncsrv database.
+// Other SQL schemas can be read by passing the two queries.
+func importSQLCommand(args []string) error {
+	flags := flag.NewFlagSet("import-sql", flag.ExitOnError)
+	driver := flags.String("driver", "sqlite3", "Driver of the source database: sqlite3, postgres or mysql")
+	dsn := flags.String("dsn", "", "Source database, a file name for sqlite3")
+	preset := flags.String("preset", "koreader-sync", "Schema of the source database, koreader-sync for koreader-sync and older kosyncsrv releases; use the queries for others")
+	usersQuery := flags.String("users-query", "", "Query returning username, password; overrides the preset")
+	documentsQuery := flags.String("documents-query", "",
+		"Query returning username, document, progress, percentage, device, device_id, timestamp; overrides the preset")
+	mode := flags.String("mode", "merge", "merge or replace, see the import command")
+	flags.Parse(args)
+	queries, ok := sqlImportPresets[*preset]
+	if *dsn == "" || !ok || (*mode != "merge" && *mode != "replace") {
+		return fmt.Errorf("usage: kosyncsrv import-sql [-driver sqlite3|postgres|mysql] -dsn <source> [-preset koreader-sync] [-mode merge|replace]")
+	}
+	if *usersQuery != "" {
+		queries.users = *usersQuery
+	}
+	if *documentsQuery != "" {
+		queries.documents = *documentsQuery
+	}
+
+	driverName, source := *driver, *dsn
+	switch *driver {
+	case "sqlite3":
+		driverName = sqliteDriver
+	case "postgres":
+	case "mysql":
+		var err error
+		if source, err = mysqlDSN(source); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown database driver %q", *driver)
+	}
+	db, err := sqlx.Connect(driverName, source)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dump, err := dumpSQL(db, queries)
+	if err != nil {
+		return err
+	}
+	return importDump(dump, *mode == "replace")
+}
+
+func dumpSQL(db *sqlx.DB, queries sqlImportPreset) (DatabaseDump, error) {
+	var users []importedUser
+	if err := db.Select(&users, queries.users); err != nil {
+		return DatabaseDump{}, fmt.Errorf("reading users: %w", err)
+	}
+	var documents []importedDocument
+	if err := db.Select(&documents, queries.documents); err != nil {
+		return DatabaseDump{}, fmt.Errorf("reading documents: %w", err)
+	}
+
+	userDocuments := map[string][]Document{}
+	for _, document := range documents {
+		if !document.Progress.Valid {
+			log.Printf("Skipping document %q of %s without progress", document.Document, document.Username)
+			continue
+		}
+		userDocuments[document.Username] = append(userDocuments[document.Username], Document{
+			DocumentId: document.Document,
+			Progress:   &StringOrInt{inner: document.Progress.String},
+			Percentage: document.Percentage.Float64,
+			Device:     document.Device.String,
+			DeviceId:   document.DeviceId.String,
+			Timestamp:  document.Timestamp.Int64,
+		})
+	}
+	var dump DatabaseDump
+	for _, user := range users {
+		dump.Users = append(dump.Users, UserDump{
+			Username:  user.Username,
+			Password:  user.Password.String,
+			Documents: userDocuments[user.Username],
+		})
+	}
+	return dump, nil
+}
@@ -0,0 +1,70 @@
+//go:build cgo || modernc
+// +build cgo modernc
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// writeTestSQLite creates a SQLite database running statements
+func writeTestSQLite(t *testing.T, statements ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "source.db")
+	db, err := sqlx.Connect(sqliteDriver, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return path
+}
+
+func TestImportSQL(t *testing.T) {
+	path := writeTestSQLite(t,
+		`CREATE TABLE "user" (username TEXT PRIMARY KEY, password TEXT)`,
+		`CREATE TABLE "document" (username TEXT, documentid TEXT, progress TEXT, percentage REAL,
+			device TEXT, device_id TEXT, timestamp INTEGER)`,
+		`INSERT INTO "user" VALUES ('alice', 'pw')`,
+		`INSERT INTO "document" VALUES ('alice', 'doc1', '/body/DocFragment[12]/body/p[3]', 0.42, 'kobo', 'K1', 1600000000)`,
+		`INSERT INTO "document" VALUES ('alice', 'doc2', NULL, 0.1, 'kobo', 'K1', 1600000000)`,
+	)
+	router := newTestRouter(t)
+	if err := importSQLCommand([]string{"-dsn", path}); err != nil {
+		t.Fatal(err)
+	}
+	checkImportedProgress(t, router)
+	if _, err := store.GetDocument("alice", "doc2"); err != ErrNotFound {
+		t.Errorf("document without progress imported: %v", err)
+	}
+}
+
+func TestImportSQLQueries(t *testing.T) {
+	path := writeTestSQLite(t,
+		`CREATE TABLE accounts (name TEXT, key TEXT)`,
+		`CREATE TABLE positions (owner TEXT, book TEXT, xpointer TEXT, pct REAL, reader TEXT, updated INTEGER)`,
+		`INSERT INTO accounts VALUES ('alice', 'pw')`,
+		`INSERT INTO positions VALUES ('alice', 'doc1', '/body/p[3]', 0.42, 'kobo', 1600000000)`,
+	)
+	router := newTestRouter(t)
+	err := importSQLCommand([]string{"-dsn", path,
+		"-users-query", "SELECT name AS username, key AS password FROM accounts",
+		"-documents-query", `SELECT owner AS username, book AS document, xpointer AS progress, pct AS percentage,
+			reader AS device, reader AS device_id, updated AS timestamp FROM positions`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImportedProgress(t, router)
+
+	if err := importSQLCommand([]string{"-dsn", path}); err == nil {
+		t.Error("the koreader-sync preset reads another schema")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Journal operations
+const (
+	JournalRegister   = "register"
+	JournalPassword   = "password"
+	JournalDeleteUser = "delete_user"
+	JournalProgress   = "progress"
+	// JournalDeleteDocument entries carry a document with just its id
+	JournalDeleteDocument = "delete_document"
+	// JournalDeleteDevice entries carry a document with just the device_id
+	JournalDeleteDevice = "delete_device"
+)
+
+// JournalEntry is one line of the journal. It holds password keys, so the file is created with mode 0600.
+type JournalEntry struct {
+	Time     int64     `json:"time"`
+	Op       string    `json:"op"`
+	User     string    `json:"user"`
+	Password string    `json:"password,omitempty"`
+	Document *Document `json:"document,omitempty"`
+}
+
+// Journal appends every accepted change as a JSON line to a file outside the database,
+// so the database can be rebuilt from a backup plus the journal, and the sync traffic audited.
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// journal is nil unless -journal is set; Record is a no-op then
+var journal *Journal
+
+func openJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file}, nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// Record appends the entry and syncs it to disk. The change has already been stored, so
+// a failure is only logged instead of failing the request.
+func (j *Journal) Record(entry JournalEntry) {
+	if j == nil {
+		return
+	}
+	entry.Time = time.Now().Unix()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Journal:", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		log.Println("Journal:", err)
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		log.Println("Journal:", err)
+	}
+}
+
+// userJournal returns the entries of the user in the -journal file, without password keys,
+// none without a journal
+func userJournal(username string) ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	if journal == nil {
+		return entries, nil
+	}
+	file, err := os.Open(journal.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		// A line still being written is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.User != username {
+			continue
+		}
+		entry.Password = ""
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// replayJournalCommand applies a journal to the store. Progress entries only overwrite older progress,
+// so a journal can be replayed on top of a backup that already contains part of it.
+func replayJournalCommand(args []string) error {
+	flags := flag.NewFlagSet("replay-journal", flag.ExitOnError)
+	since := flags.Int64("since", 0, "Skip entries recorded before this unix time, e.g. the time of the backup")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: kosyncsrv replay-journal [-since unixtime] <file>")
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var applied, skipped int
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if entry.Time < *since {
+			continue
+		}
+		ok, err := replayJournalEntry(entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if ok {
+			applied++
+		} else {
+			skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("Applied %d journal entries, skipped %d\n", applied, skipped)
+	return nil
+}
+
+func replayJournalEntry(entry JournalEntry) (bool, error) {
+	switch entry.Op {
+	case JournalRegister:
+		err := store.AddUser(entry.User, entry.Password)
+		if err == ErrAlreadyExists {
+			return false, store.UpdateUserPassword(entry.User, entry.Password)
+		}
+		return err == nil, err
+	case JournalPassword:
+		err := store.UpdateUserPassword(entry.User, entry.Password)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	case JournalDeleteUser:
+		err := store.DeleteUser(entry.User)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	case JournalProgress:
+		if entry.Document == nil || !validImportedDocument(*entry.Document) {
+			return false, nil
+		}
+		if _, err := store.GetUser(entry.User); err == ErrNotFound {
+			return false, nil
+		}
+		return importDocument(entry.User, *entry.Document)
+	case JournalDeleteDocument:
+		if entry.Document == nil {
+			return false, nil
+		}
+		err := store.DeleteDocument(entry.User, entry.Document.DocumentId)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	case JournalDeleteDevice:
+		if entry.Document == nil {
+			return false, nil
+		}
+		deleted, err := store.DeleteDeviceDocuments(entry.User, entry.Document.DeviceId)
+		return deleted > 0, err
+	default:
+		return false, fmt.Errorf("unknown journal operation %q", entry.Op)
+	}
+}
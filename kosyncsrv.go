@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/robfig/cron/v3"
 )
 
 type User struct {
@@ -31,6 +37,18 @@ type Document struct {
 	Percentage float64      `json:"percentage"`
 	DeviceId   string       `json:"device_id"`
 	Timestamp  int64        `json:"timestamp"`
+	// The fields of v2, see mediatype.go. An update without them keeps the stored note, status and metadata.
+	Note     *string           `json:"note,omitempty"`
+	Status   string            `json:"status,omitempty"`
+	Metadata *ProgressMetadata `json:"metadata,omitempty"`
+	// Position is stored with the progress of the device, see position.go
+	Position *Position `json:"position,omitempty"`
+	// TimestampMs is the timestamp in milliseconds with -timestamp-precision ms, v2 only
+	TimestampMs int64 `json:"timestamp_ms,omitempty"`
+	// Devices are the last positions of each device on the document, sent with ?devices=1 in v2
+	Devices []DevicePosition `json:"devices,omitempty"`
+	// Deleted marks the tombstone of a deleted document in a delta sync, see listProgress
+	Deleted bool `json:"deleted,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -51,86 +69,372 @@ var (
 	UsernameAlreadyRegistered = ErrorResponse{http.StatusForbidden, 2002, "Username is already registered."}
 	InvalidRequest            = ErrorResponse{http.StatusForbidden, 2003, "Invalid Request"}
 	DocumentIdNotProvided     = ErrorResponse{http.StatusForbidden, 2004, "Field 'document' not provided."}
+	InsufficientScope         = ErrorResponse{http.StatusForbidden, 2005, "Insufficient scope for this request."}
+	InvalidScope              = ErrorResponse{http.StatusBadRequest, 2006, "Unknown or non-grantable scope."}
+	APIKeyAlreadyExists       = ErrorResponse{http.StatusForbidden, 2007, "An API key with this name already exists."}
+	APIKeyNotFound            = ErrorResponse{http.StatusNotFound, 2008, "API key not found."}
+	AdminOnly                 = ErrorResponse{http.StatusForbidden, 2009, "This request is restricted to administrators."}
+	BackupUnavailable         = ErrorResponse{http.StatusNotImplemented, 2010, "Backups are not available with this configuration."}
+	MaintenanceUnavailable    = ErrorResponse{http.StatusNotImplemented, 2011, "The database backend needs no maintenance."}
+	DocumentMetadataNotFound  = ErrorResponse{http.StatusNotFound, 2012, "No metadata for this document."}
+	UserNotFound              = ErrorResponse{http.StatusNotFound, 2013, "User not found."}
+	TenantNotFound            = ErrorResponse{http.StatusNotFound, 2014, "Unknown tenant."}
+	RegistrationDisabled      = ErrorResponse{http.StatusForbidden, 2015, "Registration is disabled."}
+	QuotaExceeded             = ErrorResponse{http.StatusForbidden, 2016, "Quota exceeded."}
+	CheckUnavailable          = ErrorResponse{http.StatusNotImplemented, 2017, "The database backend has no integrity check."}
+	DocumentNotFound          = ErrorResponse{http.StatusNotFound, 2018, "No progress for this document."}
+	NoPreviousProgress        = ErrorResponse{http.StatusNotFound, 2019, "No earlier position in the history of this document."}
+	StaleProgress             = ErrorResponse{http.StatusConflict, 2020, "A newer position of this document is already stored."}
+	WebhooksDisabled          = ErrorResponse{http.StatusForbidden, 2021, "Webhooks are disabled on this server."}
+	WebhookAlreadyExists      = ErrorResponse{http.StatusForbidden, 2022, "A webhook with this name already exists."}
+	WebhookNotFound           = ErrorResponse{http.StatusNotFound, 2023, "Webhook not found."}
+	WebhookLimitReached       = ErrorResponse{http.StatusForbidden, 2024, "Too many webhooks."}
+	StatisticsNotFound        = ErrorResponse{http.StatusNotFound, 2025, "No reading statistics for this document."}
+	AnnotationsNotFound       = ErrorResponse{http.StatusNotFound, 2026, "No annotations for this document."}
+	AnnotationNotFound        = ErrorResponse{http.StatusNotFound, 2027, "Annotation not found."}
+	BookmarkNotFound          = ErrorResponse{http.StatusNotFound, 2028, "Bookmark not found."}
+	WordNotFound              = ErrorResponse{http.StatusNotFound, 2029, "Word not found."}
+	CollectionNotFound        = ErrorResponse{http.StatusNotFound, 2030, "Collection not found."}
+	SettingNotFound           = ErrorResponse{http.StatusNotFound, 2031, "Setting not found."}
+	AliasNotFound             = ErrorResponse{http.StatusNotFound, 2032, "Alias not found."}
+	DeviceNotFound            = ErrorResponse{http.StatusNotFound, 2033, "Device not found."}
+	StatusNotFound            = ErrorResponse{http.StatusNotFound, 2034, "No status for this document."}
+	UnsupportedEncoding       = ErrorResponse{http.StatusUnsupportedMediaType, 2035, "Unsupported Content-Encoding."}
+	SlotNotFound              = ErrorResponse{http.StatusNotFound, 2036, "No such progress slot for this document."}
+	GroupNotFound             = ErrorResponse{http.StatusNotFound, 2037, "Reading group not found."}
+	GroupOwnerOnly            = ErrorResponse{http.StatusForbidden, 2038, "Only the owner of the reading group can do this."}
+	ShareLinkNotFound         = ErrorResponse{http.StatusNotFound, 2039, "Share link not found."}
+	InvalidConfirmation       = ErrorResponse{http.StatusForbidden, 2040, "Invalid or expired confirmation token."}
+	IdempotencyKeyReused      = ErrorResponse{http.StatusUnprocessableEntity, 2041, "The Idempotency-Key was used for a different request."}
+	IdempotencyKeyInUse       = ErrorResponse{http.StatusConflict, 2042, "A request with this Idempotency-Key is still being processed."}
+	ProgressModified          = ErrorResponse{http.StatusPreconditionFailed, 2043, "The progress of this document changed since."}
+	TooManyRequests           = ErrorResponse{http.StatusTooManyRequests, 2044, "Too many requests, retry later."}
+	DevicesUnavailable        = ErrorResponse{http.StatusNotImplemented, 2045, "The database backend keeps no progress per device."}
 )
 
+// errorResponses are the errors of the API, for the OpenAPI document
+var errorResponses = []*ErrorResponse{
+	&InvalidHeader, &InvalidAcceptHeader, &UnknownServerError, &Unauthorized, &UsernameAlreadyRegistered,
+	&InvalidRequest, &DocumentIdNotProvided, &InsufficientScope, &InvalidScope, &APIKeyAlreadyExists,
+	&APIKeyNotFound, &AdminOnly, &BackupUnavailable, &MaintenanceUnavailable, &DocumentMetadataNotFound,
+	&UserNotFound, &TenantNotFound, &RegistrationDisabled, &QuotaExceeded, &CheckUnavailable, &DocumentNotFound,
+	&NoPreviousProgress, &StaleProgress, &WebhooksDisabled, &WebhookAlreadyExists, &WebhookNotFound,
+	&WebhookLimitReached, &StatisticsNotFound, &AnnotationsNotFound, &AnnotationNotFound, &BookmarkNotFound,
+	&WordNotFound, &CollectionNotFound, &SettingNotFound, &AliasNotFound, &DeviceNotFound, &StatusNotFound,
+	&UnsupportedEncoding, &SlotNotFound, &GroupNotFound, &GroupOwnerOnly, &ShareLinkNotFound,
+	&InvalidConfirmation, &IdempotencyKeyReused, &IdempotencyKeyInUse,
+	&ProgressModified, &TooManyRequests, &DevicesUnavailable,
+}
+
 // StringOrInt Depending on whether the document has pages, KOReader may send progress as a string or int.
 // This is a helper type to facilitate marshalling and unmarshalling.
+// inner is the progress as a string. raw keeps the JSON value as it was sent unless it's just inner
+// quoted, e.g. a number or a structured position, so the progress is returned byte-identical.
 type StringOrInt struct {
 	inner string
+	raw   string
 }
 
+// maxProgressRawLength bounds the JSON value of the progress as stored
+const maxProgressRawLength = 1024
+
 func (s *StringOrInt) MarshalJSON() ([]byte, error) {
+	if s.raw != "" {
+		return []byte(s.raw), nil
+	}
 	return json.Marshal(s.inner)
 }
 
 func (s *StringOrInt) UnmarshalJSON(b []byte) error {
-	var i int
-	err := json.Unmarshal(b, &i)
-	if err == nil {
-		*s = StringOrInt{strconv.Itoa(i)}
-		return nil
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
 	}
-
-	var ss string
-	err = json.Unmarshal(b, &ss)
-	if err == nil {
-		*s = StringOrInt{ss}
-		return nil
+	var inner string
+	switch value := value.(type) {
+	case string:
+		inner = value
+	case json.Number:
+		inner = value.String()
+	case map[string]interface{}, []interface{}:
+		inner = string(b)
+	default:
+		return errors.New("progress must be a string, a number, an object or an array")
 	}
-
-	return err
+	*s = StringOrInt{inner: inner}
+	if quoted, _ := json.Marshal(inner); !bytes.Equal(quoted, b) {
+		s.raw = string(b)
+	}
+	return nil
 }
 
 func validKeyField(field string) bool {
 	return len(field) > 0 && !strings.Contains(field, ":")
 }
 
+// validPercentage checks the reading progress is a fraction between 0 and 1, which the
+// SQL schemas enforce as well. The value is stored as a double and returned exactly as sent.
+func validPercentage(percentage float64) bool {
+	return percentage >= 0 && percentage <= 1
+}
+
+// clampPercentage brings a percentage outside 0-1 into range with -out-of-range-percentage clamp,
+// e.g. the 1.0000001 of a client rounding badly. Otherwise, and for NaN, it's returned unchanged.
+func clampPercentage(percentage float64) float64 {
+	if config.OutOfRangePercentage != "clamp" {
+		return percentage
+	}
+	if percentage < 0 {
+		return 0
+	}
+	if percentage > 1 {
+		return 1
+	}
+	return percentage
+}
+
 func register(c *gin.Context) {
 	var user User
-	if err := c.ShouldBindJSON(&user); err != nil {
+	if err := bindBody(c, &user); err != nil {
 		c.Error(&InvalidRequest)
 		return
 	}
 
-	if user.Username == "" || user.Password == "" {
+	if !validKeyField(user.Username) || user.Password == "" {
 		c.Error(&InvalidRequest)
 		return
 	}
-	if !addDBUser(user.Username, user.Password) {
+	if err := checkRegistration(c); err != nil {
+		c.Error(err)
+		return
+	}
+	username := tenantUsername(c, normalizeUsername(user.Username))
+	if _, err := lookupUser(username); config.CaseInsensitiveUsernames && err != ErrNotFound {
 		c.Error(&UsernameAlreadyRegistered)
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{
-		"username": user.Username,
+	if err := store.AddUser(username, user.Password); err != nil {
+		c.Error(&UsernameAlreadyRegistered)
+		return
+	}
+	journal.Record(JournalEntry{Op: JournalRegister, User: username, Password: user.Password})
+	respond(c, http.StatusCreated, gin.H{
+		"username": displayUsername(username),
 	})
 }
 
+type PasswordChange struct {
+	Password   string `json:"password"`
+	RevokeKeys bool   `json:"revoke_keys"`
+}
+
+func changePassword(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request PasswordChange
+	if err := bindBody(c, &request); err != nil || request.Password == "" {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if err := store.UpdateUserPassword(username, request.Password); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	journal.Record(JournalEntry{Op: JournalPassword, User: username, Password: request.Password})
+	var revoked int64
+	if request.RevokeKeys {
+		var err error
+		if revoked, err = store.DeleteAPIKeys(username); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	respond(c, http.StatusOK, gin.H{
+		"username":     displayUsername(username),
+		"revoked_keys": revoked,
+	})
+}
+
+func deleteAccount(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	if err := store.DeleteUser(username); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	journal.Record(JournalEntry{Op: JournalDeleteUser, User: username})
+	c.Status(http.StatusNoContent)
+}
+
 func authorize(c *gin.Context) {
-	c.JSON(200, gin.H{
+	respond(c, http.StatusOK, gin.H{
 		"authorized": "OK",
 	})
 }
 
+// Account is the authenticated account as returned by GET /users/me
+type Account struct {
+	Username  string    `json:"username"`
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt int64     `json:"created_at"`
+	Documents int       `json:"documents"`
+	Scopes    []string  `json:"scopes"`
+	LastSync  *LastSync `json:"last_sync,omitempty"`
+}
+
+// LastSync is the device and document of the progress synced last
+type LastSync struct {
+	Device     string `json:"device"`
+	DeviceId   string `json:"device_id"`
+	DocumentId string `json:"document"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// whoami answers with the account the credentials belong to, so clients can verify their setup
+func whoami(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	user, err := store.GetUser(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	account := Account{
+		Username:  displayUsername(username),
+		Tenant:    usernameTenant(username),
+		CreatedAt: user.CreatedAt,
+		Scopes:    c.GetStringSlice("scopes"),
+	}
+	ids := map[string]bool{}
+	for _, document := range documents {
+		ids[document.DocumentId] = true
+	}
+	account.Documents = len(ids)
+	// Newest first
+	if len(documents) > 0 {
+		account.LastSync = &LastSync{documents[0].Device, documents[0].DeviceId, documents[0].DocumentId, documents[0].Timestamp}
+	}
+	respond(c, http.StatusOK, account)
+}
+
 func getProgress(c *gin.Context) {
-	username := c.MustGet("header").(Header).AuthUser
+	username := c.MustGet("username").(string)
 	var requestDocument Document
 	if err := c.ShouldBindUri(&requestDocument); err != nil {
 		c.Error(&UnknownServerError)
 		return
 	}
-	document, err := getDBDocument(username, requestDocument.DocumentId)
+	canonical := canonicalDocument(username, requestDocument.DocumentId)
+	document, ok := findProgress(username, canonical, requestDeviceId(c))
+	if !ok {
+		progressNotFound(c)
+		return
+	}
+	extendProgress(c, username, canonical, &document)
+	if withDevices, _ := strconv.ParseBool(c.Query("devices")); withDevices && apiVersion(c) >= 2 {
+		devices, err := devicePositions(username, canonical)
+		if err == ErrDevicesUnsupported {
+			c.Error(&DevicesUnavailable)
+			return
+		}
+		if err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		document.Devices = devices
+	}
+	document.DocumentId = requestDocument.DocumentId
+	writeProgress(c, document)
+}
+
+// findProgress returns the progress of the document picked by the user's conflict strategy for the
+// device asking, false when there is none
+func findProgress(username string, documentId string, deviceId string) (Document, bool) {
+	strategy := conflictStrategy(username)
+	if strategy == ConflictLatest {
+		document, err := store.GetDocument(username, documentId)
+		return document, err == nil
+	}
+	devices, err := store.GetDocumentDevices(username, documentId)
+	if err == ErrDevicesUnsupported {
+		// The only progress kept is the latest
+		document, err := store.GetDocument(username, documentId)
+		return document, err == nil
+	}
 	if err != nil {
-		c.JSON(http.StatusOK, struct{}{})
-	} else {
-		c.JSON(http.StatusOK, document)
+		return Document{}, false
 	}
+	return resolveProgress(strategy, devices, deviceId)
+}
+
+// progressNotFound answers a fetch of a document without progress. KOReader expects an empty object,
+// other sync servers answer 404, which -missing-document-404 switches to.
+func progressNotFound(c *gin.Context) {
+	if config.MissingDocument404 {
+		c.Error(&DocumentNotFound)
+		return
+	}
+	respond(c, http.StatusOK, struct{}{})
+}
+
+type ProgressBatch struct {
+	Documents []string `json:"documents"`
+}
+
+// maxBatchDocuments bounds the documents of a batch fetch
+const maxBatchDocuments = 1000
+
+// getProgressBatch returns the progress of several documents keyed by document, e.g. for a library
+// view; documents without progress are left out. All of the user's progress is read in a single query,
+// the user's conflict strategy picks among the devices of each document.
+func getProgressBatch(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var batch ProgressBatch
+	if err := bindBody(c, &batch); err != nil || len(batch.Documents) > maxBatchDocuments {
+		c.Error(&InvalidRequest)
+		return
+	}
+	// The documents asked for by their canonical documents, see aliases.go
+	wanted := map[string][]string{}
+	for _, documentId := range batch.Documents {
+		canonical := canonicalDocument(username, documentId)
+		wanted[canonical] = append(wanted[canonical], documentId)
+	}
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	// Newest first, so the devices of each document stay ordered newest first
+	devices := map[string][]Document{}
+	for _, document := range documents {
+		if len(wanted[document.DocumentId]) > 0 {
+			devices[document.DocumentId] = append(devices[document.DocumentId], document)
+		}
+	}
+	strategy := conflictStrategy(username)
+	deviceId := requestDeviceId(c)
+	progress := map[string]Document{}
+	for canonical, documentDevices := range devices {
+		resolved, _ := resolveProgress(strategy, documentDevices, deviceId)
+		extendProgress(c, username, canonical, &resolved)
+		for _, documentId := range wanted[canonical] {
+			resolved.DocumentId = documentId
+			progress[documentId] = resolved
+		}
+	}
+	respond(c, http.StatusOK, progress)
 }
 
 func updateProgress(c *gin.Context) {
-	username := c.MustGet("header").(Header).AuthUser
+	username := c.MustGet("username").(string)
 	var requestDocument Document
 
-	if err := c.ShouldBindJSON(&requestDocument); err != nil {
+	if err := bindBody(c, &requestDocument); err != nil {
 		// Semi-hacky; really should explicitly check if err is ValidationErrors and dig down in that
 		errorMessage := err.Error()
 		if strings.Contains(errorMessage, "DocumentId") && strings.Contains(errorMessage, "required") {
@@ -144,26 +448,192 @@ func updateProgress(c *gin.Context) {
 		c.Error(&DocumentIdNotProvided)
 		return
 	}
-	if requestDocument.Progress == nil || requestDocument.Device == "" {
+	dropExtendedFields(c, &requestDocument)
+	// The positions of the devices and tombstones are only answered
+	requestDocument.Devices = nil
+	requestDocument.Deleted = false
+	if requestDocument.Progress == nil || len(requestDocument.Progress.raw) > maxProgressRawLength || requestDocument.Device == "" {
 		c.Error(&InvalidRequest)
 		return
 	}
-	timestamp := updateDBDocument(username, requestDocument)
-	c.JSON(http.StatusOK, gin.H{
+	if percentage := clampPercentage(requestDocument.Percentage); percentage != requestDocument.Percentage {
+		log.Printf("Clamped the percentage %v of %s by %s", requestDocument.Percentage, requestDocument.DocumentId, username)
+		requestDocument.Percentage = percentage
+	}
+	if !validPercentage(requestDocument.Percentage) || !validNote(requestDocument.Note) ||
+		requestDocument.Status != "" && !validStatus(requestDocument.Status) ||
+		requestDocument.Metadata != nil && !validProgressMetadata(*requestDocument.Metadata) ||
+		!validPosition(requestDocument.Position) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	// Progress of an alias is stored as the canonical document's, the answer names the document sent
+	documentId := requestDocument.DocumentId
+	requestDocument.DocumentId = canonicalDocument(username, documentId)
+	if err := checkDocumentQuota(c, username, requestDocument.DocumentId); err != nil {
+		c.Error(err)
+		return
+	}
+	stale, err := staleUpdate(username, requestDocument)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if stale && config.StaleUpdates == "reject" {
+		c.Error(&StaleProgress)
+		return
+	}
+	if hasPreconditions(c) {
+		// Conditional updates are serialized so two of them can't both pass the check
+		conditionalUpdatesMu.Lock()
+		defer conditionalUpdatesMu.Unlock()
+		current, exists := findProgress(username, requestDocument.DocumentId, requestDeviceId(c))
+		if exists {
+			extendProgress(c, username, requestDocument.DocumentId, &current)
+			current.DocumentId = documentId
+		}
+		if preconditionFailed(c, current, exists) {
+			if exists {
+				c.Header("ETag", codedETag(c, progressETag(c, current)))
+				c.Header("Last-Modified", time.Unix(current.Timestamp, 0).UTC().Format(http.TimeFormat))
+			}
+			c.Error(&ProgressModified)
+			return
+		}
+	}
+	timestamp, err := store.UpdateDocument(username, requestDocument)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	requestDocument.Timestamp = timestamp
+	if requestDocument.Note != nil {
+		if err := setDocumentNote(username, requestDocument.DocumentId, *requestDocument.Note); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	if requestDocument.Status != "" {
+		if _, err := setDocumentStatus(username, requestDocument.DocumentId, requestDocument.Status); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	if requestDocument.Metadata != nil {
+		metadata := DocumentMetadata{
+			DocumentId: requestDocument.DocumentId,
+			Title:      requestDocument.Metadata.Title,
+			Author:     requestDocument.Metadata.Author,
+			Series:     requestDocument.Metadata.Series,
+			UpdatedAt:  timestamp,
+		}
+		if err := store.SetDocumentMetadata(newDbDocumentMetadata(username, metadata)); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	journal.Record(JournalEntry{Op: JournalProgress, User: username, Document: &requestDocument})
+	progressChanges.Publish(ProgressChange{username, requestDocument.DocumentId})
+	trackDevice(username, requestDocument.Device, requestDocument.DeviceId, timestamp)
+	updateFurthestSlot(username, requestDocument)
+	response := gin.H{
 		"timestamp": timestamp,
-		"document":  requestDocument.DocumentId,
+		"document":  documentId,
+	}
+	if stale {
+		response["stale"] = true
+	}
+	respond(c, http.StatusOK, response)
+}
+
+// serverTime answers with the server's clock, so clients with a drifting clock can work out their offset
+// and timestamp updates in server time, see staleUpdate
+func serverTime(c *gin.Context) {
+	now := time.Now()
+	respond(c, http.StatusOK, gin.H{
+		"timestamp":    now.Unix(),
+		"timestamp_ms": now.UnixNano() / int64(time.Millisecond),
 	})
 }
 
+// conditionalUpdatesMu serializes the progress updates with preconditions, see preconditionFailed
+var conditionalUpdatesMu sync.Mutex
+
+// staleUpdate reports whether the device timestamped the update before the stored progress was synced,
+// e.g. an offline device with a wrong clock catching up. KOReader itself doesn't send a timestamp, such
+// updates are never stale. With -stale-updates accept the stored progress isn't even looked up.
+func staleUpdate(username string, document Document) (bool, error) {
+	if config.StaleUpdates == "accept" || document.Timestamp <= 0 {
+		return false, nil
+	}
+	stored, err := store.GetDocument(username, document.DocumentId)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if document.Timestamp >= stored.Timestamp {
+		return false, nil
+	}
+	log.Printf("Stale update of %s by %s: timestamped %d, stored progress from %d", document.DocumentId, username, document.Timestamp, stored.Timestamp)
+	return true, nil
+}
+
+// deleteProgress removes the progress of a document from all devices, e.g. of a test file. The
+// deletion is kept as a tombstone so other devices learn about it; syncing the document again revives it.
+func deleteProgress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	err := deleteDocumentProgress(username, canonicalDocument(username, c.Param("document")))
+	if err == ErrNotFound {
+		c.Error(&DocumentNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// deleteDocumentProgress deletes the progress of the document on all devices with its note, status and
+// slots, leaving tombstones
+func deleteDocumentProgress(username string, documentId string) error {
+	if err := store.DeleteDocument(username, documentId); err != nil {
+		return err
+	}
+	if err := setDocumentNote(username, documentId, ""); err != nil {
+		return err
+	}
+	if err := store.DeleteRecord(username, RecordStatus, documentId); err != nil && err != ErrNotFound {
+		return err
+	}
+	if err := deleteDocumentSlots(username, documentId); err != nil {
+		return err
+	}
+	journal.Record(JournalEntry{Op: JournalDeleteDocument, User: username, Document: &Document{DocumentId: documentId}})
+	progressChanges.Publish(ProgressChange{username, documentId})
+	return nil
+}
+
 func ErrorHandler(c *gin.Context) {
 	c.Next()
 	var err *ErrorResponse
 	// This specific project only returns one error per call, so we don't need to loop through all c.Errors
 	if len(c.Errors) > 0 && errors.As(c.Errors[0].Err, &err) {
-		c.AbortWithStatusJSON(err.Status, gin.H{"code": err.Code, "message": err.Message})
+		writeError(c, err)
 	}
 }
 
+// writeError answers with the error and stops the request, for middlewares running before ErrorHandler
+func writeError(c *gin.Context, err *ErrorResponse) {
+	c.Abort()
+	respond(c, err.Status, gin.H{"code": err.Code, "message": err.Message})
+}
+
+// unversionedRoutes are fetched by browsers, which don't send the API's media types
+var unversionedRoutes = map[string]bool{"/share/:token": true, "/openapi.json": true, "/docs": true}
+
 func AcceptHeaderCheck(c *gin.Context) {
 	var header Header
 	if err := c.ShouldBindHeader(&header); err != nil {
@@ -171,7 +641,26 @@ func AcceptHeaderCheck(c *gin.Context) {
 		c.Abort()
 		return
 	}
-	if header.Accept == "application/vnd.koreader.v1+json" {
+	if version, encoding, ok := parseMediaType(header.Accept); ok {
+		c.Set("header", header)
+		c.Set("apiVersion", version)
+		c.Set("encoding", encoding)
+		// Every answer depends on the negotiated media type, so caches mustn't serve a v1 JSON answer to a
+		// v2 or binary client or the other way round. The header leaves the v1 body as it was.
+		c.Writer.Header().Add("Vary", "Accept")
+		c.Next()
+		return
+	}
+	if unversionedRoutes[c.FullPath()] {
+		c.Next()
+		return
+	}
+	if isEventStream(c) {
+		// EventSource can't send headers, so the credentials may come as ?user=&key= instead
+		if header.AuthUser == "" && header.AuthKey == "" {
+			header.AuthUser = c.Query("user")
+			header.AuthKey = c.Query("key")
+		}
 		c.Set("header", header)
 		c.Next()
 		return
@@ -180,53 +669,288 @@ func AcceptHeaderCheck(c *gin.Context) {
 	c.Abort()
 }
 
+// fromLAN reports whether the request comes directly from one of the LAN mode subnets.
+// The peer address is used rather than c.ClientIP() so forwarded headers can't be spoofed to gain access.
+func fromLAN(c *gin.Context) bool {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, subnet := range config.LANSubnet {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authFailureLog writes authentication failures in a stable format for log based tools like fail2ban,
+// see contrib/fail2ban. Keep the format in sync with the filter there. The address is the peer's, or
+// the one forwarded by a -trusted-proxies proxy.
+var authFailureLog = log.New(os.Stderr, "", 0)
+
+func logAuthFailure(c *gin.Context, username string) {
+	authFailureLog.Printf("%s kosyncsrv auth failure ip=%s user=%q",
+		time.Now().UTC().Format("2006-01-02T15:04:05Z"), c.ClientIP(), username)
+}
+
 func AuthRequired(c *gin.Context) {
 	header := c.MustGet("header").(Header)
+	_, inTenant := currentTenant(c)
+	if config.LANUser != "" && !inTenant && fromLAN(c) {
+		c.Set("username", config.LANUser)
+		c.Set("scopes", []string{ScopeAll})
+		c.Next()
+		return
+	}
 	if validKeyField(header.AuthUser) && len(header.AuthKey) > 0 {
-		user, noRows := getDBUser(header.AuthUser)
-		if !noRows && header.AuthKey == user.Password {
-			c.Set("username", header.AuthUser)
+		username := tenantUsername(c, header.AuthUser)
+		user, err := lookupUser(username)
+		if err == nil {
+			// The account's own spelling, with -case-insensitive-usernames it may differ from the header
+			username = user.Username
+		}
+		if err == nil && header.AuthKey == user.Password {
+			c.Set("username", username)
+			c.Set("scopes", []string{ScopeAll})
+			c.Next()
+			return
+		}
+		if apiKey, err := store.GetAPIKey(username, hashAPIKey(header.AuthKey)); err == nil {
+			c.Set("username", username)
+			c.Set("scopes", strings.Fields(apiKey.Scopes))
 			c.Next()
 			return
 		}
 	}
 
+	logAuthFailure(c, header.AuthUser)
 	c.Error(&Unauthorized)
 	c.Abort()
 }
 
+// syncRoutes registers the sync API on group, which is either the root or a tenant,
+// and returns the group of the routes requiring authentication
+func syncRoutes(group *gin.RouterGroup) *gin.RouterGroup {
+	group.POST("/users/create", RateLimit, register)
+	authorized := group.Group("/", RateLimit, AuthRequired, Idempotency)
+	{
+		authorized.GET("/users/auth", authorize)
+		authorized.GET("/users/me", whoami)
+		authorized.GET("/users/me/devices", RequireScope(ScopeProgressRead), listDevices)
+		authorized.PUT("/users/me/devices/:device", RequireScope(ScopeAccount), renameDevice)
+		authorized.DELETE("/users/me/devices/:device", RequireScope(ScopeAccount), deleteDevice)
+		authorized.GET("/syncs/progress", RequireScope(ScopeProgressRead), listProgress)
+		authorized.GET("/syncs/progress/:document", RequireScope(ScopeProgressRead), getProgress)
+		authorized.GET("/syncs/progress/:document/history", RequireScope(ScopeProgressRead), getProgressHistory)
+		authorized.PUT("/syncs/progress", RequireScope(ScopeProgressWrite), updateProgress)
+		authorized.POST("/syncs/progress/batch", RequireScope(ScopeProgressRead), getProgressBatch)
+		authorized.DELETE("/syncs/progress/:document", RequireScope(ScopeProgressWrite), deleteProgress)
+		authorized.POST("/syncs/wipe", RequireScope(ScopeAccount), requestWipe)
+		authorized.DELETE("/syncs/progress", RequireScope(ScopeAccount), wipeProgress)
+		authorized.GET("/syncs/progress/:document/wait", RequireScope(ScopeProgressRead), waitProgress)
+		authorized.POST("/syncs/progress/:document/undo", RequireScope(ScopeProgressWrite), undoProgress)
+		authorized.GET("/syncs/ws", RequireScope(ScopeProgressRead), progressWebSocket)
+		authorized.GET("/syncs/events", RequireScope(ScopeProgressRead), progressEvents)
+		authorized.GET("/syncs/aliases", RequireScope(ScopeProgressRead), listAliases)
+		authorized.POST("/syncs/import/:source", RequireScope(ScopeProgressWrite), importPositionsUpload)
+		authorized.PUT("/syncs/aliases/:document", RequireScope(ScopeProgressWrite), createAlias)
+		authorized.POST("/syncs/aliases", RequireScope(ScopeProgressWrite), linkFilenames)
+		authorized.DELETE("/syncs/aliases/:document", RequireScope(ScopeProgressWrite), deleteAlias)
+		authorized.GET("/syncs/slots/:document", RequireScope(ScopeProgressRead), listSlots)
+		authorized.GET("/syncs/slots/:document/:slot", RequireScope(ScopeProgressRead), getSlot)
+		authorized.PUT("/syncs/slots/:document/:slot", RequireScope(ScopeProgressWrite), updateSlot)
+		authorized.DELETE("/syncs/slots/:document/:slot", RequireScope(ScopeProgressWrite), deleteSlot)
+		authorized.GET("/syncs/shares", RequireScope(ScopeProgressRead), listShareLinks)
+		authorized.POST("/syncs/shares", RequireScope(ScopeProgressWrite), createShareLink)
+		authorized.DELETE("/syncs/shares/:id", RequireScope(ScopeProgressWrite), deleteShareLink)
+		authorized.GET("/syncs/groups", RequireScope(ScopeProgressRead), listGroups)
+		authorized.POST("/syncs/groups", RequireScope(ScopeProgressWrite), createGroup)
+		authorized.GET("/syncs/groups/:group", RequireScope(ScopeProgressRead), getGroup)
+		authorized.DELETE("/syncs/groups/:group", RequireScope(ScopeProgressWrite), deleteGroup)
+		authorized.POST("/syncs/groups/:group/members", RequireScope(ScopeProgressWrite), inviteGroupMember)
+		authorized.DELETE("/syncs/groups/:group/members/:username", RequireScope(ScopeProgressWrite), removeGroupMember)
+		authorized.POST("/syncs/groups/:group/join", RequireScope(ScopeProgressWrite), joinGroup)
+		authorized.PUT("/syncs/groups/:group/documents", RequireScope(ScopeProgressWrite), shareGroupDocuments)
+		authorized.GET("/syncs/groups/:group/progress", RequireScope(ScopeProgressRead), getGroupProgress)
+		authorized.GET("/syncs/status", RequireScope(ScopeProgressRead), listStatuses)
+		authorized.GET("/syncs/status/:document", RequireScope(ScopeProgressRead), getStatus)
+		authorized.PUT("/syncs/status/:document", RequireScope(ScopeProgressWrite), updateStatus)
+		authorized.DELETE("/syncs/status/:document", RequireScope(ScopeProgressWrite), deleteStatus)
+		authorized.GET("/syncs/metadata", RequireScope(ScopeProgressRead), listDocumentMetadata)
+		authorized.GET("/syncs/metadata/:document", RequireScope(ScopeProgressRead), getDocumentMetadata)
+		authorized.PUT("/syncs/metadata/:document", RequireScope(ScopeProgressWrite), updateDocumentMetadata)
+		authorized.DELETE("/syncs/metadata/:document", RequireScope(ScopeProgressWrite), deleteDocumentMetadata)
+		authorized.GET("/syncs/statistics", RequireScope(ScopeProgressRead), listReadingStatistics)
+		authorized.GET("/syncs/statistics/:document", RequireScope(ScopeProgressRead), getReadingStatistics)
+		authorized.PUT("/syncs/statistics/:document", RequireScope(ScopeProgressWrite), updateReadingStatistics)
+		authorized.DELETE("/syncs/statistics/:document", RequireScope(ScopeProgressWrite), deleteReadingStatistics)
+		authorized.GET("/syncs/reading-time", RequireScope(ScopeProgressRead), getReadingTime)
+		authorized.GET("/syncs/reading-time/:document", RequireScope(ScopeProgressRead), getReadingTime)
+		authorized.GET("/syncs/goals", RequireScope(ScopeProgressRead), getGoalProgress)
+		authorized.PUT("/syncs/goals", RequireScope(ScopeProgressWrite), updateGoals)
+		authorized.DELETE("/syncs/goals", RequireScope(ScopeProgressWrite), deleteGoals)
+		authorized.GET("/syncs/annotations", RequireScope(ScopeProgressRead), listAnnotations)
+		authorized.GET("/syncs/annotations/:document", RequireScope(ScopeProgressRead), getAnnotations)
+		authorized.PUT("/syncs/annotations/:document", RequireScope(ScopeProgressWrite), updateAnnotations)
+		authorized.DELETE("/syncs/annotations/:document/:id", RequireScope(ScopeProgressWrite), deleteAnnotation)
+		authorized.GET("/syncs/bookmarks/:document", RequireScope(ScopeProgressRead), listBookmarks)
+		authorized.POST("/syncs/bookmarks/:document", RequireScope(ScopeProgressWrite), createBookmark)
+		authorized.DELETE("/syncs/bookmarks/:document/:id", RequireScope(ScopeProgressWrite), deleteBookmark)
+		authorized.GET("/syncs/vocabulary", RequireScope(ScopeProgressRead), listVocabulary)
+		authorized.PUT("/syncs/vocabulary", RequireScope(ScopeProgressWrite), updateVocabulary)
+		authorized.DELETE("/syncs/vocabulary/:word", RequireScope(ScopeProgressWrite), deleteVocabularyWord)
+		authorized.GET("/syncs/collections", RequireScope(ScopeProgressRead), listCollections)
+		authorized.GET("/syncs/collections/:name", RequireScope(ScopeProgressRead), getCollection)
+		authorized.POST("/syncs/collections/:name", RequireScope(ScopeProgressWrite), updateCollection)
+		authorized.DELETE("/syncs/collections/:name", RequireScope(ScopeProgressWrite), deleteCollection)
+		authorized.GET("/syncs/settings", RequireScope(ScopeProgressRead), listSettingNamespaces)
+		authorized.GET("/syncs/settings/:namespace", RequireScope(ScopeProgressRead), listSettings)
+		authorized.GET("/syncs/settings/:namespace/:key", RequireScope(ScopeProgressRead), getSetting)
+		authorized.PUT("/syncs/settings/:namespace/:key", RequireScope(ScopeProgressWrite), updateSetting)
+		authorized.DELETE("/syncs/settings/:namespace/:key", RequireScope(ScopeProgressWrite), deleteSetting)
+		authorized.PUT("/users/password", RequireScope(ScopeAccount), changePassword)
+		authorized.GET("/users/me/export", RequireScope(ScopeAccount), exportUserData)
+		authorized.DELETE("/users/me", RequireScope(ScopeAccount), deleteAccount)
+		authorized.GET("/users/keys", RequireScope(ScopeAccount), listAPIKeys)
+		authorized.POST("/users/keys", RequireScope(ScopeAccount), createAPIKey)
+		authorized.DELETE("/users/keys/:name", RequireScope(ScopeAccount), deleteAPIKey)
+		webhooks := authorized.Group("/users/webhooks", RequireScope(ScopeAccount), WebhooksEnabled)
+		webhooks.GET("", listWebhooks)
+		webhooks.POST("", createWebhook)
+		webhooks.DELETE("/:name", deleteWebhook)
+	}
+	return authorized
+}
+
 func main() {
-	dbfile := flag.String("d", "syncdata.db", "Sqlite3 DB file name")
-	dbname = *dbfile
-	srvhost := flag.String("t", "0.0.0.0", "Server host")
-	srvport := flag.Int("p", 8080, "Server port")
-	sslswitch := flag.Bool("ssl", false, "Start with https")
-	sslc := flag.String("c", "", "SSL Certificate file")
-	sslk := flag.String("k", "", "SSL Private key file")
-	bindsrv := *srvhost + ":" + fmt.Sprint(*srvport)
-	flag.Usage = func() {
-		fmt.Println(`Usage: kosyncsrv [-h] [-t 127.0.0.1] [-p 8080] [-ssl -c "./cert.pem" -k "./cert.key"]`)
-		flag.PrintDefaults()
-	}
-	flag.Parse()
-	initDB()
-
-	router := gin.Default()
+	parseFlags()
+	var err error
+	if config.LitestreamURL != "" {
+		if err := restoreDatabase(); err != nil {
+			log.Fatalln("Restoring the database:", err)
+		}
+	}
+	if store, err = openStore(); err != nil {
+		log.Fatalln(err)
+	}
+	defer store.Close()
+	if config.SchemaVersion >= 0 {
+		log.Println("Database schema is at version", config.SchemaVersion)
+		return
+	}
+	if err := hashPlaintextAPIKeys(); err != nil {
+		log.Fatalln("Hashing the API keys:", err)
+	}
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if config.LANUser != "" {
+		if _, err := store.GetUser(config.LANUser); err != nil {
+			log.Fatalln("LAN mode user", config.LANUser, "does not exist, register it first")
+		}
+	}
+	if config.JournalFile != "" {
+		if journal, err = openJournal(config.JournalFile); err != nil {
+			log.Fatalln("Opening the journal:", err)
+		}
+		defer journal.Close()
+	}
+	if config.WebhookURL != "" || config.UserWebhooks {
+		startWebhooks()
+	}
+	scheduler := cron.New()
+	if config.BackupDir != "" {
+		if err := scheduleBackups(scheduler); err != nil {
+			log.Fatalln("Invalid -backup-schedule:", err)
+		}
+	}
+	if config.DocumentMaxAge > 0 {
+		if err := scheduleRetention(scheduler); err != nil {
+			log.Fatalln("Invalid -retention-schedule:", err)
+		}
+	}
+	if config.MaintenanceSchedule != "" {
+		if err := scheduleMaintenance(scheduler); err != nil {
+			log.Fatalln("Invalid -maintenance-schedule:", err)
+		}
+	}
+	scheduler.Start()
+	// Waits for a running backup or maintenance to finish before the database is closed
+	defer func() { <-scheduler.Stop().Done() }()
+	if config.LitestreamURL != "" {
+		replication, err := startReplication()
+		if err != nil {
+			log.Fatalln("Starting Litestream:", err)
+		}
+		defer stopReplication(replication)
+	}
+
+	if err := serve(newRouter()); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// accessLogFormatter formats requests like gin's default logger, but without the query string, which can
+// carry the credentials of server-sent events
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	path := param.Path
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor, methodColor, resetColor = param.StatusCodeColor(), param.MethodColor(), param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency - param.Latency%time.Second
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		path,
+		param.ErrorMessage,
+	)
+}
+
+// newRouter returns the routes of the server
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: accessLogFormatter}), gin.Recovery())
+	// Without trusted proxies gin would take the client address from any X-Forwarded-For header
+	if err := router.SetTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalln("Invalid -trusted-proxies:", err)
+	}
+	router.Use(Compression)
 	router.Use(ErrorHandler)
 	router.Use(AcceptHeaderCheck)
 	router.GET("/healthcheck", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"state": "OK"})
 	})
-	router.POST("/users/create", register)
-	authorized := router.Group("/", AuthRequired)
-	{
-		authorized.GET("/users/auth", authorize)
-		authorized.GET("/syncs/progress/:document", getProgress)
-		authorized.PUT("/syncs/progress", updateProgress)
+	router.GET("/time", serverTime)
+	router.GET("/share/:token", getSharedProgress)
+	router.GET("/openapi.json", serveOpenAPI(router))
+	if config.SwaggerUI {
+		router.GET("/docs", serveSwaggerUI)
+	}
+	authorized := syncRoutes(&router.RouterGroup)
+	if len(config.Tenants) > 0 {
+		syncRoutes(router.Group("/t/:tenant", TenantRequired))
 	}
-	if *sslswitch {
-		router.RunTLS(bindsrv, *sslc, *sslk)
-	} else {
-		router.Run(bindsrv)
+	admin := authorized.Group("/admin", AdminRequired)
+	{
+		admin.POST("/backup", createBackup)
+		admin.POST("/maintenance", runMaintenance)
+		admin.GET("/stats", getAdminStatistics)
+		admin.POST("/check", runCheck)
+		admin.PUT("/users/:username/metadata/:document", adminUpdateDocumentMetadata)
 	}
+	return router
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The handler tests run the routes of the server against the memory backend, with the defaults of the
+// flags. Each test starts with an empty store and may change the configuration, which is restored after it.
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Args = append(os.Args, "-db-driver", "memory")
+	parseFlags()
+	os.Exit(m.Run())
+}
+
+// newTestRouter returns the routes of the server on an empty memory store
+func newTestRouter(t *testing.T) *gin.Engine {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		store = nil
+	})
+	store = newMemoryStore()
+	return newRouter()
+}
+
+// testRequest sends a v1 request with the credentials of user and key, none when user is empty
+func testRequest(router http.Handler, method string, path string, body string, user string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Accept", mediaTypeV1)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.Header.Set("x-auth-user", user)
+		req.Header.Set("x-auth-key", key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// registerTestUser registers a user through the API, prefix is the tenant's route, e.g. /t/family
+func registerTestUser(t *testing.T, router http.Handler, prefix string, username string, password string) {
+	t.Helper()
+	w := testRequest(router, http.MethodPost, prefix+"/users/create",
+		`{"username": "`+username+`", "password": "`+password+`"}`, "", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("registering %s: %d %s", username, w.Code, w.Body)
+	}
+}
+
+// syncTestProgress stores the progress of a document through the API
+func syncTestProgress(t *testing.T, router http.Handler, prefix string, user string, key string, document string, percentage string) {
+	t.Helper()
+	w := testRequest(router, http.MethodPut, prefix+"/syncs/progress",
+		`{"document": "`+document+`", "progress": "/body/p[1]", "percentage": `+percentage+`, "device": "kobo", "device_id": "K1"}`,
+		user, key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("syncing %s: %d %s", document, w.Code, w.Body)
+	}
+}
+
+// decodeTestResponse decodes the JSON answer into value
+func decodeTestResponse(t *testing.T, w *httptest.ResponseRecorder, value interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+}
+
+func TestLANMode(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	var err error
+	config.LANUser = "alice"
+	if config.LANSubnet, err = parseSubnets("192.168.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	config.Tenants = map[string]Tenant{"family": {Name: "family", Registration: true}}
+	router = newRouter()
+
+	tests := []struct {
+		name      string
+		path      string
+		peer      string
+		forwarded string
+		status    int
+	}{
+		{"from the LAN", "/users/auth", "192.168.1.20:40000", "", http.StatusOK},
+		{"from outside", "/users/auth", "203.0.113.7:40000", "", http.StatusUnauthorized},
+		{"forwarded as from the LAN", "/users/auth", "203.0.113.7:40000", "192.168.1.20", http.StatusUnauthorized},
+		{"tenant from the LAN", "/t/family/users/auth", "192.168.1.20:40000", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.RemoteAddr = test.peer
+		req.Header.Set("Accept", mediaTypeV1)
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body, test.status)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/syncs/progress",
+		strings.NewReader(`{"document": "doc1", "progress": "3", "percentage": 0.3, "device": "kobo"}`))
+	req.RemoteAddr = "192.168.1.20:40000"
+	req.Header.Set("Accept", mediaTypeV1)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if document, err := store.GetDocument("alice", "doc1"); err != nil || document.Percentage != 0.3 {
+		t.Errorf("progress synced from the LAN wasn't stored as alice's: %+v %v", document, err)
+	}
+}
+
+func TestAccessLogOmitsQuery(t *testing.T) {
+	line := accessLogFormatter(gin.LogFormatterParams{Method: http.MethodGet, Path: "/syncs/events?user=alice&key=secret", StatusCode: http.StatusOK})
+	if strings.Contains(line, "secret") || !strings.Contains(line, `"/syncs/events"`) {
+		t.Errorf("access log line: %s", line)
+	}
+}
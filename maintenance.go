@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+// maintenanceStore is implemented by the backends that need periodic maintenance
+type maintenanceStore interface {
+	// Maintain reclaims free space and refreshes the query planner statistics
+	Maintain() (MaintenanceResult, error)
+}
+
+type MaintenanceResult struct {
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+	Reclaimed  int64 `json:"reclaimed"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+func maintainDatabase() (MaintenanceResult, bool, error) {
+	maintenanceStore, ok := store.(maintenanceStore)
+	if !ok {
+		return MaintenanceResult{}, false, nil
+	}
+	start := time.Now()
+	result, err := maintenanceStore.Maintain()
+	if err != nil {
+		return result, true, err
+	}
+	result.Reclaimed = result.SizeBefore - result.SizeAfter
+	result.DurationMs = time.Since(start).Milliseconds()
+	log.Printf("Database maintenance done in %dms, size %d -> %d bytes, %d bytes reclaimed",
+		result.DurationMs, result.SizeBefore, result.SizeAfter, result.Reclaimed)
+	return result, true, nil
+}
+
+func scheduleMaintenance(scheduler *cron.Cron) error {
+	_, err := scheduler.AddFunc(config.MaintenanceSchedule, func() {
+		if _, _, err := maintainDatabase(); err != nil {
+			log.Println("Database maintenance failed:", err)
+		}
+	})
+	return err
+}
+
+func runMaintenance(c *gin.Context) {
+	result, ok, err := maintainDatabase()
+	if !ok {
+		c.Error(&MaintenanceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("Database maintenance failed:", err)
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, result)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The media types of the API are application/vnd.koreader.v<version>+<encoding>, negotiated by the
+// Accept header. v1+json is what stock KOReader speaks and stays byte-compatible with the original sync
+// server; v2 unlocks the extended fields of the progress, and msgpack and cbor encode the requests and
+// answers in binary, see encoding.go.
+const (
+	mediaTypePrefix = "application/vnd.koreader.v"
+	mediaTypeV1     = mediaTypePrefix + "1+" + EncodingJSON
+)
+
+// parseMediaType returns the version and the encoding of a media type of the API
+func parseMediaType(mediaType string) (int, string, bool) {
+	if !strings.HasPrefix(mediaType, mediaTypePrefix) {
+		return 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(mediaType, mediaTypePrefix), "+", 2)
+	if len(parts) != 2 || !validEncoding(parts[1]) {
+		return 0, "", false
+	}
+	switch parts[0] {
+	case "1":
+		return 1, parts[1], true
+	case "2":
+		return 2, parts[1], true
+	}
+	return 0, "", false
+}
+
+// apiVersion returns the API version the request negotiated, 1 unless it asked for v2
+func apiVersion(c *gin.Context) int {
+	if version := c.GetInt("apiVersion"); version > 0 {
+		return version
+	}
+	return 1
+}
+
+// ProgressMetadata is the title, author and series sent and returned with the progress in v2
+type ProgressMetadata struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	Series string `json:"series"`
+}
+
+// extendProgress adds the v2 fields to the progress of the canonical document, v1 answers get none of them
+func extendProgress(c *gin.Context, username string, documentId string, document *Document) {
+	if apiVersion(c) < 2 {
+		dropPosition(c, document)
+		return
+	}
+	document.Note = documentNote(username, documentId)
+	document.Status = documentStatus(username, documentId)
+	if metadata, err := store.GetDocumentMetadata(username, documentId); err == nil {
+		document.Metadata = &ProgressMetadata{Title: metadata.Title, Author: metadata.Author, Series: metadata.Series}
+	}
+}
+
+// dropPosition leaves the structured position and the milliseconds of the timestamp out of answers to v1 requests
+func dropPosition(c *gin.Context, document *Document) {
+	if apiVersion(c) < 2 {
+		document.Position = nil
+		document.TimestampMs = 0
+	}
+}
+
+// dropExtendedFields ignores the v2 fields of a progress update sent as v1
+func dropExtendedFields(c *gin.Context, document *Document) {
+	if apiVersion(c) < 2 {
+		document.Note = nil
+		document.Status = ""
+		document.Metadata = nil
+		document.Position = nil
+		document.TimestampMs = 0
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestVaryAccept(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.5")
+	for _, accept := range []string{mediaTypeV1, mediaTypePrefix + "2+" + EncodingMsgpack} {
+		if vary := conditionalGet(router, accept, "", "").Header().Values("Vary"); len(vary) == 0 || vary[0] != "Accept" {
+			t.Errorf("%s: Vary %v", accept, vary)
+		}
+	}
+}
+
+func TestBinaryEncodingBeyondProgress(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	msgpack := mediaTypePrefix + "1+" + EncodingMsgpack
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, msgpackHandle).Encode(map[string]interface{}{"password": "pw2"}); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/users/password", bytes.NewReader(body))
+	req.Header.Set("Accept", msgpack)
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set("x-auth-user", "alice")
+	req.Header.Set("x-auth-key", "pw")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != msgpack {
+		t.Fatalf("changing the password in MessagePack: %d %s %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var answer map[string]interface{}
+	if err := codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(&answer); err != nil {
+		t.Errorf("answer isn't MessagePack: %v", err)
+	}
+}
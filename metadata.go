@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DocumentMetadata gives a document hash a human readable title, author and series
+// for listings and dashboards. KOReader itself never sends it.
+type DocumentMetadata struct {
+	DocumentId string `json:"document"`
+	Title      string `json:"title"`
+	Author     string `json:"author"`
+	Series     string `json:"series"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+type DbDocumentMetadata struct {
+	Username   string `db:"username"`
+	DocumentID string `db:"documentid"`
+	Title      string `db:"title"`
+	Author     string `db:"author"`
+	Series     string `db:"series"`
+	UpdatedAt  int64  `db:"updated_at"`
+}
+
+func (dbMetadata DbDocumentMetadata) toDocumentMetadata() DocumentMetadata {
+	return DocumentMetadata{
+		DocumentId: dbMetadata.DocumentID,
+		Title:      dbMetadata.Title,
+		Author:     dbMetadata.Author,
+		Series:     dbMetadata.Series,
+		UpdatedAt:  dbMetadata.UpdatedAt,
+	}
+}
+
+func newDbDocumentMetadata(username string, metadata DocumentMetadata) DbDocumentMetadata {
+	return DbDocumentMetadata{
+		Username:   username,
+		DocumentID: metadata.DocumentId,
+		Title:      metadata.Title,
+		Author:     metadata.Author,
+		Series:     metadata.Series,
+		UpdatedAt:  metadata.UpdatedAt,
+	}
+}
+
+// maxMetadataLength matches the VARCHAR(255) columns of the MySQL schema
+const maxMetadataLength = 255
+
+func validDocumentMetadata(metadata DocumentMetadata) bool {
+	return validKeyField(metadata.DocumentId) &&
+		validProgressMetadata(ProgressMetadata{Title: metadata.Title, Author: metadata.Author, Series: metadata.Series})
+}
+
+func validProgressMetadata(metadata ProgressMetadata) bool {
+	if metadata.Title == "" {
+		return false
+	}
+	for _, field := range []string{metadata.Title, metadata.Author, metadata.Series} {
+		if utf8.RuneCountInString(field) > maxMetadataLength {
+			return false
+		}
+	}
+	return true
+}
+
+func userDocumentMetadata(username string) ([]DocumentMetadata, error) {
+	dbMetadata, err := store.GetDocumentsMetadata(username)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make([]DocumentMetadata, 0, len(dbMetadata))
+	for _, m := range dbMetadata {
+		metadata = append(metadata, m.toDocumentMetadata())
+	}
+	return metadata, nil
+}
+
+// listDocumentMetadata returns the metadata ordered by ?sort=document (default), title or updated_at, see pageListing
+func listDocumentMetadata(c *gin.Context) {
+	metadata, err := userDocumentMetadata(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	orders := map[string]listingOrder{
+		"document":   func(i, j int) bool { return metadata[i].DocumentId < metadata[j].DocumentId },
+		"title":      func(i, j int) bool { return metadata[i].Title < metadata[j].Title },
+		"updated_at": func(i, j int) bool { return metadata[i].UpdatedAt < metadata[j].UpdatedAt },
+	}
+	if !sortListing(c, metadata, orders, "document", "asc") {
+		c.Error(&InvalidRequest)
+		return
+	}
+	start, end, ok := pageListing(c, len(metadata), 0)
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	respond(c, http.StatusOK, metadata[start:end])
+}
+
+func getDocumentMetadata(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	dbMetadata, err := store.GetDocumentMetadata(username, c.Param("document"))
+	if err == ErrNotFound {
+		c.Error(&DocumentMetadataNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, dbMetadata.toDocumentMetadata())
+}
+
+func updateDocumentMetadata(c *gin.Context) {
+	setDocumentMetadata(c, c.MustGet("username").(string))
+}
+
+// adminUpdateDocumentMetadata lets an administrator name the documents of any user
+func adminUpdateDocumentMetadata(c *gin.Context) {
+	user, err := lookupUser(c.Param("username"))
+	if err != nil {
+		c.Error(&UserNotFound)
+		return
+	}
+	setDocumentMetadata(c, user.Username)
+}
+
+func setDocumentMetadata(c *gin.Context, username string) {
+	var metadata DocumentMetadata
+	if err := bindBody(c, &metadata); err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	metadata.DocumentId = c.Param("document")
+	metadata.UpdatedAt = time.Now().Unix()
+	if !validDocumentMetadata(metadata) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if err := store.SetDocumentMetadata(newDbDocumentMetadata(username, metadata)); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, metadata)
+}
+
+func deleteDocumentMetadata(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	err := store.DeleteDocumentMetadata(username, c.Param("document"))
+	if err == ErrNotFound {
+		c.Error(&DocumentMetadataNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered step of a SQL backend's schema. Version n is migrations[n-1] of the dialect.
+// Statements are executed one by one since not every driver accepts several in a single Exec.
+type migration struct {
+	up   []string
+	down []string
+}
+
+var schemaVersionTable = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version  INTEGER NOT NULL PRIMARY KEY,
+	applied  BIGINT NOT NULL
+)`
+
+// cleanupConstraintViolations fixes or removes rows that would violate the NOT NULL and CHECK
+// constraints added in schema version 4. Out of range percentages are clamped, broken rows deleted.
+var cleanupConstraintViolations = []string{
+	`DELETE FROM "user" WHERE username IS NULL OR password IS NULL`,
+	`DELETE FROM "document" WHERE username IS NULL OR documentid IS NULL OR progress IS NULL OR device IS NULL
+		OR timestamp IS NULL OR timestamp <= 0`,
+	`UPDATE "document" SET percentage=0 WHERE percentage IS NULL OR percentage < 0`,
+	`UPDATE "document" SET percentage=1 WHERE percentage > 1`,
+	`UPDATE "document" SET device_id='' WHERE device_id IS NULL`,
+	`DELETE FROM "api_key" WHERE username IS NULL OR name IS NULL OR "key" IS NULL OR scopes IS NULL OR created IS NULL`,
+}
+
+// collapseDeviceDocuments keeps only the newest progress of each document, before migrating
+// down from per device progress rows. MySQL can't use the table in a subquery of its DELETE.
+var collapseDeviceDocuments = `DELETE FROM "document" WHERE EXISTS (
+	SELECT 1 FROM "document" newer WHERE newer.username=document.username AND newer.documentid=document.documentid
+		AND (newer.timestamp > document.timestamp OR (newer.timestamp = document.timestamp AND newer.device_id > document.device_id)))`
+
+// clampHistoryPercentage prepares the history for the percentage range check added in schema version 10
+var clampHistoryPercentage = `UPDATE "document_history" SET percentage=CASE WHEN percentage < 0 THEN 0 ELSE 1 END
+	WHERE percentage < 0 OR percentage > 1`
+
+func (s *sqlStore) schemaVersion() (int, error) {
+	var version int
+	err := s.db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	return version, err
+}
+
+// migrate brings the schema up or down to the target version, each step in its own transaction.
+// Note that MySQL commits DDL statements implicitly, so a failing step may be left half applied there.
+func (s *sqlStore) migrate(target int) error {
+	if _, err := s.db.Exec(schemaVersionTable); err != nil {
+		return err
+	}
+	current, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := len(s.dialect.migrations)
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, latest)
+	}
+	if target < 0 || target > latest {
+		return fmt.Errorf("schema version must be between 0 and %d", latest)
+	}
+
+	for current < target {
+		current++
+		log.Println("Migrating database schema up to version", current)
+		err := s.migrationStep(s.dialect.migrations[current-1].up,
+			"INSERT INTO schema_version (version, applied) VALUES (?, ?)", current, time.Now().Unix())
+		if err != nil {
+			return fmt.Errorf("migration %d up: %w", current, err)
+		}
+	}
+	for current > target {
+		log.Println("Migrating database schema down from version", current)
+		err := s.migrationStep(s.dialect.migrations[current-1].down,
+			"DELETE FROM schema_version WHERE version=?", current)
+		if err != nil {
+			return fmt.Errorf("migration %d down: %w", current, err)
+		}
+		current--
+	}
+	return nil
+}
+
+func (s *sqlStore) migrationStep(statements []string, versionQuery string, versionArgs ...interface{}) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(tx.Rebind(versionQuery), versionArgs...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
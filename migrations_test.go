@@ -0,0 +1,80 @@
+//go:build cgo || modernc
+// +build cgo modernc
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The migrations are tested on SQLite, which needs cgo unless built with the modernc driver
+
+func openTestSQLiteStore(t *testing.T) *sqlStore {
+	t.Helper()
+	s, err := openSQLStore(sqliteDialect, sqliteDSN(filepath.Join(t.TempDir(), "syncdata.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMigrationsRoundTrip(t *testing.T) {
+	s := openTestSQLiteStore(t)
+	latest := len(sqliteDialect.migrations)
+	if version, err := s.schemaVersion(); err != nil || version != latest {
+		t.Fatalf("new database at version %d %v, want %d", version, err, latest)
+	}
+	for _, target := range []int{latest - 1, 1, 0, latest} {
+		if err := s.migrate(target); err != nil {
+			t.Fatalf("migrating to %d: %v", target, err)
+		}
+		if version, err := s.schemaVersion(); err != nil || version != target {
+			t.Fatalf("migrated to version %d %v, want %d", version, err, target)
+		}
+	}
+}
+
+func TestMigrationsKeepData(t *testing.T) {
+	s := openTestSQLiteStore(t)
+	if err := s.AddUser("alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	document := Document{DocumentId: "doc1", Progress: &StringOrInt{inner: "7"}, Percentage: 0.7, Device: "kobo", DeviceId: "K1"}
+	if _, err := s.UpdateDocument("alice", document); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrate(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrate(len(sqliteDialect.migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser("alice"); err != nil {
+		t.Errorf("user lost by migrating down and up: %v", err)
+	}
+	stored, err := s.GetDocument("alice", "doc1")
+	if err != nil || stored.Percentage != 0.7 || stored.Progress.inner != "7" {
+		t.Errorf("progress lost by migrating down and up: %+v %v", stored, err)
+	}
+}
+
+func TestMigrationsRefuseNewerSchema(t *testing.T) {
+	s := openTestSQLiteStore(t)
+	newer := len(sqliteDialect.migrations) + 1
+	if _, err := s.db.Exec("INSERT INTO schema_version (version, applied) VALUES (?, 0)", newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrate(newer - 1); err == nil || !strings.Contains(err.Error(), "newer than this build supports") {
+		t.Errorf("migrating a newer schema: %v", err)
+	}
+	if err := s.migrate(-1); err == nil {
+		t.Error("migrating to a negative version succeeded")
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, openTestSQLiteStore(t))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// DocumentNote is a free-form note of the user on a document, e.g. "stopped at ch. 12, boring". It's sent
+// with the progress and stored as a RecordNote record per canonical document, shared by all devices.
+type DocumentNote struct {
+	DocumentId string `json:"document"`
+	Note       string `json:"note"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+// maxNoteLength bounds a note in characters
+const maxNoteLength = 4096
+
+func validNote(note *string) bool {
+	return note == nil || utf8.RuneCountInString(*note) <= maxNoteLength
+}
+
+// documentNote returns the note of the document, nil when it has none
+func documentNote(username string, documentId string) *string {
+	var note DocumentNote
+	if err := getRecord(username, RecordNote, documentId, &note); err != nil {
+		return nil
+	}
+	return &note.Note
+}
+
+// setDocumentNote stores the note of the document, an empty note removes it
+func setDocumentNote(username string, documentId string, note string) error {
+	if note == "" {
+		err := store.DeleteRecord(username, RecordNote, documentId)
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	return putRecord(username, RecordNote, documentId, DocumentNote{DocumentId: documentId, Note: note, UpdatedAt: time.Now().Unix()})
+}
+
+// userNotes returns the notes of the user keyed by document
+func userNotes(username string) (map[string]DocumentNote, error) {
+	records, err := store.GetRecords(username, RecordNote)
+	if err != nil {
+		return nil, err
+	}
+	notes := make(map[string]DocumentNote, len(records))
+	for _, record := range records {
+		var note DocumentNote
+		if err := json.Unmarshal([]byte(record.Value), &note); err != nil {
+			return nil, err
+		}
+		notes[record.Name] = note
+	}
+	return notes, nil
+}
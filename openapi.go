@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The OpenAPI document is generated from the routes registered on the router, so it can't fall behind
+// them. Only the sync payloads have their schemas spelled out, the rest of the API is described by its
+// routes and errors.
+
+// publicOperations are the handlers answering without credentials
+var publicOperations = map[string]bool{
+	"register": true, "getSharedProgress": true, "serveOpenAPI": true, "serveSwaggerUI": true, "healthcheck": true,
+	"serverTime": true,
+}
+
+// negotiatedOperations are the handlers answering in the negotiated media type, see respond, the others
+// always answer JSON
+var negotiatedOperations = map[string]bool{
+	"register": true, "authorize": true, "getProgress": true, "updateProgress": true, "getProgressBatch": true,
+	"listProgress": true, "waitProgress": true, "serverTime": true,
+}
+
+// operationSchemas are the request and response bodies of the sync payloads
+var operationSchemas = map[string]struct{ request, response gin.H }{
+	"register":         {gin.H{"$ref": "#/components/schemas/Credentials"}, nil},
+	"getProgress":      {nil, gin.H{"$ref": "#/components/schemas/Document"}},
+	"waitProgress":     {nil, gin.H{"$ref": "#/components/schemas/Document"}},
+	"updateProgress":   {gin.H{"$ref": "#/components/schemas/Document"}, nil},
+	"getProgressBatch": {gin.H{"$ref": "#/components/schemas/ProgressBatch"}, gin.H{"type": "object", "additionalProperties": gin.H{"$ref": "#/components/schemas/Document"}}},
+	"listProgress":     {nil, gin.H{"type": "array", "items": gin.H{"$ref": "#/components/schemas/Document"}}},
+}
+
+var (
+	pathParameter  = regexp.MustCompile(`[:*]([A-Za-z_]+)`)
+	operationIdSep = regexp.MustCompile(`[^A-Za-z0-9]+`)
+)
+
+// handlerName returns the name of the handler function of a route, e.g. getProgress
+func handlerName(route gin.RouteInfo) string {
+	name := strings.TrimPrefix(route.Handler, "main.")
+	// Closures are named after the function returning them, e.g. main.serveOpenAPI.func1
+	if i := strings.Index(name, ".func"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "main" && strings.HasSuffix(route.Path, "/healthcheck") {
+		return "healthcheck"
+	}
+	return name
+}
+
+// mediaTypes returns the content of a body in every media type the operation speaks
+func mediaTypes(name string, schema gin.H) gin.H {
+	if schema == nil {
+		schema = gin.H{"type": "object"}
+	}
+	if !negotiatedOperations[name] {
+		return gin.H{"application/json": gin.H{"schema": schema}}
+	}
+	content := gin.H{}
+	for _, version := range []string{"1", "2"} {
+		for _, encoding := range []string{EncodingJSON, EncodingMsgpack, EncodingCBOR} {
+			content[mediaTypePrefix+version+"+"+encoding] = gin.H{"schema": schema}
+		}
+	}
+	return content
+}
+
+func openAPIOperation(route gin.RouteInfo) gin.H {
+	name := handlerName(route)
+	tag := "server"
+	segments := strings.Split(strings.TrimPrefix(route.Path, "/"), "/")
+	if len(segments) > 2 && segments[0] == "t" {
+		segments = segments[2:]
+	}
+	if len(segments) > 1 && (segments[0] == "syncs" || segments[0] == "users" || segments[0] == "admin") {
+		tag = segments[0] + "/" + strings.TrimPrefix(segments[1], ":")
+	} else if segments[0] != "" {
+		tag = segments[0]
+	}
+	operation := gin.H{
+		"operationId": strings.ToLower(route.Method) + "_" + strings.Trim(operationIdSep.ReplaceAllString(route.Path, "_"), "_"),
+		"summary":     name,
+		"tags":        []string{tag},
+		"responses": gin.H{
+			"2XX":     gin.H{"description": "Success", "content": mediaTypes(name, operationSchemas[name].response)},
+			"default": gin.H{"description": "Error, see the codes of the Error schema", "content": mediaTypes(name, gin.H{"$ref": "#/components/schemas/Error"})},
+		},
+	}
+	parameters := []gin.H{}
+	for _, match := range pathParameter.FindAllStringSubmatch(route.Path, -1) {
+		parameters = append(parameters, gin.H{"name": match[1], "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+	}
+	if !strings.HasSuffix(route.Path, "/share/:token") && name != "serveOpenAPI" && name != "serveSwaggerUI" {
+		parameters = append(parameters, gin.H{"$ref": "#/components/parameters/Accept"})
+	}
+	operation["parameters"] = parameters
+	if publicOperations[name] {
+		operation["security"] = []gin.H{}
+	}
+	if route.Method == http.MethodPost || route.Method == http.MethodPut {
+		operation["requestBody"] = gin.H{"content": mediaTypes(name, operationSchemas[name].request)}
+	}
+	return operation
+}
+
+// openAPIComponents are the schemas, parameters and security schemes the operations refer to
+func openAPIComponents() gin.H {
+	codes := make([]int, 0, len(errorResponses))
+	var descriptions []string
+	for _, err := range errorResponses {
+		codes = append(codes, err.Code)
+		descriptions = append(descriptions, fmt.Sprintf("- %d (HTTP %d): %s", err.Code, err.Status, err.Message))
+	}
+	str := gin.H{"type": "string"}
+	return gin.H{
+		"schemas": gin.H{
+			"Error": gin.H{
+				"type":     "object",
+				"required": []string{"code", "message"},
+				"properties": gin.H{
+					"code":    gin.H{"type": "integer", "enum": codes, "description": strings.Join(descriptions, "\n")},
+					"message": str,
+				},
+			},
+			"Credentials": gin.H{
+				"type":       "object",
+				"required":   []string{"username", "password"},
+				"properties": gin.H{"username": str, "password": gin.H{"type": "string", "description": "MD5 of the password, as KOReader sends it"}},
+			},
+			"ProgressBatch": gin.H{
+				"type":       "object",
+				"properties": gin.H{"documents": gin.H{"type": "array", "items": str, "maxItems": maxBatchDocuments}},
+			},
+			"Document": gin.H{
+				"type":     "object",
+				"required": []string{"document"},
+				"properties": gin.H{
+					"document":     str,
+					"progress":     gin.H{"description": "Opaque position of KOReader, an xpointer or a page number"},
+					"percentage":   gin.H{"type": "number", "minimum": 0, "maximum": 1},
+					"device":       str,
+					"device_id":    str,
+					"timestamp":    gin.H{"type": "integer", "readOnly": true},
+					"timestamp_ms": gin.H{"type": "integer", "readOnly": true, "description": "v2 only, with -timestamp-precision ms"},
+					"note":         gin.H{"type": "string", "maxLength": maxNoteLength, "description": "v2 only"},
+					"status":       gin.H{"type": "string", "enum": []string{StatusReading, StatusFinished, StatusAbandoned, StatusOnHold}, "description": "v2 only"},
+					"metadata":     gin.H{"$ref": "#/components/schemas/ProgressMetadata"},
+					"position":     gin.H{"$ref": "#/components/schemas/Position"},
+					"devices":      gin.H{"type": "array", "items": gin.H{"$ref": "#/components/schemas/DevicePosition"}, "readOnly": true, "description": "v2 only, with ?devices=1"},
+					"deleted":      gin.H{"type": "boolean", "readOnly": true, "description": "Tombstone of a delta sync"},
+				},
+			},
+			"DevicePosition": gin.H{
+				"type": "object",
+				"properties": gin.H{
+					"device_id":    str,
+					"device":       str,
+					"name":         str,
+					"progress":     gin.H{"description": "Opaque position of KOReader, an xpointer or a page number"},
+					"percentage":   gin.H{"type": "number"},
+					"position":     gin.H{"$ref": "#/components/schemas/Position"},
+					"timestamp":    gin.H{"type": "integer"},
+					"timestamp_ms": gin.H{"type": "integer"},
+				},
+			},
+			"ProgressMetadata": gin.H{
+				"type":        "object",
+				"description": "v2 only",
+				"properties":  gin.H{"title": str, "author": str, "series": str},
+			},
+			"Position": gin.H{
+				"type":        "object",
+				"description": "v2 only",
+				"properties":  gin.H{"chapter": str, "xpointer": str, "page": gin.H{"type": "integer"}, "offset": gin.H{"type": "integer"}},
+			},
+		},
+		"parameters": gin.H{
+			"Accept": gin.H{
+				"name":        "Accept",
+				"in":          "header",
+				"required":    true,
+				"description": "application/vnd.koreader.v<1|2>+<json|msgpack|cbor>; v1+json is what KOReader sends",
+				"schema":      gin.H{"type": "string", "default": mediaTypeV1},
+			},
+		},
+		"securitySchemes": gin.H{
+			"user": gin.H{"type": "apiKey", "in": "header", "name": "x-auth-user"},
+			"key":  gin.H{"type": "apiKey", "in": "header", "name": "x-auth-key", "description": "MD5 of the password, or an API key"},
+		},
+	}
+}
+
+func buildOpenAPI(routes gin.RoutesInfo) gin.H {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	paths := gin.H{}
+	for _, route := range routes {
+		path := pathParameter.ReplaceAllString(route.Path, "{$1}")
+		if _, ok := paths[path]; !ok {
+			paths[path] = gin.H{}
+		}
+		paths[path].(gin.H)[strings.ToLower(route.Method)] = openAPIOperation(route)
+	}
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "kosyncsrv",
+			"version":     "2",
+			"description": "KOReader progress sync server. Stock KOReader speaks application/vnd.koreader.v1+json.",
+		},
+		"security":   []gin.H{{"user": []string{}, "key": []string{}}},
+		"paths":      paths,
+		"components": openAPIComponents(),
+	}
+}
+
+// serveOpenAPI answers with the OpenAPI document of the router's routes, generated on the first request
+// once all routes are registered
+func serveOpenAPI(router *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	var document gin.H
+	return func(c *gin.Context) {
+		once.Do(func() { document = buildOpenAPI(router.Routes()) })
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.JSON(http.StatusOK, document)
+	}
+}
+
+// swaggerUIPage loads Swagger UI from a CDN, the server doesn't bundle it
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kosyncsrv API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"})</script>
+</body>
+</html>
+`
+
+func serveSwaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
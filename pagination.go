@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPageLimit bounds the ?limit= of the listings
+const maxPageLimit = 1000
+
+// listingOrder is a sort key of a listing, comparing the elements i and j in ascending order
+type listingOrder func(i int, j int) bool
+
+// sortListing orders list by the ?sort= key of orders, defaultKey without one, ascending or with
+// ?order=desc descending. Ties keep the order the listing was built in. It returns false for an
+// unknown key or order.
+func sortListing(c *gin.Context, list interface{}, orders map[string]listingOrder, defaultKey string, defaultOrder string) bool {
+	less, ok := orders[c.DefaultQuery("sort", defaultKey)]
+	order := c.DefaultQuery("order", defaultOrder)
+	if !ok || (order != "asc" && order != "desc") {
+		return false
+	}
+	if order == "desc" {
+		sort.SliceStable(list, func(i, j int) bool { return less(j, i) })
+	} else {
+		sort.SliceStable(list, less)
+	}
+	return true
+}
+
+// pageListing returns the range of a listing of total elements that ?offset= and ?limit= ask for,
+// defaultLimit elements without a limit, all of them when it's 0. The total is sent as X-Total-Count
+// and the next page, if any, as a Link header. It returns false for an invalid offset or limit.
+func pageListing(c *gin.Context, total int, defaultLimit int) (int, int, bool) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		return 0, 0, false
+	}
+	limit := defaultLimit
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, 0, false
+		}
+	}
+	start, end := offset, total
+	if start > total {
+		start = total
+	}
+	if limit > 0 && start+limit < total {
+		end = start + limit
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if end < total {
+		next := *c.Request.URL
+		query := next.Query()
+		query.Set("offset", strconv.Itoa(end))
+		query.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = query.Encode()
+		c.Header("Link", "<"+next.RequestURI()+`>; rel="next"`)
+	}
+	return start, end, true
+}
+
+// ProgressFilter selects the progress rows of a listing, the zero value selects all of them
+type ProgressFilter struct {
+	Device   string
+	DeviceId string
+	// Since selects the documents with a selected row updated since, see listProgress
+	Since int64
+	// Until excludes the rows updated from then on, 0 leaves it open
+	Until         int64
+	MinPercentage float64
+}
+
+// parseProgressFilter reads the filter from ?device=, ?device_id=, ?since=, ?until= and ?min_percentage=
+func parseProgressFilter(c *gin.Context) (ProgressFilter, bool) {
+	filter := ProgressFilter{Device: c.Query("device"), DeviceId: c.Query("device_id")}
+	var err error
+	if filter.Since, err = strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64); err != nil {
+		return filter, false
+	}
+	if filter.Until, err = strconv.ParseInt(c.DefaultQuery("until", "0"), 10, 64); err != nil {
+		return filter, false
+	}
+	if filter.MinPercentage, err = strconv.ParseFloat(c.DefaultQuery("min_percentage", "0"), 64); err != nil {
+		return filter, false
+	}
+	return filter, validPercentage(filter.MinPercentage)
+}
+
+func (filter ProgressFilter) matches(document Document) bool {
+	return (filter.Device == "" || document.Device == filter.Device) &&
+		(filter.DeviceId == "" || document.DeviceId == filter.DeviceId) &&
+		(filter.Until == 0 || document.Timestamp < filter.Until) &&
+		document.Percentage >= filter.MinPercentage
+}
+
+// listProgress returns the progress of every document, picked by the user's conflict strategy for the
+// device of ?device_id=, by default the last synced first and 100 documents a page. The filter of
+// parseProgressFilter applies to the progress of each device before the strategy picks one, e.g.
+// ?device=phone&until=... lists how far the phone got until then.
+//
+// ?since= makes it a delta sync: only the documents updated since are listed, still with the progress the
+// strategy picks among all of their devices, and the documents deleted since as tombstones marked
+// deleted. X-Sync-Timestamp is the since of the next delta sync.
+func listProgress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	filter, ok := parseProgressFilter(c)
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	// Taken before reading, so updates made meanwhile are in the next delta as well
+	c.Header("X-Sync-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	var ids []string
+	devices := map[string][]Document{}
+	updated := map[string]bool{}
+	newest := map[string]int64{}
+	for _, document := range documents {
+		if document.Timestamp > newest[document.DocumentId] {
+			newest[document.DocumentId] = document.Timestamp
+		}
+		if !filter.matches(document) {
+			continue
+		}
+		if _, ok := devices[document.DocumentId]; !ok {
+			ids = append(ids, document.DocumentId)
+		}
+		devices[document.DocumentId] = append(devices[document.DocumentId], document)
+		if document.Timestamp >= filter.Since {
+			updated[document.DocumentId] = true
+		}
+	}
+	strategy := conflictStrategy(username)
+	list := make([]Document, 0, len(ids))
+	for _, documentId := range ids {
+		if !updated[documentId] {
+			continue
+		}
+		if document, ok := resolveProgress(strategy, devices[documentId], requestDeviceId(c)); ok {
+			list = append(list, document)
+		}
+	}
+	if filter.Since > 0 {
+		tombstones, err := deletedDocuments(username, filter, newest)
+		if err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		list = append(list, tombstones...)
+	}
+	orders := map[string]listingOrder{
+		"timestamp":  func(i, j int) bool { return list[i].Timestamp < list[j].Timestamp },
+		"percentage": func(i, j int) bool { return list[i].Percentage < list[j].Percentage },
+		"document":   func(i, j int) bool { return list[i].DocumentId < list[j].DocumentId },
+	}
+	if !sortListing(c, list, orders, "timestamp", "desc") {
+		c.Error(&InvalidRequest)
+		return
+	}
+	start, end, ok := pageListing(c, len(list), 100)
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	list = list[start:end]
+	for i := range list {
+		if !list[i].Deleted {
+			extendProgress(c, username, list[i].DocumentId, &list[i])
+		}
+	}
+	respond(c, http.StatusOK, list)
+}
+
+// deletedDocuments returns the documents deleted within the filter's range, by a user, a wiped device
+// or the retention, as documents marked deleted at the time of their last deletion. Documents still
+// having the progress of a device, newest holding the last sync of each, are left out.
+func deletedDocuments(username string, filter ProgressFilter, newest map[string]int64) ([]Document, error) {
+	dbDocuments, err := store.GetDeletedDocuments(username, filter.Since)
+	if err != nil {
+		return nil, err
+	}
+	deletedAt := map[string]int64{}
+	for _, dbDocument := range dbDocuments {
+		if _, ok := newest[dbDocument.DocumentID]; ok || filter.Until != 0 && dbDocument.DeletedAt >= filter.Until {
+			continue
+		}
+		if dbDocument.DeletedAt > deletedAt[dbDocument.DocumentID] {
+			deletedAt[dbDocument.DocumentID] = dbDocument.DeletedAt
+		}
+	}
+	tombstones := make([]Document, 0, len(deletedAt))
+	for documentId, timestamp := range deletedAt {
+		tombstones = append(tombstones, Document{DocumentId: documentId, Timestamp: timestamp, Deleted: true})
+	}
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].DocumentId < tombstones[j].DocumentId })
+	return tombstones, nil
+}
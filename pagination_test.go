@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// deltaSync lists alice's documents changed since the beginning and returns whether each is deleted
+func deltaSync(t *testing.T, router http.Handler) map[string]bool {
+	t.Helper()
+	w := testRequest(router, http.MethodGet, "/syncs/progress?since=1", "", "alice", "pw")
+	if w.Code != http.StatusOK {
+		t.Fatalf("delta sync: %d %s", w.Code, w.Body)
+	}
+	var documents []Document
+	decodeTestResponse(t, w, &documents)
+	deleted := map[string]bool{}
+	for _, document := range documents {
+		deleted[document.DocumentId] = document.Deleted
+	}
+	return deleted
+}
+
+func TestDeltaTombstones(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.1")
+	syncTestProgress(t, router, "", "alice", "pw", "doc3", "0.3")
+	for _, document := range []string{"doc2", "doc3"} {
+		w := testRequest(router, http.MethodPut, "/syncs/progress",
+			`{"document": "`+document+`", "progress": "2", "percentage": 0.2, "device": "phone", "device_id": "P1"}`, "alice", "pw")
+		if w.Code != http.StatusOK {
+			t.Fatalf("syncing %s: %d %s", document, w.Code, w.Body)
+		}
+	}
+
+	if w := testRequest(router, http.MethodDelete, "/syncs/progress/doc1", "", "alice", "pw"); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting doc1: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodDelete, "/users/me/devices/P1", "", "alice", "pw"); w.Code != http.StatusOK {
+		t.Fatalf("deleting the device: %d %s", w.Code, w.Body)
+	}
+	deleted := deltaSync(t, router)
+	// doc2 was only synced by the deleted device, doc3 keeps the progress of the other one
+	want := map[string]bool{"doc1": true, "doc2": true, "doc3": false}
+	for document, tombstone := range want {
+		if listed, ok := deleted[document]; !ok || listed != tombstone {
+			t.Errorf("%s: listed %v deleted %v, want deleted %v", document, ok, listed, tombstone)
+		}
+	}
+
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.4")
+	if deleted := deltaSync(t, router); deleted["doc1"] {
+		t.Error("doc1 synced again after its deletion is still listed as deleted")
+	}
+	w := testRequest(router, http.MethodGet, "/syncs/progress", "", "alice", "pw")
+	var documents []Document
+	decodeTestResponse(t, w, &documents)
+	for _, document := range documents {
+		if document.Deleted {
+			t.Errorf("tombstone of %s listed without ?since=", document.DocumentId)
+		}
+	}
+}
+
+func TestDeltaTombstonesOfPrunedDocuments(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.1")
+	noArchive := func(pruned []DbDocument) error { return nil }
+
+	before := time.Now().Unix() + 1
+	if _, err := store.PruneDocuments(before, noArchive); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := deltaSync(t, router); !deleted["doc1"] {
+		t.Errorf("pruned doc1 isn't listed as deleted: %v", deleted)
+	}
+	// The next pruning removes the tombstone
+	if _, err := store.PruneDocuments(before, noArchive); err != nil {
+		t.Fatal(err)
+	}
+	if deleted := deltaSync(t, router); len(deleted) != 0 {
+		t.Errorf("tombstone listed after it was pruned: %v", deleted)
+	}
+}
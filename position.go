@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// Position is the structured position a client may send with the opaque progress in v2, e.g. for
+// dashboards showing the chapter. Fields the client doesn't know are left empty.
+type Position struct {
+	Chapter string `json:"chapter,omitempty"`
+	// XPointer is KOReader's position in a reflowable document, e.g. /body/DocFragment[12]/body/p[3]/text().42
+	XPointer string `json:"xpointer,omitempty"`
+	Page     int    `json:"page,omitempty"`
+	// Offset is a position within the page, e.g. a character offset
+	Offset int `json:"offset,omitempty"`
+}
+
+func validPosition(position *Position) bool {
+	if position == nil {
+		return true
+	}
+	return *position != Position{} && utf8.RuneCountInString(position.Chapter) <= maxMetadataLength &&
+		len(position.XPointer) <= maxProgressRawLength && position.Page >= 0 && position.Offset >= 0
+}
+
+// comparePositions orders two positions by page and offset, 0 when either has no page
+func comparePositions(a *Position, b *Position) int {
+	if a == nil || b == nil || a.Page == 0 || b.Page == 0 {
+		return 0
+	}
+	switch {
+	case a.Page != b.Page:
+		return a.Page - b.Page
+	default:
+		return a.Offset - b.Offset
+	}
+}
+
+// encodePosition returns the JSON of the position as stored, empty without one
+func encodePosition(position *Position) string {
+	if position == nil {
+		return ""
+	}
+	data, _ := json.Marshal(position)
+	return string(data)
+}
+
+func decodePosition(stored string) *Position {
+	if stored == "" {
+		return nil
+	}
+	var position Position
+	if err := json.Unmarshal([]byte(stored), &position); err != nil {
+		return nil
+	}
+	return &position
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateWindow counts the requests of a client address in the current window
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	rateWindows   = map[string]*rateWindow{}
+	rateWindowsMu sync.Mutex
+)
+
+// RateLimit allows each client address -rate-limit requests per -rate-limit-window, counted in fixed windows
+// in the memory of the server process. It runs before AuthRequired, so failed authentications are counted
+// too, and the address is the peer's unless a -trusted-proxies proxy forwarded the request, so it can't be
+// dodged by forging X-Forwarded-For. Every answer tells the client where it stands with X-RateLimit-Limit,
+// X-RateLimit-Remaining and X-RateLimit-Reset, the unix time the window ends, so it can back off before
+// being refused with 429.
+func RateLimit(c *gin.Context) {
+	if config.RateLimit <= 0 {
+		c.Next()
+		return
+	}
+	key := c.ClientIP()
+	now := time.Now()
+	rateWindowsMu.Lock()
+	window, ok := rateWindows[key]
+	if !ok || now.Sub(window.start) >= config.RateLimitWindow {
+		if !ok && len(rateWindows) >= 10000 {
+			for key, window := range rateWindows {
+				if now.Sub(window.start) >= config.RateLimitWindow {
+					delete(rateWindows, key)
+				}
+			}
+		}
+		window = &rateWindow{start: now}
+		rateWindows[key] = window
+	}
+	window.count++
+	count, reset := window.count, window.start.Add(config.RateLimitWindow)
+	rateWindowsMu.Unlock()
+
+	remaining := config.RateLimit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(config.RateLimit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if count > config.RateLimit {
+		c.Header("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		writeError(c, &TooManyRequests)
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadingSession is a row of page_stat_data in the statistics database of KOReader's statistics
+// plugin: how long a page was shown, starting at start_time
+type ReadingSession struct {
+	Page       int   `json:"page"`
+	StartTime  int64 `json:"start_time"`
+	Duration   int64 `json:"duration"`
+	TotalPages int   `json:"total_pages"`
+}
+
+// BookStatistics is the statistics plugin's book row with its sessions, stored as a RecordReadingStatistics
+// record per document. The totals are computed from the sessions.
+type BookStatistics struct {
+	DocumentId     string           `json:"document"`
+	Title          string           `json:"title"`
+	Authors        string           `json:"authors"`
+	Series         string           `json:"series"`
+	Language       string           `json:"language"`
+	Pages          int              `json:"pages"`
+	LastOpen       int64            `json:"last_open"`
+	TotalReadTime  int64            `json:"total_read_time"`
+	TotalReadPages int              `json:"total_read_pages"`
+	Sessions       []ReadingSession `json:"sessions,omitempty"`
+}
+
+// maxReadingSessions bounds the sessions of an upload
+const maxReadingSessions = 20000
+
+// readingStatisticsMu serializes the merges, two devices uploading the same book at once would
+// otherwise lose the sessions of one of them
+var readingStatisticsMu sync.Mutex
+
+func validBookStatistics(book BookStatistics) bool {
+	for _, field := range []string{book.Title, book.Authors, book.Series, book.Language} {
+		if utf8.RuneCountInString(field) > maxMetadataLength {
+			return false
+		}
+	}
+	if book.Pages < 0 || len(book.Sessions) > maxReadingSessions {
+		return false
+	}
+	for _, session := range book.Sessions {
+		if session.Page < 0 || session.StartTime <= 0 || session.Duration < 0 || session.TotalPages < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSessions adds the sessions missing from stored, a session being identified by its page
+// and start time like in KOReader's own merge, and orders them by start time
+func mergeSessions(stored []ReadingSession, added []ReadingSession) []ReadingSession {
+	type sessionKey struct {
+		page      int
+		startTime int64
+	}
+	seen := map[sessionKey]bool{}
+	for _, session := range stored {
+		seen[sessionKey{session.Page, session.StartTime}] = true
+	}
+	merged := stored
+	for _, session := range added {
+		key := sessionKey{session.Page, session.StartTime}
+		if !seen[key] {
+			seen[key] = true
+			merged = append(merged, session)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].StartTime != merged[j].StartTime {
+			return merged[i].StartTime < merged[j].StartTime
+		}
+		return merged[i].Page < merged[j].Page
+	})
+	return merged
+}
+
+// computeTotals sets the totals like the plugin does: the time of all sessions, the distinct pages read
+// and the end of the last session
+func (book *BookStatistics) computeTotals() {
+	book.TotalReadTime = 0
+	pages := map[int]bool{}
+	for _, session := range book.Sessions {
+		book.TotalReadTime += session.Duration
+		pages[session.Page] = true
+		if end := session.StartTime + session.Duration; end > book.LastOpen {
+			book.LastOpen = end
+		}
+	}
+	book.TotalReadPages = len(pages)
+}
+
+func getBookStatistics(username string, documentId string) (BookStatistics, error) {
+	var book BookStatistics
+	err := getRecord(username, RecordReadingStatistics, documentId, &book)
+	return book, err
+}
+
+// userBookStatistics returns the statistics of all books of the user, ordered by document
+func userBookStatistics(username string) ([]BookStatistics, error) {
+	records, err := store.GetRecords(username, RecordReadingStatistics)
+	if err != nil {
+		return nil, err
+	}
+	books := make([]BookStatistics, 0, len(records))
+	for _, record := range records {
+		var book BookStatistics
+		if err := json.Unmarshal([]byte(record.Value), &book); err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, nil
+}
+
+// updateReadingStatistics merges the uploaded book and sessions into the stored ones and answers with
+// the merged statistics, so a device can add the sessions of the others to its own database
+func updateReadingStatistics(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := c.Param("document")
+	var upload BookStatistics
+	if err := bindBody(c, &upload); err != nil || !validKeyField(documentId) || !validBookStatistics(upload) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	readingStatisticsMu.Lock()
+	defer readingStatisticsMu.Unlock()
+	book, err := getBookStatistics(username, documentId)
+	if err != nil && err != ErrNotFound {
+		c.Error(&UnknownServerError)
+		return
+	}
+	book.DocumentId = documentId
+	// Book fields left empty by the upload keep their stored value
+	if upload.Title != "" {
+		book.Title = upload.Title
+	}
+	if upload.Authors != "" {
+		book.Authors = upload.Authors
+	}
+	if upload.Series != "" {
+		book.Series = upload.Series
+	}
+	if upload.Language != "" {
+		book.Language = upload.Language
+	}
+	if upload.Pages > 0 {
+		book.Pages = upload.Pages
+	}
+	if upload.LastOpen > book.LastOpen {
+		book.LastOpen = upload.LastOpen
+	}
+	book.Sessions = mergeSessions(book.Sessions, upload.Sessions)
+	book.computeTotals()
+	if err := putRecord(username, RecordReadingStatistics, documentId, book); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, book)
+}
+
+func getReadingStatistics(c *gin.Context) {
+	book, err := getBookStatistics(c.MustGet("username").(string), c.Param("document"))
+	if err == ErrNotFound {
+		c.Error(&StatisticsNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, book)
+}
+
+// listReadingStatistics returns the books with their totals but without the sessions, ordered by
+// ?sort=document (default), title, last_open or total_read_time
+func listReadingStatistics(c *gin.Context) {
+	books, err := userBookStatistics(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	for i := range books {
+		books[i].Sessions = nil
+	}
+	orders := map[string]listingOrder{
+		"document":        func(i, j int) bool { return books[i].DocumentId < books[j].DocumentId },
+		"title":           func(i, j int) bool { return books[i].Title < books[j].Title },
+		"last_open":       func(i, j int) bool { return books[i].LastOpen < books[j].LastOpen },
+		"total_read_time": func(i, j int) bool { return books[i].TotalReadTime < books[j].TotalReadTime },
+	}
+	if !sortListing(c, books, orders, "document", "asc") {
+		c.Error(&InvalidRequest)
+		return
+	}
+	start, end, ok := pageListing(c, len(books), 0)
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	respond(c, http.StatusOK, books[start:end])
+}
+
+func deleteReadingStatistics(c *gin.Context) {
+	err := store.DeleteRecord(c.MustGet("username").(string), RecordReadingStatistics, c.Param("document"))
+	if err == ErrNotFound {
+		c.Error(&StatisticsNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
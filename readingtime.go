@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadingTime is the reading of a day, week or month computed from the synced reading statistics
+type ReadingTime struct {
+	// Period is the day as 2006-01-02, the ISO week as 2006-W01 or the month as 2006-01
+	Period   string `json:"period"`
+	Start    int64  `json:"start"`
+	ReadTime int64  `json:"read_time"`
+	Pages    int    `json:"pages"`
+	Books    int    `json:"books"`
+}
+
+type ReadingTimeReport struct {
+	Document      string        `json:"document,omitempty"`
+	Unit          string        `json:"unit"`
+	Timezone      string        `json:"timezone"`
+	TotalReadTime int64         `json:"total_read_time"`
+	Periods       []ReadingTime `json:"periods"`
+}
+
+// periodStart returns the start of the day, ISO week or month containing t and its label
+func periodStart(unit string, t time.Time) (time.Time, string) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch unit {
+	case "week":
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		year, week := start.ISOWeek()
+		return start, fmt.Sprintf("%d-W%02d", year, week)
+	case "month":
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.Format("2006-01")
+	default:
+		return day, day.Format("2006-01-02")
+	}
+}
+
+// aggregateReadingTime adds up the sessions of the books starting in [from, to) per period. Pages
+// counts each page of a book once per period.
+func aggregateReadingTime(books []BookStatistics, unit string, location *time.Location, from int64, to int64) ([]ReadingTime, int64) {
+	type pageKey struct {
+		book string
+		page int
+	}
+	periods := map[string]*ReadingTime{}
+	pages := map[string]map[pageKey]bool{}
+	readBooks := map[string]map[string]bool{}
+	var total int64
+	for _, book := range books {
+		for _, session := range book.Sessions {
+			if session.StartTime < from || to != 0 && session.StartTime >= to {
+				continue
+			}
+			start, label := periodStart(unit, time.Unix(session.StartTime, 0).In(location))
+			period, ok := periods[label]
+			if !ok {
+				period = &ReadingTime{Period: label, Start: start.Unix()}
+				periods[label] = period
+				pages[label] = map[pageKey]bool{}
+				readBooks[label] = map[string]bool{}
+			}
+			period.ReadTime += session.Duration
+			total += session.Duration
+			pages[label][pageKey{book.DocumentId, session.Page}] = true
+			readBooks[label][book.DocumentId] = true
+		}
+	}
+	result := make([]ReadingTime, 0, len(periods))
+	for label, period := range periods {
+		period.Pages = len(pages[label])
+		period.Books = len(readBooks[label])
+		result = append(result, *period)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start < result[j].Start })
+	return result, total
+}
+
+// getReadingTime reports the reading time per ?unit=day (default), week or month of all books or,
+// with :document, of one. ?tz= names the timezone the periods start in, UTC by default, and ?from=
+// and ?to= limit the sessions to a range of unix timestamps.
+func getReadingTime(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	report := ReadingTimeReport{Document: c.Param("document"), Unit: c.DefaultQuery("unit", "day"), Timezone: c.DefaultQuery("tz", "UTC")}
+	if report.Unit != "day" && report.Unit != "week" && report.Unit != "month" {
+		c.Error(&InvalidRequest)
+		return
+	}
+	location, err := time.LoadLocation(report.Timezone)
+	if err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	from, err := strconv.ParseInt(c.DefaultQuery("from", "0"), 10, 64)
+	if err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	to, err := strconv.ParseInt(c.DefaultQuery("to", "0"), 10, 64)
+	if err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+
+	var books []BookStatistics
+	if report.Document != "" {
+		book, err := getBookStatistics(username, report.Document)
+		if err == ErrNotFound {
+			c.Error(&StatisticsNotFound)
+			return
+		}
+		if err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		books = append(books, book)
+	} else {
+		var err error
+		if books, err = userBookStatistics(username); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	report.Periods, report.TotalReadTime = aggregateReadingTime(books, report.Unit, location, from, to)
+	respond(c, http.StatusOK, report)
+}
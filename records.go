@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of the records kept through Store.PutRecord. Kinds never contain ':'.
+const (
+	RecordWebhook           = "webhook"
+	RecordReadingStatistics = "reading_statistics"
+	RecordAnnotations       = "annotations"
+	RecordBookmarks         = "bookmarks"
+	RecordVocabulary        = "vocabulary"
+	RecordCollection        = "collection"
+	RecordSetting           = "setting"
+	RecordGoals             = "goals"
+	RecordAlias             = "alias"
+	RecordDevice            = "device"
+	RecordNote              = "note"
+	RecordStatus            = "status"
+	RecordSlot              = "slot"
+	RecordGroup             = "group"
+	RecordGroupMember       = "group_member"
+	RecordShare             = "share"
+)
+
+// recordKinds are the kinds included in the database dump
+var recordKinds = []string{RecordWebhook, RecordReadingStatistics, RecordAnnotations, RecordBookmarks, RecordVocabulary, RecordCollection, RecordSetting, RecordGoals, RecordAlias, RecordDevice, RecordNote, RecordStatus, RecordSlot, RecordGroup, RecordGroupMember, RecordShare}
+
+func validRecordKind(kind string) bool {
+	for _, known := range recordKinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Record is a record in the database dump
+type Record struct {
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Value     json.RawMessage `json:"value"`
+	UpdatedAt int64           `json:"updated_at"`
+}
+
+// getRecord decodes the user's record into value
+func getRecord(username string, kind string, name string, value interface{}) error {
+	record, err := store.GetRecord(username, kind, name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(record.Value), value)
+}
+
+// putRecord stores value as the user's record
+func putRecord(username string, kind string, name string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.PutRecord(DbRecord{Username: username, Kind: kind, Name: name, Value: string(b), UpdatedAt: time.Now().Unix()})
+}
+
+// userRecords returns the records of every kind of the user for the dump
+func userRecords(username string) ([]Record, error) {
+	var records []Record
+	for _, kind := range recordKinds {
+		dbRecords, err := store.GetRecords(username, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, dbRecord := range dbRecords {
+			records = append(records, Record{kind, dbRecord.Name, json.RawMessage(dbRecord.Value), dbRecord.UpdatedAt})
+		}
+	}
+	return records, nil
+}
+
+// importRecord stores a record of the dump unless the stored one is at least as new
+func importRecord(username string, record Record) error {
+	existing, err := store.GetRecord(username, record.Kind, record.Name)
+	if err == nil && existing.UpdatedAt >= record.UpdatedAt {
+		return nil
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	return store.PutRecord(DbRecord{Username: username, Kind: record.Kind, Name: record.Name, Value: string(record.Value), UpdatedAt: record.UpdatedAt})
+}
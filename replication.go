@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Replication of the SQLite database is delegated to Litestream (https://litestream.io), which streams
+// the WAL to S3 compatible storage, e.g. s3://bucket/kosyncsrv?endpoint=minio.lan:9000.
+// Credentials are read by Litestream from the usual AWS_* environment variables.
+
+// restoreDatabase restores the database from the replica when the local file is missing
+func restoreDatabase() error {
+	if _, err := os.Stat(config.DBFile); !os.IsNotExist(err) {
+		return err
+	}
+	log.Println("Database", config.DBFile, "is missing, restoring it from", config.LitestreamURL)
+	cmd := exec.Command(config.LitestreamBin, "restore", "-if-replica-exists", "-o", config.DBFile, config.LitestreamURL)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// litestreamStopTimeout is how long Litestream may take to finish its uploads when the server stops
+const litestreamStopTimeout = 30 * time.Second
+
+// replication is a running litestream replicate, done is closed when it has exited
+type replication struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// startReplication runs litestream replicate next to the server. Litestream needs the database in WAL mode.
+func startReplication() (*replication, error) {
+	cmd := exec.Command(config.LitestreamBin, "replicate", config.DBFile, config.LitestreamURL)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	r := &replication{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Println("Litestream replication stopped:", err)
+		} else {
+			log.Println("Litestream replication stopped")
+		}
+		close(r.done)
+	}()
+	return r, nil
+}
+
+// stopReplication stops Litestream and waits up to litestreamStopTimeout for it, then kills it
+func stopReplication(r *replication) {
+	// Litestream finishes pending uploads on SIGINT
+	r.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-r.done:
+	case <-time.After(litestreamStopTimeout):
+		log.Printf("Litestream didn't stop within %v, killing it", litestreamStopTimeout)
+		r.cmd.Process.Kill()
+		<-r.done
+	}
+}
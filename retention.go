@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ArchivedDocument is a line of the -document-archive file
+type ArchivedDocument struct {
+	Archived int64    `json:"archived"`
+	User     string   `json:"user"`
+	Document Document `json:"document"`
+	Deleted  bool     `json:"deleted,omitempty"`
+}
+
+// scheduleRetention prunes the documents not updated within -document-max-age on the -retention-schedule
+func scheduleRetention(scheduler *cron.Cron) error {
+	_, err := scheduler.AddFunc(config.RetentionSchedule, func() {
+		if err := pruneDocuments(); err != nil {
+			log.Println("Pruning stale documents failed:", err)
+		}
+	})
+	return err
+}
+
+func pruneDocuments() error {
+	now := time.Now()
+	archive := func(pruned []DbDocument) error {
+		if config.DocumentArchive == "" || len(pruned) == 0 {
+			return nil
+		}
+		return archiveDocuments(pruned, now.Unix())
+	}
+	pruned, err := store.PruneDocuments(now.Add(-config.DocumentMaxAge).Unix(), archive)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pruned %d documents not updated within %v", pruned, config.DocumentMaxAge)
+	return nil
+}
+
+// archiveDocuments appends the pruned documents to the -document-archive as JSON lines.
+// It runs before they are removed, a failure keeps them in the database.
+func archiveDocuments(pruned []DbDocument, archived int64) error {
+	file, err := os.OpenFile(config.DocumentArchive, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, dbDocument := range pruned {
+		err := encoder.Encode(ArchivedDocument{
+			Archived: archived,
+			User:     dbDocument.Username,
+			Document: dbDocument.toDocument(),
+			Deleted:  dbDocument.DeletedAt != 0,
+		})
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Setting is a value of the per-user key/value store, e.g. a KOReader setting or a whole profile.
+// Values are opaque JSON, stored as RecordSetting records named "<namespace>:<key>".
+type Setting struct {
+	Namespace string          `json:"namespace"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	UpdatedAt int64           `json:"updated_at"`
+}
+
+const (
+	// maxSettingNamespace and maxSettingKey fit the record names of the MySQL schema
+	maxSettingNamespace = 64
+	maxSettingKey       = 120
+	// maxSettingValue bounds a single value in bytes
+	maxSettingValue = 64 * 1024
+)
+
+// settingsMu serializes the writes, so concurrent ones can't exceed -settings-quota together
+var settingsMu sync.Mutex
+
+func validSettingNamespace(namespace string) bool {
+	return validKeyField(namespace) && utf8.RuneCountInString(namespace) <= maxSettingNamespace
+}
+
+func validSettingKey(key string) bool {
+	return key != "" && utf8.RuneCountInString(key) <= maxSettingKey
+}
+
+func newSetting(record DbRecord) Setting {
+	namespace := strings.SplitN(record.Name, ":", 2)[0]
+	return Setting{
+		Namespace: namespace,
+		Key:       strings.TrimPrefix(record.Name, namespace+":"),
+		Value:     json.RawMessage(record.Value),
+		UpdatedAt: record.UpdatedAt,
+	}
+}
+
+// listSettingNamespaces returns the namespaces holding settings in alphabetical order
+func listSettingNamespaces(c *gin.Context) {
+	records, err := store.GetRecords(c.MustGet("username").(string), RecordSetting)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	seen := map[string]bool{}
+	namespaces := []string{}
+	for _, record := range records {
+		if namespace := newSetting(record).Namespace; !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	respond(c, http.StatusOK, namespaces)
+}
+
+// listSettings returns the settings of the namespace ordered by key
+func listSettings(c *gin.Context) {
+	records, err := store.GetRecords(c.MustGet("username").(string), RecordSetting)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	settings := []Setting{}
+	for _, record := range records {
+		if setting := newSetting(record); setting.Namespace == c.Param("namespace") {
+			settings = append(settings, setting)
+		}
+	}
+	respond(c, http.StatusOK, settings)
+}
+
+func getSetting(c *gin.Context) {
+	record, err := store.GetRecord(c.MustGet("username").(string), RecordSetting, c.Param("namespace")+":"+c.Param("key"))
+	if err == ErrNotFound {
+		c.Error(&SettingNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, newSetting(record))
+}
+
+// updateSetting stores the request body, any JSON value, as the setting
+func updateSetting(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	namespace := c.Param("namespace")
+	key := c.Param("key")
+	value, err := c.GetRawData()
+	if err != nil || !validSettingNamespace(namespace) || !validSettingKey(key) || !json.Valid(value) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	if len(value) > maxSettingValue {
+		c.Error(&QuotaExceeded)
+		return
+	}
+	name := namespace + ":" + key
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	if config.SettingsQuota > 0 {
+		records, err := store.GetRecords(username, RecordSetting)
+		if err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		size := len(value)
+		for _, record := range records {
+			if record.Name != name {
+				size += len(record.Value)
+			}
+		}
+		if size > config.SettingsQuota {
+			c.Error(&QuotaExceeded)
+			return
+		}
+	}
+	record := DbRecord{Username: username, Kind: RecordSetting, Name: name, Value: string(value), UpdatedAt: time.Now().Unix()}
+	if err := store.PutRecord(record); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, newSetting(record))
+}
+
+func deleteSetting(c *gin.Context) {
+	err := store.DeleteRecord(c.MustGet("username").(string), RecordSetting, c.Param("namespace")+":"+c.Param("key"))
+	if err == ErrNotFound {
+		c.Error(&SettingNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
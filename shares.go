@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShareLink is a revocable public link to the progress of one document, e.g. to show "currently 62%
+// through Dune" on a personal site. It's a RecordShare record named by the link's secret id, a random
+// token that is looked up across all users, so the link doesn't reveal whose progress it shows.
+type ShareLink struct {
+	Id         string `json:"id"`
+	DocumentId string `json:"document"`
+	Created    int64  `json:"created"`
+	// Token is the link's part of /share/:token, the id
+	Token string `json:"token"`
+}
+
+// SharedProgress is what a share link exposes, nothing but the title and how far the user is
+type SharedProgress struct {
+	Title      string  `json:"title,omitempty"`
+	Percentage float64 `json:"percentage"`
+	Timestamp  int64   `json:"timestamp"`
+}
+
+// maxShareLinks bounds the share links of a user
+const maxShareLinks = 100
+
+func userShareLinks(username string) ([]ShareLink, error) {
+	records, err := store.GetRecords(username, RecordShare)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]ShareLink, 0, len(records))
+	for _, record := range records {
+		var link ShareLink
+		if err := json.Unmarshal([]byte(record.Value), &link); err != nil {
+			return nil, err
+		}
+		link.Token = link.Id
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func listShareLinks(c *gin.Context) {
+	links, err := userShareLinks(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, links)
+}
+
+func createShareLink(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		DocumentId string `json:"document"`
+	}
+	if err := bindBody(c, &request); err != nil || !validKeyField(request.DocumentId) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	links, err := userShareLinks(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if len(links) >= maxShareLinks {
+		c.Error(&QuotaExceeded)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	link := ShareLink{Id: hex.EncodeToString(b), DocumentId: request.DocumentId, Created: time.Now().Unix()}
+	if err := putRecord(username, RecordShare, link.Id, link); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	link.Token = link.Id
+	respond(c, http.StatusCreated, link)
+}
+
+func deleteShareLink(c *gin.Context) {
+	err := store.DeleteRecord(c.MustGet("username").(string), RecordShare, c.Param("id"))
+	if err == ErrNotFound {
+		c.Error(&ShareLinkNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getSharedProgress answers a public share link, without authentication, with the progress the
+// user's conflict strategy picks
+func getSharedProgress(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	record, err := store.FindRecord(RecordShare, c.Param("token"))
+	if err != nil {
+		c.Error(&ShareLinkNotFound)
+		return
+	}
+	var link ShareLink
+	if err := json.Unmarshal([]byte(record.Value), &link); err != nil {
+		c.Error(&ShareLinkNotFound)
+		return
+	}
+	username := record.Username
+	documentId := canonicalDocument(username, link.DocumentId)
+	document, ok := findProgress(username, documentId, "")
+	if !ok {
+		c.Error(&DocumentNotFound)
+		return
+	}
+	shared := SharedProgress{Percentage: document.Percentage, Timestamp: document.Timestamp}
+	if metadata, err := store.GetDocumentMetadata(username, documentId); err == nil {
+		shared.Title = metadata.Title
+	}
+	c.Header("Cache-Control", "public, max-age=60")
+	respond(c, http.StatusOK, shared)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestShareLinks(t *testing.T) {
+	router := newTestRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	syncTestProgress(t, router, "", "alice", "pw", "doc1", "0.62")
+	w := testRequest(router, http.MethodPost, "/syncs/shares", `{"document": "doc1"}`, "alice", "pw")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the link: %d %s", w.Code, w.Body)
+	}
+	var link ShareLink
+	decodeTestResponse(t, w, &link)
+	if strings.Contains(link.Token, "alice") || strings.Contains(link.Token, "YWxpY2") {
+		t.Errorf("token reveals the username: %s", link.Token)
+	}
+
+	w = testRequest(router, http.MethodGet, "/share/"+link.Token, "", "", "")
+	var shared SharedProgress
+	decodeTestResponse(t, w, &shared)
+	if w.Code != http.StatusOK || shared.Percentage != 0.62 {
+		t.Errorf("shared progress: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodGet, "/share/nope", "", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodDelete, "/syncs/shares/"+link.Id, "", "alice", "pw"); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting the link: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodGet, "/share/"+link.Token, "", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoked link: %d %s", w.Code, w.Body)
+	}
+}
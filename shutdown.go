@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shuttingDown is closed when the server starts shutting down, so the long-lived requests, i.e. the
+// long polls, event streams and WebSockets, end instead of holding up the shutdown
+var shuttingDown = make(chan struct{})
+
+// serve answers requests until SIGTERM or SIGINT, then stops accepting connections and waits up to
+// -shutdown-timeout for the requests in flight, so the database is only closed once their writes are
+// done. It returns the error of a listener otherwise. Every address of -listen is served alike, with
+// -ssl over HTTPS and the addresses of -http-listen over plain HTTP. With socket activation the sockets
+// passed by systemd are served instead, those named "http" over plain HTTP.
+func serve(handler http.Handler) error {
+	server := &http.Server{Handler: handler}
+	plainServer := server
+	if config.SSL {
+		plainServer = &http.Server{Handler: handler}
+	}
+	listeners, names, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	var plain []bool
+	for _, name := range names {
+		plain = append(plain, !config.SSL || name == "http")
+	}
+	if len(listeners) == 0 {
+		for _, address := range config.ListenAddresses() {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, listener)
+			plain = append(plain, !config.SSL)
+		}
+		for _, address := range config.HTTPListen {
+			listener, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, listener)
+			plain = append(plain, true)
+		}
+	}
+	if config.SSL && config.HTTPMode == "redirect" {
+		plainServer.Handler = httpsRedirect(httpsPort(listeners, plain))
+	}
+	if config.SSL {
+		server.TLSConfig, plainServer.Handler = tlsConfig(plainServer.Handler)
+	}
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		if plain[i] {
+			go func(listener net.Listener) { errs <- plainServer.Serve(listener) }(listener)
+			log.Println("Listening on", listener.Addr(), "over HTTP")
+		} else {
+			go func(listener net.Listener) { errs <- server.ServeTLS(listener, config.SSLCert, config.SSLKey) }(listener)
+			log.Println("Listening on", listener.Addr(), "over HTTPS")
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	if err := sdNotify("READY=1"); err != nil {
+		log.Println("Notifying systemd:", err)
+	}
+	startWatchdog(shuttingDown)
+	select {
+	case err := <-errs:
+		return err
+	case received := <-signals:
+		log.Println("Received", received.String()+", shutting down")
+	}
+	sdNotify("STOPPING=1")
+	close(shuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Requests still running after", config.ShutdownTimeout, "were cut off:", err)
+	}
+	if plainServer != server {
+		plainServer.Shutdown(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Progress slots keep named positions of a document besides its progress, e.g. to re-read earlier
+// chapters without losing the furthest position. Slots are stored as RecordSlot records named
+// "<document>:<slot>" holding the Document, under the canonical document.
+const (
+	// SlotCurrent is the progress itself, it can't be stored
+	SlotCurrent = "current"
+	// SlotFurthest is kept up to date by every progress update further into the document
+	SlotFurthest = "furthest-read"
+)
+
+const (
+	maxSlotName = 64
+	// maxSlots bounds the slots of a document
+	maxSlots = 16
+)
+
+var slotsMu sync.Mutex
+
+func validSlotName(slot string) bool {
+	return validKeyField(slot) && utf8.RuneCountInString(slot) <= maxSlotName && slot != SlotCurrent
+}
+
+// documentSlots returns the stored slots of the document keyed by slot
+func documentSlots(username string, documentId string) (map[string]Document, error) {
+	records, err := store.GetRecords(username, RecordSlot)
+	if err != nil {
+		return nil, err
+	}
+	slots := map[string]Document{}
+	for _, record := range records {
+		slot := strings.TrimPrefix(record.Name, documentId+":")
+		if slot == record.Name {
+			continue
+		}
+		var document Document
+		if err := json.Unmarshal([]byte(record.Value), &document); err != nil {
+			return nil, err
+		}
+		slots[slot] = document
+	}
+	return slots, nil
+}
+
+// updateFurthestSlot moves the furthest-read slot to the progress when it's further into the document.
+// Failures are only logged, the progress is stored already.
+func updateFurthestSlot(username string, document Document) {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	name := document.DocumentId + ":" + SlotFurthest
+	var furthest Document
+	err := getRecord(username, RecordSlot, name, &furthest)
+	if err != nil && err != ErrNotFound {
+		log.Println("Looking up the furthest position of", document.DocumentId, "of", username, "failed:", err)
+		return
+	}
+	if err == nil && (document.Percentage < furthest.Percentage ||
+		document.Percentage == furthest.Percentage && comparePositions(document.Position, furthest.Position) <= 0) {
+		return
+	}
+	if err := putRecord(username, RecordSlot, name, slotProgress(document)); err != nil {
+		log.Println("Recording the furthest position of", document.DocumentId, "of", username, "failed:", err)
+	}
+}
+
+// slotProgress returns the fields of the progress a slot keeps
+func slotProgress(document Document) Document {
+	return Document{
+		DocumentId: document.DocumentId,
+		Progress:   document.Progress,
+		Percentage: document.Percentage,
+		Device:     document.Device,
+		DeviceId:   document.DeviceId,
+		Timestamp:  document.Timestamp,
+		Position:   document.Position,
+	}
+}
+
+// deleteDocumentSlots removes the slots of the document together with its progress
+func deleteDocumentSlots(username string, documentId string) error {
+	slots, err := documentSlots(username, documentId)
+	if err != nil {
+		return err
+	}
+	for slot := range slots {
+		if err := store.DeleteRecord(username, RecordSlot, documentId+":"+slot); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProgressSlot is a named position of a document as returned by the slot endpoints
+type ProgressSlot struct {
+	Slot string `json:"slot"`
+	Document
+}
+
+// listSlots returns the current progress and the stored slots of the document, ordered by name
+func listSlots(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := canonicalDocument(username, c.Param("document"))
+	slots, err := documentSlots(username, documentId)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if current, ok := findProgress(username, documentId, requestDeviceId(c)); ok {
+		slots[SlotCurrent] = current
+	}
+	list := []ProgressSlot{}
+	for slot, document := range slots {
+		document.DocumentId = c.Param("document")
+		list = append(list, ProgressSlot{Slot: slot, Document: document})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Slot < list[j].Slot })
+	for i := range list {
+		dropPosition(c, &list[i].Document)
+	}
+	respond(c, http.StatusOK, list)
+}
+
+func getSlot(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := canonicalDocument(username, c.Param("document"))
+	var document Document
+	if c.Param("slot") == SlotCurrent {
+		var ok bool
+		if document, ok = findProgress(username, documentId, requestDeviceId(c)); !ok {
+			c.Error(&SlotNotFound)
+			return
+		}
+	} else {
+		err := getRecord(username, RecordSlot, documentId+":"+c.Param("slot"), &document)
+		if err == ErrNotFound {
+			c.Error(&SlotNotFound)
+			return
+		}
+		if err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	document.DocumentId = c.Param("document")
+	dropPosition(c, &document)
+	respond(c, http.StatusOK, ProgressSlot{Slot: c.Param("slot"), Document: document})
+}
+
+// updateSlot stores a position of the document, sent like a progress update without the document, as the slot
+func updateSlot(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := canonicalDocument(username, c.Param("document"))
+	slot := c.Param("slot")
+	body, err := c.GetRawData()
+	if err != nil {
+		c.Error(&InvalidRequest)
+		return
+	}
+	var document Document
+	if err := json.Unmarshal(body, &document); err != nil || !validKeyField(documentId) || !validSlotName(slot) ||
+		document.Progress == nil || len(document.Progress.raw) > maxProgressRawLength || document.Device == "" ||
+		!validPercentage(document.Percentage) || !validPosition(document.Position) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	document.DocumentId = documentId
+	document.Timestamp = time.Now().Unix()
+	document = slotProgress(document)
+
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	slots, err := documentSlots(username, documentId)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if _, ok := slots[slot]; !ok && len(slots) >= maxSlots {
+		c.Error(&QuotaExceeded)
+		return
+	}
+	if err := putRecord(username, RecordSlot, documentId+":"+slot, document); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	document.DocumentId = c.Param("document")
+	dropPosition(c, &document)
+	respond(c, http.StatusOK, ProgressSlot{Slot: slot, Document: document})
+}
+
+func deleteSlot(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	err := store.DeleteRecord(username, RecordSlot, canonicalDocument(username, c.Param("document"))+":"+c.Param("slot"))
+	if err == ErrNotFound {
+		c.Error(&SlotNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
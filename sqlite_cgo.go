@@ -0,0 +1,68 @@
+//go:build !modernc && !sqlcipher && cgo
+// +build !modernc,!sqlcipher,cgo
+
+package main
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the database/sql driver used by the sqlite3 backend.
+// Build with -tags modernc to use the cgo-free driver instead, see sqlite_modernc.go,
+// or with -tags sqlcipher for encryption, see sqlite_sqlcipher.go. Without cgo, see sqlite_nocgo.go.
+const sqliteDriver = "sqlite3"
+
+const sqlcipherSupported = false
+
+// sqliteDSN adds the configured pragmas as go-sqlite3 connection parameters
+func sqliteDSN(file string) string {
+	params := url.Values{}
+	for _, pragma := range sqlitePragmas() {
+		params.Set("_"+pragma.name, pragma.value)
+	}
+	return withDSNParams(file, params)
+}
+
+// sqliteCompactCopy writes a compacted copy of the database to dest with VACUUM INTO
+func sqliteCompactCopy(db *sqlx.DB, dest string) error {
+	_, err := db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// sqliteBackup copies the database to dest with SQLite's online backup API,
+// which doesn't block the server's connections while copying.
+func sqliteBackup(dest string) error {
+	driver := &sqlite3.SQLiteDriver{}
+	src, err := driver.Open(sqliteDSN(config.DBFile))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := driver.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	backup, err := dst.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+	for done := false; !done; {
+		if done, err = backup.Step(-1); err != nil {
+			backup.Finish()
+			return err
+		}
+	}
+	return backup.Finish()
+}
+
+// sqliteBusy reports whether err means another connection holds a conflicting lock
+func sqliteBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
@@ -0,0 +1,62 @@
+//go:build modernc
+// +build modernc
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDriver is the database/sql driver used by the sqlite3 backend.
+// modernc.org/sqlite is a pure Go translation of SQLite, so this build doesn't need cgo.
+const sqliteDriver = "sqlite"
+
+const sqlcipherSupported = false
+
+func init() {
+	sqlx.BindDriver(sqliteDriver, sqlx.QUESTION)
+}
+
+// sqliteDSN adds the configured pragmas as modernc.org/sqlite _pragma connection parameters
+func sqliteDSN(file string) string {
+	params := url.Values{}
+	for _, pragma := range sqlitePragmas() {
+		params.Add("_pragma", pragma.name+"("+pragma.value+")")
+	}
+	return withDSNParams(file, params)
+}
+
+// sqliteCompactCopy writes a compacted copy of the database to dest with VACUUM INTO
+func sqliteCompactCopy(db *sqlx.DB, dest string) error {
+	_, err := db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// sqliteBackup copies the database to dest. This version of modernc.org/sqlite doesn't expose
+// the online backup API, so it uses VACUUM INTO, which gives a consistent snapshot as well.
+func sqliteBackup(dest string) error {
+	db, err := sql.Open(sqliteDriver, sqliteDSN(config.DBFile))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// sqliteBusy reports whether err means another connection holds a conflicting lock.
+// modernc.org/sqlite reports extended result codes, whose low byte is the primary code.
+func sqliteBusy(err error) bool {
+	const sqliteBusyCode, sqliteLockedCode = 5, 6
+	var sqliteErr interface{ Code() int }
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff
+	return code == sqliteBusyCode || code == sqliteLockedCode
+}
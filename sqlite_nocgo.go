@@ -0,0 +1,53 @@
+//go:build !modernc && !sqlcipher && !cgo
+// +build !modernc,!sqlcipher,!cgo
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the database/sql driver used by the sqlite3 backend. go-sqlite3 needs cgo, without it
+// the driver only reports so; use -db-driver bolt, or build with -tags modernc to keep SQLite.
+const sqliteDriver = "sqlite3"
+
+const sqlcipherSupported = false
+
+// errSQLiteWithoutCgo is returned by the SQLite operations that can't be done without the driver
+var errSQLiteWithoutCgo = errors.New("the sqlite3 backend is unsupported without cgo, rebuild with CGO_ENABLED=1 or -tags modernc")
+
+// sqliteDSN adds the configured pragmas as go-sqlite3 connection parameters
+func sqliteDSN(file string) string {
+	params := url.Values{}
+	for _, pragma := range sqlitePragmas() {
+		params.Set("_"+pragma.name, pragma.value)
+	}
+	return withDSNParams(file, params)
+}
+
+// sqliteCompactCopy writes a compacted copy of the database to dest with VACUUM INTO
+func sqliteCompactCopy(db *sqlx.DB, dest string) error {
+	_, err := db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// sqliteBackup can't open the database without cgo
+func sqliteBackup(dest string) error {
+	return errSQLiteWithoutCgo
+}
+
+// sqliteBusy reports whether err means another connection holds a conflicting lock. The error type
+// of go-sqlite3 needs cgo, so its messages are matched instead.
+func sqliteBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked") ||
+		strings.Contains(message, "SQLITE_BUSY") || strings.Contains(message, "SQLITE_LOCKED")
+}
@@ -0,0 +1,73 @@
+//go:build sqlcipher && !modernc
+// +build sqlcipher,!modernc
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+// sqliteDriver is the database/sql driver used by the sqlite3 backend.
+// go-sqlcipher is a go-sqlite3 fork bundling SQLCipher, so the database can be encrypted at rest.
+const sqliteDriver = "sqlite3"
+
+const sqlcipherSupported = true
+
+// sqliteDSN adds the configured pragmas and the SQLCipher key as connection parameters
+func sqliteDSN(file string) string {
+	params := url.Values{}
+	for _, pragma := range sqlitePragmas() {
+		params.Set("_"+pragma.name, pragma.value)
+	}
+	if config.SQLCipherKey != "" {
+		params.Set("_pragma_key", config.SQLCipherKey)
+	}
+	return withDSNParams(file, params)
+}
+
+// sqliteCompactCopy copies the database to dest, encrypted with the same key
+func sqliteCompactCopy(db *sqlx.DB, dest string) error {
+	return sqlcipherExport(db.DB, dest)
+}
+
+// sqliteBackup copies the database to dest. The online backup API can't copy encrypted
+// databases, so this uses sqlcipher_export like sqliteCompactCopy.
+func sqliteBackup(dest string) error {
+	db, err := sql.Open(sqliteDriver, sqliteDSN(config.DBFile))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return sqlcipherExport(db, dest)
+}
+
+// sqlcipherExport attaches dest and exports the database into it. ATTACH only affects
+// the connection it runs on, so all statements share one connection.
+func sqlcipherExport(db *sql.DB, dest string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS backup KEY ?", dest, config.SQLCipherKey); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "SELECT sqlcipher_export('backup')")
+	if _, detachErr := conn.ExecContext(ctx, "DETACH DATABASE backup"); err == nil {
+		err = detachErr
+	}
+	return err
+}
+
+// sqliteBusy reports whether err means another connection holds a conflicting lock
+func sqliteBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Statistics are the aggregate numbers of the whole server for administrators
+type Statistics struct {
+	Generated int64 `json:"generated"`
+	Users     int   `json:"users"`
+	Documents int   `json:"documents"`
+	// Synced counts the progress of every device updated within the last 24 hours, ActiveUsers the users behind it
+	Synced           int             `json:"synced_24h"`
+	ActiveUsers      int             `json:"active_users_24h"`
+	DatabaseSize     int64           `json:"database_size"`
+	DocumentsPerUser []UserDocuments `json:"documents_per_user"`
+}
+
+type UserDocuments struct {
+	Username  string `db:"username" json:"username"`
+	Documents int    `db:"documents" json:"documents"`
+}
+
+// statisticsMaxAge is how long computed statistics are served from memory, so dashboards
+// polling the endpoint don't run the aggregate queries on every request
+const statisticsMaxAge = time.Minute
+
+var statisticsCache struct {
+	sync.Mutex
+	statistics Statistics
+	expires    time.Time
+}
+
+func getStatistics() (Statistics, error) {
+	statisticsCache.Lock()
+	defer statisticsCache.Unlock()
+	now := time.Now()
+	if now.Before(statisticsCache.expires) {
+		return statisticsCache.statistics, nil
+	}
+	statistics, err := store.GetStatistics(now.Add(-24 * time.Hour).Unix())
+	if err != nil {
+		return statistics, err
+	}
+	statistics.Generated = now.Unix()
+	statisticsCache.statistics = statistics
+	statisticsCache.expires = now.Add(statisticsMaxAge)
+	return statistics, nil
+}
+
+func getAdminStatistics(c *gin.Context) {
+	statistics, err := getStatistics()
+	if err != nil {
+		log.Println("Computing the statistics failed:", err)
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusOK, statistics)
+}
+
+func statsCommand(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the statistics as JSON")
+	flags.Parse(args)
+	statistics, err := getStatistics()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statistics)
+	}
+	fmt.Printf("Users:              %d\n", statistics.Users)
+	fmt.Printf("Documents:          %d\n", statistics.Documents)
+	fmt.Printf("Synced in 24h:      %d positions by %d users\n", statistics.Synced, statistics.ActiveUsers)
+	fmt.Printf("Database size:      %d bytes\n", statistics.DatabaseSize)
+	fmt.Println("Documents per user:")
+	for _, user := range statistics.DocumentsPerUser {
+		fmt.Printf("  %-20s %d\n", user.Username, user.Documents)
+	}
+	return nil
+}
+
+// countUserDocuments adds up the statistics from the documents of one user, for the
+// backends without aggregate queries; documents counts each document once, whatever its devices
+func (statistics *Statistics) countUserDocuments(username string, documents []DbDocument, since int64) {
+	ids := map[string]bool{}
+	synced := 0
+	for _, dbDocument := range documents {
+		if dbDocument.DeletedAt != 0 {
+			continue
+		}
+		ids[dbDocument.DocumentID] = true
+		if dbDocument.UpdatedAt >= since {
+			synced++
+		}
+	}
+	statistics.Users++
+	statistics.Documents += len(ids)
+	statistics.Synced += synced
+	if synced > 0 {
+		statistics.ActiveUsers++
+	}
+	if len(ids) > 0 {
+		statistics.DocumentsPerUser = append(statistics.DocumentsPerUser, UserDocuments{username, len(ids)})
+	}
+}
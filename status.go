@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DocumentStatus is where the user stands with a document, stored as a RecordStatus record per canonical
+// document so all devices share it
+type DocumentStatus struct {
+	DocumentId string `json:"document"`
+	Status     string `json:"status"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+const (
+	StatusReading   = "reading"
+	StatusFinished  = "finished"
+	StatusAbandoned = "abandoned"
+	StatusOnHold    = "on-hold"
+)
+
+func validStatus(status string) bool {
+	switch status {
+	case StatusReading, StatusFinished, StatusAbandoned, StatusOnHold:
+		return true
+	}
+	return false
+}
+
+// documentStatus returns the status of the document, empty when it has none
+func documentStatus(username string, documentId string) string {
+	var status DocumentStatus
+	if err := getRecord(username, RecordStatus, documentId, &status); err != nil {
+		return ""
+	}
+	return status.Status
+}
+
+// setDocumentStatus stores the status of the document unless it has it already
+func setDocumentStatus(username string, documentId string, status string) (DocumentStatus, error) {
+	var stored DocumentStatus
+	err := getRecord(username, RecordStatus, documentId, &stored)
+	if err == nil && stored.Status == status {
+		return stored, nil
+	}
+	if err != nil && err != ErrNotFound {
+		return stored, err
+	}
+	stored = DocumentStatus{DocumentId: documentId, Status: status, UpdatedAt: time.Now().Unix()}
+	return stored, putRecord(username, RecordStatus, documentId, stored)
+}
+
+// userStatuses returns the statuses of the user keyed by document
+func userStatuses(username string) (map[string]DocumentStatus, error) {
+	records, err := store.GetRecords(username, RecordStatus)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]DocumentStatus, len(records))
+	for _, record := range records {
+		var status DocumentStatus
+		if err := json.Unmarshal([]byte(record.Value), &status); err != nil {
+			return nil, err
+		}
+		statuses[record.Name] = status
+	}
+	return statuses, nil
+}
+
+// listStatuses returns the statuses ordered by ?sort=document (default) or updated_at, with ?status= only
+// the documents having that one
+func listStatuses(c *gin.Context) {
+	filter := c.Query("status")
+	if filter != "" && !validStatus(filter) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	records, err := store.GetRecords(c.MustGet("username").(string), RecordStatus)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	statuses := []DocumentStatus{}
+	for _, record := range records {
+		var status DocumentStatus
+		if err := json.Unmarshal([]byte(record.Value), &status); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		if filter == "" || status.Status == filter {
+			statuses = append(statuses, status)
+		}
+	}
+	orders := map[string]listingOrder{
+		"document":   func(i, j int) bool { return statuses[i].DocumentId < statuses[j].DocumentId },
+		"updated_at": func(i, j int) bool { return statuses[i].UpdatedAt < statuses[j].UpdatedAt },
+	}
+	if !sortListing(c, statuses, orders, "document", "asc") {
+		c.Error(&InvalidRequest)
+		return
+	}
+	start, end, ok := pageListing(c, len(statuses), 0)
+	if !ok {
+		c.Error(&InvalidRequest)
+		return
+	}
+	respond(c, http.StatusOK, statuses[start:end])
+}
+
+func getStatus(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var status DocumentStatus
+	err := getRecord(username, RecordStatus, canonicalDocument(username, c.Param("document")), &status)
+	if err == ErrNotFound {
+		c.Error(&StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	status.DocumentId = c.Param("document")
+	respond(c, http.StatusOK, status)
+}
+
+func updateStatus(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request struct {
+		Status string `json:"status"`
+	}
+	if err := bindBody(c, &request); err != nil || !validStatus(request.Status) || !validKeyField(c.Param("document")) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	status, err := setDocumentStatus(username, canonicalDocument(username, c.Param("document")), request.Status)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	status.DocumentId = c.Param("document")
+	respond(c, http.StatusOK, status)
+}
+
+func deleteStatus(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	err := store.DeleteRecord(username, RecordStatus, canonicalDocument(username, c.Param("document")))
+	if err == ErrNotFound {
+		c.Error(&StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
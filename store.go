@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrDevicesUnsupported is returned by the backends keeping a single progress per document
+	ErrDevicesUnsupported = errors.New("the database backend keeps no progress per device")
+)
+
+// Store is the storage backend used by the handlers. Lookups return ErrNotFound when nothing matches,
+// inserts violating a uniqueness rule return ErrAlreadyExists.
+type Store interface {
+	GetUser(username string) (DbUser, error)
+	// GetUsers returns all users ordered by username
+	GetUsers() ([]DbUser, error)
+	AddUser(username string, password string) error
+	// DeleteUser removes the user together with all of their documents, metadata, records and API keys
+	DeleteUser(username string) error
+	UpdateUserPassword(username string, password string) error
+
+	// Progress is kept per document and device_id, so devices don't overwrite each other's position.
+	// GetDocument returns the most recent progress of the document across all devices.
+	GetDocument(username string, documentId string) (Document, error)
+	// GetDocumentDevices returns the progress of each device on the document, newest first, or
+	// ErrDevicesUnsupported
+	GetDocumentDevices(username string, documentId string) ([]Document, error)
+	// GetDocuments returns the progress of every document and device, newest first
+	GetDocuments(username string) ([]Document, error)
+	// UpdateDocument stores the progress of the document on the device and returns the timestamp it
+	// was stored with. The progress is also appended to the document's history, see pruneHistory.
+	UpdateDocument(username string, document Document) (int64, error)
+	// DeleteDocument marks the document progress of all devices as deleted, keeping tombstones so the
+	// deletion can be synced to other devices. Deleted documents are not returned anymore.
+	DeleteDocument(username string, documentId string) error
+	// DeleteDeviceDocuments marks the progress of the device on all documents as deleted like DeleteDocument
+	// and returns how many documents it was deleted from
+	DeleteDeviceDocuments(username string, deviceId string) (int64, error)
+	// GetDeletedDocuments returns the tombstones of the user deleted since, in no particular order
+	GetDeletedDocuments(username string, since int64) ([]DbDocument, error)
+	// ImportDocument stores the device's progress with its own timestamp, without touching the history
+	ImportDocument(username string, document Document) error
+	// PruneDocuments marks the progress rows not updated since before as deleted like DeleteDocument,
+	// removes the tombstones not updated since before, and the history of the documents left without
+	// rows. archive is called with the rows before they change, an error from it aborts the pruning.
+	// It returns the number of rows pruned.
+	PruneDocuments(before int64, archive func(pruned []DbDocument) error) (int, error)
+	// GetDocumentHistory returns the progress history of a document, newest first
+	GetDocumentHistory(username string, documentId string) ([]Document, error)
+
+	GetDocumentMetadata(username string, documentId string) (DbDocumentMetadata, error)
+	// GetDocumentsMetadata returns the metadata of all of the user's documents ordered by document
+	GetDocumentsMetadata(username string) ([]DbDocumentMetadata, error)
+	// SetDocumentMetadata creates or replaces the metadata of a document
+	SetDocumentMetadata(metadata DbDocumentMetadata) error
+	DeleteDocumentMetadata(username string, documentId string) error
+
+	// GetStatistics aggregates the numbers of all users, counting the documents updated since for the
+	// sync activity. DocumentsPerUser is ordered by username and leaves out users without documents.
+	GetStatistics(since int64) (Statistics, error)
+
+	// Records are small JSON values of a user stored by kind and name, for the features without a
+	// table of their own, see records.go. GetRecords returns the records of a kind ordered by name.
+	GetRecord(username string, kind string, name string) (DbRecord, error)
+	GetRecords(username string, kind string) ([]DbRecord, error)
+	// PutRecord creates or replaces a record
+	PutRecord(record DbRecord) error
+	DeleteRecord(username string, kind string, name string) error
+	// FindRecord returns the record of a kind and name of whichever user has it, for records named by a
+	// random id like the share links
+	FindRecord(kind string, name string) (DbRecord, error)
+
+	AddAPIKey(apiKey DbAPIKey) error
+	GetAPIKey(username string, key string) (DbAPIKey, error)
+	GetAPIKeys(username string) ([]DbAPIKey, error)
+	DeleteAPIKey(username string, name string) error
+	DeleteAPIKeys(username string) (int64, error)
+
+	Close() error
+}
+
+var store Store
+
+// foldUserStore is implemented by the backends that can look up a user case-insensitively with an index
+type foldUserStore interface {
+	GetUserFold(username string) (DbUser, error)
+}
+
+// lookupUser finds the account of a username sent by a client. With -case-insensitive-usernames
+// "Alice" finds the account "alice", as well as an account "ALICE" registered before the option was on.
+func lookupUser(username string) (DbUser, error) {
+	user, err := store.GetUser(username)
+	if err != ErrNotFound || !config.CaseInsensitiveUsernames {
+		return user, err
+	}
+	if lower := strings.ToLower(username); lower != username {
+		if user, err = store.GetUser(lower); err != ErrNotFound {
+			return user, err
+		}
+	}
+	if foldUserStore, ok := store.(foldUserStore); ok {
+		return foldUserStore.GetUserFold(username)
+	}
+	users, err := store.GetUsers()
+	if err != nil {
+		return DbUser{}, err
+	}
+	for _, user := range users {
+		if strings.EqualFold(user.Username, username) {
+			return user, nil
+		}
+	}
+	return DbUser{}, ErrNotFound
+}
+
+// normalizeUsername lowercases a new username with -case-insensitive-usernames
+func normalizeUsername(username string) string {
+	if config.CaseInsensitiveUsernames {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+type DbUser struct {
+	Username  string `db:"username"`
+	Password  string `db:"password"`
+	CreatedAt int64  `db:"created_at"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+type DbDocument struct {
+	Username   string  `db:"username"`
+	DocumentID string  `db:"documentid"`
+	Percentage float64 `db:"percentage"`
+	Progress   string  `db:"progress"`
+	// ProgressRaw is the JSON value of the progress as sent, empty when it's Progress quoted
+	ProgressRaw string `db:"progress_raw"`
+	// Position is the JSON of the structured position, empty without one
+	Position  string `db:"position"`
+	Device    string `db:"device"`
+	DeviceId  string `db:"device_id"`
+	Timestamp int64  `db:"timestamp"`
+	// TimestampMs is the timestamp in milliseconds, 0 when stored with -timestamp-precision s
+	TimestampMs int64 `db:"timestamp_ms"`
+	CreatedAt   int64 `db:"created_at"`
+	UpdatedAt   int64 `db:"updated_at"`
+	DeletedAt   int64 `db:"deleted_at"` // 0 unless the document is a tombstone
+}
+
+type DbRecord struct {
+	Username  string `db:"username"`
+	Kind      string `db:"kind"`
+	Name      string `db:"name"`
+	Value     string `db:"value"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+type DbAPIKey struct {
+	Username string `db:"username"`
+	Name     string `db:"name"`
+	Key      string `db:"key"`
+	Scopes   string `db:"scopes"`
+	Created  int64  `db:"created"`
+}
+
+func (dbDocument DbDocument) toDocument() Document {
+	return Document{
+		DocumentId:  dbDocument.DocumentID,
+		Progress:    &StringOrInt{inner: dbDocument.Progress, raw: dbDocument.ProgressRaw},
+		Position:    decodePosition(dbDocument.Position),
+		Device:      dbDocument.Device,
+		Percentage:  dbDocument.Percentage,
+		DeviceId:    dbDocument.DeviceId,
+		Timestamp:   dbDocument.Timestamp,
+		TimestampMs: dbDocument.TimestampMs,
+	}
+}
+
+// sortDocuments orders documents newest first, like the SQL backends return them
+func sortDocuments(documents []Document) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		if documents[i].Timestamp != documents[j].Timestamp {
+			return documents[i].Timestamp > documents[j].Timestamp
+		}
+		return documents[i].TimestampMs > documents[j].TimestampMs
+	})
+}
+
+// stampDocument sets the timestamp of progress being synced, with -timestamp-precision ms in milliseconds
+// as well, so updates of two devices within the same second are still ordered
+func stampDocument(document *Document) {
+	now := time.Now()
+	document.Timestamp = now.Unix()
+	document.TimestampMs = 0
+	if config.MillisecondTimestamps {
+		document.TimestampMs = now.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+func newDbDocument(username string, document Document) DbDocument {
+	return DbDocument{
+		Username:    username,
+		DocumentID:  document.DocumentId,
+		Percentage:  document.Percentage,
+		Progress:    document.Progress.inner,
+		ProgressRaw: document.Progress.raw,
+		Position:    encodePosition(document.Position),
+		Device:      document.Device,
+		DeviceId:    document.DeviceId,
+		Timestamp:   document.Timestamp,
+		TimestampMs: document.TimestampMs,
+	}
+}
+
+// sqliteInMemory is the -d value keeping the sqlite3 database in memory, it's lost on exit
+const sqliteInMemory = ":memory:"
+
+// defaultDBFile keeps using syncdata.db in the working directory when it exists, as earlier versions
+// did, and otherwise puts the database into $XDG_DATA_HOME/kosyncsrv (~/.local/share/kosyncsrv)
+func defaultDBFile() string {
+	if _, err := os.Stat("syncdata.db"); err == nil {
+		return "syncdata.db"
+	}
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "syncdata.db"
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "kosyncsrv", "syncdata.db")
+}
+
+// prepareDBFile creates the directories of the database file and the file itself, readable by the
+// owner only, so the drivers don't fail with an opaque "unable to open database file"
+func prepareDBFile(path string) error {
+	if path == sqliteInMemory {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating the database directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening the database file: %w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("Database file %s is accessible by other users (%v), consider chmod 600", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+func openStore() (Store, error) {
+	switch config.DBDriver {
+	case "sqlite3", "bolt":
+		if err := prepareDBFile(config.DBFile); err != nil {
+			return nil, err
+		}
+	}
+	switch config.DBDriver {
+	case "sqlite3":
+		if err := checkShardFiles(config.DBFile, config.SQLiteShards); err != nil {
+			return nil, err
+		}
+		if config.SQLiteShards > 0 {
+			return openShardedStore(config.DBFile, config.SQLiteShards)
+		}
+		return openSQLStore(sqliteDialect, sqliteDSN(config.DBFile))
+	case "postgres":
+		s, err := openSQLStore(postgresDialect, config.DSN)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.openReplicas(config.DSNReplicas); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	case "mysql":
+		dsn, err := mysqlDSN(config.DSN)
+		if err != nil {
+			return nil, err
+		}
+		return openSQLStore(mysqlDialect, dsn)
+	case "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		return openBoltStore(config.DBFile)
+	case "redis":
+		return openRedisStore(config.DSN)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", config.DBDriver)
+	}
+}
@@ -0,0 +1,786 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket     = []byte("users")
+	boltDocumentsBucket = []byte("documents") // username -> documentid:device_id -> document, see boltDocumentKey
+	boltAPIKeysBucket   = []byte("api_keys")
+	boltHistoryBucket   = []byte("history")  // username -> documentid -> sequence -> document
+	boltMetadataBucket  = []byte("metadata") // username -> documentid -> metadata
+	boltRecordsBucket   = []byte("records")  // username -> kind -> name -> record
+)
+
+// boltStore is a pure Go key/value Store, so the binary can be built with CGO_ENABLED=0.
+// Records are stored as JSON of the same structs the SQL backends use.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltUsersBucket, boltDocumentsBucket, boltAPIKeysBucket, boltHistoryBucket, boltMetadataBucket, boltRecordsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return boltRekeyDocuments(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// boltDocumentKey keys the progress by document and device. validKeyField keeps ':' out of
+// document ids, so the prefix up to the first ':' is always the document.
+func boltDocumentKey(documentId string, deviceId string) string {
+	return documentId + ":" + deviceId
+}
+
+// boltRekeyDocuments moves documents stored by older versions under their document id alone
+// to their boltDocumentKey
+func boltRekeyDocuments(tx *bolt.Tx) error {
+	return tx.Bucket(boltDocumentsBucket).ForEach(func(username, v []byte) error {
+		userDocuments := tx.Bucket(boltDocumentsBucket).Bucket(username)
+		if userDocuments == nil {
+			return nil
+		}
+		var legacy []DbDocument
+		err := userDocuments.ForEach(func(k, v []byte) error {
+			if bytes.IndexByte(k, ':') >= 0 {
+				return nil
+			}
+			var dbDocument DbDocument
+			if err := json.Unmarshal(v, &dbDocument); err != nil {
+				return err
+			}
+			legacy = append(legacy, dbDocument)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, dbDocument := range legacy {
+			if err := userDocuments.Delete([]byte(dbDocument.DocumentID)); err != nil {
+				return err
+			}
+			if err := boltPut(userDocuments, boltDocumentKey(dbDocument.DocumentID, dbDocument.DeviceId), dbDocument); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltDocumentDevices returns the progress rows of all devices on the document, tombstones included
+func boltDocumentDevices(userDocuments *bolt.Bucket, documentId string) ([]DbDocument, error) {
+	var dbDocuments []DbDocument
+	if userDocuments == nil {
+		return dbDocuments, nil
+	}
+	prefix := []byte(boltDocumentKey(documentId, ""))
+	cursor := userDocuments.Cursor()
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		var dbDocument DbDocument
+		if err := json.Unmarshal(v, &dbDocument); err != nil {
+			return nil, err
+		}
+		dbDocuments = append(dbDocuments, dbDocument)
+	}
+	return dbDocuments, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) Backup(dest string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(dest, 0600)
+	})
+}
+
+// Check walks the pages of the file, verifies the buckets exist and that every record decodes
+func (s *boltStore) Check() ([]string, error) {
+	var problems []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, err.Error())
+		}
+		for _, name := range [][]byte{boltUsersBucket, boltDocumentsBucket, boltAPIKeysBucket, boltHistoryBucket, boltMetadataBucket, boltRecordsBucket} {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				problems = append(problems, fmt.Sprintf("bucket %s is missing", name))
+				continue
+			}
+			boltCheckRecords(bucket, string(name), &problems)
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// boltCheckRecords descends into the nested buckets and reports the values that aren't JSON
+func boltCheckRecords(bucket *bolt.Bucket, path string, problems *[]string) {
+	bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			boltCheckRecords(bucket.Bucket(k), path+"/"+string(k), problems)
+		} else if !json.Valid(v) {
+			*problems = append(*problems, fmt.Sprintf("%s/%s is not valid JSON", path, k))
+		}
+		return nil
+	})
+}
+
+func boltGet(bucket *bolt.Bucket, key string, dest interface{}) error {
+	if bucket == nil {
+		return ErrNotFound
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(value, dest)
+}
+
+func boltPut(bucket *bolt.Bucket, key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), b)
+}
+
+func (s *boltStore) GetUser(username string) (DbUser, error) {
+	var user DbUser
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltUsersBucket), username, &user)
+	})
+	return user, err
+}
+
+func (s *boltStore) GetUsers() ([]DbUser, error) {
+	users := []DbUser{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Keys are iterated in byte order, which is the username order
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			var user DbUser
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func (s *boltStore) AddUser(username string, password string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsersBucket)
+		if users.Get([]byte(username)) != nil {
+			return ErrAlreadyExists
+		}
+		now := time.Now().Unix()
+		return boltPut(users, username, DbUser{Username: username, Password: password, CreatedAt: now, UpdatedAt: now})
+	})
+}
+
+func (s *boltStore) DeleteUser(username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsersBucket)
+		if users.Get([]byte(username)) == nil {
+			return ErrNotFound
+		}
+		if err := users.Delete([]byte(username)); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltDocumentsBucket, boltHistoryBucket, boltMetadataBucket, boltRecordsBucket} {
+			bucket := tx.Bucket(name)
+			if bucket.Bucket([]byte(username)) != nil {
+				if err := bucket.DeleteBucket([]byte(username)); err != nil {
+					return err
+				}
+			}
+		}
+		apiKeys, err := userAPIKeys(tx, username)
+		if err != nil {
+			return err
+		}
+		for _, apiKey := range apiKeys {
+			if err := tx.Bucket(boltAPIKeysBucket).Delete([]byte(apiKey.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) UpdateUserPassword(username string, password string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsersBucket)
+		var user DbUser
+		if err := boltGet(users, username, &user); err != nil {
+			return err
+		}
+		user.Password = password
+		user.UpdatedAt = time.Now().Unix()
+		return boltPut(users, username, user)
+	})
+}
+
+func (s *boltStore) GetDocument(username string, documentId string) (Document, error) {
+	documents, err := s.GetDocumentDevices(username, documentId)
+	if err != nil {
+		return Document{}, err
+	}
+	if len(documents) == 0 {
+		return Document{}, ErrNotFound
+	}
+	return documents[0], nil
+}
+
+func (s *boltStore) GetDocumentDevices(username string, documentId string) ([]Document, error) {
+	documents := []Document{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		dbDocuments, err := boltDocumentDevices(tx.Bucket(boltDocumentsBucket).Bucket([]byte(username)), documentId)
+		for _, dbDocument := range dbDocuments {
+			if dbDocument.DeletedAt == 0 {
+				documents = append(documents, dbDocument.toDocument())
+			}
+		}
+		return err
+	})
+	sortDocuments(documents)
+	return documents, err
+}
+
+func (s *boltStore) GetDocuments(username string) ([]Document, error) {
+	documents := []Document{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		userDocuments := tx.Bucket(boltDocumentsBucket).Bucket([]byte(username))
+		if userDocuments == nil {
+			return nil
+		}
+		return userDocuments.ForEach(func(k, v []byte) error {
+			var dbDocument DbDocument
+			if err := json.Unmarshal(v, &dbDocument); err != nil {
+				return err
+			}
+			if dbDocument.DeletedAt == 0 {
+				documents = append(documents, dbDocument.toDocument())
+			}
+			return nil
+		})
+	})
+	sortDocuments(documents)
+	return documents, err
+}
+
+func (s *boltStore) UpdateDocument(username string, document Document) (int64, error) {
+	stampDocument(&document)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		dbDocument, err := boltPutDocument(tx, username, document)
+		if err != nil {
+			return err
+		}
+		if config.HistoryCount > 0 {
+			return boltAppendHistory(tx, dbDocument)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return document.Timestamp, nil
+}
+
+func (s *boltStore) ImportDocument(username string, document Document) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := boltPutDocument(tx, username, document)
+		return err
+	})
+}
+
+func boltPutDocument(tx *bolt.Tx, username string, document Document) (DbDocument, error) {
+	dbDocument := newDbDocument(username, document)
+	userDocuments, err := tx.Bucket(boltDocumentsBucket).CreateBucketIfNotExists([]byte(username))
+	if err != nil {
+		return dbDocument, err
+	}
+	dbDocument.CreatedAt = document.Timestamp
+	dbDocument.UpdatedAt = document.Timestamp
+	key := boltDocumentKey(document.DocumentId, document.DeviceId)
+	var existing DbDocument
+	if err := boltGet(userDocuments, key, &existing); err == nil {
+		dbDocument.CreatedAt = existing.CreatedAt
+	}
+	return dbDocument, boltPut(userDocuments, key, dbDocument)
+}
+
+func (s *boltStore) DeleteDocument(username string, documentId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		userDocuments := tx.Bucket(boltDocumentsBucket).Bucket([]byte(username))
+		dbDocuments, err := boltDocumentDevices(userDocuments, documentId)
+		if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		deleted := false
+		for _, dbDocument := range dbDocuments {
+			if dbDocument.DeletedAt != 0 {
+				continue
+			}
+			dbDocument.DeletedAt = now
+			dbDocument.UpdatedAt = now
+			if err := boltPut(userDocuments, boltDocumentKey(documentId, dbDocument.DeviceId), dbDocument); err != nil {
+				return err
+			}
+			deleted = true
+		}
+		if !deleted {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) DeleteDeviceDocuments(username string, deviceId string) (int64, error) {
+	var deleted int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deleted = 0
+		userDocuments := tx.Bucket(boltDocumentsBucket).Bucket([]byte(username))
+		if userDocuments == nil {
+			return nil
+		}
+		var dbDocuments []DbDocument
+		err := userDocuments.ForEach(func(k, v []byte) error {
+			var dbDocument DbDocument
+			if err := json.Unmarshal(v, &dbDocument); err != nil {
+				return err
+			}
+			if dbDocument.DeviceId == deviceId && dbDocument.DeletedAt == 0 {
+				dbDocuments = append(dbDocuments, dbDocument)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Buckets can't be changed while iterating them
+		now := time.Now().Unix()
+		for _, dbDocument := range dbDocuments {
+			dbDocument.DeletedAt = now
+			dbDocument.UpdatedAt = now
+			if err := boltPut(userDocuments, boltDocumentKey(dbDocument.DocumentID, deviceId), dbDocument); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (s *boltStore) GetDeletedDocuments(username string, since int64) ([]DbDocument, error) {
+	var dbDocuments []DbDocument
+	err := s.db.View(func(tx *bolt.Tx) error {
+		userDocuments := tx.Bucket(boltDocumentsBucket).Bucket([]byte(username))
+		if userDocuments == nil {
+			return nil
+		}
+		return userDocuments.ForEach(func(k, v []byte) error {
+			var dbDocument DbDocument
+			if err := json.Unmarshal(v, &dbDocument); err != nil {
+				return err
+			}
+			if dbDocument.DeletedAt != 0 && dbDocument.DeletedAt >= since {
+				dbDocuments = append(dbDocuments, dbDocument)
+			}
+			return nil
+		})
+	})
+	return dbDocuments, err
+}
+
+func (s *boltStore) PruneDocuments(before int64, archive func(pruned []DbDocument) error) (int, error) {
+	var pruned []DbDocument
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		pruned = nil
+		documents := tx.Bucket(boltDocumentsBucket)
+		err := documents.ForEach(func(username, v []byte) error {
+			userDocuments := documents.Bucket(username)
+			if userDocuments == nil {
+				return nil
+			}
+			return userDocuments.ForEach(func(k, v []byte) error {
+				var dbDocument DbDocument
+				if err := json.Unmarshal(v, &dbDocument); err != nil {
+					return err
+				}
+				if dbDocument.UpdatedAt < before {
+					pruned = append(pruned, dbDocument)
+				}
+				return nil
+			})
+		})
+		if err != nil || len(pruned) == 0 {
+			return err
+		}
+		if err := archive(pruned); err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		for _, dbDocument := range pruned {
+			userDocuments := documents.Bucket([]byte(dbDocument.Username))
+			key := boltDocumentKey(dbDocument.DocumentID, dbDocument.DeviceId)
+			if dbDocument.DeletedAt == 0 {
+				dbDocument.DeletedAt = now
+				dbDocument.UpdatedAt = now
+				if err := boltPut(userDocuments, key, dbDocument); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := userDocuments.Delete([]byte(key)); err != nil {
+				return err
+			}
+			remaining, err := boltDocumentDevices(userDocuments, dbDocument.DocumentID)
+			if err != nil {
+				return err
+			}
+			userHistory := tx.Bucket(boltHistoryBucket).Bucket([]byte(dbDocument.Username))
+			if len(remaining) == 0 && userHistory != nil && userHistory.Bucket([]byte(dbDocument.DocumentID)) != nil {
+				if err := userHistory.DeleteBucket([]byte(dbDocument.DocumentID)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return len(pruned), err
+}
+
+func (s *boltStore) GetStatistics(since int64) (Statistics, error) {
+	statistics := Statistics{DocumentsPerUser: []UserDocuments{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		statistics.DatabaseSize = tx.Size()
+		return tx.Bucket(boltUsersBucket).ForEach(func(username, v []byte) error {
+			var dbDocuments []DbDocument
+			if userDocuments := tx.Bucket(boltDocumentsBucket).Bucket(username); userDocuments != nil {
+				err := userDocuments.ForEach(func(k, v []byte) error {
+					var dbDocument DbDocument
+					if err := json.Unmarshal(v, &dbDocument); err != nil {
+						return err
+					}
+					dbDocuments = append(dbDocuments, dbDocument)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			statistics.countUserDocuments(string(username), dbDocuments, since)
+			return nil
+		})
+	})
+	return statistics, err
+}
+
+// boltAppendHistory adds the progress to the document history, keyed by a big endian
+// sequence so the cursor walks it in insertion order, and prunes it
+func boltAppendHistory(tx *bolt.Tx, dbDocument DbDocument) error {
+	userHistory, err := tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(dbDocument.Username))
+	if err != nil {
+		return err
+	}
+	history, err := userHistory.CreateBucketIfNotExists([]byte(dbDocument.DocumentID))
+	if err != nil {
+		return err
+	}
+	sequence, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	if err := boltPut(history, string(key), dbDocument); err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	var entries []DbDocument
+	cursor := history.Cursor()
+	for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+		var entry DbDocument
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte{}, k...))
+		entries = append(entries, entry)
+	}
+	for _, k := range keys[pruneHistory(entries, dbDocument.Timestamp):] {
+		if err := history.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) GetDocumentHistory(username string, documentId string) ([]Document, error) {
+	history := []Document{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		userHistory := tx.Bucket(boltHistoryBucket).Bucket([]byte(username))
+		if userHistory == nil || userHistory.Bucket([]byte(documentId)) == nil {
+			return nil
+		}
+		cursor := userHistory.Bucket([]byte(documentId)).Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var dbDocument DbDocument
+			if err := json.Unmarshal(v, &dbDocument); err != nil {
+				return err
+			}
+			history = append(history, dbDocument.toDocument())
+		}
+		return nil
+	})
+	return history, err
+}
+
+func (s *boltStore) GetDocumentMetadata(username string, documentId string) (DbDocumentMetadata, error) {
+	var metadata DbDocumentMetadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltMetadataBucket).Bucket([]byte(username)), documentId, &metadata)
+	})
+	return metadata, err
+}
+
+func (s *boltStore) GetDocumentsMetadata(username string) ([]DbDocumentMetadata, error) {
+	metadata := []DbDocumentMetadata{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		userMetadata := tx.Bucket(boltMetadataBucket).Bucket([]byte(username))
+		if userMetadata == nil {
+			return nil
+		}
+		// Keys are iterated in byte order, which is the document order
+		return userMetadata.ForEach(func(k, v []byte) error {
+			var m DbDocumentMetadata
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			metadata = append(metadata, m)
+			return nil
+		})
+	})
+	return metadata, err
+}
+
+func (s *boltStore) SetDocumentMetadata(metadata DbDocumentMetadata) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		userMetadata, err := tx.Bucket(boltMetadataBucket).CreateBucketIfNotExists([]byte(metadata.Username))
+		if err != nil {
+			return err
+		}
+		return boltPut(userMetadata, metadata.DocumentID, metadata)
+	})
+}
+
+func (s *boltStore) DeleteDocumentMetadata(username string, documentId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		userMetadata := tx.Bucket(boltMetadataBucket).Bucket([]byte(username))
+		if userMetadata == nil || userMetadata.Get([]byte(documentId)) == nil {
+			return ErrNotFound
+		}
+		return userMetadata.Delete([]byte(documentId))
+	})
+}
+
+// boltRecords returns the bucket of the user's records of a kind, nil if there are none
+func boltRecords(tx *bolt.Tx, username string, kind string) *bolt.Bucket {
+	userRecords := tx.Bucket(boltRecordsBucket).Bucket([]byte(username))
+	if userRecords == nil {
+		return nil
+	}
+	return userRecords.Bucket([]byte(kind))
+}
+
+func (s *boltStore) GetRecord(username string, kind string, name string) (DbRecord, error) {
+	var record DbRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(boltRecords(tx, username, kind), name, &record)
+	})
+	return record, err
+}
+
+func (s *boltStore) GetRecords(username string, kind string) ([]DbRecord, error) {
+	records := []DbRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRecords(tx, username, kind)
+		if bucket == nil {
+			return nil
+		}
+		// Keys are iterated in byte order, which is the name order
+		return bucket.ForEach(func(k, v []byte) error {
+			var record DbRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *boltStore) PutRecord(record DbRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		userRecords, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(record.Username))
+		if err != nil {
+			return err
+		}
+		bucket, err := userRecords.CreateBucketIfNotExists([]byte(record.Kind))
+		if err != nil {
+			return err
+		}
+		return boltPut(bucket, record.Name, record)
+	})
+}
+
+func (s *boltStore) DeleteRecord(username string, kind string, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRecords(tx, username, kind)
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (s *boltStore) FindRecord(kind string, name string) (DbRecord, error) {
+	var record DbRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltRecordsBucket).Cursor()
+		// The users' records are nested buckets, which have no value
+		for username, value := cursor.First(); username != nil; username, value = cursor.Next() {
+			if value != nil {
+				continue
+			}
+			if err := boltGet(boltRecords(tx, string(username), kind), name, &record); err != ErrNotFound {
+				return err
+			}
+		}
+		return ErrNotFound
+	})
+	return record, err
+}
+
+func (s *boltStore) AddAPIKey(apiKey DbAPIKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		apiKeys := tx.Bucket(boltAPIKeysBucket)
+		if apiKeys.Get([]byte(apiKey.Key)) != nil {
+			return ErrAlreadyExists
+		}
+		err := apiKeys.ForEach(func(k, v []byte) error {
+			var existing DbAPIKey
+			if err := json.Unmarshal(v, &existing); err != nil {
+				return err
+			}
+			if existing.Username == apiKey.Username && existing.Name == apiKey.Name {
+				return ErrAlreadyExists
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return boltPut(apiKeys, apiKey.Key, apiKey)
+	})
+}
+
+func (s *boltStore) GetAPIKey(username string, key string) (DbAPIKey, error) {
+	var apiKey DbAPIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltAPIKeysBucket), key, &apiKey)
+	})
+	if err == nil && apiKey.Username != username {
+		return DbAPIKey{}, ErrNotFound
+	}
+	return apiKey, err
+}
+
+// userAPIKeys returns the API keys of the user in creation order
+func userAPIKeys(tx *bolt.Tx, username string) ([]DbAPIKey, error) {
+	apiKeys := []DbAPIKey{}
+	err := tx.Bucket(boltAPIKeysBucket).ForEach(func(k, v []byte) error {
+		var apiKey DbAPIKey
+		if err := json.Unmarshal(v, &apiKey); err != nil {
+			return err
+		}
+		if apiKey.Username == username {
+			apiKeys = append(apiKeys, apiKey)
+		}
+		return nil
+	})
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].Created < apiKeys[j].Created
+	})
+	return apiKeys, err
+}
+
+func (s *boltStore) GetAPIKeys(username string) ([]DbAPIKey, error) {
+	var apiKeys []DbAPIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		apiKeys, err = userAPIKeys(tx, username)
+		return err
+	})
+	return apiKeys, err
+}
+
+func (s *boltStore) DeleteAPIKey(username string, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		apiKeys, err := userAPIKeys(tx, username)
+		if err != nil {
+			return err
+		}
+		for _, apiKey := range apiKeys {
+			if apiKey.Name == name {
+				return tx.Bucket(boltAPIKeysBucket).Delete([]byte(apiKey.Key))
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+func (s *boltStore) DeleteAPIKeys(username string) (int64, error) {
+	var deleted int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		apiKeys, err := userAPIKeys(tx, username)
+		if err != nil {
+			return err
+		}
+		for _, apiKey := range apiKeys {
+			if err := tx.Bucket(boltAPIKeysBucket).Delete([]byte(apiKey.Key)); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
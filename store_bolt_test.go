@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kosync.bolt")
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data outlives the process
+	s, err = openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if user, err := s.GetUser("alice"); err != nil || user.Password != "new" {
+		t.Errorf("alice after reopening: %+v %v", user, err)
+	}
+	if document, err := s.GetDocument("alice", "doc2"); err != nil || document.Progress.inner != "6" {
+		t.Errorf("progress after reopening: %+v %v", document, err)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory and loses it on exit.
+// It is meant for ephemeral test instances and integration tests.
+type memoryStore struct {
+	mu        sync.RWMutex
+	users     map[string]DbUser
+	documents map[string]map[string]map[string]DbDocument // username -> documentid -> device_id -> document
+	history   map[string]map[string][]DbDocument          // username -> documentid -> history, newest first
+	metadata  map[string]map[string]DbDocumentMetadata    // username -> documentid -> metadata
+	records   map[string]map[string]map[string]DbRecord   // username -> kind -> name -> record
+	apiKeys   map[string]DbAPIKey                         // key -> api key
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:     map[string]DbUser{},
+		documents: map[string]map[string]map[string]DbDocument{},
+		history:   map[string]map[string][]DbDocument{},
+		metadata:  map[string]map[string]DbDocumentMetadata{},
+		records:   map[string]map[string]map[string]DbRecord{},
+		apiKeys:   map[string]DbAPIKey{},
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) GetUser(username string) (DbUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		return user, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) GetUsers() ([]DbUser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]DbUser, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+func (s *memoryStore) AddUser(username string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return ErrAlreadyExists
+	}
+	now := time.Now().Unix()
+	s.users[username] = DbUser{Username: username, Password: password, CreatedAt: now, UpdatedAt: now}
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return ErrNotFound
+	}
+	delete(s.users, username)
+	delete(s.documents, username)
+	delete(s.history, username)
+	delete(s.metadata, username)
+	delete(s.records, username)
+	for key, apiKey := range s.apiKeys {
+		if apiKey.Username == username {
+			delete(s.apiKeys, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpdateUserPassword(username string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = password
+	user.UpdatedAt = time.Now().Unix()
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryStore) GetDocument(username string, documentId string) (Document, error) {
+	documents, _ := s.GetDocumentDevices(username, documentId)
+	if len(documents) == 0 {
+		return Document{}, ErrNotFound
+	}
+	return documents[0], nil
+}
+
+func (s *memoryStore) GetDocumentDevices(username string, documentId string) ([]Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	documents := []Document{}
+	for _, dbDocument := range s.documents[username][documentId] {
+		if dbDocument.DeletedAt == 0 {
+			documents = append(documents, dbDocument.toDocument())
+		}
+	}
+	sortDocuments(documents)
+	return documents, nil
+}
+
+func (s *memoryStore) GetDocuments(username string) ([]Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	documents := []Document{}
+	for _, devices := range s.documents[username] {
+		for _, dbDocument := range devices {
+			if dbDocument.DeletedAt == 0 {
+				documents = append(documents, dbDocument.toDocument())
+			}
+		}
+	}
+	sortDocuments(documents)
+	return documents, nil
+}
+
+func (s *memoryStore) UpdateDocument(username string, document Document) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stampDocument(&document)
+	dbDocument := s.putDocument(username, document)
+	if config.HistoryCount > 0 {
+		if s.history[username] == nil {
+			s.history[username] = map[string][]DbDocument{}
+		}
+		history := append([]DbDocument{dbDocument}, s.history[username][document.DocumentId]...)
+		s.history[username][document.DocumentId] = history[:pruneHistory(history, document.Timestamp)]
+	}
+	return document.Timestamp, nil
+}
+
+func (s *memoryStore) ImportDocument(username string, document Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putDocument(username, document)
+	return nil
+}
+
+// putDocument stores the document with its timestamp, the caller holds the lock
+func (s *memoryStore) putDocument(username string, document Document) DbDocument {
+	if s.documents[username] == nil {
+		s.documents[username] = map[string]map[string]DbDocument{}
+	}
+	devices := s.documents[username][document.DocumentId]
+	if devices == nil {
+		devices = map[string]DbDocument{}
+		s.documents[username][document.DocumentId] = devices
+	}
+	dbDocument := newDbDocument(username, document)
+	dbDocument.CreatedAt = document.Timestamp
+	dbDocument.UpdatedAt = document.Timestamp
+	if existing, ok := devices[document.DeviceId]; ok {
+		dbDocument.CreatedAt = existing.CreatedAt
+	}
+	devices[document.DeviceId] = dbDocument
+	return dbDocument
+}
+
+func (s *memoryStore) DeleteDocument(username string, documentId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := s.documents[username][documentId]
+	now := time.Now().Unix()
+	deleted := false
+	for deviceId, dbDocument := range devices {
+		if dbDocument.DeletedAt == 0 {
+			dbDocument.DeletedAt = now
+			dbDocument.UpdatedAt = now
+			devices[deviceId] = dbDocument
+			deleted = true
+		}
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteDeviceDocuments(username string, deviceId string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	var deleted int64
+	for _, devices := range s.documents[username] {
+		if dbDocument, ok := devices[deviceId]; ok && dbDocument.DeletedAt == 0 {
+			dbDocument.DeletedAt = now
+			dbDocument.UpdatedAt = now
+			devices[deviceId] = dbDocument
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) GetDeletedDocuments(username string, since int64) ([]DbDocument, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var dbDocuments []DbDocument
+	for _, devices := range s.documents[username] {
+		for _, dbDocument := range devices {
+			if dbDocument.DeletedAt != 0 && dbDocument.DeletedAt >= since {
+				dbDocuments = append(dbDocuments, dbDocument)
+			}
+		}
+	}
+	return dbDocuments, nil
+}
+
+func (s *memoryStore) PruneDocuments(before int64, archive func(pruned []DbDocument) error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pruned []DbDocument
+	for _, documents := range s.documents {
+		for _, devices := range documents {
+			for _, dbDocument := range devices {
+				if dbDocument.UpdatedAt < before {
+					pruned = append(pruned, dbDocument)
+				}
+			}
+		}
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	if err := archive(pruned); err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	for _, dbDocument := range pruned {
+		devices := s.documents[dbDocument.Username][dbDocument.DocumentID]
+		if dbDocument.DeletedAt == 0 {
+			dbDocument.DeletedAt = now
+			dbDocument.UpdatedAt = now
+			devices[dbDocument.DeviceId] = dbDocument
+			continue
+		}
+		delete(devices, dbDocument.DeviceId)
+		if len(devices) == 0 {
+			delete(s.documents[dbDocument.Username], dbDocument.DocumentID)
+			delete(s.history[dbDocument.Username], dbDocument.DocumentID)
+		}
+	}
+	return len(pruned), nil
+}
+
+func (s *memoryStore) GetStatistics(since int64) (Statistics, error) {
+	users, _ := s.GetUsers()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statistics := Statistics{DocumentsPerUser: []UserDocuments{}}
+	for _, user := range users {
+		var dbDocuments []DbDocument
+		for _, devices := range s.documents[user.Username] {
+			for _, dbDocument := range devices {
+				dbDocuments = append(dbDocuments, dbDocument)
+			}
+		}
+		statistics.countUserDocuments(user.Username, dbDocuments, since)
+	}
+	return statistics, nil
+}
+
+func (s *memoryStore) GetDocumentHistory(username string, documentId string) ([]Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history := make([]Document, 0, len(s.history[username][documentId]))
+	for _, dbDocument := range s.history[username][documentId] {
+		history = append(history, dbDocument.toDocument())
+	}
+	return history, nil
+}
+
+func (s *memoryStore) GetDocumentMetadata(username string, documentId string) (DbDocumentMetadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	metadata, ok := s.metadata[username][documentId]
+	if !ok {
+		return metadata, ErrNotFound
+	}
+	return metadata, nil
+}
+
+func (s *memoryStore) GetDocumentsMetadata(username string) ([]DbDocumentMetadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	metadata := make([]DbDocumentMetadata, 0, len(s.metadata[username]))
+	for _, m := range s.metadata[username] {
+		metadata = append(metadata, m)
+	}
+	sort.Slice(metadata, func(i, j int) bool {
+		return metadata[i].DocumentID < metadata[j].DocumentID
+	})
+	return metadata, nil
+}
+
+func (s *memoryStore) SetDocumentMetadata(metadata DbDocumentMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.metadata[metadata.Username] == nil {
+		s.metadata[metadata.Username] = map[string]DbDocumentMetadata{}
+	}
+	s.metadata[metadata.Username][metadata.DocumentID] = metadata
+	return nil
+}
+
+func (s *memoryStore) DeleteDocumentMetadata(username string, documentId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.metadata[username][documentId]; !ok {
+		return ErrNotFound
+	}
+	delete(s.metadata[username], documentId)
+	return nil
+}
+
+func (s *memoryStore) GetRecord(username string, kind string, name string) (DbRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[username][kind][name]
+	if !ok {
+		return record, ErrNotFound
+	}
+	return record, nil
+}
+
+func (s *memoryStore) GetRecords(username string, kind string) ([]DbRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]DbRecord, 0, len(s.records[username][kind]))
+	for _, record := range s.records[username][kind] {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+	return records, nil
+}
+
+func (s *memoryStore) PutRecord(record DbRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records[record.Username] == nil {
+		s.records[record.Username] = map[string]map[string]DbRecord{}
+	}
+	if s.records[record.Username][record.Kind] == nil {
+		s.records[record.Username][record.Kind] = map[string]DbRecord{}
+	}
+	s.records[record.Username][record.Kind][record.Name] = record
+	return nil
+}
+
+func (s *memoryStore) DeleteRecord(username string, kind string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[username][kind][name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.records[username][kind], name)
+	return nil
+}
+
+func (s *memoryStore) FindRecord(kind string, name string) (DbRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, userRecords := range s.records {
+		if record, ok := userRecords[kind][name]; ok {
+			return record, nil
+		}
+	}
+	return DbRecord{}, ErrNotFound
+}
+
+func (s *memoryStore) AddAPIKey(apiKey DbAPIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.apiKeys[apiKey.Key]; ok {
+		return ErrAlreadyExists
+	}
+	for _, existing := range s.apiKeys {
+		if existing.Username == apiKey.Username && existing.Name == apiKey.Name {
+			return ErrAlreadyExists
+		}
+	}
+	s.apiKeys[apiKey.Key] = apiKey
+	return nil
+}
+
+func (s *memoryStore) GetAPIKey(username string, key string) (DbAPIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	apiKey, ok := s.apiKeys[key]
+	if !ok || apiKey.Username != username {
+		return DbAPIKey{}, ErrNotFound
+	}
+	return apiKey, nil
+}
+
+func (s *memoryStore) GetAPIKeys(username string) ([]DbAPIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	apiKeys := []DbAPIKey{}
+	for _, apiKey := range s.apiKeys {
+		if apiKey.Username == username {
+			apiKeys = append(apiKeys, apiKey)
+		}
+	}
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].Created < apiKeys[j].Created
+	})
+	return apiKeys, nil
+}
+
+func (s *memoryStore) DeleteAPIKey(username string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, apiKey := range s.apiKeys {
+		if apiKey.Username == username && apiKey.Name == name {
+			delete(s.apiKeys, key)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) DeleteAPIKeys(username string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for key, apiKey := range s.apiKeys {
+		if apiKey.Username == username {
+			delete(s.apiKeys, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
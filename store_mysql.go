@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQL can't put a unique index on TEXT columns and has no CREATE INDEX IF NOT EXISTS,
+// so the keys are declared inline on VARCHAR columns.
+var mysqlMigrations = []migration{
+	{
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS "user" (
+				"username"  VARCHAR(255) NOT NULL,
+				"password"  VARCHAR(255),
+				UNIQUE KEY username (username)
+			) CHARACTER SET utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS "document" (
+				"username"  VARCHAR(255) NOT NULL,
+				"documentid"  VARCHAR(255) NOT NULL,
+				"percentage"  DOUBLE,
+				"progress"  VARCHAR(255),
+				"device"  VARCHAR(255),
+				"device_id"  VARCHAR(255),
+				"timestamp"  BIGINT,
+				UNIQUE KEY username_documentid (username, documentid)
+			) CHARACTER SET utf8mb4`,
+		},
+		down: []string{`DROP TABLE "document"`, `DROP TABLE "user"`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS "api_key" (
+				"username"  VARCHAR(255) NOT NULL,
+				"name"  VARCHAR(255) NOT NULL,
+				"key"  VARCHAR(255) NOT NULL,
+				"scopes"  VARCHAR(255),
+				"created"  BIGINT,
+				UNIQUE KEY username_name (username, name),
+				UNIQUE KEY api_key_key ("key")
+			) CHARACTER SET utf8mb4`,
+		},
+		down: []string{`DROP TABLE "api_key"`},
+	},
+	{
+		up: []string{
+			`DELETE FROM "document" WHERE username NOT IN (SELECT username FROM "user")`,
+			`ALTER TABLE "document" ADD CONSTRAINT document_user_fk
+				FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE`,
+			`DELETE FROM "api_key" WHERE username NOT IN (SELECT username FROM "user")`,
+			`ALTER TABLE "api_key" ADD CONSTRAINT api_key_user_fk
+				FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP FOREIGN KEY document_user_fk`,
+			`ALTER TABLE "api_key" DROP FOREIGN KEY api_key_user_fk`,
+		},
+	},
+	{
+		// CHECK constraints are enforced from MySQL 8.0.16 and MariaDB 10.2 on
+		up: append(append([]string{}, cleanupConstraintViolations...),
+			`ALTER TABLE "user" MODIFY "password" VARCHAR(255) NOT NULL`,
+			`ALTER TABLE "document"
+				MODIFY "percentage" DOUBLE NOT NULL DEFAULT 0,
+				MODIFY "progress" VARCHAR(255) NOT NULL,
+				MODIFY "device" VARCHAR(255) NOT NULL,
+				MODIFY "device_id" VARCHAR(255) NOT NULL DEFAULT '',
+				MODIFY "timestamp" BIGINT NOT NULL,
+				ADD CONSTRAINT document_percentage_range CHECK (percentage BETWEEN 0 AND 1),
+				ADD CONSTRAINT document_timestamp_positive CHECK ("timestamp" > 0)`,
+			`ALTER TABLE "api_key" MODIFY "scopes" VARCHAR(255) NOT NULL, MODIFY "created" BIGINT NOT NULL`,
+		),
+		down: []string{
+			`ALTER TABLE "user" MODIFY "password" VARCHAR(255)`,
+			`ALTER TABLE "document"
+				DROP CONSTRAINT document_percentage_range,
+				DROP CONSTRAINT document_timestamp_positive,
+				MODIFY "percentage" DOUBLE,
+				MODIFY "progress" VARCHAR(255),
+				MODIFY "device" VARCHAR(255),
+				MODIFY "device_id" VARCHAR(255),
+				MODIFY "timestamp" BIGINT`,
+			`ALTER TABLE "api_key" MODIFY "scopes" VARCHAR(255), MODIFY "created" BIGINT`,
+		},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "user" ADD COLUMN "created_at" BIGINT NOT NULL DEFAULT 0, ADD COLUMN "updated_at" BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document" ADD COLUMN "created_at" BIGINT NOT NULL DEFAULT 0, ADD COLUMN "updated_at" BIGINT NOT NULL DEFAULT 0`,
+			`UPDATE "document" SET created_at="timestamp", updated_at="timestamp"`,
+			`UPDATE "user" SET updated_at=UNIX_TIMESTAMP(),
+				created_at=COALESCE((SELECT MIN("timestamp") FROM "document" WHERE document.username="user".username), UNIX_TIMESTAMP())`,
+		},
+		down: []string{
+			`ALTER TABLE "user" DROP COLUMN "created_at", DROP COLUMN "updated_at"`,
+			`ALTER TABLE "document" DROP COLUMN "created_at", DROP COLUMN "updated_at"`,
+		},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "document_history" (
+				"id"  BIGINT AUTO_INCREMENT PRIMARY KEY,
+				"username"  VARCHAR(255) NOT NULL,
+				"documentid"  VARCHAR(255) NOT NULL,
+				"percentage"  DOUBLE NOT NULL DEFAULT 0,
+				"progress"  VARCHAR(255) NOT NULL,
+				"device"  VARCHAR(255) NOT NULL,
+				"device_id"  VARCHAR(255) NOT NULL DEFAULT '',
+				"timestamp"  BIGINT NOT NULL,
+				CONSTRAINT document_history_user_fk
+					FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE,
+				KEY document_history_username_documentid (username, documentid)
+			) CHARACTER SET utf8mb4`,
+		},
+		down: []string{`DROP TABLE "document_history"`},
+	},
+	{
+		up:   []string{`ALTER TABLE "document" ADD COLUMN "deleted_at" BIGINT NOT NULL DEFAULT 0`},
+		down: []string{`ALTER TABLE "document" DROP COLUMN "deleted_at"`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "document_metadata" (
+				"username"  VARCHAR(255) NOT NULL,
+				"documentid"  VARCHAR(255) NOT NULL,
+				"title"  VARCHAR(255) NOT NULL,
+				"author"  VARCHAR(255) NOT NULL DEFAULT '',
+				"series"  VARCHAR(255) NOT NULL DEFAULT '',
+				"updated_at"  BIGINT NOT NULL,
+				CONSTRAINT document_metadata_user_fk
+					FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE,
+				UNIQUE KEY document_metadata_username_documentid (username, documentid)
+			) CHARACTER SET utf8mb4`,
+		},
+		down: []string{`DROP TABLE "document_metadata"`},
+	},
+	{
+		// The new key is added first, the foreign key on username needs an index starting with it
+		up: []string{
+			`ALTER TABLE "document" ADD UNIQUE KEY username_documentid_device_id (username, documentid, device_id),
+				DROP INDEX username_documentid`,
+		},
+		down: []string{
+			`DELETE document FROM "document" JOIN "document" newer
+				ON newer.username=document.username AND newer.documentid=document.documentid
+				AND (newer.timestamp > document.timestamp OR (newer.timestamp = document.timestamp AND newer.device_id > document.device_id))`,
+			`ALTER TABLE "document" ADD UNIQUE KEY username_documentid (username, documentid),
+				DROP INDEX username_documentid_device_id`,
+		},
+	},
+	{
+		up: []string{
+			clampHistoryPercentage,
+			`ALTER TABLE "document_history" ADD CONSTRAINT document_history_percentage_range CHECK (percentage BETWEEN 0 AND 1)`,
+		},
+		down: []string{`ALTER TABLE "document_history" DROP CONSTRAINT document_history_percentage_range`},
+	},
+	{
+		up:   []string{`ALTER TABLE "document" ADD KEY document_updated_at (updated_at)`},
+		down: []string{`ALTER TABLE "document" DROP KEY document_updated_at`},
+	},
+	{
+		// TEXT columns can't have a default before MySQL 8.0.13, maxProgressRawLength fits the VARCHAR
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "progress_raw" VARCHAR(1024) NOT NULL DEFAULT ''`,
+			`ALTER TABLE "document_history" ADD COLUMN "progress_raw" VARCHAR(1024) NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "progress_raw"`,
+			`ALTER TABLE "document_history" DROP COLUMN "progress_raw"`,
+		},
+	},
+	{
+		// Names are shorter than elsewhere, so the unique key stays within InnoDB's 3072 byte limit
+		up: []string{
+			`CREATE TABLE "user_record" (
+				"username"  VARCHAR(255) NOT NULL,
+				"kind"  VARCHAR(64) NOT NULL,
+				"name"  VARCHAR(191) NOT NULL,
+				"value"  MEDIUMTEXT NOT NULL,
+				"updated_at"  BIGINT NOT NULL,
+				CONSTRAINT user_record_user_fk
+					FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE,
+				UNIQUE KEY user_record_username_kind_name (username, kind, name)
+			) CHARACTER SET utf8mb4`,
+		},
+		down: []string{`DROP TABLE "user_record"`},
+	},
+	{
+		// Fits the JSON of a Position with the longest chapter and xpointer
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "position" VARCHAR(4096) NOT NULL DEFAULT ''`,
+			`ALTER TABLE "document_history" ADD COLUMN "position" VARCHAR(4096) NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "position"`,
+			`ALTER TABLE "document_history" DROP COLUMN "position"`,
+		},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "timestamp_ms" BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document_history" ADD COLUMN "timestamp_ms" BIGINT NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "timestamp_ms"`,
+			`ALTER TABLE "document_history" DROP COLUMN "timestamp_ms"`,
+		},
+	},
+	{
+		// Lets FindRecord look up a record without its user
+		up:   []string{`ALTER TABLE "user_record" ADD KEY user_record_kind_name (kind, name)`},
+		down: []string{`ALTER TABLE "user_record" DROP KEY user_record_kind_name`},
+	},
+}
+
+var mysqlDialect = sqlDialect{
+	driver:     "mysql",
+	migrations: mysqlMigrations,
+	upsert:     upsertOnDuplicateKey,
+	sizeQuery: `SELECT COALESCE(SUM(data_length + index_length + data_free), 0)
+		FROM information_schema.tables WHERE table_schema = DATABASE()`,
+	maintain:       mysqlOptimizeTables,
+	integrityCheck: mysqlCheckTables,
+	// Connections are recycled before MySQL's wait_timeout closes them on the server side
+	pool: poolSettings{maxOpenConns: 20, maxIdleConns: 10, connMaxLifetime: 5 * time.Minute},
+}
+
+// mysqlTableStatus is a row of the result of OPTIMIZE TABLE and CHECK TABLE, errors are reported in it
+type mysqlTableStatus struct {
+	Table   string `db:"Table"`
+	Op      string `db:"Op"`
+	MsgType string `db:"Msg_type"`
+	MsgText string `db:"Msg_text"`
+}
+
+// mysqlTables returns the names of the tables in the database
+func mysqlTables(db *sqlx.DB) ([]string, error) {
+	var tables []string
+	err := db.Select(&tables, "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE()")
+	return tables, err
+}
+
+// mysqlOptimizeTables rebuilds every table of the database, which also updates the index statistics
+func mysqlOptimizeTables(db *sqlx.DB) error {
+	tables, err := mysqlTables(db)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		var status []mysqlTableStatus
+		if err := db.Select(&status, `OPTIMIZE TABLE "`+table+`"`); err != nil {
+			return err
+		}
+		for _, row := range status {
+			if row.MsgType == "error" {
+				return fmt.Errorf("optimizing %s: %s", table, row.MsgText)
+			}
+		}
+	}
+	return nil
+}
+
+// mysqlCheckTables runs CHECK TABLE on every table of the database
+func mysqlCheckTables(db *sqlx.DB) ([]string, error) {
+	tables, err := mysqlTables(db)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, table := range tables {
+		var status []mysqlTableStatus
+		if err := db.Select(&status, `CHECK TABLE "`+table+`"`); err != nil {
+			return nil, err
+		}
+		for _, row := range status {
+			if row.MsgType == "error" || row.MsgType == "warning" {
+				problems = append(problems, fmt.Sprintf("%s: %s", table, row.MsgText))
+			}
+		}
+	}
+	return problems, nil
+}
+
+func upsertOnDuplicateKey(table string, keys []string, columns []string) string {
+	var updates []string
+	for _, column := range upsertUpdatedColumns(keys, columns) {
+		updates = append(updates, `"`+column+`"=VALUES("`+column+`")`)
+	}
+	return insertStatement(table, columns) + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+// mysqlDSN enables ANSI_QUOTES on every connection, so the double quoted identifiers
+// shared with the other SQL backends keep working.
+func mysqlDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["sql_mode"] = "CONCAT(@@sql_mode, ',ANSI_QUOTES')"
+	return cfg.FormatDSN(), nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+var postgresMigrations = []migration{
+	{
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS "user" (
+				"username"  TEXT NOT NULL,
+				"password"  TEXT
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS username ON "user"(username)`,
+			`CREATE TABLE IF NOT EXISTS "document" (
+				"username"  TEXT NOT NULL,
+				"documentid"  TEXT NOT NULL,
+				"percentage"  DOUBLE PRECISION,
+				"progress"  TEXT,
+				"device"  TEXT,
+				"device_id"  TEXT,
+				"timestamp"  BIGINT
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS username_documentid ON document(username,documentid)`,
+		},
+		down: []string{`DROP TABLE "document"`, `DROP TABLE "user"`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS "api_key" (
+				"username"  TEXT NOT NULL,
+				"name"  TEXT NOT NULL,
+				"key"  TEXT NOT NULL,
+				"scopes"  TEXT,
+				"created"  BIGINT
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS username_name ON api_key(username,name)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS api_key_key ON api_key("key")`,
+		},
+		down: []string{`DROP TABLE "api_key"`},
+	},
+	{
+		up: []string{
+			`DELETE FROM "document" WHERE username NOT IN (SELECT username FROM "user")`,
+			`ALTER TABLE "document" ADD CONSTRAINT document_user_fk
+				FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE`,
+			`DELETE FROM "api_key" WHERE username NOT IN (SELECT username FROM "user")`,
+			`ALTER TABLE "api_key" ADD CONSTRAINT api_key_user_fk
+				FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP CONSTRAINT document_user_fk`,
+			`ALTER TABLE "api_key" DROP CONSTRAINT api_key_user_fk`,
+		},
+	},
+	{
+		up: append(append([]string{}, cleanupConstraintViolations...),
+			`ALTER TABLE "user" ALTER COLUMN password SET NOT NULL`,
+			`ALTER TABLE "document"
+				ALTER COLUMN percentage SET DEFAULT 0, ALTER COLUMN percentage SET NOT NULL,
+				ALTER COLUMN progress SET NOT NULL,
+				ALTER COLUMN device SET NOT NULL,
+				ALTER COLUMN device_id SET DEFAULT '', ALTER COLUMN device_id SET NOT NULL,
+				ALTER COLUMN timestamp SET NOT NULL,
+				ADD CONSTRAINT document_percentage_range CHECK (percentage BETWEEN 0 AND 1),
+				ADD CONSTRAINT document_timestamp_positive CHECK (timestamp > 0)`,
+			`ALTER TABLE "api_key" ALTER COLUMN scopes SET NOT NULL, ALTER COLUMN created SET NOT NULL`,
+		),
+		down: []string{
+			`ALTER TABLE "user" ALTER COLUMN password DROP NOT NULL`,
+			`ALTER TABLE "document"
+				ALTER COLUMN percentage DROP DEFAULT, ALTER COLUMN percentage DROP NOT NULL,
+				ALTER COLUMN progress DROP NOT NULL,
+				ALTER COLUMN device DROP NOT NULL,
+				ALTER COLUMN device_id DROP DEFAULT, ALTER COLUMN device_id DROP NOT NULL,
+				ALTER COLUMN timestamp DROP NOT NULL,
+				DROP CONSTRAINT document_percentage_range,
+				DROP CONSTRAINT document_timestamp_positive`,
+			`ALTER TABLE "api_key" ALTER COLUMN scopes DROP NOT NULL, ALTER COLUMN created DROP NOT NULL`,
+		},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "user" ADD COLUMN "created_at" BIGINT NOT NULL DEFAULT 0, ADD COLUMN "updated_at" BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document" ADD COLUMN "created_at" BIGINT NOT NULL DEFAULT 0, ADD COLUMN "updated_at" BIGINT NOT NULL DEFAULT 0`,
+			`UPDATE "document" SET created_at="timestamp", updated_at="timestamp"`,
+			`UPDATE "user" SET updated_at=EXTRACT(EPOCH FROM now())::BIGINT,
+				created_at=COALESCE((SELECT MIN("timestamp") FROM "document" WHERE document.username="user".username), EXTRACT(EPOCH FROM now())::BIGINT)`,
+		},
+		down: []string{
+			`ALTER TABLE "user" DROP COLUMN "created_at", DROP COLUMN "updated_at"`,
+			`ALTER TABLE "document" DROP COLUMN "created_at", DROP COLUMN "updated_at"`,
+		},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "document_history" (
+				"id"  BIGSERIAL PRIMARY KEY,
+				"username"  TEXT NOT NULL,
+				"documentid"  TEXT NOT NULL,
+				"percentage"  DOUBLE PRECISION NOT NULL DEFAULT 0,
+				"progress"  TEXT NOT NULL,
+				"device"  TEXT NOT NULL,
+				"device_id"  TEXT NOT NULL DEFAULT '',
+				"timestamp"  BIGINT NOT NULL,
+				CONSTRAINT document_history_user_fk
+					FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE
+			)`,
+			`CREATE INDEX document_history_username_documentid ON document_history(username,documentid)`,
+		},
+		down: []string{`DROP TABLE "document_history"`},
+	},
+	{
+		up:   []string{`ALTER TABLE "document" ADD COLUMN "deleted_at" BIGINT NOT NULL DEFAULT 0`},
+		down: []string{`ALTER TABLE "document" DROP COLUMN "deleted_at"`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "document_metadata" (
+				"username"  TEXT NOT NULL,
+				"documentid"  TEXT NOT NULL,
+				"title"  TEXT NOT NULL,
+				"author"  TEXT NOT NULL DEFAULT '',
+				"series"  TEXT NOT NULL DEFAULT '',
+				"updated_at"  BIGINT NOT NULL,
+				CONSTRAINT document_metadata_user_fk
+					FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE
+			)`,
+			`CREATE UNIQUE INDEX document_metadata_username_documentid ON document_metadata(username,documentid)`,
+		},
+		down: []string{`DROP TABLE "document_metadata"`},
+	},
+	{
+		up: []string{
+			`DROP INDEX username_documentid`,
+			`CREATE UNIQUE INDEX username_documentid_device_id ON document(username,documentid,device_id)`,
+		},
+		down: []string{
+			collapseDeviceDocuments,
+			`DROP INDEX username_documentid_device_id`,
+			`CREATE UNIQUE INDEX username_documentid ON document(username,documentid)`,
+		},
+	},
+	{
+		up: []string{
+			clampHistoryPercentage,
+			`ALTER TABLE "document_history" ADD CONSTRAINT document_history_percentage_range CHECK (percentage BETWEEN 0 AND 1)`,
+		},
+		down: []string{`ALTER TABLE "document_history" DROP CONSTRAINT document_history_percentage_range`},
+	},
+	{
+		up:   []string{`CREATE INDEX document_updated_at ON document(updated_at)`},
+		down: []string{`DROP INDEX document_updated_at`},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "progress_raw" TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE "document_history" ADD COLUMN "progress_raw" TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "progress_raw"`,
+			`ALTER TABLE "document_history" DROP COLUMN "progress_raw"`,
+		},
+	},
+	{
+		// Looks up the users case-insensitively for -case-insensitive-usernames
+		up:   []string{`CREATE INDEX user_username_lower ON "user"(LOWER(username))`},
+		down: []string{`DROP INDEX user_username_lower`},
+	},
+	{
+		up: []string{
+			`CREATE TABLE "user_record" (
+				"username"  TEXT NOT NULL,
+				"kind"  TEXT NOT NULL,
+				"name"  TEXT NOT NULL,
+				"value"  TEXT NOT NULL,
+				"updated_at"  BIGINT NOT NULL,
+				CONSTRAINT user_record_user_fk
+					FOREIGN KEY (username) REFERENCES "user"(username) ON DELETE CASCADE
+			)`,
+			`CREATE UNIQUE INDEX user_record_username_kind_name ON user_record(username,kind,name)`,
+		},
+		down: []string{`DROP TABLE "user_record"`},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "position" TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE "document_history" ADD COLUMN "position" TEXT NOT NULL DEFAULT ''`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "position"`,
+			`ALTER TABLE "document_history" DROP COLUMN "position"`,
+		},
+	},
+	{
+		up: []string{
+			`ALTER TABLE "document" ADD COLUMN "timestamp_ms" BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE "document_history" ADD COLUMN "timestamp_ms" BIGINT NOT NULL DEFAULT 0`,
+		},
+		down: []string{
+			`ALTER TABLE "document" DROP COLUMN "timestamp_ms"`,
+			`ALTER TABLE "document_history" DROP COLUMN "timestamp_ms"`,
+		},
+	},
+	{
+		// Lets FindRecord look up a record without its user
+		up:   []string{`CREATE INDEX user_record_kind_name ON user_record(kind,name)`},
+		down: []string{`DROP INDEX user_record_kind_name`},
+	},
+}
+
+var postgresDialect = sqlDialect{
+	driver:     "postgres",
+	migrations: postgresMigrations,
+	upsert:     upsertOnConflict,
+	sizeQuery:  "SELECT pg_database_size(current_database())",
+	// Plain VACUUM makes the space reusable without the exclusive locks of VACUUM FULL
+	maintain: execStatements("VACUUM ANALYZE"),
+	// PostgreSQL has no integrity check short of the amcheck extension, which needs a superuser
+	pool: poolSettings{maxOpenConns: 20, maxIdleConns: 10, connMaxLifetime: time.Hour},
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Key layout of the original koreader-sync-server, so existing Redis data can be used as is.
+// The ':' separator is why validKeyField rejects usernames and documents containing it.
+const (
+	redisUserKey     = "user:%s:key"
+	redisDocumentKey = "user:%s:document:%s"
+)
+
+// API keys are not part of the original layout and live under their own prefix.
+const (
+	redisAPIKeyKey      = "kosyncsrv:apikey:%s"          // key -> JSON encoded DbAPIKey
+	redisUserAPIKeyKey  = "kosyncsrv:user:%s:apikeys"    // hash of name -> key
+	redisUserMetaKey    = "kosyncsrv:user:%s:meta"       // hash of created_at, updated_at
+	redisHistoryKey     = "kosyncsrv:user:%s:history:%s" // list of JSON encoded DbDocument, newest first
+	redisMetadataKey    = "kosyncsrv:user:%s:metadata"   // hash of documentid -> JSON encoded DbDocumentMetadata
+	redisRecordsKey     = "kosyncsrv:user:%s:records"    // hash of kind:name -> JSON encoded DbRecord
+	redisRecordOwnerKey = "kosyncsrv:records:%s"         // hash of name -> username of the records of a kind
+	// redisRecordsIndexedKey is set once the records stored before redisRecordOwnerKey are indexed
+	redisRecordsIndexedKey = "kosyncsrv:records-indexed"
+)
+
+// redisGlobEscaper escapes the characters that are special in SCAN MATCH patterns
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+type redisStore struct {
+	pool *redis.Pool
+}
+
+func openRedisStore(url string) (*redisStore, error) {
+	pool := &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url)
+		},
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	s := &redisStore{pool: pool}
+	if err := s.indexRecords(); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("indexing the records: %w", err)
+	}
+	return s, nil
+}
+
+// indexRecords adds the records stored by earlier versions to the owners of their kind, once
+func (s *redisStore) indexRecords() error {
+	indexed, err := redis.Bool(s.do("EXISTS", redisRecordsIndexedKey))
+	if err != nil || indexed {
+		return err
+	}
+	prefix, suffix := "kosyncsrv:user:", ":records"
+	keys, err := s.scanKeys(prefix + "*" + suffix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		username := strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)
+		// History keys of a document named records match the pattern as well
+		if strings.Contains(username, ":") {
+			continue
+		}
+		fields, err := redis.Strings(s.do("HKEYS", key))
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			kind, name := splitRedisRecordField(field)
+			if _, err := s.do("HSET", fmt.Sprintf(redisRecordOwnerKey, kind), name, username); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = s.do("SET", redisRecordsIndexedKey, 1)
+	return err
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
+
+func (s *redisStore) do(command string, args ...interface{}) (interface{}, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return conn.Do(command, args...)
+}
+
+func (s *redisStore) GetUser(username string) (DbUser, error) {
+	password, err := redis.String(s.do("GET", fmt.Sprintf(redisUserKey, username)))
+	if err == redis.ErrNil {
+		return DbUser{}, ErrNotFound
+	}
+	if err != nil {
+		return DbUser{}, err
+	}
+	user := DbUser{Username: username, Password: password}
+	// Users created by the original server have no meta hash and keep zero timestamps
+	meta, err := redis.Int64Map(s.do("HGETALL", fmt.Sprintf(redisUserMetaKey, username)))
+	if err != nil {
+		return DbUser{}, err
+	}
+	user.CreatedAt = meta["created_at"]
+	user.UpdatedAt = meta["updated_at"]
+	return user, nil
+}
+
+func (s *redisStore) GetUsers() ([]DbUser, error) {
+	prefix, suffix := "user:", ":key"
+	keys, err := s.scanKeys(prefix + "*" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	users := []DbUser{}
+	for _, key := range keys {
+		username := strings.TrimSuffix(strings.TrimPrefix(key, prefix), suffix)
+		// Document keys like user:alice:document:key match the pattern as well
+		if strings.Contains(username, ":") {
+			continue
+		}
+		user, err := s.GetUser(username)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// scanKeys returns the keys matching the SCAN MATCH pattern
+func (s *redisStore) scanKeys(pattern string) ([]string, error) {
+	var keys []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(s.do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+func (s *redisStore) AddUser(username string, password string) error {
+	added, err := redis.Bool(s.do("SETNX", fmt.Sprintf(redisUserKey, username), password))
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrAlreadyExists
+	}
+	now := time.Now().Unix()
+	_, err = s.do("HMSET", fmt.Sprintf(redisUserMetaKey, username), "created_at", now, "updated_at", now)
+	return err
+}
+
+func (s *redisStore) DeleteUser(username string) error {
+	if _, err := s.GetUser(username); err != nil {
+		return err
+	}
+	dbDocuments, err := s.scanDocuments(username)
+	if err != nil {
+		return err
+	}
+	for _, dbDocument := range dbDocuments {
+		_, err := s.do("DEL", fmt.Sprintf(redisDocumentKey, username, dbDocument.DocumentID),
+			fmt.Sprintf(redisHistoryKey, username, dbDocument.DocumentID))
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := s.DeleteAPIKeys(username); err != nil {
+		return err
+	}
+	fields, err := redis.Strings(s.do("HKEYS", fmt.Sprintf(redisRecordsKey, username)))
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		kind, name := splitRedisRecordField(field)
+		if _, err := s.do("HDEL", fmt.Sprintf(redisRecordOwnerKey, kind), name); err != nil {
+			return err
+		}
+	}
+	_, err = s.do("DEL", fmt.Sprintf(redisUserKey, username), fmt.Sprintf(redisUserMetaKey, username),
+		fmt.Sprintf(redisMetadataKey, username), fmt.Sprintf(redisRecordsKey, username))
+	return err
+}
+
+func (s *redisStore) UpdateUserPassword(username string, password string) error {
+	updated, err := redis.String(s.do("SET", fmt.Sprintf(redisUserKey, username), password, "XX"))
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if updated != "OK" {
+		return ErrNotFound
+	}
+	_, err = s.do("HSET", fmt.Sprintf(redisUserMetaKey, username), "updated_at", time.Now().Unix())
+	return err
+}
+
+func (s *redisStore) getDocument(key string) (DbDocument, error) {
+	fields, err := redis.StringMap(s.do("HGETALL", key))
+	if err != nil {
+		return DbDocument{}, err
+	}
+	if len(fields) == 0 {
+		return DbDocument{}, ErrNotFound
+	}
+	return redisDocumentFromFields(fields), nil
+}
+
+// redisDocumentFromFields converts a document hash. The original server stores everything
+// as strings; tolerate missing or odd numbers like it does.
+func redisDocumentFromFields(fields map[string]string) DbDocument {
+	var dbDocument DbDocument
+	dbDocument.Percentage, _ = strconv.ParseFloat(fields["percentage"], 64)
+	dbDocument.Progress = fields["progress"]
+	dbDocument.ProgressRaw = fields["progress_raw"]
+	dbDocument.Position = fields["position"]
+	dbDocument.TimestampMs, _ = strconv.ParseInt(fields["timestamp_ms"], 10, 64)
+	dbDocument.Device = fields["device"]
+	dbDocument.DeviceId = fields["device_id"]
+	dbDocument.Timestamp, _ = strconv.ParseInt(fields["timestamp"], 10, 64)
+	dbDocument.CreatedAt, _ = strconv.ParseInt(fields["created_at"], 10, 64)
+	dbDocument.UpdatedAt, _ = strconv.ParseInt(fields["updated_at"], 10, 64)
+	dbDocument.DeletedAt, _ = strconv.ParseInt(fields["deleted_at"], 10, 64)
+	return dbDocument
+}
+
+func (s *redisStore) GetDocument(username string, documentId string) (Document, error) {
+	dbDocument, err := s.getDocument(fmt.Sprintf(redisDocumentKey, username, documentId))
+	if err != nil {
+		return Document{}, err
+	}
+	if dbDocument.DeletedAt != 0 {
+		return Document{}, ErrNotFound
+	}
+	dbDocument.Username = username
+	dbDocument.DocumentID = documentId
+	return dbDocument.toDocument(), nil
+}
+
+// GetDocumentDevices is unsupported: the original key layout has one hash per document, so the devices
+// share it and the last one to sync wins
+func (s *redisStore) GetDocumentDevices(username string, documentId string) ([]Document, error) {
+	return nil, ErrDevicesUnsupported
+}
+
+// scanDocuments returns all documents of the user, tombstones included
+func (s *redisStore) scanDocuments(username string) ([]DbDocument, error) {
+	prefix := fmt.Sprintf(redisDocumentKey, username, "")
+	keys, err := s.scanKeys(redisGlobEscaper.Replace(prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+	var dbDocuments []DbDocument
+	for _, key := range keys {
+		dbDocument, err := s.getDocument(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		dbDocument.Username = username
+		dbDocument.DocumentID = strings.TrimPrefix(key, prefix)
+		dbDocuments = append(dbDocuments, dbDocument)
+	}
+	return dbDocuments, nil
+}
+
+func (s *redisStore) GetDocuments(username string) ([]Document, error) {
+	dbDocuments, err := s.scanDocuments(username)
+	if err != nil {
+		return nil, err
+	}
+	documents := []Document{}
+	for _, dbDocument := range dbDocuments {
+		if dbDocument.DeletedAt == 0 {
+			documents = append(documents, dbDocument.toDocument())
+		}
+	}
+	sortDocuments(documents)
+	return documents, nil
+}
+
+func (s *redisStore) UpdateDocument(username string, document Document) (int64, error) {
+	stampDocument(&document)
+	dbDocument, err := s.putDocument(username, document)
+	if err != nil {
+		return 0, err
+	}
+	if config.HistoryCount > 0 {
+		if err := s.appendHistory(dbDocument); err != nil {
+			return 0, err
+		}
+	}
+	return document.Timestamp, nil
+}
+
+func (s *redisStore) ImportDocument(username string, document Document) error {
+	_, err := s.putDocument(username, document)
+	return err
+}
+
+func (s *redisStore) putDocument(username string, document Document) (DbDocument, error) {
+	dbDocument := newDbDocument(username, document)
+	key := fmt.Sprintf(redisDocumentKey, username, document.DocumentId)
+	_, err := s.do("HMSET", key,
+		"percentage", dbDocument.Percentage,
+		"progress", dbDocument.Progress,
+		"progress_raw", dbDocument.ProgressRaw,
+		"position", dbDocument.Position,
+		"device", dbDocument.Device,
+		"device_id", dbDocument.DeviceId,
+		"timestamp", dbDocument.Timestamp,
+		"timestamp_ms", dbDocument.TimestampMs,
+		"updated_at", dbDocument.Timestamp,
+		"deleted_at", 0)
+	if err != nil {
+		return dbDocument, err
+	}
+	_, err = s.do("HSETNX", key, "created_at", dbDocument.Timestamp)
+	return dbDocument, err
+}
+
+// DeleteDocument keeps the hash as a tombstone. Note that the original koreader-sync-server
+// doesn't know about deleted_at and still returns the progress.
+func (s *redisStore) DeleteDocument(username string, documentId string) error {
+	key := fmt.Sprintf(redisDocumentKey, username, documentId)
+	dbDocument, err := s.getDocument(key)
+	if err != nil {
+		return err
+	}
+	if dbDocument.DeletedAt != 0 {
+		return ErrNotFound
+	}
+	now := time.Now().Unix()
+	_, err = s.do("HMSET", key, "deleted_at", now, "updated_at", now)
+	return err
+}
+
+// DeleteDeviceDocuments deletes the documents last synced by the device, the redis backend keeps
+// only the latest progress of each document
+func (s *redisStore) DeleteDeviceDocuments(username string, deviceId string) (int64, error) {
+	dbDocuments, err := s.scanDocuments(username)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	var deleted int64
+	for _, dbDocument := range dbDocuments {
+		if dbDocument.DeviceId != deviceId || dbDocument.DeletedAt != 0 {
+			continue
+		}
+		if _, err := s.do("HMSET", fmt.Sprintf(redisDocumentKey, username, dbDocument.DocumentID), "deleted_at", now, "updated_at", now); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (s *redisStore) GetDeletedDocuments(username string, since int64) ([]DbDocument, error) {
+	dbDocuments, err := s.scanDocuments(username)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []DbDocument
+	for _, dbDocument := range dbDocuments {
+		if dbDocument.DeletedAt != 0 && dbDocument.DeletedAt >= since {
+			deleted = append(deleted, dbDocument)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *redisStore) PruneDocuments(before int64, archive func(pruned []DbDocument) error) (int, error) {
+	users, err := s.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+	var pruned []DbDocument
+	for _, user := range users {
+		dbDocuments, err := s.scanDocuments(user.Username)
+		if err != nil {
+			return 0, err
+		}
+		for _, dbDocument := range dbDocuments {
+			// Documents written by the original server have no updated_at
+			updated := dbDocument.UpdatedAt
+			if updated == 0 {
+				updated = dbDocument.Timestamp
+			}
+			if updated < before {
+				pruned = append(pruned, dbDocument)
+			}
+		}
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	if err := archive(pruned); err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	for _, dbDocument := range pruned {
+		key := fmt.Sprintf(redisDocumentKey, dbDocument.Username, dbDocument.DocumentID)
+		if dbDocument.DeletedAt == 0 {
+			if _, err := s.do("HMSET", key, "deleted_at", now, "updated_at", now); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		_, err := s.do("DEL", key, fmt.Sprintf(redisHistoryKey, dbDocument.Username, dbDocument.DocumentID))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pruned), nil
+}
+
+// GetStatistics scans all keys, unlike the other backends Redis has no way to aggregate
+func (s *redisStore) GetStatistics(since int64) (Statistics, error) {
+	statistics := Statistics{DocumentsPerUser: []UserDocuments{}}
+	users, err := s.GetUsers()
+	if err != nil {
+		return statistics, err
+	}
+	for _, user := range users {
+		dbDocuments, err := s.scanDocuments(user.Username)
+		if err != nil {
+			return statistics, err
+		}
+		for i := range dbDocuments {
+			// Documents written by the original server have no updated_at
+			if dbDocuments[i].UpdatedAt == 0 {
+				dbDocuments[i].UpdatedAt = dbDocuments[i].Timestamp
+			}
+		}
+		statistics.countUserDocuments(user.Username, dbDocuments, since)
+	}
+	info, err := redis.String(s.do("INFO", "memory"))
+	if err != nil {
+		return statistics, err
+	}
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, "used_memory:") {
+			statistics.DatabaseSize, _ = strconv.ParseInt(strings.TrimPrefix(line, "used_memory:"), 10, 64)
+		}
+	}
+	return statistics, nil
+}
+
+func (s *redisStore) appendHistory(dbDocument DbDocument) error {
+	b, err := json.Marshal(dbDocument)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf(redisHistoryKey, dbDocument.Username, dbDocument.DocumentID)
+	if _, err := s.do("LPUSH", key, b); err != nil {
+		return err
+	}
+	history, err := s.getHistory(key)
+	if err != nil {
+		return err
+	}
+	kept := pruneHistory(history, dbDocument.Timestamp)
+	if kept == 0 {
+		_, err = s.do("DEL", key)
+		return err
+	}
+	_, err = s.do("LTRIM", key, 0, kept-1)
+	return err
+}
+
+func (s *redisStore) getHistory(key string) ([]DbDocument, error) {
+	values, err := redis.ByteSlices(s.do("LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	history := make([]DbDocument, 0, len(values))
+	for _, value := range values {
+		var dbDocument DbDocument
+		if err := json.Unmarshal(value, &dbDocument); err != nil {
+			return nil, err
+		}
+		history = append(history, dbDocument)
+	}
+	return history, nil
+}
+
+func (s *redisStore) GetDocumentHistory(username string, documentId string) ([]Document, error) {
+	dbDocuments, err := s.getHistory(fmt.Sprintf(redisHistoryKey, username, documentId))
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Document, 0, len(dbDocuments))
+	for _, dbDocument := range dbDocuments {
+		history = append(history, dbDocument.toDocument())
+	}
+	return history, nil
+}
+
+func (s *redisStore) GetDocumentMetadata(username string, documentId string) (DbDocumentMetadata, error) {
+	var metadata DbDocumentMetadata
+	b, err := redis.Bytes(s.do("HGET", fmt.Sprintf(redisMetadataKey, username), documentId))
+	if err == redis.ErrNil {
+		return metadata, ErrNotFound
+	}
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(b, &metadata)
+	return metadata, err
+}
+
+func (s *redisStore) GetDocumentsMetadata(username string) ([]DbDocumentMetadata, error) {
+	values, err := redis.StringMap(s.do("HGETALL", fmt.Sprintf(redisMetadataKey, username)))
+	if err != nil {
+		return nil, err
+	}
+	metadata := make([]DbDocumentMetadata, 0, len(values))
+	for _, value := range values {
+		var m DbDocumentMetadata
+		if err := json.Unmarshal([]byte(value), &m); err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, m)
+	}
+	sort.Slice(metadata, func(i, j int) bool {
+		return metadata[i].DocumentID < metadata[j].DocumentID
+	})
+	return metadata, nil
+}
+
+func (s *redisStore) SetDocumentMetadata(metadata DbDocumentMetadata) error {
+	b, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = s.do("HSET", fmt.Sprintf(redisMetadataKey, metadata.Username), metadata.DocumentID, b)
+	return err
+}
+
+func (s *redisStore) DeleteDocumentMetadata(username string, documentId string) error {
+	deleted, err := redis.Int(s.do("HDEL", fmt.Sprintf(redisMetadataKey, username), documentId))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// redisRecordField keys a record in the user's hash, kinds never contain ':'
+func redisRecordField(kind string, name string) string {
+	return kind + ":" + name
+}
+
+func splitRedisRecordField(field string) (string, string) {
+	i := strings.IndexByte(field, ':')
+	return field[:i], field[i+1:]
+}
+
+func (s *redisStore) GetRecord(username string, kind string, name string) (DbRecord, error) {
+	var record DbRecord
+	b, err := redis.Bytes(s.do("HGET", fmt.Sprintf(redisRecordsKey, username), redisRecordField(kind, name)))
+	if err == redis.ErrNil {
+		return record, ErrNotFound
+	}
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(b, &record)
+	return record, err
+}
+
+func (s *redisStore) GetRecords(username string, kind string) ([]DbRecord, error) {
+	values, err := redis.StringMap(s.do("HGETALL", fmt.Sprintf(redisRecordsKey, username)))
+	if err != nil {
+		return nil, err
+	}
+	records := []DbRecord{}
+	for field, value := range values {
+		if !strings.HasPrefix(field, kind+":") {
+			continue
+		}
+		var record DbRecord
+		if err := json.Unmarshal([]byte(value), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Name < records[j].Name
+	})
+	return records, nil
+}
+
+func (s *redisStore) PutRecord(record DbRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do("HSET", fmt.Sprintf(redisRecordsKey, record.Username), redisRecordField(record.Kind, record.Name), b); err != nil {
+		return err
+	}
+	_, err = s.do("HSET", fmt.Sprintf(redisRecordOwnerKey, record.Kind), record.Name, record.Username)
+	return err
+}
+
+func (s *redisStore) DeleteRecord(username string, kind string, name string) error {
+	deleted, err := redis.Int(s.do("HDEL", fmt.Sprintf(redisRecordsKey, username), redisRecordField(kind, name)))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	_, err = s.do("HDEL", fmt.Sprintf(redisRecordOwnerKey, kind), name)
+	return err
+}
+
+func (s *redisStore) FindRecord(kind string, name string) (DbRecord, error) {
+	username, err := redis.String(s.do("HGET", fmt.Sprintf(redisRecordOwnerKey, kind), name))
+	if err == redis.ErrNil {
+		return DbRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return DbRecord{}, err
+	}
+	return s.GetRecord(username, kind, name)
+}
+
+func (s *redisStore) AddAPIKey(apiKey DbAPIKey) error {
+	b, err := json.Marshal(apiKey)
+	if err != nil {
+		return err
+	}
+	added, err := redis.Bool(s.do("HSETNX", fmt.Sprintf(redisUserAPIKeyKey, apiKey.Username), apiKey.Name, apiKey.Key))
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrAlreadyExists
+	}
+	_, err = s.do("SET", fmt.Sprintf(redisAPIKeyKey, apiKey.Key), b)
+	return err
+}
+
+func (s *redisStore) GetAPIKey(username string, key string) (DbAPIKey, error) {
+	var apiKey DbAPIKey
+	b, err := redis.Bytes(s.do("GET", fmt.Sprintf(redisAPIKeyKey, key)))
+	if err == redis.ErrNil {
+		return apiKey, ErrNotFound
+	}
+	if err != nil {
+		return apiKey, err
+	}
+	if err := json.Unmarshal(b, &apiKey); err != nil {
+		return apiKey, err
+	}
+	if apiKey.Username != username {
+		return DbAPIKey{}, ErrNotFound
+	}
+	return apiKey, nil
+}
+
+func (s *redisStore) GetAPIKeys(username string) ([]DbAPIKey, error) {
+	keys, err := redis.StringMap(s.do("HGETALL", fmt.Sprintf(redisUserAPIKeyKey, username)))
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := []DbAPIKey{}
+	for _, key := range keys {
+		apiKey, err := s.GetAPIKey(username, key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].Created < apiKeys[j].Created
+	})
+	return apiKeys, nil
+}
+
+func (s *redisStore) DeleteAPIKey(username string, name string) error {
+	userKeys := fmt.Sprintf(redisUserAPIKeyKey, username)
+	key, err := redis.String(s.do("HGET", userKeys, name))
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := s.do("DEL", fmt.Sprintf(redisAPIKeyKey, key)); err != nil {
+		return err
+	}
+	_, err = s.do("HDEL", userKeys, name)
+	return err
+}
+
+func (s *redisStore) DeleteAPIKeys(username string) (int64, error) {
+	apiKeys, err := s.GetAPIKeys(username)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, apiKey := range apiKeys {
+		if err := s.DeleteAPIKey(username, apiKey.Name); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+// The Redis backend is tested against miniredis, an in-process implementation of the commands it uses
+
+func startTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+func openTestRedisStore(t *testing.T, server *miniredis.Miniredis) *redisStore {
+	t.Helper()
+	s, err := openRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(t, openTestRedisStore(t, startTestRedis(t)))
+}
+
+func TestRedisStoreOriginalLayout(t *testing.T) {
+	server := startTestRedis(t)
+	// Data of the original koreader-sync-server, which has no meta hashes and stores numbers as strings
+	server.Set("user:alice:key", "pw")
+	for field, value := range map[string]string{
+		"percentage": "0.25",
+		"progress":   "/body/p[3]",
+		"device":     "kobo",
+		"device_id":  "K1",
+		"timestamp":  "1000",
+	} {
+		server.HSet("user:alice:document:doc1", field, value)
+	}
+	s := openTestRedisStore(t, server)
+
+	if user, err := s.GetUser("alice"); err != nil || user.Password != "pw" || user.CreatedAt != 0 {
+		t.Errorf("user of the original server: %+v %v", user, err)
+	}
+	document, err := s.GetDocument("alice", "doc1")
+	if err != nil || document.Percentage != 0.25 || document.Progress.inner != "/body/p[3]" || document.Timestamp != 1000 {
+		t.Errorf("progress of the original server: %+v %v", document, err)
+	}
+
+	if _, err := s.UpdateDocument("alice", testStoreDocument("doc1", "/body/p[4]", 0.3, "K1", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if progress := server.HGet("user:alice:document:doc1", "progress"); progress != "/body/p[4]" {
+		t.Errorf("progress stored as %q, the original server can't read it", progress)
+	}
+}
+
+func TestRedisStoreIndexesRecords(t *testing.T) {
+	server := startTestRedis(t)
+	s := openTestRedisStore(t, server)
+	if err := s.AddUser("alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutRecord(DbRecord{Username: "alice", Kind: RecordShare, Name: "token1", Value: "{}", UpdatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records stored before the index was kept are indexed when the store is opened
+	server.Del(redisRecordsIndexedKey)
+	server.Del(fmt.Sprintf(redisRecordOwnerKey, RecordShare))
+	s = openTestRedisStore(t, server)
+	if record, err := s.FindRecord(RecordShare, "token1"); err != nil || record.Username != "alice" {
+		t.Errorf("record stored before the index: %+v %v", record, err)
+	}
+}
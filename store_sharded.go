@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// shardedStore spreads the documents of the sqlite3 backend over -sqlite-shards database files by a hash
+// of the username, so users syncing at the same time don't wait for each other's write lock. Users and
+// API keys stay in the main database. Each shard holds a row for each of its users, which only anchors
+// the foreign keys; the password is kept in the main database alone.
+type shardedStore struct {
+	main   *sqlStore
+	shards []*sqlStore
+}
+
+// shardFile returns the file of shard i of n, e.g. syncdata-shard-3-of-8.db
+func shardFile(path string, i int, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-shard-%d-of-%d%s", strings.TrimSuffix(path, ext), i+1, n, ext)
+}
+
+// checkShardFiles makes sure the shard files next to path were created with n shards, the users
+// would be looked up in the wrong shards otherwise
+func checkShardFiles(path string, n int) error {
+	ext := filepath.Ext(path)
+	existing, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-shard-*-of-*" + ext)
+	if err != nil {
+		return err
+	}
+	for _, file := range existing {
+		if !strings.HasSuffix(file, fmt.Sprintf("-of-%d%s", n, ext)) {
+			return fmt.Errorf("%s was created with a different -sqlite-shards count", file)
+		}
+	}
+	return nil
+}
+
+func openShardedStore(path string, n int) (*shardedStore, error) {
+	main, err := openSQLStore(sqliteDialect, sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	s := &shardedStore{main: main}
+	for i := 0; i < n; i++ {
+		file := shardFile(path, i, n)
+		if err := prepareDBFile(file); err != nil {
+			s.Close()
+			return nil, err
+		}
+		shard, err := openSQLStore(sqliteDialect, sqliteDSN(file))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		s.shards = append(s.shards, shard)
+	}
+	if config.SkipMigrations {
+		return s, nil
+	}
+	if err := s.adoptUsers(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// adoptUsers adds the users of the main database missing in their shard, e.g. after sharding was
+// turned on. Progress already stored in the main database isn't moved.
+func (s *shardedStore) adoptUsers() error {
+	var documents int
+	if err := s.main.get(&documents, "SELECT COUNT(*) FROM document"); err != nil {
+		return err
+	}
+	if documents > 0 {
+		return fmt.Errorf("%s holds progress outside the shards, export it and import it into a new database with -sqlite-shards", config.DBFile)
+	}
+	users, err := s.main.GetUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := s.shard(user.Username).AddUser(user.Username, ""); err != nil && err != ErrAlreadyExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) shard(username string) *sqlStore {
+	hash := fnv.New32a()
+	hash.Write([]byte(username))
+	return s.shards[hash.Sum32()%uint32(len(s.shards))]
+}
+
+// sqlStores returns the main database followed by the shards
+func (s *shardedStore) sqlStores() []*sqlStore {
+	return append([]*sqlStore{s.main}, s.shards...)
+}
+
+func (s *shardedStore) GetUser(username string) (DbUser, error) {
+	return s.main.GetUser(username)
+}
+
+func (s *shardedStore) GetUserFold(username string) (DbUser, error) {
+	return s.main.GetUserFold(username)
+}
+
+func (s *shardedStore) GetUsers() ([]DbUser, error) {
+	return s.main.GetUsers()
+}
+
+func (s *shardedStore) AddUser(username string, password string) error {
+	if err := s.main.AddUser(username, password); err != nil {
+		return err
+	}
+	// A leftover row of a user whose deletion failed halfway is reused
+	if err := s.shard(username).AddUser(username, ""); err != nil && err != ErrAlreadyExists {
+		s.main.DeleteUser(username)
+		return err
+	}
+	return nil
+}
+
+// DeleteUser removes the documents first, a failure leaves the account in place to try again
+func (s *shardedStore) DeleteUser(username string) error {
+	if err := s.shard(username).DeleteUser(username); err != nil {
+		return err
+	}
+	return s.main.DeleteUser(username)
+}
+
+func (s *shardedStore) UpdateUserPassword(username string, password string) error {
+	return s.main.UpdateUserPassword(username, password)
+}
+
+func (s *shardedStore) GetDocument(username string, documentId string) (Document, error) {
+	return s.shard(username).GetDocument(username, documentId)
+}
+
+func (s *shardedStore) GetDocumentDevices(username string, documentId string) ([]Document, error) {
+	return s.shard(username).GetDocumentDevices(username, documentId)
+}
+
+func (s *shardedStore) GetDocuments(username string) ([]Document, error) {
+	return s.shard(username).GetDocuments(username)
+}
+
+func (s *shardedStore) UpdateDocument(username string, document Document) (int64, error) {
+	return s.shard(username).UpdateDocument(username, document)
+}
+
+func (s *shardedStore) DeleteDocument(username string, documentId string) error {
+	return s.shard(username).DeleteDocument(username, documentId)
+}
+
+func (s *shardedStore) DeleteDeviceDocuments(username string, deviceId string) (int64, error) {
+	return s.shard(username).DeleteDeviceDocuments(username, deviceId)
+}
+
+func (s *shardedStore) GetDeletedDocuments(username string, since int64) ([]DbDocument, error) {
+	return s.shard(username).GetDeletedDocuments(username, since)
+}
+
+func (s *shardedStore) ImportDocument(username string, document Document) error {
+	return s.shard(username).ImportDocument(username, document)
+}
+
+func (s *shardedStore) PruneDocuments(before int64, archive func(pruned []DbDocument) error) (int, error) {
+	total := 0
+	for _, shard := range s.shards {
+		pruned, err := shard.PruneDocuments(before, archive)
+		total += pruned
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *shardedStore) GetDocumentHistory(username string, documentId string) ([]Document, error) {
+	return s.shard(username).GetDocumentHistory(username, documentId)
+}
+
+func (s *shardedStore) GetDocumentMetadata(username string, documentId string) (DbDocumentMetadata, error) {
+	return s.shard(username).GetDocumentMetadata(username, documentId)
+}
+
+func (s *shardedStore) GetDocumentsMetadata(username string) ([]DbDocumentMetadata, error) {
+	return s.shard(username).GetDocumentsMetadata(username)
+}
+
+func (s *shardedStore) SetDocumentMetadata(metadata DbDocumentMetadata) error {
+	return s.shard(metadata.Username).SetDocumentMetadata(metadata)
+}
+
+func (s *shardedStore) DeleteDocumentMetadata(username string, documentId string) error {
+	return s.shard(username).DeleteDocumentMetadata(username, documentId)
+}
+
+// GetStatistics counts the users in the main database and adds up the documents of the shards
+func (s *shardedStore) GetStatistics(since int64) (Statistics, error) {
+	statistics, err := s.main.GetStatistics(since)
+	if err != nil {
+		return statistics, err
+	}
+	for _, shard := range s.shards {
+		shardStatistics, err := shard.GetStatistics(since)
+		if err != nil {
+			return statistics, err
+		}
+		statistics.Documents += shardStatistics.Documents
+		statistics.Synced += shardStatistics.Synced
+		statistics.ActiveUsers += shardStatistics.ActiveUsers
+		statistics.DatabaseSize += shardStatistics.DatabaseSize
+		statistics.DocumentsPerUser = append(statistics.DocumentsPerUser, shardStatistics.DocumentsPerUser...)
+	}
+	sort.Slice(statistics.DocumentsPerUser, func(i, j int) bool {
+		return statistics.DocumentsPerUser[i].Username < statistics.DocumentsPerUser[j].Username
+	})
+	return statistics, nil
+}
+
+func (s *shardedStore) GetRecord(username string, kind string, name string) (DbRecord, error) {
+	return s.shard(username).GetRecord(username, kind, name)
+}
+
+func (s *shardedStore) GetRecords(username string, kind string) ([]DbRecord, error) {
+	return s.shard(username).GetRecords(username, kind)
+}
+
+func (s *shardedStore) PutRecord(record DbRecord) error {
+	return s.shard(record.Username).PutRecord(record)
+}
+
+func (s *shardedStore) DeleteRecord(username string, kind string, name string) error {
+	return s.shard(username).DeleteRecord(username, kind, name)
+}
+
+func (s *shardedStore) FindRecord(kind string, name string) (DbRecord, error) {
+	for _, shard := range s.shards {
+		record, err := shard.FindRecord(kind, name)
+		if err != ErrNotFound {
+			return record, err
+		}
+	}
+	return DbRecord{}, ErrNotFound
+}
+
+func (s *shardedStore) AddAPIKey(apiKey DbAPIKey) error {
+	return s.main.AddAPIKey(apiKey)
+}
+
+func (s *shardedStore) GetAPIKey(username string, key string) (DbAPIKey, error) {
+	return s.main.GetAPIKey(username, key)
+}
+
+func (s *shardedStore) GetAPIKeys(username string) ([]DbAPIKey, error) {
+	return s.main.GetAPIKeys(username)
+}
+
+func (s *shardedStore) DeleteAPIKey(username string, name string) error {
+	return s.main.DeleteAPIKey(username, name)
+}
+
+func (s *shardedStore) DeleteAPIKeys(username string) (int64, error) {
+	return s.main.DeleteAPIKeys(username)
+}
+
+func (s *shardedStore) Maintain() (MaintenanceResult, error) {
+	var total MaintenanceResult
+	for _, sqlStore := range s.sqlStores() {
+		result, err := sqlStore.Maintain()
+		if err != nil {
+			return total, err
+		}
+		total.SizeBefore += result.SizeBefore
+		total.SizeAfter += result.SizeAfter
+	}
+	return total, nil
+}
+
+func (s *shardedStore) Check() ([]string, error) {
+	problems, err := s.main.Check()
+	if err != nil {
+		return nil, err
+	}
+	for i, shard := range s.shards {
+		found, err := shard.Check()
+		if err != nil {
+			return nil, err
+		}
+		for _, problem := range found {
+			problems = append(problems, fmt.Sprintf("shard %d: %s", i+1, problem))
+		}
+	}
+	return problems, nil
+}
+
+func (s *shardedStore) Close() error {
+	var err error
+	for _, sqlStore := range s.sqlStores() {
+		if sqlStore == nil {
+			continue
+		}
+		if closeErr := sqlStore.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
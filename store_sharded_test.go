@@ -0,0 +1,86 @@
+//go:build cgo || modernc
+// +build cgo modernc
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func openTestShardedStore(t *testing.T, path string, n int) *shardedStore {
+	t.Helper()
+	s, err := openShardedStore(path, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestShardedStore(t *testing.T) {
+	testStore(t, openTestShardedStore(t, filepath.Join(t.TempDir(), "syncdata.db"), 4))
+}
+
+func TestShardedProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "syncdata.db")
+	router := newTestRouter(t)
+	s := openTestShardedStore(t, path, 4)
+	store = s
+	users := []string{"alice", "bob", "carol", "dave", "erin"}
+	for _, username := range users {
+		registerTestUser(t, router, "", username, "pw")
+		syncTestProgress(t, router, "", username, "pw", "doc-"+username, "0.5")
+	}
+
+	var documents int
+	if err := s.main.get(&documents, "SELECT COUNT(*) FROM document"); err != nil || documents != 0 {
+		t.Errorf("%d documents in the main database %v, want none", documents, err)
+	}
+	for _, username := range users {
+		for i, shard := range s.shards {
+			err := shard.get(&documents, "SELECT COUNT(*) FROM document WHERE username=?", username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if shard == s.shard(username) {
+				want = 1
+			}
+			if documents != want {
+				t.Errorf("%d documents of %s in shard %d, want %d", documents, username, i+1, want)
+			}
+		}
+		w := testRequest(router, http.MethodGet, "/syncs/progress/doc-"+username, "", username, "pw")
+		if w.Code != http.StatusOK {
+			t.Errorf("progress of %s: %d %s", username, w.Code, w.Body)
+		}
+	}
+
+	if err := checkShardFiles(path, 4); err != nil {
+		t.Errorf("the same shard count: %v", err)
+	}
+	if err := checkShardFiles(path, 8); err == nil {
+		t.Error("a different shard count is accepted")
+	}
+}
+
+func TestShardingRefusesUnshardedProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "syncdata.db")
+	s, err := openSQLStore(sqliteDialect, sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUser("alice", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportDocument("alice", testStoreDocument("doc1", "1", 0.01, "K1", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if sharded, err := openShardedStore(path, 2); err == nil {
+		sharded.Close()
+		t.Error("sharding a database holding progress")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"testing"
+)
+
+func testStoreDocument(documentId string, progress string, percentage float64, deviceId string, timestamp int64) Document {
+	return Document{
+		DocumentId: documentId,
+		Progress:   &StringOrInt{inner: progress},
+		Percentage: percentage,
+		Device:     "device " + deviceId,
+		DeviceId:   deviceId,
+		Timestamp:  timestamp,
+	}
+}
+
+// testStore runs the behaviour every backend shares, see the Store interface, against an empty store s
+func testStore(t *testing.T, s Store) {
+	t.Run("users", func(t *testing.T) { testStoreUsers(t, s) })
+	t.Run("documents", func(t *testing.T) { testStoreDocuments(t, s) })
+	t.Run("metadata", func(t *testing.T) { testStoreMetadata(t, s) })
+	t.Run("records", func(t *testing.T) { testStoreRecords(t, s) })
+	t.Run("API keys", func(t *testing.T) { testStoreAPIKeys(t, s) })
+	t.Run("deleting a user", func(t *testing.T) { testStoreDeleteUser(t, s) })
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	for _, username := range []string{"bob", "alice"} {
+		if err := s.AddUser(username, "pw-"+username); err != nil {
+			t.Fatalf("adding %s: %v", username, err)
+		}
+	}
+	if err := s.AddUser("alice", "other"); err != ErrAlreadyExists {
+		t.Errorf("adding alice again: %v", err)
+	}
+	if _, err := s.GetUser("carol"); err != ErrNotFound {
+		t.Errorf("unknown user: %v", err)
+	}
+	if err := s.UpdateUserPassword("alice", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := s.GetUser("alice"); err != nil || user.Password != "new" {
+		t.Errorf("alice after the password change: %+v %v", user, err)
+	}
+	if err := s.UpdateUserPassword("carol", "new"); err != ErrNotFound {
+		t.Errorf("password change of an unknown user: %v", err)
+	}
+	users, err := s.GetUsers()
+	if err != nil || len(users) != 2 || users[0].Username != "alice" || users[1].Username != "bob" {
+		t.Errorf("users: %+v %v", users, err)
+	}
+}
+
+func testStoreDocuments(t *testing.T, s Store) {
+	for _, document := range []Document{
+		testStoreDocument("doc1", "10", 0.1, "K1", 1000),
+		testStoreDocument("doc1", "20", 0.2, "P1", 2000),
+		testStoreDocument("doc2", "5", 0.05, "K1", 1500),
+	} {
+		if err := s.ImportDocument("alice", document); err != nil {
+			t.Fatal(err)
+		}
+	}
+	document, err := s.GetDocument("alice", "doc1")
+	if err != nil || document.DeviceId != "P1" || document.Progress.inner != "20" || document.Timestamp != 2000 {
+		t.Errorf("newest progress of doc1: %+v %v", document, err)
+	}
+	if devices, err := s.GetDocumentDevices("alice", "doc1"); err != ErrDevicesUnsupported && (err != nil || len(devices) != 2 || devices[0].DeviceId != "P1") {
+		t.Errorf("progress of each device: %+v %v", devices, err)
+	}
+	if documents, err := s.GetDocuments("alice"); err != nil || len(documents) == 0 || documents[0].DocumentId != "doc1" {
+		t.Errorf("documents: %+v %v", documents, err)
+	}
+	if _, err := s.GetDocument("bob", "doc1"); err != ErrNotFound {
+		t.Errorf("progress of another user: %v", err)
+	}
+
+	timestamp, err := s.UpdateDocument("alice", testStoreDocument("doc2", "6", 0.06, "K1", 0))
+	if err != nil || timestamp == 0 {
+		t.Fatalf("updating doc2: %d %v", timestamp, err)
+	}
+	if history, err := s.GetDocumentHistory("alice", "doc2"); err != nil || len(history) != 1 || history[0].Progress.inner != "6" {
+		t.Errorf("history of doc2: %+v %v", history, err)
+	}
+
+	if err := s.DeleteDocument("alice", "doc1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetDocument("alice", "doc1"); err != ErrNotFound {
+		t.Errorf("deleted document: %v", err)
+	}
+	if err := s.DeleteDocument("alice", "doc1"); err != ErrNotFound {
+		t.Errorf("deleting a deleted document: %v", err)
+	}
+	deleted, err := s.GetDeletedDocuments("alice", 1)
+	if err != nil || len(deleted) == 0 {
+		t.Fatalf("tombstones: %+v %v", deleted, err)
+	}
+	for _, dbDocument := range deleted {
+		if dbDocument.DocumentID != "doc1" || dbDocument.DeletedAt == 0 {
+			t.Errorf("tombstone: %+v", dbDocument)
+		}
+	}
+}
+
+func testStoreMetadata(t *testing.T, s Store) {
+	metadata := DbDocumentMetadata{Username: "alice", DocumentID: "doc2", Title: "Dune", Author: "Frank Herbert"}
+	if err := s.SetDocumentMetadata(metadata); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := s.GetDocumentMetadata("alice", "doc2"); err != nil || stored.Title != "Dune" || stored.Author != "Frank Herbert" {
+		t.Errorf("metadata: %+v %v", stored, err)
+	}
+	if all, err := s.GetDocumentsMetadata("alice"); err != nil || len(all) != 1 {
+		t.Errorf("metadata of all documents: %+v %v", all, err)
+	}
+	if err := s.DeleteDocumentMetadata("alice", "doc2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetDocumentMetadata("alice", "doc2"); err != ErrNotFound {
+		t.Errorf("deleted metadata: %v", err)
+	}
+}
+
+func testStoreRecords(t *testing.T, s Store) {
+	for _, name := range []string{"b", "a"} {
+		if err := s.PutRecord(DbRecord{Username: "alice", Kind: RecordSetting, Name: name, Value: `"` + name + `"`, UpdatedAt: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PutRecord(DbRecord{Username: "alice", Kind: RecordSetting, Name: "a", Value: `"A"`, UpdatedAt: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := s.GetRecord("alice", RecordSetting, "a"); err != nil || record.Value != `"A"` || record.UpdatedAt != 2 {
+		t.Errorf("replaced record: %+v %v", record, err)
+	}
+	records, err := s.GetRecords("alice", RecordSetting)
+	if err != nil || len(records) != 2 || records[0].Name != "a" || records[1].Name != "b" {
+		t.Errorf("records: %+v %v", records, err)
+	}
+	if records, err := s.GetRecords("alice", RecordGoals); err != nil || len(records) != 0 {
+		t.Errorf("records of another kind: %+v %v", records, err)
+	}
+	if err := s.PutRecord(DbRecord{Username: "bob", Kind: RecordShare, Name: "token1", Value: "{}", UpdatedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := s.FindRecord(RecordShare, "token1"); err != nil || record.Username != "bob" {
+		t.Errorf("found record: %+v %v", record, err)
+	}
+	if err := s.DeleteRecord("alice", RecordSetting, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetRecord("alice", RecordSetting, "b"); err != ErrNotFound {
+		t.Errorf("deleted record: %v", err)
+	}
+	if err := s.DeleteRecord("alice", RecordSetting, "b"); err != ErrNotFound {
+		t.Errorf("deleting a deleted record: %v", err)
+	}
+}
+
+func testStoreAPIKeys(t *testing.T, s Store) {
+	for i, name := range []string{"reader", "writer"} {
+		apiKey := DbAPIKey{Username: "alice", Name: name, Key: hashAPIKey(name), Scopes: ScopeProgressRead, Created: int64(i + 1)}
+		if err := s.AddAPIKey(apiKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddAPIKey(DbAPIKey{Username: "alice", Name: "reader", Key: hashAPIKey("other"), Created: 3}); err != ErrAlreadyExists {
+		t.Errorf("adding a key of the same name: %v", err)
+	}
+	if apiKey, err := s.GetAPIKey("alice", hashAPIKey("reader")); err != nil || apiKey.Name != "reader" {
+		t.Errorf("key: %+v %v", apiKey, err)
+	}
+	if _, err := s.GetAPIKey("bob", hashAPIKey("reader")); err != ErrNotFound {
+		t.Errorf("key of another user: %v", err)
+	}
+	if apiKeys, err := s.GetAPIKeys("alice"); err != nil || len(apiKeys) != 2 || apiKeys[0].Name != "reader" {
+		t.Errorf("keys: %+v %v", apiKeys, err)
+	}
+	if err := s.DeleteAPIKey("alice", "reader"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetAPIKey("alice", hashAPIKey("reader")); err != ErrNotFound {
+		t.Errorf("deleted key: %v", err)
+	}
+	if deleted, err := s.DeleteAPIKeys("alice"); err != nil || deleted != 1 {
+		t.Errorf("deleting all keys: %d %v", deleted, err)
+	}
+}
+
+func testStoreDeleteUser(t *testing.T, s Store) {
+	if err := s.AddAPIKey(DbAPIKey{Username: "bob", Name: "k", Key: hashAPIKey("bob"), Scopes: ScopeProgressRead, Created: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportDocument("bob", testStoreDocument("doc1", "1", 0.01, "B1", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser("bob"); err != ErrNotFound {
+		t.Errorf("deleted user: %v", err)
+	}
+	if _, err := s.GetDocument("bob", "doc1"); err != ErrNotFound {
+		t.Errorf("progress of a deleted user: %v", err)
+	}
+	if _, err := s.GetAPIKey("bob", hashAPIKey("bob")); err != ErrNotFound {
+		t.Errorf("key of a deleted user: %v", err)
+	}
+	if _, err := s.FindRecord(RecordShare, "token1"); err != ErrNotFound {
+		t.Errorf("record of a deleted user: %v", err)
+	}
+	if err := s.DeleteUser("bob"); err != ErrNotFound {
+		t.Errorf("deleting a deleted user: %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, newMemoryStore())
+}
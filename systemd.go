@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemd starts the server on demand through socket activation, passing the sockets it listens on,
+// and learns with sd_notify when the server is ready, stopping, or still alive for the watchdog. Both
+// are implemented by their environment variables, see sd_listen_fds(3) and sd_notify(3).
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation with their
+// FileDescriptorName, none when the server wasn't socket activated
+func systemdListeners() ([]net.Listener, []string, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for len(names) < count {
+		names = append(names, "")
+	}
+	// Not passed on to the processes started by the server, e.g. litestream
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		// The listener holds a duplicate of the descriptor
+		file.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket %d passed by systemd: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, names[:count], nil
+}
+
+// sdNotify sends a state to the service manager, e.g. READY=1. It does nothing unless the server was
+// started by systemd with NotifyAccess, e.g. by a Type=notify unit.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// An abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval of the keep-alives the WatchdogSec of the unit asks for,
+// 0 without a watchdog
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+	// Twice per timeout, as sd_watchdog_enabled(3) recommends
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startWatchdog sends the watchdog keep-alives until stop is closed
+func startWatchdog(stop <-chan struct{}) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sdNotify("WATCHDOG=1")
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tenant is an isolated pool of users served under /t/<name>/, e.g. one per family or organization.
+// KOReader only needs the tenant's URL as its custom sync server.
+//
+// Tenant users are stored as "<tenant>:<username>". validKeyField keeps ':' out of the usernames
+// clients send, so the users of different tenants and of the default namespace can't collide.
+type Tenant struct {
+	Name string `json:"-"`
+	// Registration allows new users to sign up through /users/create
+	Registration bool `json:"registration"`
+	// MaxUsers and MaxDocuments (per user) limit the tenant, 0 means no limit
+	MaxUsers     int `json:"max_users"`
+	MaxDocuments int `json:"max_documents"`
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// loadTenants reads the -tenants file, a JSON object of tenant name to settings:
+//
+//	{"family": {"max_users": 6}, "book-club": {"registration": false}}
+func loadTenants(path string) (map[string]Tenant, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	tenants := map[string]Tenant{}
+	for name, settings := range raw {
+		if !tenantNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		tenant := Tenant{Name: name, Registration: true}
+		if err := json.Unmarshal(settings, &tenant); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		if tenant.MaxUsers < 0 || tenant.MaxDocuments < 0 {
+			return nil, fmt.Errorf("tenant %s: limits can't be negative", name)
+		}
+		tenants[name] = tenant
+	}
+	return tenants, nil
+}
+
+// TenantRequired resolves the :tenant of the route, unknown tenants don't exist as far as clients can tell
+func TenantRequired(c *gin.Context) {
+	tenant, ok := config.Tenants[c.Param("tenant")]
+	if !ok {
+		c.Error(&TenantNotFound)
+		c.Abort()
+		return
+	}
+	c.Set("tenant", tenant)
+	c.Next()
+}
+
+// currentTenant returns the tenant of the request, false in the default namespace
+func currentTenant(c *gin.Context) (Tenant, bool) {
+	tenant, ok := c.Get("tenant")
+	if !ok {
+		return Tenant{}, false
+	}
+	return tenant.(Tenant), true
+}
+
+// tenantUsername returns the name the user of the request is stored under
+func tenantUsername(c *gin.Context, username string) string {
+	if tenant, ok := currentTenant(c); ok {
+		return tenant.Name + ":" + username
+	}
+	return username
+}
+
+// displayUsername strips the tenant from a stored username
+func displayUsername(username string) string {
+	if i := strings.IndexByte(username, ':'); i >= 0 {
+		return username[i+1:]
+	}
+	return username
+}
+
+// usernameTenant returns the tenant of a stored username, empty in the default namespace
+func usernameTenant(username string) string {
+	if i := strings.IndexByte(username, ':'); i >= 0 {
+		return username[:i]
+	}
+	return ""
+}
+
+// validStoredUsername checks a stored username, e.g. of a dump, whose tenant has to be one of -tenants
+func validStoredUsername(username string) bool {
+	if tenant := usernameTenant(username); tenant != "" {
+		if _, ok := config.Tenants[tenant]; !ok {
+			return false
+		}
+	}
+	return validKeyField(displayUsername(username))
+}
+
+// checkRegistration applies the tenant's registration policy and user limit
+func checkRegistration(c *gin.Context) *ErrorResponse {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return nil
+	}
+	if !tenant.Registration {
+		return &RegistrationDisabled
+	}
+	if tenant.MaxUsers == 0 {
+		return nil
+	}
+	users, err := store.GetUsers()
+	if err != nil {
+		return &UnknownServerError
+	}
+	count := 0
+	for _, user := range users {
+		if strings.HasPrefix(user.Username, tenant.Name+":") {
+			count++
+		}
+	}
+	if count >= tenant.MaxUsers {
+		return &QuotaExceeded
+	}
+	return nil
+}
+
+// checkDocumentQuota applies the tenant's document limit before progress of a new document is stored
+func checkDocumentQuota(c *gin.Context, username string, documentId string) *ErrorResponse {
+	tenant, ok := currentTenant(c)
+	if !ok || tenant.MaxDocuments == 0 {
+		return nil
+	}
+	if _, err := store.GetDocument(username, documentId); err == nil {
+		return nil
+	} else if err != ErrNotFound {
+		return &UnknownServerError
+	}
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		return &UnknownServerError
+	}
+	ids := map[string]bool{}
+	for _, document := range documents {
+		ids[document.DocumentId] = true
+	}
+	if len(ids) >= tenant.MaxDocuments {
+		return &QuotaExceeded
+	}
+	return nil
+}
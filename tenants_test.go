@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestTenantRouter(t *testing.T) http.Handler {
+	newTestRouter(t)
+	config.Tenants = map[string]Tenant{
+		"family": {Name: "family", Registration: true, MaxUsers: 2},
+		"club":   {Name: "club", Registration: false},
+	}
+	return newRouter()
+}
+
+func TestTenantIsolation(t *testing.T) {
+	router := newTestTenantRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	registerTestUser(t, router, "/t/family", "alice", "pw")
+	syncTestProgress(t, router, "/t/family", "alice", "pw", "doc1", "0.25")
+
+	w := testRequest(router, http.MethodGet, "/t/family/syncs/progress/doc1", "", "alice", "pw")
+	var document Document
+	decodeTestResponse(t, w, &document)
+	if w.Code != http.StatusOK || document.Percentage != 0.25 {
+		t.Errorf("tenant's own progress: %d %s", w.Code, w.Body)
+	}
+	// The same name and password in the default namespace is another user
+	if w := testRequest(router, http.MethodGet, "/syncs/progress/doc1", "", "alice", "pw"); w.Body.String() != "{}" {
+		t.Errorf("progress of a tenant user seen outside the tenant: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodGet, "/t/club/users/auth", "", "alice", "pw"); w.Code != http.StatusUnauthorized {
+		t.Errorf("tenant user authenticated in another tenant: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodGet, "/t/nope/users/auth", "", "alice", "pw"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown tenant: %d %s", w.Code, w.Body)
+	}
+	if _, err := store.GetUser("family:alice"); err != nil {
+		t.Errorf("tenant user not stored under the tenant's name: %v", err)
+	}
+}
+
+func TestTenantRegistration(t *testing.T) {
+	router := newTestTenantRouter(t)
+	if w := testRequest(router, http.MethodPost, "/t/club/users/create", `{"username": "bob", "password": "pw"}`, "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("registration in a closed tenant: %d %s", w.Code, w.Body)
+	}
+	registerTestUser(t, router, "/t/family", "alice", "pw")
+	registerTestUser(t, router, "/t/family", "bob", "pw")
+	if w := testRequest(router, http.MethodPost, "/t/family/users/create", `{"username": "carol", "password": "pw"}`, "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("registration beyond max_users: %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(router, http.MethodPost, "/users/create", `{"username": "family:eve", "password": "pw"}`, "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("registration of a tenant name in the default namespace: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTenantDumpRoundTrip(t *testing.T) {
+	router := newTestTenantRouter(t)
+	registerTestUser(t, router, "", "alice", "pw")
+	registerTestUser(t, router, "/t/family", "alice", "pw")
+	syncTestProgress(t, router, "/t/family", "alice", "pw", "doc1", "0.5")
+	if err := store.AddUser("gone:mallory", "pw"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "dump.json")
+	if err := exportCommand([]string{"-o", path}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump DatabaseDump
+	if err := json.Unmarshal(b, &dump); err != nil {
+		t.Fatal(err)
+	}
+	store = newMemoryStore()
+	if err := importDump(dump, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"alice", "family:alice"} {
+		if _, err := store.GetUser(username); err != nil {
+			t.Errorf("%s not imported: %v", username, err)
+		}
+	}
+	if document, err := store.GetDocument("family:alice", "doc1"); err != nil || document.Percentage != 0.5 {
+		t.Errorf("progress of the tenant user not imported: %+v %v", document, err)
+	}
+	if _, err := store.GetUser("gone:mallory"); err != ErrNotFound {
+		t.Errorf("user of a tenant missing from -tenants imported: %v", err)
+	}
+}
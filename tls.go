@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager gets and renews the certificates of -acme-domains, answering the TLS-ALPN-01 challenges
+// on the HTTPS listeners and the HTTP-01 challenges on the plain HTTP ones
+func acmeManager() *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Cache:      autocert.DirCache(config.ACMECache),
+		Email:      config.ACMEEmail,
+	}
+	if config.ACMEDirectory != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.ACMEDirectory}
+	}
+	return manager
+}
+
+// tlsConfig returns the TLS configuration of the HTTPS listeners and wraps the handler of the plain
+// HTTP ones to answer the ACME challenges, with -acme. The certificate of -c and -k is loaded by the
+// listeners otherwise.
+func tlsConfig(plainHandler http.Handler) (*tls.Config, http.Handler) {
+	if !config.ACME {
+		return nil, plainHandler
+	}
+	manager := acmeManager()
+	return manager.TLSConfig(), manager.HTTPHandler(plainHandler)
+}
+
+// httpsPort returns the port of the first HTTPS listener, the port plain HTTP requests are redirected to
+func httpsPort(listeners []net.Listener, plain []bool) string {
+	for i, listener := range listeners {
+		if !plain[i] {
+			if _, port, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+				return port
+			}
+		}
+	}
+	return "443"
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL over HTTPS on port. Fetches are moved
+// permanently with 301, the other methods with 308, which keeps clients from turning e.g. a progress
+// update into a GET.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
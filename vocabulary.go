@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VocabularyWord is a word of KOReader's vocabulary builder with its context and review state, the
+// columns of its vocabulary table. Each word is stored as a RecordVocabulary record named by the word,
+// deleted words are kept as tombstones like annotations.
+type VocabularyWord struct {
+	Word        string `json:"word"`
+	Book        string `json:"book,omitempty"`
+	PrevContext string `json:"prev_context,omitempty"`
+	NextContext string `json:"next_context,omitempty"`
+	Highlight   string `json:"highlight,omitempty"`
+	Created     int64  `json:"created"`
+	ReviewTime  int64  `json:"review_time"`
+	DueTime     int64  `json:"due_time"`
+	ReviewCount int    `json:"review_count"`
+	StreakCount int    `json:"streak_count"`
+	UpdatedAt   int64  `json:"updated_at"`
+	Deleted     bool   `json:"deleted,omitempty"`
+}
+
+type VocabularyUpload struct {
+	Words []VocabularyWord `json:"words"`
+}
+
+const (
+	// maxWordLength fits the record names of the MySQL schema
+	maxWordLength = 100
+	// maxVocabularyContext bounds the context before and after the word in bytes
+	maxVocabularyContext = 4096
+	// maxVocabularyWords bounds the words of a user, tombstones included
+	maxVocabularyWords = 50000
+)
+
+// vocabularyMu serializes the merges of the word lists
+var vocabularyMu sync.Mutex
+
+func validVocabularyWord(word VocabularyWord) bool {
+	if word.Word == "" || utf8.RuneCountInString(word.Word) > maxWordLength ||
+		utf8.RuneCountInString(word.Book) > maxMetadataLength || utf8.RuneCountInString(word.Highlight) > maxMetadataLength {
+		return false
+	}
+	return len(word.PrevContext) <= maxVocabularyContext && len(word.NextContext) <= maxVocabularyContext &&
+		word.Created >= 0 && word.ReviewTime >= 0 && word.DueTime >= 0 && word.ReviewCount >= 0 &&
+		word.StreakCount >= 0 && word.UpdatedAt >= 0
+}
+
+func userVocabulary(username string) ([]VocabularyWord, error) {
+	records, err := store.GetRecords(username, RecordVocabulary)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]VocabularyWord, 0, len(records))
+	for _, record := range records {
+		var word VocabularyWord
+		if err := json.Unmarshal([]byte(record.Value), &word); err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+	return words, nil
+}
+
+// listVocabulary returns the words ordered alphabetically. With ?since= only those changed since then
+// are returned, tombstones included, otherwise tombstones are left out.
+func listVocabulary(c *gin.Context) {
+	var since int64
+	if value := c.Query("since"); value != "" {
+		var err error
+		if since, err = strconv.ParseInt(value, 10, 64); err != nil {
+			c.Error(&InvalidRequest)
+			return
+		}
+	}
+	words, err := userVocabulary(c.MustGet("username").(string))
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	kept := []VocabularyWord{}
+	for _, word := range words {
+		if since != 0 && word.UpdatedAt >= since || since == 0 && !word.Deleted {
+			kept = append(kept, word)
+		}
+	}
+	respond(c, http.StatusOK, kept)
+}
+
+// updateVocabulary merges the uploaded words into the list, for each word the one updated last wins and
+// an upload wins a tie. Words without updated_at are stamped with now. It answers with the words the
+// upload changed.
+func updateVocabulary(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var upload VocabularyUpload
+	if err := bindBody(c, &upload); err != nil || len(upload.Words) > maxVocabularyWords {
+		c.Error(&InvalidRequest)
+		return
+	}
+	for _, word := range upload.Words {
+		if !validVocabularyWord(word) {
+			c.Error(&InvalidRequest)
+			return
+		}
+	}
+	vocabularyMu.Lock()
+	defer vocabularyMu.Unlock()
+	words, err := userVocabulary(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	stored := map[string]VocabularyWord{}
+	for _, word := range words {
+		stored[word.Word] = word
+	}
+	now := time.Now().Unix()
+	changed := []VocabularyWord{}
+	for _, word := range upload.Words {
+		if word.UpdatedAt == 0 {
+			word.UpdatedAt = now
+		}
+		if word.Created == 0 {
+			word.Created = word.UpdatedAt
+		}
+		existing, ok := stored[word.Word]
+		if ok && word.UpdatedAt < existing.UpdatedAt {
+			continue
+		}
+		if !ok && len(stored) >= maxVocabularyWords {
+			c.Error(&QuotaExceeded)
+			return
+		}
+		if err := putRecord(username, RecordVocabulary, word.Word, word); err != nil {
+			c.Error(&UnknownServerError)
+			return
+		}
+		stored[word.Word] = word
+		changed = append(changed, word)
+	}
+	respond(c, http.StatusOK, changed)
+}
+
+// deleteVocabularyWord turns the word into a tombstone
+func deleteVocabularyWord(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	vocabularyMu.Lock()
+	defer vocabularyMu.Unlock()
+	var word VocabularyWord
+	err := getRecord(username, RecordVocabulary, c.Param("word"), &word)
+	if err == ErrNotFound || err == nil && word.Deleted {
+		c.Error(&WordNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	word = VocabularyWord{Word: word.Word, Created: word.Created, UpdatedAt: time.Now().Unix(), Deleted: true}
+	if err := putRecord(username, RecordVocabulary, word.Word, word); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultWaitTimeout stays below the 60 second idle timeout common to reverse proxies
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
+// waitProgress holds the request until the progress of the document changes, so a device can take
+// over reading from another within moments instead of polling. The client names the progress it
+// has with If-None-Match or If-Modified-Since, without them the next change is waited for. Changed
+// progress is answered like getProgress; when ?timeout= (seconds, default 30) elapses first, the
+// answer is 304 Not Modified.
+func waitProgress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documentId := canonicalDocument(username, c.Param("document"))
+	timeout := defaultWaitTimeout
+	if seconds := c.Query("timeout"); seconds != "" {
+		n, err := strconv.Atoi(seconds)
+		if err != nil || n < 1 || time.Duration(n)*time.Second > maxWaitTimeout {
+			c.Error(&InvalidRequest)
+			return
+		}
+		timeout = time.Duration(n) * time.Second
+	}
+
+	// Subscribed before the lookup, so a change in between isn't missed
+	changes, unsubscribe := progressChanges.Subscribe(username)
+	defer unsubscribe()
+	document, found := findProgress(username, documentId, requestDeviceId(c))
+	if found {
+		extendProgress(c, username, documentId, &document)
+	}
+	document.DocumentId = c.Param("document")
+	if hasConditions(c) && found && !notModified(c, document) {
+		writeProgress(c, document)
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case change := <-changes:
+			if change.DocumentId != documentId {
+				continue
+			}
+			current, ok := findProgress(username, documentId, requestDeviceId(c))
+			if !ok {
+				if found {
+					progressNotFound(c)
+					return
+				}
+				continue
+			}
+			extendProgress(c, username, documentId, &current)
+			current.DocumentId = c.Param("document")
+			// e.g. an update of another device that didn't change the progress picked by the conflict strategy
+			if found && progressETag(c, current) == progressETag(c, document) || notModified(c, current) {
+				continue
+			}
+			writeProgress(c, current)
+			return
+		case <-timer.C:
+			c.Status(http.StatusNotModified)
+			return
+		case <-shuttingDown:
+			// Like a timeout, the client polls again, e.g. once the server restarted
+			c.Status(http.StatusNotModified)
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
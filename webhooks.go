@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxUserWebhooks bounds the webhooks of a user, each change is posted to all of them
+const maxUserWebhooks = 10
+
+// webhookRetries are the delays before each delivery attempt; only a 2xx answer counts as delivered
+var webhookRetries = []time.Duration{0, 10 * time.Second, time.Minute}
+
+// webhookQueueSize bounds the deliveries waiting for a webhook while its receiver is slow or down,
+// webhookWorkerIdle is how long the worker of a webhook waits for the next one before it exits
+const (
+	webhookQueueSize  = 100
+	webhookWorkerIdle = time.Minute
+)
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// A redirect would turn the POST into a GET, the receiver has to be configured with the final URL
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// nonPublicNetworks are the addresses the webhooks of users aren't delivered to, so users can't make the
+// server post into its own network, e.g. to the cloud metadata service at 169.254.169.254
+var nonPublicNetworks, _ = parseSubnets("0.0.0.0/8 10.0.0.0/8 100.64.0.0/10 127.0.0.0/8 169.254.0.0/16 " +
+	"172.16.0.0/12 192.0.0.0/24 192.168.0.0/16 198.18.0.0/15 224.0.0.0/3 ::/127 64:ff9b::/96 fc00::/7 fe80::/10 ff00::/8")
+
+func publicIP(ip net.IP) bool {
+	for _, subnet := range nonPublicNetworks {
+		if subnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublicOnly refuses connections to non-public addresses. It checks the address being connected to,
+// after the name was resolved, so a name pointing into the network doesn't get through either.
+func dialPublicOnly(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// userWebhookClient delivers to the webhooks of users, which may only be on public addresses. Unlike
+// the -webhook-url, which the administrator may point at a host of their network.
+var userWebhookClient = &http.Client{
+	Timeout:       webhookClient.Timeout,
+	CheckRedirect: webhookClient.CheckRedirect,
+	Transport: &http.Transport{
+		// No proxy, it would connect on the server's behalf past dialPublicOnly
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// Webhook is a URL of the user receiving their progress changes, stored as a RecordWebhook record.
+// The secret signs the deliveries and is only returned when the webhook is created.
+type Webhook struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Secret  string `json:"secret,omitempty"`
+	Created int64  `json:"created"`
+	// client posts the deliveries, userWebhookClient unless it's the -webhook-url
+	client *http.Client
+}
+
+// WebhookPayload is the body posted to the webhooks
+type WebhookPayload struct {
+	ProgressEvent
+	Username string `json:"username"`
+	Tenant   string `json:"tenant,omitempty"`
+	Sent     int64  `json:"sent"`
+}
+
+func validWebhookURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validUserWebhookURL rejects the URLs of users naming a non-public address right away, names resolving
+// to one are refused by dialPublicOnly on delivery
+func validUserWebhookURL(rawURL string) bool {
+	if !validWebhookURL(rawURL) {
+		return false
+	}
+	u, _ := url.Parse(rawURL)
+	ip := net.ParseIP(u.Hostname())
+	return u.Hostname() != "localhost" && (ip == nil || publicIP(ip))
+}
+
+// signWebhook returns the X-Kosync-Signature of a delivery: the hex HMAC-SHA256 of the timestamp,
+// a dot and the body, so a captured delivery can't be replayed with another timestamp
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookKey names a webhook for its worker, the -webhook-url has no username
+type webhookKey struct {
+	username string
+	name     string
+}
+
+type webhookDelivery struct {
+	webhook Webhook
+	body    []byte
+}
+
+// webhookWorkers deliver to one webhook each, in the order of the changes, so a slow or dead receiver
+// holds up neither the others nor more than one goroutine. Deliveries beyond webhookQueueSize are dropped,
+// which is logged with their count.
+var webhookWorkers = struct {
+	sync.Mutex
+	queues  map[webhookKey]chan webhookDelivery
+	dropped int64
+}{queues: map[webhookKey]chan webhookDelivery{}}
+
+func queueWebhook(key webhookKey, webhook Webhook, body []byte) {
+	webhookWorkers.Lock()
+	defer webhookWorkers.Unlock()
+	queue, ok := webhookWorkers.queues[key]
+	if !ok {
+		queue = make(chan webhookDelivery, webhookQueueSize)
+		webhookWorkers.queues[key] = queue
+		go runWebhookWorker(key, queue)
+	}
+	select {
+	case queue <- webhookDelivery{webhook, body}:
+	default:
+		webhookWorkers.dropped++
+		log.Printf("Webhook %s is too far behind, dropped a delivery, %d deliveries dropped so far",
+			webhook.URL, webhookWorkers.dropped)
+	}
+}
+
+// runWebhookWorker delivers the queued deliveries one after the other and exits once the queue stayed
+// empty for webhookWorkerIdle
+func runWebhookWorker(key webhookKey, queue chan webhookDelivery) {
+	for {
+		select {
+		case delivery := <-queue:
+			deliverWebhook(delivery.webhook.client, delivery.webhook.URL, delivery.webhook.Secret, delivery.body)
+		case <-time.After(webhookWorkerIdle):
+			webhookWorkers.Lock()
+			// queueWebhook holds the lock while queueing, so nothing can arrive after this check
+			if len(queue) == 0 {
+				delete(webhookWorkers.queues, key)
+				webhookWorkers.Unlock()
+				return
+			}
+			webhookWorkers.Unlock()
+		}
+	}
+}
+
+// deliverWebhook posts the payload, retrying failed attempts
+func deliverWebhook(client *http.Client, webhookURL string, secret string, body []byte) {
+	var err error
+	for _, delay := range webhookRetries {
+		time.Sleep(delay)
+		if err = postWebhook(client, webhookURL, secret, body); err == nil {
+			return
+		}
+	}
+	log.Printf("Webhook %s failed after %d attempts: %v", webhookURL, len(webhookRetries), err)
+}
+
+func postWebhook(client *http.Client, webhookURL string, secret string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kosyncsrv")
+	req.Header.Set("X-Kosync-Timestamp", timestamp)
+	req.Header.Set("X-Kosync-Signature", signWebhook(secret, timestamp, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}
+
+// startWebhooks posts every progress change to the -webhook-url and, with -user-webhooks, to the
+// webhooks of the user. Like the WebSocket, only changes made through this server process are posted.
+// They are queued, so none is missed while the receivers or the database are slow.
+func startWebhooks() {
+	changes := progressChanges.Queue()
+	go func() {
+		for {
+			notifyWebhooks(changes.Next())
+		}
+	}()
+}
+
+func notifyWebhooks(change ProgressChange) {
+	webhooks := map[webhookKey]Webhook{}
+	if config.WebhookURL != "" {
+		webhooks[webhookKey{}] = Webhook{URL: config.WebhookURL, Secret: config.WebhookSecret, client: webhookClient}
+	}
+	if config.UserWebhooks {
+		userWebhooks, err := getWebhooks(change.Username)
+		if err != nil {
+			log.Printf("Loading the webhooks of %s: %v", change.Username, err)
+		}
+		for _, webhook := range userWebhooks {
+			webhook.client = userWebhookClient
+			webhooks[webhookKey{change.Username, webhook.Name}] = webhook
+		}
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(WebhookPayload{
+		ProgressEvent: progressEvent(change, ""),
+		Username:      displayUsername(change.Username),
+		Tenant:        usernameTenant(change.Username),
+		Sent:          time.Now().Unix(),
+	})
+	if err != nil {
+		log.Println("Webhook payload:", err)
+		return
+	}
+	for key, webhook := range webhooks {
+		queueWebhook(key, webhook, body)
+	}
+}
+
+func getWebhooks(username string) ([]Webhook, error) {
+	records, err := store.GetRecords(username, RecordWebhook)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]Webhook, 0, len(records))
+	for _, record := range records {
+		var webhook Webhook
+		if err := json.Unmarshal([]byte(record.Value), &webhook); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// WebhooksEnabled answers 403 to the webhook endpoints unless -user-webhooks allows users to register
+// URLs, which the server then posts to from inside its network
+func WebhooksEnabled(c *gin.Context) {
+	if !config.UserWebhooks {
+		c.Error(&WebhooksDisabled)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func createWebhook(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	var request Webhook
+	if err := bindBody(c, &request); err != nil || !validKeyField(request.Name) || !validUserWebhookURL(request.URL) {
+		c.Error(&InvalidRequest)
+		return
+	}
+	webhooks, err := getWebhooks(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	if len(webhooks) >= maxUserWebhooks {
+		c.Error(&WebhookLimitReached)
+		return
+	}
+	for _, webhook := range webhooks {
+		if webhook.Name == request.Name {
+			c.Error(&WebhookAlreadyExists)
+			return
+		}
+	}
+	secret, err := generateAPIKey()
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	webhook := Webhook{Name: request.Name, URL: request.URL, Secret: secret, Created: time.Now().Unix()}
+	if err := putRecord(username, RecordWebhook, webhook.Name, webhook); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	respond(c, http.StatusCreated, webhook)
+}
+
+func listWebhooks(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	webhooks, err := getWebhooks(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	respond(c, http.StatusOK, webhooks)
+}
+
+func deleteWebhook(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	err := store.DeleteRecord(username, RecordWebhook, c.Param("name"))
+	if err == ErrNotFound {
+		c.Error(&WebhookNotFound)
+		return
+	}
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
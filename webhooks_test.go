@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUserWebhookURLs(t *testing.T) {
+	router := newTestRouter(t)
+	config.UserWebhooks = true
+	registerTestUser(t, router, "", "alice", "pw")
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"https://hooks.example.com/kosync", http.StatusCreated},
+		{"http://169.254.169.254/latest/meta-data", InvalidRequest.Status},
+		{"http://127.0.0.1:8080/", InvalidRequest.Status},
+		{"http://[::1]/", InvalidRequest.Status},
+		{"http://10.1.2.3/", InvalidRequest.Status},
+		{"http://localhost/", InvalidRequest.Status},
+		{"ftp://hooks.example.com/", InvalidRequest.Status},
+	}
+	for i, test := range tests {
+		w := testRequest(router, http.MethodPost, "/users/webhooks", `{"name": "hook`+string(rune('a'+i))+`", "url": "`+test.url+`"}`, "alice", "pw")
+		if w.Code != test.status {
+			t.Errorf("%s: got %d %s, want %d", test.url, w.Code, w.Body, test.status)
+		}
+	}
+}
+
+func TestUserWebhookDeliveryRefusesLoopback(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	if err := postWebhook(userWebhookClient, receiver.URL, "secret", []byte("{}")); err == nil {
+		t.Error("user webhook delivered to a loopback address")
+	}
+	if err := postWebhook(webhookClient, receiver.URL, "secret", []byte("{}")); err != nil {
+		t.Errorf("-webhook-url delivery to a loopback address: %v", err)
+	}
+}
+
+func TestWebhookDeliveriesInOrder(t *testing.T) {
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer receiver.Close()
+	webhook := Webhook{URL: receiver.URL, Secret: "secret", client: webhookClient}
+	key := webhookKey{"alice", "ordered"}
+	for i := 0; i < 5; i++ {
+		queueWebhook(key, webhook, []byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < 5; i++ {
+		if body := <-received; body != strconv.Itoa(i) {
+			t.Fatalf("delivery %d: got %s", i, body)
+		}
+	}
+}
+
+func TestWebhookQueueBounded(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+	webhook := Webhook{URL: receiver.URL, Secret: "secret", client: webhookClient}
+	key := webhookKey{"alice", "stuck"}
+	webhookWorkers.Lock()
+	dropped := webhookWorkers.dropped
+	webhookWorkers.Unlock()
+
+	// The worker takes the first delivery and waits for the receiver, the queue holds the next ones
+	queueWebhook(key, webhook, []byte("first"))
+	for {
+		webhookWorkers.Lock()
+		taken := len(webhookWorkers.queues[key]) == 0
+		webhookWorkers.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < webhookQueueSize+3; i++ {
+		queueWebhook(key, webhook, []byte("{}"))
+	}
+	webhookWorkers.Lock()
+	defer webhookWorkers.Unlock()
+	if webhookWorkers.dropped-dropped != 3 {
+		t.Errorf("dropped %d deliveries, want 3", webhookWorkers.dropped-dropped)
+	}
+}
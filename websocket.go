@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	websocketWriteTimeout = 10 * time.Second
+	// websocketPingInterval keeps proxies from closing idle connections and detects vanished devices
+	websocketPingInterval = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{}
+
+// progressWebSocket pushes a ProgressEvent as a JSON text message for every change of the account's
+// progress. Messages sent by the client are ignored. Like the long-polling wait, only changes made
+// through this server process are pushed.
+func progressWebSocket(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	changes, unsubscribe := progressChanges.Subscribe(username)
+	defer unsubscribe()
+	// The upgrader answers failed handshakes itself
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadDeadline(time.Now().Add(2 * websocketPingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * websocketPingInterval))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case change := <-changes:
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if err := conn.WriteJSON(progressEvent(change, requestDeviceId(c))); err != nil {
+				log.Println("WebSocket of", username+":", err)
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-shuttingDown:
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(websocketWriteTimeout))
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WipeConfirmation is the token a user has to send back to delete the progress of all documents, so a
+// single mistaken request can't wipe an account's progress
+type WipeConfirmation struct {
+	Token     string `json:"token"`
+	Documents int    `json:"documents"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// wipeTokenLifetime is how long a confirmation token is valid, in seconds
+const wipeTokenLifetime = 5 * 60
+
+// wipeTokens holds the pending confirmation of each user. They're only kept in memory: a restart
+// just requires asking for a new one.
+var (
+	wipeTokens   = map[string]WipeConfirmation{}
+	wipeTokensMu sync.Mutex
+)
+
+// userDocumentIds returns the documents the user has progress for
+func userDocumentIds(username string) ([]string, error) {
+	documents, err := store.GetDocuments(username)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var ids []string
+	for _, document := range documents {
+		if !seen[document.DocumentId] {
+			seen[document.DocumentId] = true
+			ids = append(ids, document.DocumentId)
+		}
+	}
+	return ids, nil
+}
+
+// requestWipe answers with a confirmation token for wipeProgress, replacing the pending one
+func requestWipe(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	documents, err := userDocumentIds(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	confirmation := WipeConfirmation{
+		Token:     hex.EncodeToString(b),
+		Documents: len(documents),
+		ExpiresAt: time.Now().Unix() + wipeTokenLifetime,
+	}
+	wipeTokensMu.Lock()
+	wipeTokens[username] = confirmation
+	wipeTokensMu.Unlock()
+	respond(c, http.StatusOK, confirmation)
+}
+
+// wipeProgress deletes the progress of all documents of the account, with their notes, statuses and
+// slots, when ?confirm= is the token of requestWipe. The account and its other data are kept.
+func wipeProgress(c *gin.Context) {
+	username := c.MustGet("username").(string)
+	wipeTokensMu.Lock()
+	confirmation, ok := wipeTokens[username]
+	valid := ok && confirmation.ExpiresAt > time.Now().Unix() &&
+		subtle.ConstantTimeCompare([]byte(confirmation.Token), []byte(c.Query("confirm"))) == 1
+	if valid {
+		delete(wipeTokens, username)
+	}
+	wipeTokensMu.Unlock()
+	if !valid {
+		c.Error(&InvalidConfirmation)
+		return
+	}
+	documents, err := userDocumentIds(username)
+	if err != nil {
+		c.Error(&UnknownServerError)
+		return
+	}
+	for _, documentId := range documents {
+		if err := deleteDocumentProgress(username, documentId); err != nil && err != ErrNotFound {
+			c.Error(&UnknownServerError)
+			return
+		}
+	}
+	respond(c, http.StatusOK, gin.H{"deleted_documents": len(documents)})
+}